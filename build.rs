@@ -0,0 +1,66 @@
+use std::process::Command;
+use std::time::{SystemTime, UNIX_EPOCH};
+
+// Bakes build metadata into the binary for `annadl version`. Each value can be overridden
+// from the environment, e.g. by packagers building from a tarball without .git.
+fn main() {
+    let commit = env_or("ANNADL_GIT_COMMIT", || {
+        command_output("git", &["rev-parse", "--short=12", "HEAD"])
+    });
+    let build_date = env_or("ANNADL_BUILD_DATE", || {
+        // SOURCE_DATE_EPOCH keeps reproducible builds reproducible
+        let secs = std::env::var("SOURCE_DATE_EPOCH")
+            .ok()
+            .and_then(|v| v.parse().ok())
+            .unwrap_or_else(|| SystemTime::now().duration_since(UNIX_EPOCH).map(|d| d.as_secs()).unwrap_or(0));
+        Some(utc_date(secs))
+    });
+    let rustc = std::env::var("RUSTC").unwrap_or_else(|_| "rustc".to_string());
+    let rustc_version = command_output(&rustc, &["--version"]).unwrap_or_else(|| "unknown".to_string());
+
+    println!("cargo:rustc-env=ANNADL_GIT_COMMIT={}", commit);
+    println!("cargo:rustc-env=ANNADL_BUILD_DATE={}", build_date);
+    println!("cargo:rustc-env=ANNADL_RUSTC_VERSION={}", rustc_version);
+    println!("cargo:rustc-env=ANNADL_TARGET={}", std::env::var("TARGET").unwrap_or_default());
+
+    println!("cargo:rerun-if-changed=.git/HEAD");
+    println!("cargo:rerun-if-changed=.git/refs");
+    println!("cargo:rerun-if-env-changed=ANNADL_GIT_COMMIT");
+    println!("cargo:rerun-if-env-changed=ANNADL_BUILD_DATE");
+    println!("cargo:rerun-if-env-changed=SOURCE_DATE_EPOCH");
+}
+
+fn env_or(name: &str, fallback: impl FnOnce() -> Option<String>) -> String {
+    std::env::var(name)
+        .ok()
+        .filter(|v| !v.is_empty())
+        .or_else(fallback)
+        .unwrap_or_else(|| "unknown".to_string())
+}
+
+fn command_output(program: &str, args: &[&str]) -> Option<String> {
+    let output = Command::new(program).args(args).output().ok()?;
+    if !output.status.success() {
+        return None;
+    }
+    let text = String::from_utf8(output.stdout).ok()?.trim().to_string();
+    if text.is_empty() {
+        None
+    } else {
+        Some(text)
+    }
+}
+
+// YYYY-MM-DD for a Unix timestamp (Howard Hinnant's days-to-civil algorithm)
+fn utc_date(secs: u64) -> String {
+    let days = (secs / 86_400) as i64 + 719_468;
+    let era = days.div_euclid(146_097);
+    let day_of_era = days.rem_euclid(146_097);
+    let year_of_era = (day_of_era - day_of_era / 1_460 + day_of_era / 36_524 - day_of_era / 146_096) / 365;
+    let day_of_year = day_of_era - (365 * year_of_era + year_of_era / 4 - year_of_era / 100);
+    let mp = (5 * day_of_year + 2) / 153;
+    let day = day_of_year - (153 * mp + 2) / 5 + 1;
+    let month = if mp < 10 { mp + 3 } else { mp - 9 };
+    let year = year_of_era + era * 400 + if month <= 2 { 1 } else { 0 };
+    format!("{:04}-{:02}-{:02}", year, month, day)
+}
@@ -0,0 +1,39 @@
+use anyhow::{Context, Result};
+use std::process::{Command, Stdio};
+
+// The platform's URL opener; Linux `open` is openvt, so each OS gets exactly one
+#[cfg(target_os = "macos")]
+const OPEN_COMMAND: (&str, &[&str]) = ("open", &[]);
+#[cfg(windows)]
+const OPEN_COMMAND: (&str, &[&str]) = ("cmd", &["/C", "start", ""]);
+#[cfg(not(any(target_os = "macos", windows)))]
+const OPEN_COMMAND: (&str, &[&str]) = ("xdg-open", &[]);
+
+pub fn open(url: &str) -> Result<()> {
+    let (program, args) = OPEN_COMMAND;
+    open_with(program, args, url)
+}
+
+// Doesn't wait: the browser may keep running long after we return
+fn open_with(program: &str, args: &[&str], url: &str) -> Result<()> {
+    Command::new(program)
+        .args(args)
+        .arg(url)
+        .stdin(Stdio::null())
+        .stdout(Stdio::null())
+        .stderr(Stdio::null())
+        .spawn()
+        .with_context(|| format!("Failed to run {}", program))?;
+
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_open_with_missing_program_fails() {
+        assert!(open_with("annadl-no-such-browser", &[], "https://example.com").is_err());
+    }
+}
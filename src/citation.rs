@@ -0,0 +1,142 @@
+use crate::scraper::Book;
+
+#[derive(Debug, Clone, Copy, PartialEq, clap::ValueEnum)]
+pub enum CitationStyle {
+    Bibtex,
+    Apa,
+}
+
+pub fn format(book: &Book, style: CitationStyle) -> String {
+    match style {
+        CitationStyle::Bibtex => bibtex(book),
+        CitationStyle::Apa => apa(book),
+    }
+}
+
+pub fn bibtex(book: &Book) -> String {
+    let authors = split_authors(book.author.as_deref());
+    let mut fields = vec![format!("  title = {{{}}}", escape_bibtex(&book.title))];
+
+    if !authors.is_empty() {
+        let joined = authors.iter().map(|a| escape_bibtex(a)).collect::<Vec<_>>().join(" and ");
+        fields.push(format!("  author = {{{}}}", joined));
+    }
+    if let Some(year) = book.year.as_deref() {
+        fields.push(format!("  year = {{{}}}", year));
+    }
+    fields.push(format!("  url = {{{}}}", book.url));
+
+    format!("@book{{{},\n{}\n}}", citation_key(book, &authors), fields.join(",\n"))
+}
+
+pub fn apa(book: &Book) -> String {
+    let authors = split_authors(book.author.as_deref());
+    let author_part = match authors.len() {
+        0 => String::new(),
+        1 => format!("{} ", authors[0]),
+        2 => format!("{} & {} ", authors[0], authors[1]),
+        n => format!("{}, & {} ", authors[..n - 1].join(", "), authors[n - 1]),
+    };
+    let year = book.year.as_deref().unwrap_or("n.d.");
+    let title = book.title.trim_end_matches('.');
+
+    format!("{}({}). {}. {}", author_part, year, title, book.url)
+}
+
+fn split_authors(author: Option<&str>) -> Vec<String> {
+    author
+        .unwrap_or("")
+        .split(',')
+        .map(|a| a.trim())
+        .filter(|a| !a.is_empty() && !a.eq_ignore_ascii_case("unknown"))
+        .map(|a| a.to_string())
+        .collect()
+}
+
+fn citation_key(book: &Book, authors: &[String]) -> String {
+    let surname = authors
+        .first()
+        .and_then(|a| a.split_whitespace().last())
+        .unwrap_or("anon");
+    let first_word = book
+        .title
+        .split_whitespace()
+        .find(|w| w.chars().any(|c| c.is_alphanumeric()))
+        .unwrap_or("book");
+
+    format!("{}{}{}", surname, book.year.as_deref().unwrap_or(""), first_word)
+        .chars()
+        .filter(|c| c.is_ascii_alphanumeric())
+        .collect::<String>()
+        .to_lowercase()
+}
+
+fn escape_bibtex(value: &str) -> String {
+    let mut escaped = String::with_capacity(value.len());
+    for c in value.chars() {
+        if matches!(c, '{' | '}' | '&' | '%' | '$' | '#' | '_') {
+            escaped.push('\\');
+        }
+        escaped.push(c);
+    }
+    escaped
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::test_support::{test_book, BookBuilder};
+
+    fn sample_book() -> BookBuilder {
+        test_book("The Pragmatic Programmer")
+            .author("David Thomas, Andrew Hunt")
+            .year("2019")
+            .language("English")
+            .format("EPUB")
+            .size("2.1MB")
+            .url("https://annas-archive.org/md5/abc")
+    }
+
+    #[test]
+    fn test_bibtex_contains_fields() {
+        let citation = bibtex(&sample_book().build());
+        assert!(citation.starts_with("@book{thomas2019the,"));
+        assert!(citation.contains("title = {The Pragmatic Programmer}"));
+        assert!(citation.contains("author = {David Thomas and Andrew Hunt}"));
+        assert!(citation.contains("year = {2019}"));
+        assert!(citation.ends_with('}'));
+    }
+
+    #[test]
+    fn test_bibtex_escapes_special_chars() {
+        let book = test_book("Profit & Loss: 100% {Real}").build();
+        let citation = bibtex(&book);
+        assert!(citation.contains("Profit \\& Loss: 100\\% \\{Real\\}"));
+    }
+
+    #[test]
+    fn test_bibtex_without_author_or_year() {
+        let book = sample_book().author(None).year(None).build();
+        let citation = bibtex(&book);
+        assert!(citation.starts_with("@book{anonthe,"));
+        assert!(!citation.contains("author ="));
+        assert!(!citation.contains("year ="));
+    }
+
+    #[test]
+    fn test_apa_formats_authors_and_year() {
+        assert_eq!(
+            apa(&sample_book().build()),
+            "David Thomas & Andrew Hunt (2019). The Pragmatic Programmer. https://annas-archive.org/md5/abc"
+        );
+
+        let book = sample_book().author("Ann Lee, Bob Ray, Cy Twombly").build();
+        assert!(apa(&book).starts_with("Ann Lee, Bob Ray, & Cy Twombly (2019)."));
+
+        let book = sample_book().author("Unknown").year(None).build();
+        assert_eq!(
+            apa(&book),
+            "(n.d.). The Pragmatic Programmer. https://annas-archive.org/md5/abc"
+        );
+    }
+}
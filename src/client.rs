@@ -0,0 +1,118 @@
+use crate::downloader::{Downloader, Progress, Saved};
+use crate::error::AppError;
+use crate::scraper::{self, AnnaScraper, Book, DownloadLink, SearchFilters};
+use anyhow::{Context, Result};
+use std::path::PathBuf;
+
+// Library entry point tying search, link resolution and download together.
+// Nothing here prints; progress is only reported through callbacks.
+pub struct Client {
+    scraper: AnnaScraper,
+    downloader: Downloader,
+}
+
+impl Client {
+    pub fn new(download_path: PathBuf) -> Result<Self> {
+        let scraper = AnnaScraper::new()
+            .context("Failed to create scraper")?;
+        let downloader = Downloader::new(download_path)
+            .context("Failed to create downloader")?;
+        
+        Ok(Self { scraper, downloader })
+    }
+    
+    pub fn from_parts(scraper: AnnaScraper, downloader: Downloader) -> Self {
+        Self { scraper, downloader }
+    }
+    
+    pub async fn search(&self, query: &str, filters: &SearchFilters, max_results: usize) -> Result<Vec<Book>> {
+        let query = scraper::normalize_query(query)
+            .ok_or_else(|| anyhow::anyhow!("Search query is empty"))?;
+        
+        let books = self.scraper.search(&query, filters, max_results)
+            .await
+            .context("Search failed")?;
+        
+        if books.is_empty() {
+            return Err(AppError::NoResults.into());
+        }
+        
+        Ok(books)
+    }
+    
+    pub async fn links(&self, book: &Book) -> Result<Vec<DownloadLink>> {
+        let links = self.scraper.get_book_details(&book.url)
+            .await
+            .context("Failed to fetch download links")?;
+        
+        if links.is_empty() {
+            return Err(AppError::NoDownloadLinks.into());
+        }
+        
+        Ok(links)
+    }
+    
+    pub async fn sources(&self, book: &Book) -> Result<Vec<String>> {
+        let links = self.links(book).await?;
+        Ok(scraper::distinct_sources(&links))
+    }
+    
+    pub async fn resolve(&self, book: &Book) -> Result<DownloadLink> {
+        let links = self.links(book).await?;
+        scraper::preferred_link(&links)
+            .cloned()
+            .ok_or_else(|| AppError::NoDownloadLinks.into())
+    }
+    
+    pub async fn download(&self, book: &Book) -> Result<Saved> {
+        self.download_with_progress(book, |_| {}).await
+    }
+    
+    pub async fn download_with_progress<F>(&self, book: &Book, on_progress: F) -> Result<Saved>
+    where
+        F: FnMut(Progress),
+    {
+        let link = self.resolve(book).await?;
+        let filename = Self::filename_for(book);
+        
+        self.downloader.download_with_progress(&link.url, Some(&filename), on_progress)
+            .await
+            .context(AppError::Download)
+    }
+    
+    fn filename_for(book: &Book) -> String {
+        book.file_stem()
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::test_support::test_book;
+
+    fn sample_book() -> Book {
+        test_book("Dune")
+            .author("Frank Herbert")
+            .year("1965")
+            .language("English")
+            .format("EPUB")
+            .size("1.2MB")
+            .url("https://annas-archive.org/md5/abc")
+            .build()
+    }
+
+    #[test]
+    fn test_filename_for() {
+        assert_eq!(Client::filename_for(&sample_book()), "Dune - Frank Herbert");
+
+        let book = test_book(&"x".repeat(80)).build();
+        assert_eq!(Client::filename_for(&book), format!("{} - Unknown", "x".repeat(50)));
+    }
+
+    #[tokio::test]
+    async fn test_search_rejects_empty_query() {
+        let client = Client::new(std::env::temp_dir()).unwrap();
+        let err = client.search("   ", &SearchFilters::default(), 5).await.unwrap_err();
+        assert!(err.to_string().contains("empty"));
+    }
+}
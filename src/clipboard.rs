@@ -0,0 +1,56 @@
+use anyhow::{Context, Result};
+use std::io::Write;
+use std::process::{Command, Stdio};
+
+// Platform clipboard tools, tried in order until one succeeds
+const CLIPBOARD_COMMANDS: &[(&str, &[&str])] = &[
+    ("pbcopy", &[]),
+    ("wl-copy", &[]),
+    ("xclip", &["-selection", "clipboard"]),
+    ("xsel", &["--clipboard", "--input"]),
+    ("clip", &[]),
+];
+
+pub fn copy(text: &str) -> Result<()> {
+    for (program, args) in CLIPBOARD_COMMANDS {
+        if copy_with(program, args, text).is_ok() {
+            return Ok(());
+        }
+    }
+
+    anyhow::bail!("No clipboard tool found (tried pbcopy, wl-copy, xclip, xsel, clip)")
+}
+
+fn copy_with(program: &str, args: &[&str], text: &str) -> Result<()> {
+    let mut child = Command::new(program)
+        .args(args)
+        .stdin(Stdio::piped())
+        .stdout(Stdio::null())
+        .stderr(Stdio::null())
+        .spawn()
+        .with_context(|| format!("Failed to run {}", program))?;
+
+    child
+        .stdin
+        .take()
+        .context("Failed to open clipboard stdin")?
+        .write_all(text.as_bytes())
+        .context("Failed to write to clipboard")?;
+
+    let status = child.wait().context("Failed to wait for clipboard tool")?;
+    if !status.success() {
+        anyhow::bail!("{} exited with {}", program, status);
+    }
+
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_copy_with_missing_program_fails() {
+        assert!(copy_with("annadl-no-such-clipboard-tool", &[], "text").is_err());
+    }
+}
@@ -1,45 +1,235 @@
+use crate::downloader::{ConflictPolicy, DEFAULT_STALL_TIMEOUT};
+use crate::hook::PostDownload;
+use crate::naming::DateFolders;
+use crate::scraper::{self, CustomSelectors, SearchFilters, SortMode, SourceFilter, DEFAULT_CONNECT_TIMEOUT, DEFAULT_MAX_RETRIES, DEFAULT_PREFETCH_COUNT};
 use anyhow::{Context, Result};
 use serde::{Deserialize, Serialize};
 use std::path::{Path, PathBuf};
+use std::time::Duration;
+
+// Bump when the file layout changes and add the step to Config::migrate
+pub const CONFIG_VERSION: u32 = 1;
+// Hosts whose download links are always dropped, one pattern per line, kept next to the config file
+pub const BLOCK_LIST_FILE: &str = "blocked_hosts.txt";
+// Download history and TUI bookmarks, also next to the config file
+pub const HISTORY_FILE: &str = "downloads.json";
+pub const FAVORITES_FILE: &str = "favorites.json";
 
 #[derive(Debug, Serialize, Deserialize, Clone)]
 pub struct Config {
+    // Layout of the file on disk; files written before this field existed read as 0
+    #[serde(default)]
+    pub version: u32,
     #[serde(default)]
     pub download_path: Option<PathBuf>,
+    // Where partial files are written before moving to download_path; None keeps them beside it
+    #[serde(default)]
+    pub temp_dir: Option<PathBuf>,
+    #[serde(default)]
+    pub default_format: Option<String>,
+    // Formats get-list prefers when picking among the top results, best first
+    #[serde(default)]
+    pub format_priority: Vec<String>,
+    #[serde(default)]
+    pub default_language: Option<String>,
+    #[serde(default)]
+    pub default_sort: Option<SortMode>,
+    #[serde(default)]
+    pub remember_view: bool,
+    #[serde(default)]
+    pub retries: Option<u32>,
+    // Seconds without data before a download is abandoned
+    #[serde(default)]
+    pub stall_timeout: Option<u64>,
+    // Seconds to connect to a mirror or download host, TLS handshake included
+    #[serde(default)]
+    pub connect_timeout: Option<u64>,
+    // Book pages read ahead after a TUI search; 0 turns the read-ahead off
+    #[serde(default)]
+    pub prefetch_count: Option<usize>,
+    // Gateway that IPFS download links are rewritten to, e.g. "https://dweb.link"
+    #[serde(default)]
+    pub ipfs_gateway: Option<String>,
+    // What to do when a download's file already exists; None means the TUI asks
+    #[serde(default)]
+    pub on_conflict: Option<ConflictPolicy>,
+    // Folders and file name under download_path, e.g. "{author}/{title}"; None keeps "Title - Author"
+    #[serde(default)]
+    pub name_template: Option<String>,
+    // A folder per day or month under download_path, above the name template's folders
+    #[serde(default)]
+    pub date_folders: DateFolders,
+    // Sent instead of the built-in User-Agent on every request; empty keeps the built-in one
+    #[serde(default)]
+    pub user_agent: Option<String>,
+    // Shell command run after each download, e.g. "calibredb add {path}"
+    #[serde(default)]
+    pub post_download: Option<String>,
+    // Count a failed post_download command as a failed download
+    #[serde(default)]
+    pub post_download_required: bool,
+    // Check downloads against the book's md5 and move on to the next link on a mismatch
+    #[serde(default)]
+    pub verify_retry: bool,
+    #[serde(default)]
+    pub blocked_sources: Vec<String>,
+    #[serde(default)]
+    pub allowed_sources: Vec<String>,
+    // CSS selectors tried before the built-in ones when the site's markup changes
+    #[serde(default)]
+    pub search_selectors: Vec<String>,
+    #[serde(default)]
+    pub link_selectors: Vec<String>,
+    #[serde(default)]
+    pub ui: UiPrefs,
+    // Read from BLOCK_LIST_FILE on every load rather than stored in the JSON
+    #[serde(skip)]
+    pub blocked_hosts: Vec<String>,
+    // Where this config was loaded from; None means the default location
+    #[serde(skip)]
+    path: Option<PathBuf>,
+}
+
+// How the TUI looked when it was last closed; restored on the next start
+#[derive(Debug, Serialize, Deserialize, Clone, Default, PartialEq)]
+pub struct UiPrefs {
+    #[serde(default)]
+    pub show_preview: Option<bool>,
+    #[serde(default)]
+    pub sort: Option<SortMode>,
+    #[serde(default)]
+    pub theme: Theme,
+}
+
+#[derive(Debug, Serialize, Deserialize, Clone, Copy, Default, PartialEq)]
+#[serde(rename_all = "lowercase")]
+pub enum Theme {
+    #[default]
+    Color,
+    // No colours, for terminals with poor palettes; selection is shown reversed
+    Mono,
+}
+
+impl Theme {
+    pub fn next(self) -> Self {
+        match self {
+            Theme::Color => Theme::Mono,
+            Theme::Mono => Theme::Color,
+        }
+    }
+    
+    pub fn label(self) -> &'static str {
+        match self {
+            Theme::Color => "color",
+            Theme::Mono => "mono",
+        }
+    }
 }
 
 impl Default for Config {
     fn default() -> Self {
         Self {
+            version: CONFIG_VERSION,
             download_path: None,
+            temp_dir: None,
+            default_format: None,
+            format_priority: Vec::new(),
+            default_language: None,
+            default_sort: None,
+            remember_view: false,
+            retries: None,
+            stall_timeout: None,
+            connect_timeout: None,
+            prefetch_count: None,
+            ipfs_gateway: None,
+            on_conflict: None,
+            name_template: None,
+            date_folders: DateFolders::Off,
+            user_agent: None,
+            post_download: None,
+            post_download_required: false,
+            verify_retry: false,
+            blocked_sources: Vec::new(),
+            allowed_sources: Vec::new(),
+            search_selectors: Vec::new(),
+            link_selectors: Vec::new(),
+            blocked_hosts: Vec::new(),
+            ui: UiPrefs::default(),
+            path: None,
         }
     }
 }
 
 impl Config {
     pub fn load() -> Result<Self> {
-        let config_path = Self::config_path()?;
+        Self::load_from(None)
+    }
+    
+    // An explicit path (e.g. from --config-file) replaces the default location for both load and save
+    pub fn load_from(path: Option<PathBuf>) -> Result<Self> {
+        let config_path = match path {
+            Some(ref path) => path.clone(),
+            None => Self::config_path()?,
+        };
         
-        if config_path.exists() {
+        let mut config = if config_path.exists() {
             let contents = std::fs::read_to_string(&config_path)
-                .context("Failed to read config file")?;
-            let config: Config = serde_json::from_str(&contents)
+                .with_context(|| format!("Failed to read config file {}", config_path.display()))?;
+            let mut config: Config = serde_json::from_str(&contents)
                 .context("Failed to parse config JSON")?;
-            Ok(config)
+            config.migrate();
+            config.path = path;
+            config
         } else {
-            let config = Config::default();
+            let config = Config {
+                path,
+                ..Default::default()
+            };
             config.save()?;
-            Ok(config)
+            config
+        };
+        
+        config.blocked_hosts = load_block_list(&config.block_list_path()?)?;
+        Ok(config)
+    }
+    
+    pub fn block_list_path(&self) -> Result<PathBuf> {
+        Ok(self.file_path()?.with_file_name(BLOCK_LIST_FILE))
+    }
+    
+    // Follow --config-file, so a separate config keeps its own history and favorites
+    pub fn history_path(&self) -> Result<PathBuf> {
+        Ok(self.file_path()?.with_file_name(HISTORY_FILE))
+    }
+    
+    pub fn favorites_path(&self) -> Result<PathBuf> {
+        Ok(self.file_path()?.with_file_name(FAVORITES_FILE))
+    }
+    
+    pub fn file_path(&self) -> Result<PathBuf> {
+        match self.path {
+            Some(ref path) => Ok(path.clone()),
+            None => Self::config_path(),
+        }
+    }
+    
+    // Brings an older file up to CONFIG_VERSION in memory; it is written back on the next save.
+    // A newer file (from a later annadl) is read as far as this version understands it.
+    fn migrate(&mut self) {
+        // Version 0 had the same layout as 1; it only lacked the field
+        if self.version < 1 {
+            self.version = 1;
         }
     }
     
     pub fn save(&self) -> Result<()> {
-        let config_path = Self::config_path()?;
+        let config_path = self.file_path()?;
         let config_dir = config_path.parent().unwrap();
         
         std::fs::create_dir_all(config_dir)
             .context("Failed to create config directory")?;
         
+        // Default and migrate both leave version at CONFIG_VERSION (or newer), so it is current here
         let contents = serde_json::to_string_pretty(self)
             .context("Failed to serialize config")?;
         
@@ -49,24 +239,196 @@ impl Config {
         Ok(())
     }
     
+    // The stored path may use ~ or $VARS; the returned one is always expanded and absolute
     pub fn download_path(&self, cli_path: Option<PathBuf>) -> PathBuf {
-        cli_path
+        let path = cli_path
             .or_else(|| self.download_path.clone())
-            .unwrap_or_else(|| PathBuf::from("./assets"))
+            .unwrap_or_else(|| PathBuf::from("./assets"));
+        
+        Self::absolutize(&expand_path(&path))
     }
     
-    fn config_path() -> Result<PathBuf> {
-        let project_dir = dirs::config_dir()
-            .unwrap_or_else(|| PathBuf::from("."))
-            .join("anna-dl");
+    pub fn temp_dir(&self, cli_path: Option<PathBuf>) -> Option<PathBuf> {
+        cli_path
+            .or_else(|| self.temp_dir.clone())
+            .map(|path| Self::absolutize(&expand_path(&path)))
+    }
+    
+    fn absolutize(path: &Path) -> PathBuf {
+        let path = if path.is_absolute() {
+            path.to_path_buf()
+        } else {
+            std::env::current_dir()
+                .map(|cwd| cwd.join(path))
+                .unwrap_or_else(|_| path.to_path_buf())
+        };
         
-        Ok(project_dir.join("config.json"))
+        path.components()
+            .filter(|c| !matches!(c, std::path::Component::CurDir))
+            .collect()
+    }
+    
+    pub fn config_dir() -> PathBuf {
+        dirs::config_dir()
+            .unwrap_or_else(|| PathBuf::from("."))
+            .join("anna-dl")
+    }
+    
+    fn config_path() -> Result<PathBuf> {
+        Ok(Self::config_dir().join("config.json"))
     }
     
     pub fn set_download_path(&mut self, path: PathBuf) -> Result<()> {
         self.download_path = Some(path);
         self.save()
     }
+    
+    pub fn format_filter(&self, cli_format: Option<String>) -> Option<String> {
+        cli_format.or_else(|| self.default_format.clone())
+    }
+    
+    // --format-priority replaces the configured list rather than adding to it
+    pub fn format_priority(&self, cli_priority: Vec<String>) -> Vec<String> {
+        let priority = if cli_priority.is_empty() { self.format_priority.clone() } else { cli_priority };
+        priority.into_iter()
+            .map(|format| format.trim().to_string())
+            .filter(|format| !format.is_empty())
+            .collect()
+    }
+    
+    pub fn language_filter(&self, cli_language: Option<String>) -> Option<String> {
+        cli_language.or_else(|| self.default_language.clone())
+    }
+    
+    pub fn retries(&self, cli_retries: Option<u32>) -> u32 {
+        cli_retries.or(self.retries).unwrap_or(DEFAULT_MAX_RETRIES)
+    }
+    
+    pub fn stall_timeout(&self, cli_secs: Option<u64>) -> Duration {
+        cli_secs.or(self.stall_timeout)
+            .map(Duration::from_secs)
+            .unwrap_or(DEFAULT_STALL_TIMEOUT)
+    }
+    
+    pub fn connect_timeout(&self, cli_secs: Option<u64>) -> Duration {
+        cli_secs.or(self.connect_timeout)
+            .map(Duration::from_secs)
+            .unwrap_or(DEFAULT_CONNECT_TIMEOUT)
+    }
+    
+    pub fn prefetch_count(&self, cli_count: Option<usize>) -> usize {
+        cli_count.or(self.prefetch_count).unwrap_or(DEFAULT_PREFETCH_COUNT)
+    }
+    
+    // An empty --user-agent also skips the configured one, back to the built-in default
+    pub fn user_agent(&self, cli_agent: Option<String>) -> Option<String> {
+        cli_agent.or_else(|| self.user_agent.clone())
+            .map(|agent| agent.trim().to_string())
+            .filter(|agent| !agent.is_empty())
+    }
+    
+    // --post-download replaces the configured command; either required flag makes it required
+    pub fn post_download(&self, cli_command: Option<String>, cli_required: bool) -> Option<PostDownload> {
+        cli_command.or_else(|| self.post_download.clone())
+            .map(|command| command.trim().to_string())
+            .filter(|command| !command.is_empty())
+            .map(|command| PostDownload {
+                command,
+                required: cli_required || self.post_download_required,
+            })
+    }
+    
+    pub fn source_filter(&self) -> SourceFilter {
+        SourceFilter {
+            blocked: self.blocked_sources.clone(),
+            allowed: self.allowed_sources.clone(),
+            blocked_hosts: self.blocked_hosts.clone(),
+        }
+    }
+    
+    pub fn custom_selectors(&self) -> CustomSelectors {
+        CustomSelectors {
+            search: self.search_selectors.clone(),
+            links: self.link_selectors.clone(),
+        }
+    }
+    
+    pub fn set_default_format(&mut self, format: &str) -> Result<()> {
+        self.default_format = Self::non_empty(format);
+        self.save()
+    }
+    
+    pub fn set_default_language(&mut self, language: &str) -> Result<()> {
+        self.default_language = Self::non_empty(language);
+        self.save()
+    }
+    
+    // Stores the current sort and filters as defaults when remember_view is on
+    pub fn remember_view(&mut self, filters: &SearchFilters, sort: SortMode) -> Result<bool> {
+        if !self.remember_view {
+            return Ok(false);
+        }
+        
+        self.default_format = filters.format.clone();
+        self.default_language = filters.language.clone();
+        self.default_sort = Some(sort);
+        self.save()?;
+        Ok(true)
+    }
+    
+    // Returns false when nothing changed, so quitting doesn't rewrite the file every time
+    pub fn save_ui(&mut self, ui: UiPrefs) -> Result<bool> {
+        if self.ui == ui {
+            return Ok(false);
+        }
+        
+        self.ui = ui;
+        self.save()?;
+        Ok(true)
+    }
+    
+    fn non_empty(value: &str) -> Option<String> {
+        let value = value.trim();
+        if value.is_empty() {
+            None
+        } else {
+            Some(value.to_string())
+        }
+    }
+}
+
+// A missing file is the same as an empty one
+fn load_block_list(path: &Path) -> Result<Vec<String>> {
+    if !path.exists() {
+        return Ok(Vec::new());
+    }
+    let contents = std::fs::read_to_string(path)
+        .with_context(|| format!("Failed to read block list {}", path.display()))?;
+    Ok(scraper::parse_block_list(&contents))
+}
+
+// Expands a leading ~ to the home directory and $VAR / ${VAR} from the environment
+pub fn expand_path(path: &Path) -> PathBuf {
+    let raw = path.to_string_lossy();
+    
+    let tilde_expanded = match raw.strip_prefix('~') {
+        Some(rest) if rest.is_empty() || rest.starts_with('/') || rest.starts_with('\\') => {
+            match dirs::home_dir() {
+                Some(home) => format!("{}{}", home.display(), rest),
+                None => raw.to_string(),
+            }
+        }
+        _ => raw.to_string(),
+    };
+    
+    let re = regex::Regex::new(r"\$(?:\{([A-Za-z_][A-Za-z0-9_]*)\}|([A-Za-z_][A-Za-z0-9_]*))").unwrap();
+    let expanded = re.replace_all(&tilde_expanded, |caps: &regex::Captures| {
+        let name = caps.get(1).or_else(|| caps.get(2)).map(|m| m.as_str()).unwrap_or("");
+        // Unknown variables are left as written rather than silently dropped
+        std::env::var(name).unwrap_or_else(|_| caps[0].to_string())
+    });
+    
+    PathBuf::from(expanded.into_owned())
 }
 
 #[cfg(test)]
@@ -96,6 +458,7 @@ mod tests {
     fn test_config_serialization() {
         let config = Config {
             download_path: Some(PathBuf::from("/test/path")),
+            ..Default::default()
         };
 
         let json = serde_json::to_string(&config).unwrap();
@@ -125,6 +488,7 @@ mod tests {
         // Create a config with a download path
         let original_config = Config {
             download_path: Some(PathBuf::from("/my/downloads")),
+            ..Default::default()
         };
 
         // Save it
@@ -145,6 +509,7 @@ mod tests {
     fn test_download_path_priority_cli_overrides_all() {
         let config = Config {
             download_path: Some(PathBuf::from("/config/path")),
+            ..Default::default()
         };
 
         let cli_path = Some(PathBuf::from("/cli/path"));
@@ -157,6 +522,7 @@ mod tests {
     fn test_download_path_priority_config_over_default() {
         let config = Config {
             download_path: Some(PathBuf::from("/config/path")),
+            ..Default::default()
         };
 
         let result = config.download_path(None);
@@ -168,11 +534,13 @@ mod tests {
     fn test_download_path_priority_default_fallback() {
         let config = Config {
             download_path: None,
+            ..Default::default()
         };
 
         let result = config.download_path(None);
 
-        assert_eq!(result, PathBuf::from("./assets"));
+        assert_eq!(result, std::env::current_dir().unwrap().join("assets"));
+        assert!(result.is_absolute());
     }
 
     #[test]
@@ -201,6 +569,291 @@ mod tests {
         fs::remove_dir_all(&test_dir).unwrap();
     }
 
+    #[test]
+    fn test_on_conflict_roundtrip() {
+        let config: Config = serde_json::from_str(r#"{"on_conflict":"rename"}"#).unwrap();
+        assert_eq!(config.on_conflict, Some(ConflictPolicy::Rename));
+        assert_eq!(Config::default().on_conflict, None);
+    }
+    
+    #[test]
+    fn test_date_folders_roundtrip() {
+        let config: Config = serde_json::from_str(r#"{"date_folders":"monthly"}"#).unwrap();
+        assert_eq!(config.date_folders, DateFolders::Monthly);
+        assert_eq!(Config::default().date_folders, DateFolders::Off);
+        assert!(serde_json::from_str::<Config>(r#"{"date_folders":"weekly"}"#).is_err());
+    }
+    
+    #[test]
+    fn test_temp_dir_precedence() {
+        let config: Config = serde_json::from_str(r#"{"temp_dir":"/scratch/annadl"}"#).unwrap();
+        assert_eq!(config.temp_dir(Some(PathBuf::from("/tmp/parts"))), Some(PathBuf::from("/tmp/parts")));
+        assert_eq!(config.temp_dir(None), Some(PathBuf::from("/scratch/annadl")));
+        assert_eq!(Config::default().temp_dir(None), None);
+    }
+    
+    #[test]
+    fn test_format_and_language_filter_precedence() {
+        let config = Config {
+            default_format: Some("epub".to_string()),
+            default_language: Some("en".to_string()),
+            ..Default::default()
+        };
+
+        assert_eq!(config.format_filter(Some("pdf".to_string())), Some("pdf".to_string()));
+        assert_eq!(config.format_filter(None), Some("epub".to_string()));
+        assert_eq!(config.language_filter(Some("fr".to_string())), Some("fr".to_string()));
+        assert_eq!(config.language_filter(None), Some("en".to_string()));
+
+        let empty = Config::default();
+        assert_eq!(empty.format_filter(None), None);
+        assert_eq!(empty.language_filter(None), None);
+    }
+
+    #[test]
+    fn test_retries_precedence() {
+        let config: Config = serde_json::from_str(r#"{"retries":1}"#).unwrap();
+        assert_eq!(config.retries(Some(0)), 0);
+        assert_eq!(config.retries(None), 1);
+        assert_eq!(Config::default().retries(None), 3);
+    }
+
+    #[test]
+    fn test_stall_timeout_precedence() {
+        let config: Config = serde_json::from_str(r#"{"stall_timeout":120}"#).unwrap();
+        assert_eq!(config.stall_timeout(Some(5)), Duration::from_secs(5));
+        assert_eq!(config.stall_timeout(None), Duration::from_secs(120));
+        assert_eq!(Config::default().stall_timeout(None), DEFAULT_STALL_TIMEOUT);
+    }
+
+    #[test]
+    fn test_post_download_precedence() {
+        let config: Config = serde_json::from_str(r#"{"post_download":"calibredb add {path}"}"#).unwrap();
+        let hook = config.post_download(None, false).unwrap();
+        assert_eq!(hook.command, "calibredb add {path}");
+        assert!(!hook.required);
+
+        let hook = config.post_download(Some("echo {title}".to_string()), true).unwrap();
+        assert_eq!(hook.command, "echo {title}");
+        assert!(hook.required);
+
+        assert_eq!(config.post_download(Some(" ".to_string()), false), None);
+        assert_eq!(Config::default().post_download(None, true), None);
+    }
+
+    #[test]
+    fn test_connect_timeout_precedence() {
+        let config: Config = serde_json::from_str(r#"{"connect_timeout":5}"#).unwrap();
+        assert_eq!(config.connect_timeout(Some(2)), Duration::from_secs(2));
+        assert_eq!(config.connect_timeout(None), Duration::from_secs(5));
+        assert_eq!(Config::default().connect_timeout(None), DEFAULT_CONNECT_TIMEOUT);
+    }
+
+    #[test]
+    fn test_format_priority_precedence() {
+        let config: Config = serde_json::from_str(r#"{"format_priority":["epub","pdf"]}"#).unwrap();
+        assert_eq!(config.format_priority(Vec::new()), ["epub", "pdf"]);
+        assert_eq!(config.format_priority(vec!["mobi".to_string(), " ".to_string()]), ["mobi"]);
+        assert!(Config::default().format_priority(Vec::new()).is_empty());
+    }
+
+    #[test]
+    fn test_prefetch_count_precedence() {
+        let config: Config = serde_json::from_str(r#"{"prefetch_count":0}"#).unwrap();
+        assert_eq!(config.prefetch_count(Some(5)), 5);
+        assert_eq!(config.prefetch_count(None), 0);
+        assert_eq!(Config::default().prefetch_count(None), DEFAULT_PREFETCH_COUNT);
+    }
+
+    #[test]
+    fn test_user_agent_precedence() {
+        let config: Config = serde_json::from_str(r#"{"user_agent":"from-config/1.0"}"#).unwrap();
+        assert_eq!(config.user_agent(Some("from-cli/2.0".to_string())).as_deref(), Some("from-cli/2.0"));
+        assert_eq!(config.user_agent(None).as_deref(), Some("from-config/1.0"));
+        assert_eq!(config.user_agent(Some(" ".to_string())), None);
+        assert_eq!(Config::default().user_agent(None), None);
+
+        let config: Config = serde_json::from_str(r#"{"user_agent":""}"#).unwrap();
+        assert_eq!(config.user_agent(None), None);
+    }
+
+    #[test]
+    fn test_source_filter_from_config() {
+        let config: Config = serde_json::from_str(r#"{"blocked_sources":["Unknown"],"allowed_sources":["LibGen"]}"#).unwrap();
+        let filter = config.source_filter();
+        assert_eq!(filter.blocked, ["Unknown"]);
+        assert_eq!(filter.allowed, ["LibGen"]);
+        assert_eq!(Config::default().source_filter(), SourceFilter::default());
+    }
+
+    #[test]
+    fn test_config_defaults_roundtrip() {
+        let json = r#"{"download_path":null,"default_format":"epub","default_language":"de"}"#;
+        let config: Config = serde_json::from_str(json).unwrap();
+        assert_eq!(config.default_format.as_deref(), Some("epub"));
+        assert_eq!(config.default_language.as_deref(), Some("de"));
+    }
+
+    #[test]
+    fn test_remember_view_fields_roundtrip() {
+        let json = r#"{"default_sort":"newest","remember_view":true}"#;
+        let config: Config = serde_json::from_str(json).unwrap();
+        assert_eq!(config.default_sort, Some(SortMode::Newest));
+        assert!(config.remember_view);
+
+        let config: Config = serde_json::from_str("{}").unwrap();
+        assert_eq!(config.default_sort, None);
+        assert!(!config.remember_view);
+    }
+
+    #[test]
+    fn test_remember_view_disabled_is_noop() {
+        let mut config = Config::default();
+        let filters = SearchFilters {
+            format: Some("pdf".to_string()),
+            ..Default::default()
+        };
+
+        assert!(!config.remember_view(&filters, SortMode::Title).unwrap());
+        assert_eq!(config.default_format, None);
+        assert_eq!(config.default_sort, None);
+    }
+
+    #[test]
+    fn test_ui_prefs_roundtrip() {
+        let json = r#"{"ui":{"show_preview":false,"sort":"title","theme":"mono"}}"#;
+        let config: Config = serde_json::from_str(json).unwrap();
+        assert_eq!(config.ui.show_preview, Some(false));
+        assert_eq!(config.ui.sort, Some(SortMode::Title));
+        assert_eq!(config.ui.theme, Theme::Mono);
+
+        // Older configs have no ui section
+        let config: Config = serde_json::from_str("{}").unwrap();
+        assert_eq!(config.ui, UiPrefs::default());
+        assert_eq!(config.ui.theme, Theme::Color);
+    }
+
+    #[test]
+    fn test_save_ui_skips_unchanged_prefs() {
+        let test_dir = create_test_config_dir();
+        let config_path = test_dir.join("config.json");
+        let mut config = Config::load_from(Some(config_path.clone())).unwrap();
+
+        assert!(!config.save_ui(UiPrefs::default()).unwrap());
+
+        let prefs = UiPrefs { show_preview: Some(false), sort: Some(SortMode::Newest), theme: Theme::Mono };
+        assert!(config.save_ui(prefs.clone()).unwrap());
+        let reloaded = Config::load_from(Some(config_path)).unwrap();
+        assert_eq!(reloaded.ui, prefs);
+
+        fs::remove_dir_all(&test_dir).unwrap();
+    }
+
+    #[test]
+    fn test_load_reads_block_list_next_to_config() {
+        let test_dir = create_test_config_dir();
+        let config_path = test_dir.join("config.json");
+
+        let config = Config::load_from(Some(config_path.clone())).unwrap();
+        assert!(config.blocked_hosts.is_empty());
+
+        fs::write(test_dir.join(BLOCK_LIST_FILE), "# flaky\ndead.example\n").unwrap();
+        let config = Config::load_from(Some(config_path.clone())).unwrap();
+        assert_eq!(config.blocked_hosts, ["dead.example"]);
+        assert_eq!(config.source_filter().blocked_hosts, ["dead.example"]);
+
+        // The list stays in its own file
+        config.save().unwrap();
+        assert!(!fs::read_to_string(&config_path).unwrap().contains("dead.example"));
+
+        fs::remove_dir_all(&test_dir).unwrap();
+    }
+
+    #[test]
+    fn test_load_from_custom_path_creates_and_saves_there() {
+        let test_dir = create_test_config_dir();
+        let config_path = test_dir.join("nested").join("alt.json");
+
+        let mut config = Config::load_from(Some(config_path.clone())).unwrap();
+        assert!(config_path.exists());
+        assert_eq!(config.file_path().unwrap(), config_path);
+
+        config.set_default_format("pdf").unwrap();
+        let reloaded = Config::load_from(Some(config_path.clone())).unwrap();
+        assert_eq!(reloaded.default_format.as_deref(), Some("pdf"));
+
+        fs::remove_dir_all(&test_dir).unwrap();
+    }
+
+    #[test]
+    fn test_load_versionless_config_upgrades() {
+        let test_dir = create_test_config_dir();
+        let config_path = test_dir.join("config.json");
+        fs::write(&config_path, r#"{"download_path":"/srv/books","retries":2,"ui":{"theme":"mono"}}"#).unwrap();
+
+        let config = Config::load_from(Some(config_path.clone())).unwrap();
+        assert_eq!(config.version, CONFIG_VERSION);
+        assert_eq!(config.download_path, Some(PathBuf::from("/srv/books")));
+        assert_eq!(config.retries, Some(2));
+        assert_eq!(config.ui.theme, Theme::Mono);
+
+        config.save().unwrap();
+        let stored: serde_json::Value = serde_json::from_str(&fs::read_to_string(&config_path).unwrap()).unwrap();
+        assert_eq!(stored["version"], CONFIG_VERSION);
+        assert_eq!(stored["retries"], 2);
+
+        fs::remove_dir_all(&test_dir).unwrap();
+    }
+
+    #[test]
+    fn test_new_config_file_records_version() {
+        let test_dir = create_test_config_dir();
+        let config_path = test_dir.join("config.json");
+
+        Config::load_from(Some(config_path.clone())).unwrap();
+        let stored: serde_json::Value = serde_json::from_str(&fs::read_to_string(&config_path).unwrap()).unwrap();
+        assert_eq!(stored["version"], CONFIG_VERSION);
+
+        fs::remove_dir_all(&test_dir).unwrap();
+    }
+
+    #[test]
+    fn test_expand_path_tilde() {
+        let home = dirs::home_dir().unwrap();
+        assert_eq!(expand_path(Path::new("~/books")), home.join("books"));
+        assert_eq!(expand_path(Path::new("~")), home);
+        // Only a leading ~ is special
+        assert_eq!(expand_path(Path::new("/tmp/~books")), PathBuf::from("/tmp/~books"));
+        assert_eq!(expand_path(Path::new("~other/books")), PathBuf::from("~other/books"));
+    }
+
+    #[test]
+    fn test_expand_path_env_vars() {
+        std::env::set_var("ANNADL_TEST_BOOKS_DIR", "/srv/books");
+        assert_eq!(expand_path(Path::new("$ANNADL_TEST_BOOKS_DIR/scifi")), PathBuf::from("/srv/books/scifi"));
+        assert_eq!(expand_path(Path::new("${ANNADL_TEST_BOOKS_DIR}/x")), PathBuf::from("/srv/books/x"));
+        assert_eq!(expand_path(Path::new("$ANNADL_TEST_UNSET_VAR/x")), PathBuf::from("$ANNADL_TEST_UNSET_VAR/x"));
+    }
+
+    #[test]
+    fn test_download_path_expands_stored_tilde() {
+        let config = Config {
+            download_path: Some(PathBuf::from("~/Downloads/test")),
+            ..Default::default()
+        };
+
+        let result = config.download_path(None);
+        assert_eq!(result, dirs::home_dir().unwrap().join("Downloads/test"));
+        // The stored, user-friendly form is untouched
+        assert_eq!(config.download_path, Some(PathBuf::from("~/Downloads/test")));
+    }
+
+    #[test]
+    fn test_non_empty_clears_blank_values() {
+        assert_eq!(Config::non_empty("  "), None);
+        assert_eq!(Config::non_empty(" pdf "), Some("pdf".to_string()));
+    }
+
     #[test]
     fn test_config_handles_empty_json() {
         let json = r#"{}"#;
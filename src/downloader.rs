@@ -1,44 +1,213 @@
+use crate::encoding::BodyDecoder;
+use crate::error::AppError;
+use crate::scraper::{truncate_bytes, AnnaScraper, DEFAULT_CONNECT_TIMEOUT, DEFAULT_MAX_RETRIES, MAX_RETRY_AFTER, RETRY_BASE_DELAY};
 use anyhow::{Context, Result};
 use indicatif::{ProgressBar, ProgressStyle};
+use serde::{Deserialize, Serialize};
+use std::collections::HashSet;
 use std::path::{Path, PathBuf};
+use std::sync::Mutex;
+use std::time::{Duration, Instant};
 use tokio::fs::File;
-use tokio::io::AsyncWriteExt;
+use tokio::io::{AsyncSeekExt, AsyncWrite, AsyncWriteExt};
 use futures::StreamExt;
 
+// Segments smaller than this are not worth an extra connection
+const MIN_SEGMENT_BYTES: u64 = 1024 * 1024;
+
+// A transfer is only abandoned after this long without a single byte, however long it runs
+pub const DEFAULT_STALL_TIMEOUT: Duration = Duration::from_secs(60);
+
+// Most filesystems allow 255 bytes; the rest is room for " (N)" and ".part"
+const MAX_FILENAME_BYTES: usize = 240;
+
+// What to do when the file being downloaded already exists
+#[derive(Debug, Clone, Copy, PartialEq, Default, Serialize, Deserialize, clap::ValueEnum)]
+#[serde(rename_all = "lowercase")]
+pub enum ConflictPolicy {
+    #[default]
+    Overwrite,
+    // Keeps the existing file and returns its path without downloading
+    Skip,
+    // Saves as "name (1).ext", "name (2).ext", ...
+    Rename,
+}
+
+impl ConflictPolicy {
+    pub fn label(self) -> &'static str {
+        match self {
+            ConflictPolicy::Overwrite => "overwrite",
+            ConflictPolicy::Skip => "skip",
+            ConflictPolicy::Rename => "rename",
+        }
+    }
+}
+
+// Where a download ended up. Skipped means ConflictPolicy::Skip kept a file that was already
+// there: nothing was fetched, so it isn't a new download for history, stats or hooks.
+#[derive(Debug, Clone, PartialEq)]
+pub enum Saved {
+    Written(PathBuf),
+    Skipped(PathBuf),
+}
+
+impl Saved {
+    pub fn path(&self) -> &Path {
+        match self {
+            Saved::Written(path) | Saved::Skipped(path) => path,
+        }
+    }
+    
+    pub fn into_path(self) -> PathBuf {
+        match self {
+            Saved::Written(path) | Saved::Skipped(path) => path,
+        }
+    }
+}
+
 pub struct Downloader {
     client: reqwest::Client,
     download_path: PathBuf,
+    max_retries: u32,
+    connections: usize,
+    stall_timeout: Duration,
+    temp_dir: Option<PathBuf>,
+    conflict: ConflictPolicy,
+    // Set once the download and temp directories exist; concurrent downloads share the one setup
+    prepared: tokio::sync::OnceCell<()>,
+    // Targets of downloads still in flight, so two of them never write the same file
+    reserved: Mutex<HashSet<PathBuf>>,
+}
+
+// Releases a reserved target when its download ends, however it ends
+struct Reservation<'a> {
+    reserved: &'a Mutex<HashSet<PathBuf>>,
+    path: PathBuf,
+}
+
+impl Drop for Reservation<'_> {
+    fn drop(&mut self) {
+        self.reserved.lock().unwrap().remove(&self.path);
+    }
+}
+
+// Removes the target file on drop unless the download was marked successful
+struct PartialFileGuard {
+    path: PathBuf,
+    success: bool,
+}
+
+impl PartialFileGuard {
+    fn new(path: PathBuf) -> Self {
+        Self { path, success: false }
+    }
+}
+
+impl Drop for PartialFileGuard {
+    fn drop(&mut self) {
+        if !self.success {
+            let _ = std::fs::remove_file(&self.path);
+        }
+    }
+}
+
+// Reported to download callbacks; rendering is left to the caller.
+// A total of 0 means the server sent no Content-Length, and percent then stays 0.
+#[derive(Debug, Clone, Copy, Default, PartialEq)]
+pub struct Progress {
+    pub current: u64,
+    pub total: u64,
+    pub bytes_per_sec: u64,
+    pub percent: f64,
+}
+
+impl Progress {
+    pub fn new(current: u64, total: u64, elapsed: Duration) -> Self {
+        let secs = elapsed.as_secs_f64();
+        Self {
+            current,
+            total,
+            bytes_per_sec: if secs > 0.0 { (current as f64 / secs) as u64 } else { 0 },
+            percent: if total > 0 { (current as f64 / total as f64 * 100.0).min(100.0) } else { 0.0 },
+        }
+    }
 }
 
 impl Downloader {
     pub fn new(download_path: PathBuf) -> Result<Self> {
-        let client = reqwest::Client::builder()
-            .timeout(std::time::Duration::from_secs(300))
+        let client = Self::client_builder()
             .build()
             .context("Failed to create HTTP client")?;
         
-        Ok(Self { client, download_path })
+        Ok(Self::from_client(download_path, client))
     }
     
-    pub async fn download(&self, url: &str, filename: Option<&str>) -> Result<PathBuf> {
-        let response = self.client
-            .get(url)
-            .send()
-            .await
-            .context("Failed to start download")?;
-        
-        let total_size = response
-            .content_length()
-            .ok_or_else(|| anyhow::anyhow!("Failed to get content length"))?;
-        
-        let filename = self.determine_filename(url, filename, &response)?;
-        let filepath = self.download_path.join(&filename);
-        
-        tokio::fs::create_dir_all(&self.download_path)
-            .await
-            .context("Failed to create download directory")?;
-        
-        let pb = ProgressBar::new(total_size);
+    // The settings new() uses, for callers that need to adjust the transport before building
+    pub fn client_builder() -> reqwest::ClientBuilder {
+        // No overall timeout: a huge file on a slow link may take hours; stalls are caught per read
+        reqwest::Client::builder()
+            .connect_timeout(DEFAULT_CONNECT_TIMEOUT)
+    }
+    
+    // For custom transports; the stall timeout still applies on top of the client's own timeouts
+    pub fn from_client(download_path: PathBuf, client: reqwest::Client) -> Self {
+        Self {
+            client,
+            download_path,
+            max_retries: DEFAULT_MAX_RETRIES,
+            connections: 1,
+            stall_timeout: DEFAULT_STALL_TIMEOUT,
+            temp_dir: None,
+            conflict: ConflictPolicy::default(),
+            prepared: tokio::sync::OnceCell::new(),
+            reserved: Mutex::new(HashSet::new()),
+        }
+    }
+    
+    // Retries apply to starting the transfer; 0 fails on the first error
+    pub fn with_max_retries(mut self, max_retries: u32) -> Self {
+        self.max_retries = max_retries;
+        self
+    }
+    
+    // Above 1, large files from servers that accept byte ranges are fetched in that many parts
+    pub fn with_connections(mut self, connections: usize) -> Self {
+        self.connections = connections.max(1);
+        self
+    }
+    
+    // Gives up when the server sends nothing, not even headers, for this long
+    pub fn with_stall_timeout(mut self, stall_timeout: Duration) -> Self {
+        self.stall_timeout = stall_timeout;
+        self
+    }
+    
+    // Partial files go here instead of the download directory, e.g. local disk for a network share
+    pub fn with_temp_dir(mut self, temp_dir: Option<PathBuf>) -> Self {
+        self.temp_dir = temp_dir;
+        self
+    }
+    
+    pub fn with_conflict_policy(mut self, conflict: ConflictPolicy) -> Self {
+        self.conflict = conflict;
+        self
+    }
+    
+    // Where a download given this name would land, if a file is already there; lets a caller
+    // ask before starting. Names without an extension may still gain one from the server.
+    pub fn existing_target(download_path: &Path, filename: &str) -> Option<PathBuf> {
+        let path = download_path.join(fit_filename(&sanitize_filename(filename), MAX_FILENAME_BYTES));
+        path.exists().then_some(path)
+    }
+    
+    fn partial_dir(&self) -> &Path {
+        self.temp_dir.as_deref().unwrap_or(&self.download_path)
+    }
+    
+    // Terminal rendering for callers that want a ready-made bar; it only consumes Progress,
+    // so the download itself stays free of presentation
+    pub fn progress_bar() -> ProgressBar {
+        let pb = ProgressBar::new(0);
         pb.set_style(
             ProgressStyle::default_bar()
                 .template(
@@ -47,25 +216,394 @@ impl Downloader {
                 .unwrap()
                 .progress_chars("=>-"),
         );
-        pb.set_message(format!("Downloading {}", filename));
+        pb
+    }
+    
+    // A total of 0 means the server sent no Content-Length
+    pub fn update_progress_bar(pb: &ProgressBar, progress: &Progress) {
+        if progress.total > 0 {
+            pb.set_length(progress.total);
+        } else if pb.length() != Some(u64::MAX) {
+            // Switch once to an animated spinner with a running byte count
+            pb.set_length(u64::MAX);
+            pb.set_style(
+                ProgressStyle::default_spinner()
+                    .template("{spinner} [{elapsed_precise}] {bytes} ({bytes_per_sec}) {msg}")
+                    .unwrap(),
+            );
+            pb.enable_steady_tick(std::time::Duration::from_millis(120));
+        }
+        pb.set_position(progress.current);
+    }
+    
+    pub async fn download(&self, url: &str, filename: Option<&str>) -> Result<Saved> {
+        self.download_with_progress(url, filename, |_| {}).await
+    }
+    
+    pub async fn download_with_progress<F>(
+        &self,
+        url: &str,
+        filename: Option<&str>,
+        on_progress: F,
+    ) -> Result<Saved>
+    where
+        F: FnMut(Progress),
+    {
+        // With connections to split across, the first request asks for one byte: a 206 answer
+        // proves ranges work and carries the size, a 200 is the whole body as usual
+        let response = if self.connections > 1 {
+            self.fetch_range(url, Some((0, 0))).await?
+        } else {
+            self.fetch(url).await?
+        };
+        
+        let filename = self.determine_filename(url, filename, &response)?;
+        let reservation = match self.reserve_target(self.download_path.join(filename)) {
+            Ok(reservation) => reservation,
+            Err(existing) => return Ok(Saved::Skipped(existing)),
+        };
+        let filepath = reservation.path.clone();
+        
+        let partial_name = format!("{}.part", filepath.file_name().unwrap_or_default().to_string_lossy());
+        let partial_path = self.partial_dir().join(partial_name);
+        
+        self.prepare().await?;
+        
+        // Declared before the file so the handle is closed before cleanup runs
+        let mut guard = PartialFileGuard::new(partial_path.clone());
         
-        let mut file = File::create(&filepath)
+        let mut file = File::create(&partial_path)
             .await
             .context("Failed to create file")?;
         
+        match self.segment_count(&response) {
+            Some((total, segments)) => {
+                // The first response only served as the probe; each part is requested afresh
+                drop(response);
+                file.set_len(total).await.context("Failed to allocate file")?;
+                drop(file);
+                self.download_segments(url, &partial_path, total, segments, on_progress).await?;
+            }
+            None => {
+                // Too small to split, or encoded: the probe's single byte is no use
+                let response = if response.status() == reqwest::StatusCode::PARTIAL_CONTENT {
+                    self.fetch(url).await?
+                } else {
+                    response
+                };
+                self.stream_to(response, &mut file, on_progress).await?;
+                file.flush().await.context("Failed to flush file")?;
+                drop(file);
+            }
+        }
+        
+        // Only a complete file ever appears under its real name
+        move_file(&partial_path, &filepath).await?;
+        guard.success = true;
+        Ok(Saved::Written(filepath))
+    }
+    
+    // Creates the download and temp directories; runs once, however many downloads start together
+    pub async fn prepare(&self) -> Result<()> {
+        self.prepared.get_or_try_init(|| async {
+            tokio::fs::create_dir_all(&self.download_path)
+                .await
+                .context("Failed to create download directory")?;
+            tokio::fs::create_dir_all(self.partial_dir())
+                .await
+                .context("Failed to create temp directory")?;
+            Ok::<(), anyhow::Error>(())
+        }).await?;
+        Ok(())
+    }
+    
+    // Claims the path this download will be saved as, applying the conflict policy to files on
+    // disk. A target another download is still writing is always renamed: sharing its partial
+    // file would corrupt both. Err carries the existing file when the policy is to skip it.
+    fn reserve_target(&self, path: PathBuf) -> std::result::Result<Reservation<'_>, PathBuf> {
+        let mut reserved = self.reserved.lock().unwrap();
+        let taken = |candidate: &Path| candidate.exists() || reserved.contains(candidate);
+        
+        let path = if reserved.contains(&path) {
+            first_free(&path, taken)
+        } else if path.exists() {
+            match self.conflict {
+                ConflictPolicy::Overwrite => path,
+                ConflictPolicy::Skip => return Err(path),
+                ConflictPolicy::Rename => first_free(&path, taken),
+            }
+        } else {
+            path
+        };
+        
+        reserved.insert(path.clone());
+        Ok(Reservation { reserved: &self.reserved, path })
+    }
+    
+    // Splitting needs a ranged answer to the probe, a known length and a body stored as-is
+    fn segment_count(&self, response: &reqwest::Response) -> Option<(u64, usize)> {
+        if self.connections < 2 || response.status() != reqwest::StatusCode::PARTIAL_CONTENT {
+            return None;
+        }
+        
+        let encoded = response.headers().get(reqwest::header::CONTENT_ENCODING)
+            .and_then(|v| v.to_str().ok())
+            .map_or(false, |v| !v.trim().eq_ignore_ascii_case("identity"));
+        if encoded {
+            return None;
+        }
+        
+        let total = match content_range(response)? {
+            (0, 0, Some(total)) => total,
+            _ => return None,
+        };
+        let segments = std::cmp::min(self.connections as u64, total / MIN_SEGMENT_BYTES) as usize;
+        if segments < 2 {
+            return None;
+        }
+        Some((total, segments))
+    }
+    
+    async fn download_segments<F>(&self, url: &str, path: &Path, total: u64, segments: usize, mut on_progress: F) -> Result<()>
+    where
+        F: FnMut(Progress),
+    {
+        let started = Instant::now();
+        let (tx, mut rx) = tokio::sync::mpsc::unbounded_channel::<u64>();
+        
+        let parts = split_ranges(total, segments)
+            .into_iter()
+            .map(|(start, end)| self.fetch_segment(url, path, (start, end, total), tx.clone()));
+        let all = futures::future::try_join_all(parts);
+        drop(tx);
+        tokio::pin!(all);
+        
+        // Segments report the bytes they write; progress is their sum
+        let mut downloaded = 0;
+        on_progress(Progress::new(downloaded, total, started.elapsed()));
+        loop {
+            tokio::select! {
+                result = &mut all => {
+                    result?;
+                    break;
+                }
+                Some(bytes) = rx.recv() => {
+                    downloaded += bytes;
+                    on_progress(Progress::new(downloaded, total, started.elapsed()));
+                }
+            }
+        }
+        
+        while let Ok(bytes) = rx.try_recv() {
+            downloaded += bytes;
+        }
+        on_progress(Progress::new(downloaded, total, started.elapsed()));
+        Ok(())
+    }
+    
+    // Writes bytes start..=end of a `total`-byte body at the same offset in the file. A segment
+    // cut short or stalled asks again for the bytes it is still missing, with the usual backoff.
+    async fn fetch_segment(
+        &self,
+        url: &str,
+        path: &Path,
+        (start, end, total): (u64, u64, u64),
+        progress: tokio::sync::mpsc::UnboundedSender<u64>,
+    ) -> Result<()> {
+        let mut file = tokio::fs::OpenOptions::new()
+            .write(true)
+            .open(path)
+            .await
+            .context("Failed to open file")?;
+        
+        let mut next = start;
+        let mut attempt = 0;
+        loop {
+            let response = self.fetch_range(url, Some((next, end))).await?;
+            // A server that answers with other bytes would do the same on a retry
+            if response.status() != reqwest::StatusCode::PARTIAL_CONTENT {
+                anyhow::bail!("Server ignored the byte range request (HTTP {}); retry with --connections 1", response.status());
+            }
+            match content_range(&response) {
+                Some((first, last, size)) if first == next && last == end && size.map_or(true, |size| size == total) => {}
+                other => anyhow::bail!(
+                    "Server sent the wrong part of the file (Content-Range {}, asked for bytes {}-{}/{}); retry with --connections 1",
+                    other.map(|(first, last, _)| format!("{}-{}", first, last)).unwrap_or_else(|| "missing".to_string()),
+                    next, end, total
+                ),
+            }
+            
+            match self.write_segment(response, &mut file, &mut next, end, &progress).await {
+                Ok(()) => break,
+                Err(_) if attempt < self.max_retries => {
+                    tokio::time::sleep(RETRY_BASE_DELAY * 2u32.pow(attempt.min(6))).await;
+                    attempt += 1;
+                }
+                Err(e) => return Err(e.context(format!("Download segment {}-{} failed", start, end))),
+            }
+        }
+        
+        file.flush().await.context("Failed to flush file")?;
+        Ok(())
+    }
+    
+    // Streams a ranged response into the file from `next`, advancing it past every byte written
+    async fn write_segment(
+        &self,
+        response: reqwest::Response,
+        file: &mut File,
+        next: &mut u64,
+        end: u64,
+        progress: &tokio::sync::mpsc::UnboundedSender<u64>,
+    ) -> Result<()> {
+        file.seek(std::io::SeekFrom::Start(*next)).await.context("Failed to seek in file")?;
+        
+        let mut stream = response.bytes_stream();
+        while let Some(chunk) = self.unless_stalled(stream.next()).await? {
+            let chunk = chunk.context("Failed to download chunk")?;
+            // Never write past the segment, even if the server sends more than asked
+            let take = std::cmp::min(chunk.len() as u64, end + 1 - *next) as usize;
+            file.write_all(&chunk[..take]).await.context("Failed to write chunk")?;
+            *next += take as u64;
+            let _ = progress.send(take as u64);
+        }
+        
+        if *next <= end {
+            anyhow::bail!("Download incomplete: stopped at byte {} of {}", next, end + 1);
+        }
+        Ok(())
+    }
+    
+    pub async fn download_to<W, F>(&self, url: &str, writer: &mut W, on_progress: F) -> Result<u64>
+    where
+        W: AsyncWrite + Unpin,
+        F: FnMut(Progress),
+    {
+        let response = self.fetch(url).await?;
+        let written = self.stream_to(response, writer, on_progress).await?;
+        writer.flush().await.context("Failed to flush output")?;
+        Ok(written)
+    }
+    
+    async fn fetch(&self, url: &str) -> Result<reqwest::Response> {
+        self.fetch_range(url, None).await
+    }
+    
+    // `range` asks for bytes start..=end only; the server may still send the whole body
+    async fn fetch_range(&self, url: &str, range: Option<(u64, u64)>) -> Result<reqwest::Response> {
+        let mut attempt = 0;
+        
+        // Same policy as page fetches: connect/timeout errors, 429 and 5xx are retried with backoff
+        let response = loop {
+            let backoff = RETRY_BASE_DELAY * 2u32.pow(attempt.min(6));
+            
+            let mut request = self.client.get(url);
+            if let Some((start, end)) = range {
+                request = request.header(reqwest::header::RANGE, format!("bytes={}-{}", start, end));
+            }
+            let response = match self.unless_stalled(request.send()).await? {
+                Ok(response) => response,
+                Err(e) if attempt < self.max_retries && (e.is_connect() || e.is_timeout()) => {
+                    attempt += 1;
+                    tokio::time::sleep(backoff).await;
+                    continue;
+                }
+                Err(e) => {
+                    let error = crate::error::request_error(&e);
+                    return Err(anyhow::Error::new(e).context(error).context("Failed to start download"));
+                }
+            };
+            
+            let status = response.status();
+            let retryable = status == reqwest::StatusCode::TOO_MANY_REQUESTS || status.is_server_error();
+            if !retryable || attempt >= self.max_retries {
+                break response;
+            }
+            
+            let delay = response.headers()
+                .get(reqwest::header::RETRY_AFTER)
+                .and_then(|v| v.to_str().ok())
+                .and_then(|v| AnnaScraper::parse_retry_after(v, std::time::SystemTime::now()))
+                .map(|d| d.min(MAX_RETRY_AFTER))
+                .unwrap_or(backoff);
+            
+            attempt += 1;
+            tokio::time::sleep(delay).await;
+        };
+        
+        // Otherwise the mirror's error page would be saved as the book
+        let status = response.status();
+        if !status.is_success() {
+            let context = match status_hint(status) {
+                Some(hint) => format!("{} ({})", url, hint),
+                None => url.to_string(),
+            };
+            return Err(anyhow::Error::new(AppError::HttpStatus(status)).context(context));
+        }
+        
+        if response.content_length() == Some(0) {
+            anyhow::bail!("Server returned an empty file (Content-Length: 0)");
+        }
+        
+        Ok(response)
+    }
+    
+    // Resolves `future` unless it stays pending for the whole stall timeout
+    async fn unless_stalled<T>(&self, future: impl std::future::Future<Output = T>) -> Result<T> {
+        tokio::time::timeout(self.stall_timeout, future)
+            .await
+            .map_err(|_| AppError::Stalled(self.stall_timeout.as_secs()).into())
+    }
+    
+    async fn stream_to<W, F>(&self, response: reqwest::Response, writer: &mut W, mut on_progress: F) -> Result<u64>
+    where
+        W: AsyncWrite + Unpin,
+        F: FnMut(Progress),
+    {
+        // Without Content-Length the total is reported as 0 and only the running count is known
+        let total_size = response.content_length();
+        let reported_total = total_size.unwrap_or(0);
+        
+        // Unlike pages, files are only decoded when the header says so: a .gz book must stay intact
+        let mut decoder = BodyDecoder::for_encoding(
+            response.headers()
+                .get(reqwest::header::CONTENT_ENCODING)
+                .and_then(|v| v.to_str().ok()),
+        )?;
+        
+        let started = Instant::now();
         let mut stream = response.bytes_stream();
         let mut downloaded = 0;
+        let mut written = 0;
+        on_progress(Progress::new(downloaded, reported_total, started.elapsed()));
         
-        while let Some(chunk) = stream.next().await {
+        while let Some(chunk) = self.unless_stalled(stream.next()).await? {
             let chunk = chunk.context("Failed to download chunk")?;
-            file.write_all(&chunk).await.context("Failed to write chunk")?;
+            let decoded = decoder.feed(&chunk)?;
+            writer.write_all(&decoded).await.context("Failed to write chunk")?;
+            written += decoded.len() as u64;
             
-            downloaded = std::cmp::min(downloaded + chunk.len() as u64, total_size);
-            pb.set_position(downloaded);
+            // Progress follows the bytes on the wire, which is what Content-Length counts
+            downloaded += chunk.len() as u64;
+            if let Some(total) = total_size {
+                downloaded = std::cmp::min(downloaded, total);
+            }
+            on_progress(Progress::new(downloaded, reported_total, started.elapsed()));
         }
         
-        pb.finish_with_message(format!("Downloaded {}", filename));
-        Ok(filepath)
+        if let Some(total) = total_size {
+            if downloaded < total {
+                anyhow::bail!("Download incomplete: received {} of {} bytes", downloaded, total);
+            }
+        } else if downloaded == 0 {
+            anyhow::bail!("Server returned an empty file");
+        }
+        
+        let rest = decoder.finish()?;
+        writer.write_all(&rest).await.context("Failed to write chunk")?;
+        written += rest.len() as u64;
+        
+        Ok(written)
     }
     
     fn determine_filename(
@@ -74,28 +612,50 @@ impl Downloader {
         provided_name: Option<&str>,
         response: &reqwest::Response,
     ) -> Result<String> {
-        if let Some(name) = provided_name {
-            return Ok(name.to_string());
-        }
+        let name = if let Some(name) = provided_name {
+            Self::with_detected_extension(sanitize_filename(name), response)
+        } else if let Some(filename) = Self::extract_filename_from_url(url) {
+            sanitize_filename(&filename)
+        } else if let Some(name) = Self::disposition_filename(response) {
+            sanitize_filename(&name)
+        } else {
+            format!("downloaded_file_{}.tmp", 
+                std::time::SystemTime::now()
+                    .duration_since(std::time::UNIX_EPOCH)
+                    .unwrap()
+                    .as_secs()
+            )
+        };
         
-        if let Some(filename) = Self::extract_filename_from_url(url) {
-            return Ok(filename);
+        Ok(fit_filename(&name, MAX_FILENAME_BYTES))
+    }
+    
+    fn disposition_filename(response: &reqwest::Response) -> Option<String> {
+        let disposition = response.headers().get(reqwest::header::CONTENT_DISPOSITION)?;
+        Self::parse_content_disposition(disposition.to_str().ok()?)
+    }
+    
+    // Generated names like "Title - Author" get the extension the server reports
+    fn with_detected_extension(name: String, response: &reqwest::Response) -> String {
+        if has_extension(&name) {
+            return name;
         }
         
-        if let Some(disposition) = response.headers().get("content-disposition") {
-            if let Ok(disposition_str) = disposition.to_str() {
-                if let Some(name) = Self::parse_content_disposition(disposition_str) {
-                    return Ok(name);
-                }
-            }
-        }
+        let from_disposition = Self::disposition_filename(response)
+            .filter(|server_name| has_extension(server_name))
+            .and_then(|server_name| server_name.rsplit_once('.').map(|(_, ext)| ext.to_lowercase()));
+        let from_type = || {
+            response.headers()
+                .get(reqwest::header::CONTENT_TYPE)
+                .and_then(|v| v.to_str().ok())
+                .and_then(extension_for_content_type)
+                .map(|ext| ext.to_string())
+        };
         
-        Ok(format!("downloaded_file_{}.tmp", 
-            std::time::SystemTime::now()
-                .duration_since(std::time::UNIX_EPOCH)
-                .unwrap()
-                .as_secs()
-        ))
+        match from_disposition.or_else(from_type) {
+            Some(ext) => format!("{}.{}", name, ext),
+            None => name,
+        }
     }
     
     fn extract_filename_from_url(url: &str) -> Option<String> {
@@ -108,31 +668,84 @@ impl Downloader {
             })
     }
     
+    // An RFC 5987 `filename*` wins over a plain `filename`, wherever it appears
     fn parse_content_disposition(disposition: &str) -> Option<String> {
-        for part in disposition.split(';') {
-            let part = part.trim();
-            if part.starts_with("filename=") {
-                let filename = part.strip_prefix("filename=")?;
-                let filename = filename.trim_matches('"');
-                return Some(urlencoding::decode(filename).unwrap_or_default().to_string());
+        let mut plain = None;
+        let mut extended = None;
+        
+        for part in Self::split_header_params(disposition) {
+            let (key, value) = match part.split_once('=') {
+                Some(pair) => pair,
+                None => continue,
+            };
+            
+            match key.trim().to_ascii_lowercase().as_str() {
+                "filename*" => {
+                    if let Some(name) = Self::decode_ext_value(value.trim()) {
+                        extended = Some(name);
+                    }
+                }
+                "filename" => {
+                    let quoted = value.trim();
+                    let unquoted = quoted.strip_prefix('"')
+                        .and_then(|v| v.strip_suffix('"'))
+                        .map(|v| v.replace("\\\"", "\"").replace("\\\\", "\\"))
+                        .unwrap_or_else(|| quoted.to_string());
+                    plain = Some(urlencoding::decode(&unquoted).map(|v| v.to_string()).unwrap_or(unquoted));
+                }
+                _ => {}
             }
-            if part.starts_with("filename*=") {
-                let filename = part.strip_prefix("filename*=UTF-8''")?;
-                return Some(urlencoding::decode(filename).unwrap_or_default().to_string());
+        }
+        
+        extended.or(plain).filter(|name| !name.is_empty())
+    }
+    
+    // Splits on ';' outside of quoted strings, so `filename="a;b.pdf"` stays whole
+    fn split_header_params(header: &str) -> Vec<&str> {
+        let mut parts = Vec::new();
+        let mut start = 0;
+        let mut in_quotes = false;
+        let mut escaped = false;
+        
+        for (i, c) in header.char_indices() {
+            match c {
+                _ if escaped => escaped = false,
+                '\\' if in_quotes => escaped = true,
+                '"' => in_quotes = !in_quotes,
+                ';' if !in_quotes => {
+                    parts.push(&header[start..i]);
+                    start = i + 1;
+                }
+                _ => {}
             }
         }
-        None
+        parts.push(&header[start..]);
+        parts
+    }
+    
+    // charset'language'percent-encoded, e.g. UTF-8''na%C3%AFve.pdf or iso-8859-1'en'%A3%20rates
+    fn decode_ext_value(value: &str) -> Option<String> {
+        let mut fields = value.trim_matches('"').splitn(3, '\'');
+        let charset = fields.next()?.trim().to_ascii_lowercase();
+        let _language = fields.next()?;
+        let bytes = urlencoding::decode_binary(fields.next()?.as_bytes());
+        
+        match charset.as_str() {
+            "utf-8" => String::from_utf8(bytes.into_owned()).ok(),
+            "iso-8859-1" => Some(bytes.iter().map(|&b| b as char).collect()),
+            _ => None,
+        }
     }
     
     pub fn is_download_in_progress(&self, filename: &str) -> bool {
-        let temp_path = self.download_path.join(format!("{}.crdownload", filename));
-        let partial_path = self.download_path.join(format!("{}.part", filename));
+        let temp_path = self.partial_dir().join(format!("{}.crdownload", filename));
+        let partial_path = self.partial_dir().join(format!("{}.part", filename));
         
         temp_path.exists() || partial_path.exists()
     }
     
     pub async fn cleanup_partial_downloads(&self) -> Result<()> {
-        let mut entries = tokio::fs::read_dir(&self.download_path).await?;
+        let mut entries = tokio::fs::read_dir(self.partial_dir()).await?;
         
         while let Some(entry) = entries.next_entry().await? {
             let path = entry.path();
@@ -147,9 +760,923 @@ impl Downloader {
     }
 }
 
+// Hex md5 of a saved file, to compare with the md5 Anna's Archive lists for the book
+pub async fn file_md5(path: &Path) -> Result<String> {
+    let path = path.to_path_buf();
+    tokio::task::spawn_blocking(move || -> Result<String> {
+        let mut file = std::fs::File::open(&path)
+            .with_context(|| format!("Failed to open {}", path.display()))?;
+        let mut context = md5::Context::new();
+        let mut buffer = vec![0u8; 64 * 1024];
+        loop {
+            let read = std::io::Read::read(&mut file, &mut buffer)?;
+            if read == 0 {
+                break;
+            }
+            context.consume(&buffer[..read]);
+        }
+        Ok(format!("{:x}", context.compute()))
+    })
+        .await
+        .context("Checksum task failed")?
+}
+
+// The first "name (N).ext" beside `path` that doesn't exist yet
+pub fn free_path(path: &Path) -> PathBuf {
+    first_free(path, |candidate| candidate.exists())
+}
+
+fn first_free(path: &Path, taken: impl Fn(&Path) -> bool) -> PathBuf {
+    let stem = path.file_stem().map(|s| s.to_string_lossy().to_string()).unwrap_or_default();
+    let ext = path.extension().map(|e| format!(".{}", e.to_string_lossy())).unwrap_or_default();
+    (1..)
+        .map(|n| path.with_file_name(format!("{} ({}){}", stem, n, ext)))
+        .find(|candidate| !taken(candidate))
+        .unwrap()
+}
+
+// A rename can't cross filesystems (EXDEV), which a separate temp dir often does; copy instead
+async fn move_file(from: &Path, to: &Path) -> Result<()> {
+    if tokio::fs::rename(from, to).await.is_ok() {
+        return Ok(());
+    }
+    
+    if let Err(e) = tokio::fs::copy(from, to).await {
+        let _ = tokio::fs::remove_file(to).await;
+        return Err(e).with_context(|| format!("Failed to move download to {}", to.display()));
+    }
+    let _ = tokio::fs::remove_file(from).await;
+    Ok(())
+}
+
+// What a user can do about the common failures
+fn status_hint(status: reqwest::StatusCode) -> Option<&'static str> {
+    match status.as_u16() {
+        401 | 403 => Some("access denied: the mirror may be geoblocked or need a browser session; try another source"),
+        404 | 410 => Some("the link is dead; try another source"),
+        429 => Some("rate limited by the mirror; wait a few minutes before retrying"),
+        500..=599 => Some("the mirror is having problems; try again later or use another source"),
+        _ => None,
+    }
+}
+
+// "Content-Range: bytes 0-99/1234" as (0, 99, Some(1234)); the size is None when given as "*"
+fn content_range(response: &reqwest::Response) -> Option<(u64, u64, Option<u64>)> {
+    let value = response.headers().get(reqwest::header::CONTENT_RANGE)?.to_str().ok()?;
+    parse_content_range(value)
+}
+
+fn parse_content_range(value: &str) -> Option<(u64, u64, Option<u64>)> {
+    let (unit, rest) = value.trim().split_once(' ')?;
+    if !unit.eq_ignore_ascii_case("bytes") {
+        return None;
+    }
+    let (range, size) = rest.split_once('/')?;
+    let (first, last) = range.split_once('-')?;
+    let (first, last) = (first.trim().parse().ok()?, last.trim().parse().ok()?);
+    let size = match size.trim() {
+        "*" => None,
+        size => Some(size.parse().ok()?),
+    };
+    if first > last {
+        return None;
+    }
+    Some((first, last, size))
+}
+
+// Inclusive byte ranges covering 0..total in `parts` nearly equal pieces
+fn split_ranges(total: u64, parts: usize) -> Vec<(u64, u64)> {
+    let parts = std::cmp::max(parts as u64, 1);
+    let size = total / parts;
+    (0..parts)
+        .map(|i| {
+            let start = i * size;
+            let end = if i == parts - 1 { total - 1 } else { start + size - 1 };
+            (start, end)
+        })
+        .collect()
+}
+
+// Replaces path separators and characters Windows rejects, so a title can't escape the download dir
+pub fn sanitize_filename(name: &str) -> String {
+    let cleaned: String = name.chars()
+        .map(|c| match c {
+            '/' | '\\' | ':' | '*' | '?' | '"' | '<' | '>' | '|' => '_',
+            c if c.is_control() => '_',
+            c => c,
+        })
+        .collect();
+    
+    let cleaned = cleaned.trim().trim_end_matches('.').to_string();
+    if cleaned.is_empty() || cleaned.chars().all(|c| c == '.' || c == '_') {
+        "download".to_string()
+    } else {
+        cleaned
+    }
+}
+
+// Shortens what comes before the extension, never splitting a character, until the name fits
+pub fn fit_filename(name: &str, max_bytes: usize) -> String {
+    if name.len() <= max_bytes {
+        return name.to_string();
+    }
+    
+    let (stem, ext) = match name.rsplit_once('.') {
+        Some((stem, ext)) if has_extension(name) => (stem, format!(".{}", ext)),
+        _ => (name, String::new()),
+    };
+    let stem = truncate_bytes(stem, max_bytes.saturating_sub(ext.len())).trim_end();
+    format!("{}{}", stem, ext)
+}
+
+// "book.epub" has one; "Dr. Who - Author" and "Version 2.0" do not
+fn has_extension(name: &str) -> bool {
+    match name.rsplit_once('.') {
+        Some((stem, ext)) => {
+            !stem.is_empty()
+                && (1..=5).contains(&ext.len())
+                && ext.chars().all(|c| c.is_ascii_alphanumeric())
+                && ext.chars().any(|c| c.is_ascii_alphabetic())
+        }
+        None => false,
+    }
+}
+
+fn extension_for_content_type(content_type: &str) -> Option<&'static str> {
+    let mime = content_type.split(';').next()?.trim().to_ascii_lowercase();
+    let ext = match mime.as_str() {
+        "application/pdf" => "pdf",
+        "application/epub+zip" => "epub",
+        "application/x-mobipocket-ebook" => "mobi",
+        "application/vnd.amazon.ebook" => "azw3",
+        "image/vnd.djvu" | "image/x-djvu" => "djvu",
+        "application/x-fictionbook+xml" => "fb2",
+        "application/vnd.comicbook+zip" | "application/x-cbz" => "cbz",
+        "application/vnd.comicbook-rar" | "application/x-cbr" => "cbr",
+        "application/msword" => "doc",
+        "application/vnd.openxmlformats-officedocument.wordprocessingml.document" => "docx",
+        "text/plain" => "txt",
+        "application/zip" => "zip",
+        "application/vnd.rar" | "application/x-rar-compressed" => "rar",
+        _ => return None,
+    };
+    Some(ext)
+}
+
 #[cfg(test)]
 mod tests {
     use super::*;
+    use crate::test_support::{http_response, http_response_unsized, http_response_with, serve_capture, serve_hanging_after, serve_once, serve_ranges, serve_sequence};
+    
+    fn unique_temp_dir(prefix: &str) -> PathBuf {
+        std::env::temp_dir().join(format!("{}_{}", prefix, std::time::SystemTime::now().duration_since(std::time::UNIX_EPOCH).unwrap().as_nanos()))
+    }
+    
+    #[test]
+    fn test_update_progress_bar_switches_to_spinner_for_unknown_length() {
+        let pb = ProgressBar::hidden();
+        Downloader::update_progress_bar(&pb, &Progress::new(0, 0, Duration::ZERO));
+        Downloader::update_progress_bar(&pb, &Progress::new(2048, 0, Duration::from_secs(1)));
+        assert_eq!(pb.position(), 2048);
+        assert_eq!(pb.length(), Some(u64::MAX));
+        
+        let pb = ProgressBar::hidden();
+        Downloader::update_progress_bar(&pb, &Progress::new(10, 100, Duration::from_secs(1)));
+        assert_eq!(pb.length(), Some(100));
+    }
+    
+    #[tokio::test]
+    async fn test_file_md5() {
+        let dir = unique_temp_dir("annadl_md5_test");
+        std::fs::create_dir_all(&dir).unwrap();
+        std::fs::write(dir.join("hello.txt"), b"hello").unwrap();
+        
+        assert_eq!(file_md5(&dir.join("hello.txt")).await.unwrap(), "5d41402abc4b2a76b9719d911017c592");
+        assert!(file_md5(&dir.join("missing.txt")).await.is_err());
+        std::fs::remove_dir_all(&dir).unwrap();
+    }
+    
+    #[tokio::test]
+    async fn test_download_removes_partial_file_when_connection_drops() {
+        let temp_dir = unique_temp_dir("annadl_truncated_test");
+        let mut response = b"HTTP/1.1 200 OK\r\nContent-Length: 100\r\nConnection: close\r\n\r\n".to_vec();
+        response.extend_from_slice(b"only ten b");
+        let base = serve_once(response).await;
+        let downloader = Downloader::new(temp_dir.clone()).unwrap();
+        
+        let result = downloader
+            .download_with_progress(&format!("{}/broken.pdf", base), None, |_| {})
+            .await;
+        
+        assert!(result.is_err());
+        assert!(!temp_dir.join("broken.pdf").exists());
+        
+        let _ = tokio::fs::remove_dir_all(&temp_dir).await;
+    }
+    
+    // Sent before the transfer stops: a 1000-byte body of which only "partial" arrives
+    const STALLED_START: &[u8] = b"HTTP/1.1 200 OK\r\nContent-Length: 1000\r\n\r\npartial";
+    
+    // Waits until the download has started writing `part`, so its removal proves something
+    async fn wait_for_part_file(part: &Path) {
+        for _ in 0..200 {
+            if part.exists() {
+                return;
+            }
+            tokio::time::sleep(Duration::from_millis(10)).await;
+        }
+        panic!("{} was never created", part.display());
+    }
+    
+    #[tokio::test]
+    async fn test_stalled_download_fails_and_removes_partial_file() {
+        let temp_dir = unique_temp_dir("annadl_stall_test");
+        let base = serve_hanging_after(STALLED_START.to_vec()).await;
+        let downloader = Downloader::new(temp_dir.clone()).unwrap()
+            .with_stall_timeout(Duration::from_millis(500));
+        let part = downloader.partial_dir().join("stalled.epub.part");
+        
+        let url = format!("{}/stalled.epub", base);
+        let task = tokio::spawn(async move { downloader.download(&url, None).await });
+        wait_for_part_file(&part).await;
+        let err = task.await.unwrap().unwrap_err();
+        
+        assert!(matches!(err.downcast_ref::<AppError>(), Some(AppError::Stalled(_))), "{:#}", err);
+        assert!(!part.exists());
+        assert!(!temp_dir.join("stalled.epub").exists());
+        
+        let _ = tokio::fs::remove_dir_all(&temp_dir).await;
+    }
+    
+    #[tokio::test]
+    async fn test_slow_download_outlives_stall_timeout_while_progressing() {
+        use tokio::io::AsyncReadExt;
+        
+        let temp_dir = unique_temp_dir("annadl_slow_test");
+        let listener = tokio::net::TcpListener::bind("127.0.0.1:0").await.unwrap();
+        let base = format!("http://{}", listener.local_addr().unwrap());
+        tokio::spawn(async move {
+            let (mut socket, _) = listener.accept().await.unwrap();
+            let mut buf = [0u8; 4096];
+            let _ = socket.read(&mut buf).await;
+            let _ = socket.write_all(b"HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\n").await;
+            // Each byte arrives well within the stall timeout, the whole body well after it
+            for byte in b"slow!" {
+                tokio::time::sleep(std::time::Duration::from_millis(100)).await;
+                let _ = socket.write_all(&[*byte]).await;
+            }
+            let _ = socket.shutdown().await;
+        });
+        let downloader = Downloader::new(temp_dir.clone()).unwrap()
+            .with_stall_timeout(Duration::from_millis(300));
+        
+        let url = format!("{}/slow.txt", base);
+        let path = downloader.download(&url, None).await.unwrap().into_path();
+        
+        assert_eq!(std::fs::read(&path).unwrap(), b"slow!");
+        
+        let _ = tokio::fs::remove_dir_all(&temp_dir).await;
+    }
+    
+    #[tokio::test]
+    async fn test_cancelled_download_removes_partial_file() {
+        let temp_dir = unique_temp_dir("annadl_cancel_test");
+        // The connection stays open as if the transfer were still running
+        let base = serve_hanging_after(STALLED_START.to_vec()).await;
+        let downloader = Downloader::new(temp_dir.clone()).unwrap();
+        let part = downloader.partial_dir().join("slow.epub.part");
+        
+        // Dropping the future is what Ctrl+C and --deadline do
+        let url = format!("{}/slow.epub", base);
+        let task = tokio::spawn(async move { downloader.download_with_progress(&url, None, |_| {}).await });
+        wait_for_part_file(&part).await;
+        task.abort();
+        assert!(task.await.unwrap_err().is_cancelled());
+        
+        assert!(!part.exists());
+        assert!(!temp_dir.join("slow.epub").exists());
+        
+        let _ = tokio::fs::remove_dir_all(&temp_dir).await;
+    }
+    
+    #[tokio::test]
+    async fn test_from_client_uses_supplied_client() {
+        let temp_dir = unique_temp_dir("annadl_client_test");
+        let (base, request) = serve_capture(http_response(b"book")).await;
+        let client = reqwest::Client::builder().user_agent("annadl-test-agent").build().unwrap();
+        let downloader = Downloader::from_client(temp_dir.clone(), client);
+        
+        downloader
+            .download_with_progress(&format!("{}/client.epub", base), None, |_| {})
+            .await
+            .unwrap();
+        assert!(request.await.unwrap().to_lowercase().contains("user-agent: annadl-test-agent"));
+        
+        let _ = tokio::fs::remove_dir_all(&temp_dir).await;
+    }
+    
+    #[tokio::test]
+    async fn test_download_retries_server_errors() {
+        let temp_dir = unique_temp_dir("annadl_retry_test");
+        let base = serve_sequence(vec![
+            http_response_with(503, "Service Unavailable", &[("Retry-After", "0")], b""),
+            http_response(b"book"),
+        ]).await;
+        let downloader = Downloader::new(temp_dir.clone()).unwrap().with_max_retries(1);
+        
+        let path = downloader
+            .download_with_progress(&format!("{}/retry.epub", base), None, |_| {})
+            .await
+            .unwrap()
+            .into_path();
+        assert_eq!(std::fs::read(&path).unwrap(), b"book");
+        
+        let _ = tokio::fs::remove_dir_all(&temp_dir).await;
+    }
+    
+    #[tokio::test]
+    async fn test_http_error_names_url_and_hint() {
+        let temp_dir = unique_temp_dir("annadl_status_test");
+        let base = serve_once(http_response_with(403, "Forbidden", &[], b"<html>denied</html>")).await;
+        let downloader = Downloader::new(temp_dir.clone()).unwrap();
+        
+        let url = format!("{}/blocked.epub", base);
+        let err = downloader.download_with_progress(&url, None, |_| {}).await.unwrap_err();
+        
+        assert!(matches!(err.downcast_ref::<AppError>(), Some(AppError::HttpStatus(s)) if s.as_u16() == 403));
+        let message = format!("{:#}", err);
+        assert!(message.contains(&url), "{}", message);
+        assert!(message.contains("geoblocked"), "{}", message);
+        assert!(message.contains("403 Forbidden"), "{}", message);
+        assert!(!temp_dir.join("blocked.epub").exists());
+        
+        let _ = tokio::fs::remove_dir_all(&temp_dir).await;
+    }
+    
+    #[test]
+    fn test_status_hint() {
+        assert!(status_hint(reqwest::StatusCode::NOT_FOUND).unwrap().contains("dead"));
+        assert!(status_hint(reqwest::StatusCode::TOO_MANY_REQUESTS).unwrap().contains("rate limited"));
+        assert!(status_hint(reqwest::StatusCode::BAD_GATEWAY).is_some());
+        assert_eq!(status_hint(reqwest::StatusCode::IM_A_TEAPOT), None);
+    }
+    
+    #[tokio::test]
+    async fn test_download_with_zero_retries_fails_fast() {
+        let temp_dir = unique_temp_dir("annadl_no_retry_test");
+        let base = serve_sequence(vec![
+            http_response_with(503, "Service Unavailable", &[("Retry-After", "0")], b""),
+            http_response(b"book"),
+        ]).await;
+        let downloader = Downloader::new(temp_dir.clone()).unwrap().with_max_retries(0);
+        
+        let result = downloader
+            .download_with_progress(&format!("{}/retry.epub", base), None, |_| {})
+            .await;
+        assert!(result.is_err());
+        
+        let _ = tokio::fs::remove_dir_all(&temp_dir).await;
+    }
+    
+    #[tokio::test]
+    async fn test_download_adds_extension_from_content_type() {
+        let temp_dir = unique_temp_dir("annadl_ext_test");
+        let base = serve_once(http_response_with(200, "OK", &[("Content-Type", "application/epub+zip")], b"PK")).await;
+        let downloader = Downloader::new(temp_dir.clone()).unwrap();
+        
+        let path = downloader
+            .download_with_progress(&format!("{}/get?md5=abc", base), Some("Dune - Frank Herbert"), |_| {})
+            .await
+            .unwrap()
+            .into_path();
+        assert_eq!(path, temp_dir.join("Dune - Frank Herbert.epub"));
+        
+        let _ = tokio::fs::remove_dir_all(&temp_dir).await;
+    }
+    
+    #[tokio::test]
+    async fn test_download_decodes_content_encoding_only_when_declared() {
+        let temp_dir = unique_temp_dir("annadl_gzip_test");
+        let compressed = crate::encoding::gzip(b"book contents");
+        let base = serve_sequence(vec![
+            http_response_with(200, "OK", &[("Content-Encoding", "gzip")], &compressed),
+            http_response(&compressed),
+        ]).await;
+        let downloader = Downloader::new(temp_dir.clone()).unwrap();
+        
+        let path = downloader
+            .download_with_progress(&format!("{}/book.epub", base), None, |_| {})
+            .await
+            .unwrap()
+            .into_path();
+        assert_eq!(std::fs::read(&path).unwrap(), b"book contents");
+        
+        // Without the header a gzip file is the payload itself
+        let path = downloader
+            .download_with_progress(&format!("{}/book.epub.gz", base), None, |_| {})
+            .await
+            .unwrap()
+            .into_path();
+        assert_eq!(std::fs::read(&path).unwrap(), compressed);
+        
+        let _ = tokio::fs::remove_dir_all(&temp_dir).await;
+    }
+    
+    #[tokio::test]
+    async fn test_download_rejects_unsupported_content_encoding() {
+        let temp_dir = unique_temp_dir("annadl_br_test");
+        let base = serve_once(http_response_with(200, "OK", &[("Content-Encoding", "br")], b"\x1b\x00")).await;
+        let downloader = Downloader::new(temp_dir.clone()).unwrap();
+        
+        let err = downloader
+            .download_with_progress(&format!("{}/book.epub", base), None, |_| {})
+            .await
+            .unwrap_err();
+        assert!(err.to_string().contains("Unsupported Content-Encoding: br"));
+        assert!(!temp_dir.join("book.epub").exists());
+        
+        let _ = tokio::fs::remove_dir_all(&temp_dir).await;
+    }
+    
+    #[test]
+    fn test_sanitize_filename() {
+        assert_eq!(sanitize_filename("AC/DC: Live?"), "AC_DC_ Live_");
+        assert_eq!(sanitize_filename("../../etc/passwd"), ".._.._etc_passwd");
+        assert_eq!(sanitize_filename("name.pdf."), "name.pdf");
+        assert_eq!(sanitize_filename(".."), "download");
+        assert_eq!(sanitize_filename("三体 - 刘慈欣.epub"), "三体 - 刘慈欣.epub");
+    }
+    
+    #[test]
+    fn test_fit_filename_keeps_extension() {
+        assert_eq!(fit_filename("short.epub", 240), "short.epub");
+        assert_eq!(fit_filename(&format!("{}.epub", "a".repeat(300)), 20), format!("{}.epub", "a".repeat(15)));
+        assert_eq!(fit_filename(&format!("{}.pdf", "三".repeat(100)), 11), format!("{}.pdf", "三".repeat(2)));
+        assert_eq!(fit_filename("Title with spaces - Author", 11), "Title with");
+    }
+    
+    #[tokio::test]
+    async fn test_download_with_absurdly_long_name_fits_filesystem() {
+        let temp_dir = unique_temp_dir("annadl_long_name_test");
+        let base = serve_once(http_response(b"book")).await;
+        let downloader = Downloader::new(temp_dir.clone()).unwrap();
+        let name = format!("{} - {}.epub", "Title ".repeat(100), "Author Name, ".repeat(200));
+        
+        let path = downloader.download(&format!("{}/book", base), Some(&name)).await.unwrap().into_path();
+        
+        let saved = path.file_name().unwrap().to_string_lossy().to_string();
+        assert!(saved.len() <= MAX_FILENAME_BYTES, "{} bytes", saved.len());
+        assert!(saved.starts_with("Title Title"));
+        assert!(saved.ends_with(".epub"));
+        assert_eq!(tokio::fs::read(&path).await.unwrap(), b"book");
+        assert_eq!(Downloader::existing_target(&temp_dir, &name), Some(path));
+        
+        tokio::fs::remove_dir_all(&temp_dir).await.unwrap();
+    }
+    
+    #[test]
+    fn test_has_extension() {
+        assert!(has_extension("book.epub"));
+        assert!(has_extension("scan.DJVU"));
+        assert!(!has_extension("Dune - Frank Herbert"));
+        assert!(!has_extension("Dr. Who - Author"));
+        assert!(!has_extension("Version 2.0"));
+        assert!(!has_extension(".hidden"));
+    }
+    
+    #[test]
+    fn test_extension_for_content_type() {
+        assert_eq!(extension_for_content_type("application/pdf"), Some("pdf"));
+        assert_eq!(extension_for_content_type("Application/EPUB+zip; charset=binary"), Some("epub"));
+        assert_eq!(extension_for_content_type("application/octet-stream"), None);
+    }
+    
+    #[tokio::test]
+    async fn test_download_rejects_empty_content_length() {
+        let temp_dir = unique_temp_dir("annadl_empty_test");
+        let base = serve_once(http_response(b"")).await;
+        let downloader = Downloader::new(temp_dir.clone()).unwrap();
+        
+        let err = downloader
+            .download_with_progress(&format!("{}/empty.pdf", base), None, |_| {})
+            .await
+            .unwrap_err();
+        
+        assert!(err.to_string().contains("empty"));
+        assert!(!temp_dir.join("empty.pdf").exists());
+        
+        let _ = tokio::fs::remove_dir_all(&temp_dir).await;
+    }
+    
+    #[tokio::test]
+    async fn test_download_without_content_length_reports_running_total() {
+        let temp_dir = unique_temp_dir("annadl_unsized_test");
+        let base = serve_once(http_response_unsized(b"streamed without a length")).await;
+        let downloader = Downloader::new(temp_dir.clone()).unwrap();
+        
+        let mut updates = Vec::new();
+        let path = downloader
+            .download_with_progress(&format!("{}/unsized.epub", base), None, |progress| {
+                updates.push((progress.current, progress.total));
+            })
+            .await
+            .unwrap()
+            .into_path();
+        
+        assert_eq!(std::fs::read(&path).unwrap(), b"streamed without a length");
+        assert!(updates.iter().all(|&(_, total)| total == 0));
+        assert_eq!(updates.last(), Some(&(25, 0)));
+        
+        let _ = tokio::fs::remove_dir_all(&temp_dir).await;
+    }
+    
+    #[test]
+    fn test_split_ranges_covers_every_byte() {
+        assert_eq!(split_ranges(10, 3), vec![(0, 2), (3, 5), (6, 9)]);
+        assert_eq!(split_ranges(10, 1), vec![(0, 9)]);
+    }
+    
+    #[tokio::test]
+    async fn test_segmented_download_reassembles_file() {
+        let temp_dir = unique_temp_dir("annadl_segmented_test");
+        let body: Vec<u8> = (0..3 * MIN_SEGMENT_BYTES + 17).map(|i| (i % 251) as u8).collect();
+        let (base, ranged) = serve_ranges(body.clone()).await;
+        let downloader = Downloader::new(temp_dir.clone()).unwrap().with_connections(4);
+        
+        let mut last = Progress::default();
+        let path = downloader
+            .download_with_progress(&format!("{}/big.pdf", base), None, |progress| last = progress)
+            .await
+            .unwrap()
+            .into_path();
+        
+        assert!(std::fs::read(&path).unwrap() == body);
+        // The one-byte probe, then only three full megabytes, so only three parts
+        assert_eq!(ranged.load(std::sync::atomic::Ordering::SeqCst), 4);
+        assert_eq!(last.current, body.len() as u64);
+        assert_eq!(last.percent, 100.0);
+        
+        let _ = tokio::fs::remove_dir_all(&temp_dir).await;
+    }
+    
+    #[tokio::test]
+    async fn test_segmented_download_falls_back_without_range_support() {
+        let temp_dir = unique_temp_dir("annadl_no_range_test");
+        let body = vec![7u8; 3 * MIN_SEGMENT_BYTES as usize];
+        let base = serve_once(http_response(&body)).await;
+        let downloader = Downloader::new(temp_dir.clone()).unwrap().with_connections(4);
+        
+        let path = downloader
+            .download_with_progress(&format!("{}/big.pdf", base), None, |_| {})
+            .await
+            .unwrap()
+            .into_path();
+        
+        assert_eq!(std::fs::metadata(&path).unwrap().len(), body.len() as u64);
+        
+        let _ = tokio::fs::remove_dir_all(&temp_dir).await;
+    }
+    
+    #[test]
+    fn test_parse_content_range() {
+        assert_eq!(parse_content_range("bytes 0-99/1234"), Some((0, 99, Some(1234))));
+        assert_eq!(parse_content_range("bytes 100-199/*"), Some((100, 199, None)));
+        assert_eq!(parse_content_range("bytes */1234"), None);
+        assert_eq!(parse_content_range("items 0-9/10"), None);
+        assert_eq!(parse_content_range("bytes 9-0/10"), None);
+    }
+    
+    // A 206 that promises `range` but closes the connection after `sent`
+    fn truncated_range_response(range: &str, len: usize, sent: &[u8]) -> Vec<u8> {
+        let mut response = format!(
+            "HTTP/1.1 206 Partial Content\r\nContent-Length: {}\r\nContent-Range: bytes {}\r\nConnection: close\r\n\r\n",
+            len, range
+        ).into_bytes();
+        response.extend_from_slice(sent);
+        response
+    }
+    
+    #[tokio::test]
+    async fn test_segment_cut_short_resumes_where_it_stopped() {
+        let temp_dir = unique_temp_dir("annadl_segment_resume_test");
+        tokio::fs::create_dir_all(&temp_dir).await.unwrap();
+        let path = temp_dir.join("book.pdf.part");
+        tokio::fs::write(&path, vec![0u8; 10]).await.unwrap();
+        let body = b"0123456789";
+        let base = serve_sequence(vec![
+            truncated_range_response("0-9/10", 10, &body[..4]),
+            http_response_with(206, "Partial Content", &[("Content-Range", "bytes 4-9/10")], &body[4..]),
+        ]).await;
+        let downloader = Downloader::new(temp_dir.clone()).unwrap().with_max_retries(1);
+        
+        let (tx, mut rx) = tokio::sync::mpsc::unbounded_channel();
+        downloader.fetch_segment(&format!("{}/book.pdf", base), &path, (0, 9, 10), tx).await.unwrap();
+        
+        assert_eq!(std::fs::read(&path).unwrap(), body);
+        let mut written = 0;
+        while let Ok(bytes) = rx.try_recv() {
+            written += bytes;
+        }
+        assert_eq!(written, 10);
+        
+        let _ = tokio::fs::remove_dir_all(&temp_dir).await;
+    }
+    
+    #[tokio::test]
+    async fn test_segment_with_the_wrong_content_range_fails() {
+        let temp_dir = unique_temp_dir("annadl_segment_range_test");
+        tokio::fs::create_dir_all(&temp_dir).await.unwrap();
+        let path = temp_dir.join("book.pdf.part");
+        tokio::fs::write(&path, vec![0u8; 10]).await.unwrap();
+        let base = serve_once(http_response_with(206, "Partial Content", &[("Content-Range", "bytes 0-4/10")], b"01234")).await;
+        let downloader = Downloader::new(temp_dir.clone()).unwrap();
+        
+        let (tx, _rx) = tokio::sync::mpsc::unbounded_channel();
+        let err = downloader.fetch_segment(&format!("{}/book.pdf", base), &path, (5, 9, 10), tx).await.unwrap_err();
+        assert!(err.to_string().contains("Content-Range 0-4, asked for bytes 5-9/10"), "{:#}", err);
+        assert_eq!(std::fs::read(&path).unwrap(), vec![0u8; 10]);
+        
+        let _ = tokio::fs::remove_dir_all(&temp_dir).await;
+    }
+    
+    // Every report stays within a fixed total, never goes backwards, and the last is complete
+    fn assert_progress_sequence(calls: &[Progress], len: u64) {
+        assert!(calls.len() >= 2, "expected a start and an end report, got {}", calls.len());
+        assert_eq!(calls[0].current, 0);
+        for pair in calls.windows(2) {
+            assert!(pair[1].current >= pair[0].current, "progress went back: {:?}", pair);
+        }
+        for call in calls {
+            assert_eq!(call.total, len);
+            assert!(call.current <= call.total, "current past total: {:?}", call);
+        }
+        let last = calls.last().unwrap();
+        assert_eq!((last.current, last.total), (len, len));
+        assert_eq!(last.percent, 100.0);
+    }
+    
+    #[tokio::test]
+    async fn test_progress_callback_counts_up_to_total() {
+        let temp_dir = unique_temp_dir("annadl_progress_calls_test");
+        let body: Vec<u8> = (0..256 * 1024).map(|i| (i % 253) as u8).collect();
+        let base = serve_once(http_response(&body)).await;
+        let downloader = Downloader::new(temp_dir.clone()).unwrap();
+        
+        let mut calls = Vec::new();
+        downloader
+            .download_with_progress(&format!("{}/big.pdf", base), None, |progress| calls.push(progress))
+            .await
+            .unwrap();
+        
+        assert_progress_sequence(&calls, body.len() as u64);
+        
+        let _ = tokio::fs::remove_dir_all(&temp_dir).await;
+    }
+    
+    #[tokio::test]
+    async fn test_segmented_progress_callback_counts_up_to_total() {
+        let temp_dir = unique_temp_dir("annadl_segmented_progress_test");
+        let body: Vec<u8> = (0..2 * MIN_SEGMENT_BYTES + 5).map(|i| (i % 251) as u8).collect();
+        let (base, _) = serve_ranges(body.clone()).await;
+        let downloader = Downloader::new(temp_dir.clone()).unwrap().with_connections(2);
+        
+        let mut calls = Vec::new();
+        downloader
+            .download_with_progress(&format!("{}/big.pdf", base), None, |progress| calls.push(progress))
+            .await
+            .unwrap();
+        
+        assert_progress_sequence(&calls, body.len() as u64);
+        
+        let _ = tokio::fs::remove_dir_all(&temp_dir).await;
+    }
+    
+    #[test]
+    fn test_progress_computes_rate_and_percent() {
+        let progress = Progress::new(512, 2048, Duration::from_secs(2));
+        assert_eq!(progress.bytes_per_sec, 256);
+        assert_eq!(progress.percent, 25.0);
+        
+        // Unknown total and no elapsed time yet
+        let progress = Progress::new(512, 0, Duration::ZERO);
+        assert_eq!(progress.bytes_per_sec, 0);
+        assert_eq!(progress.percent, 0.0);
+    }
+    
+    #[test]
+    fn test_partial_file_guard_keeps_successful_file() {
+        let temp_dir = unique_temp_dir("annadl_guard_test");
+        std::fs::create_dir_all(&temp_dir).unwrap();
+        let kept = temp_dir.join("kept.pdf");
+        let removed = temp_dir.join("removed.pdf");
+        std::fs::write(&kept, b"ok").unwrap();
+        std::fs::write(&removed, b"partial").unwrap();
+        
+        {
+            let mut guard = PartialFileGuard::new(kept.clone());
+            guard.success = true;
+        }
+        {
+            let _guard = PartialFileGuard::new(removed.clone());
+        }
+        
+        assert!(kept.exists());
+        assert!(!removed.exists());
+        
+        std::fs::remove_dir_all(&temp_dir).unwrap();
+    }
+    
+    #[tokio::test]
+    async fn test_download_to_writer() {
+        let body = b"book contents".to_vec();
+        let base = serve_once(http_response(&body)).await;
+        let downloader = Downloader::new(std::env::temp_dir()).unwrap();
+        
+        let mut output: Vec<u8> = Vec::new();
+        let mut last = (0, 0);
+        let written = downloader
+            .download_to(&format!("{}/book.pdf", base), &mut output, |progress| last = (progress.current, progress.total))
+            .await
+            .unwrap();
+        
+        assert_eq!(written, body.len() as u64);
+        assert_eq!(output, body);
+        assert_eq!(last, (body.len() as u64, body.len() as u64));
+    }
+    
+    #[tokio::test]
+    async fn test_download_with_progress_writes_file() {
+        let temp_dir = std::env::temp_dir().join(format!("annadl_write_test_{}", std::time::SystemTime::now().duration_since(std::time::UNIX_EPOCH).unwrap().as_nanos()));
+        let body = b"%PDF-1.4 test".to_vec();
+        let base = serve_once(http_response(&body)).await;
+        let downloader = Downloader::new(temp_dir.clone()).unwrap();
+        
+        let path = downloader
+            .download_with_progress(&format!("{}/paper.pdf", base), None, |_| {})
+            .await
+            .unwrap()
+            .into_path();
+        
+        assert_eq!(path, temp_dir.join("paper.pdf"));
+        assert_eq!(tokio::fs::read(&path).await.unwrap(), body);
+        
+        tokio::fs::remove_dir_all(&temp_dir).await.unwrap();
+    }
+    
+    #[tokio::test]
+    async fn test_download_through_temp_dir_moves_finished_file() {
+        let download_dir = unique_temp_dir("annadl_final_test");
+        let partial_dir = unique_temp_dir("annadl_partial_test");
+        let body = b"%PDF-1.4 test".to_vec();
+        let base = serve_once(http_response(&body)).await;
+        let downloader = Downloader::new(download_dir.clone()).unwrap()
+            .with_temp_dir(Some(partial_dir.clone()));
+        
+        let path = downloader
+            .download_with_progress(&format!("{}/paper.pdf", base), None, |_| {})
+            .await
+            .unwrap()
+            .into_path();
+        
+        assert_eq!(path, download_dir.join("paper.pdf"));
+        assert_eq!(tokio::fs::read(&path).await.unwrap(), body);
+        assert!(std::fs::read_dir(&partial_dir).unwrap().next().is_none());
+        
+        tokio::fs::remove_dir_all(&download_dir).await.unwrap();
+        tokio::fs::remove_dir_all(&partial_dir).await.unwrap();
+    }
+    
+    #[tokio::test]
+    async fn test_failed_download_through_temp_dir_leaves_nothing() {
+        let download_dir = unique_temp_dir("annadl_final_fail_test");
+        let partial_dir = unique_temp_dir("annadl_partial_fail_test");
+        let mut response = b"HTTP/1.1 200 OK\r\nContent-Length: 100\r\nConnection: close\r\n\r\n".to_vec();
+        response.extend_from_slice(b"only ten b");
+        let base = serve_once(response).await;
+        let downloader = Downloader::new(download_dir.clone()).unwrap()
+            .with_temp_dir(Some(partial_dir.clone()));
+        
+        let result = downloader
+            .download_with_progress(&format!("{}/broken.pdf", base), None, |_| {})
+            .await;
+        
+        assert!(result.is_err());
+        assert!(!download_dir.join("broken.pdf").exists());
+        assert!(!partial_dir.join("broken.pdf.part").exists());
+        
+        let _ = tokio::fs::remove_dir_all(&download_dir).await;
+        let _ = tokio::fs::remove_dir_all(&partial_dir).await;
+    }
+    
+    #[tokio::test]
+    async fn test_conflict_policies_for_existing_file() {
+        let dir = unique_temp_dir("annadl_conflict_test");
+        tokio::fs::create_dir_all(&dir).await.unwrap();
+        let existing = dir.join("paper.pdf");
+        tokio::fs::write(&existing, b"mine").await.unwrap();
+        assert_eq!(Downloader::existing_target(&dir, "paper.pdf"), Some(existing.clone()));
+        assert_eq!(Downloader::existing_target(&dir, "other.pdf"), None);
+        
+        let base = serve_once(http_response(b"theirs")).await;
+        let downloader = Downloader::new(dir.clone()).unwrap().with_conflict_policy(ConflictPolicy::Skip);
+        let saved = downloader.download(&format!("{}/paper.pdf", base), None).await.unwrap();
+        assert_eq!(saved, Saved::Skipped(existing.clone()));
+        assert_eq!(tokio::fs::read(&existing).await.unwrap(), b"mine");
+        
+        let base = serve_once(http_response(b"theirs")).await;
+        let downloader = Downloader::new(dir.clone()).unwrap().with_conflict_policy(ConflictPolicy::Rename);
+        let path = downloader.download(&format!("{}/paper.pdf", base), None).await.unwrap().into_path();
+        assert_eq!(path, dir.join("paper (1).pdf"));
+        assert_eq!(tokio::fs::read(&existing).await.unwrap(), b"mine");
+        assert_eq!(tokio::fs::read(&path).await.unwrap(), b"theirs");
+        
+        let base = serve_once(http_response(b"theirs")).await;
+        let downloader = Downloader::new(dir.clone()).unwrap();
+        let path = downloader.download(&format!("{}/paper.pdf", base), None).await.unwrap().into_path();
+        assert_eq!(path, existing);
+        assert_eq!(tokio::fs::read(&existing).await.unwrap(), b"theirs");
+        
+        tokio::fs::remove_dir_all(&dir).await.unwrap();
+    }
+    
+    #[tokio::test]
+    async fn test_concurrent_same_name_downloads_get_distinct_files() {
+        let dir = unique_temp_dir("annadl_concurrent_test");
+        let mut bases = Vec::new();
+        for i in 0..4 {
+            bases.push(serve_once(http_response(format!("copy {}", i).as_bytes())).await);
+        }
+        let downloader = Downloader::new(dir.clone()).unwrap().with_conflict_policy(ConflictPolicy::Rename);
+        
+        let downloads = bases.iter().map(|base| downloader.download(&format!("{}/paper.pdf", base), Some("paper.pdf")));
+        let paths: Vec<PathBuf> = futures::future::try_join_all(downloads)
+            .await
+            .unwrap()
+            .into_iter()
+            .map(Saved::into_path)
+            .collect();
+        
+        let unique: HashSet<&PathBuf> = paths.iter().collect();
+        assert_eq!(unique.len(), 4);
+        let mut contents = Vec::new();
+        for path in &paths {
+            contents.push(tokio::fs::read_to_string(path).await.unwrap());
+        }
+        contents.sort();
+        assert_eq!(contents, ["copy 0", "copy 1", "copy 2", "copy 3"]);
+        assert!(dir.join("paper.pdf").exists());
+        assert!(dir.join("paper (3).pdf").exists());
+        assert!(downloader.reserved.lock().unwrap().is_empty());
+        
+        tokio::fs::remove_dir_all(&dir).await.unwrap();
+    }
+    
+    #[tokio::test]
+    async fn test_prepare_creates_download_and_temp_dirs() {
+        let download_dir = unique_temp_dir("annadl_prepare_final_test");
+        let partial_dir = unique_temp_dir("annadl_prepare_partial_test");
+        let downloader = Downloader::new(download_dir.clone()).unwrap()
+            .with_temp_dir(Some(partial_dir.clone()));
+        
+        let (first, second) = tokio::join!(downloader.prepare(), downloader.prepare());
+        first.unwrap();
+        second.unwrap();
+        assert!(download_dir.is_dir());
+        assert!(partial_dir.is_dir());
+        
+        tokio::fs::remove_dir_all(&download_dir).await.unwrap();
+        tokio::fs::remove_dir_all(&partial_dir).await.unwrap();
+    }
+    
+    #[test]
+    fn test_free_path_counts_up() {
+        let dir = unique_temp_dir("annadl_free_path_test");
+        std::fs::create_dir_all(&dir).unwrap();
+        std::fs::write(dir.join("Dune.epub"), b"").unwrap();
+        std::fs::write(dir.join("Dune (1).epub"), b"").unwrap();
+        
+        assert_eq!(free_path(&dir.join("Dune.epub")), dir.join("Dune (2).epub"));
+        assert_eq!(free_path(&dir.join("notes")), dir.join("notes (1)"));
+        
+        std::fs::remove_dir_all(&dir).unwrap();
+    }
+    
+    #[tokio::test]
+    async fn test_move_file_replaces_target() {
+        let dir = unique_temp_dir("annadl_move_test");
+        tokio::fs::create_dir_all(&dir).await.unwrap();
+        let from = dir.join("book.epub.part");
+        let to = dir.join("book.epub");
+        tokio::fs::write(&from, b"new").await.unwrap();
+        tokio::fs::write(&to, b"old").await.unwrap();
+        
+        move_file(&from, &to).await.unwrap();
+        
+        assert!(!from.exists());
+        assert_eq!(tokio::fs::read(&to).await.unwrap(), b"new");
+        
+        tokio::fs::remove_dir_all(&dir).await.unwrap();
+    }
     
     #[test]
     fn test_extract_filename_from_url() {
@@ -249,6 +1776,35 @@ mod tests {
         );
     }
 
+    #[test]
+    fn test_parse_content_disposition_rfc5987() {
+        let cases = [
+            // Examples from RFC 5987 section 3.2.2 and RFC 6266 section 5
+            ("attachment; filename*=iso-8859-1'en'%A3%20rates", Some("£ rates")),
+            ("attachment; filename*=UTF-8''%e2%82%ac%20rates", Some("€ rates")),
+            ("attachment; filename=\"EURO rates\"; filename*=utf-8''%e2%82%ac%20rates", Some("€ rates")),
+            // filename* wins even when it comes first
+            ("attachment; filename*=utf-8'en'na%C3%AFve.pdf; filename=\"naive.pdf\"", Some("naïve.pdf")),
+            ("Attachment; FILENAME*=UTF-8'en-US'%E4%B8%89%E4%BD%93.epub", Some("三体.epub")),
+            ("attachment; FileName=\"Report.pdf\"", Some("Report.pdf")),
+            // An unsupported charset falls back to the plain parameter
+            ("attachment; filename*=koi8-r''%F0; filename=\"fallback.pdf\"", Some("fallback.pdf")),
+            ("attachment; filename=\"a;b.pdf\"", Some("a;b.pdf")),
+            ("attachment; filename=\"say \\\"hi\\\".pdf\"", Some("say \"hi\".pdf")),
+            ("attachment", None),
+            ("attachment; filename=\"\"", None),
+        ];
+        
+        for (header, expected) in cases {
+            assert_eq!(
+                Downloader::parse_content_disposition(header).as_deref(),
+                expected,
+                "{}",
+                header
+            );
+        }
+    }
+
     #[test]
     fn test_parse_content_disposition_simple() {
         assert_eq!(
@@ -286,9 +1842,7 @@ mod tests {
         // When both filename and filename* are present, filename* should take precedence
         let disposition = "attachment; filename=\"fallback.pdf\"; filename*=UTF-8''actual%20file.pdf";
         let result = Downloader::parse_content_disposition(disposition);
-        // Current implementation returns first match, so it would return "fallback.pdf"
-        // But ideally it should prioritize filename*
-        assert!(result.is_some());
+        assert_eq!(result, Some("actual file.pdf".to_string()));
     }
 
     #[test]
@@ -301,9 +1855,9 @@ mod tests {
 
     #[test]
     fn test_parse_content_disposition_malformed() {
-        // Current implementation returns empty string for "filename="
+        // An empty name is no name, so the caller falls back to a generated one
         let result = Downloader::parse_content_disposition("filename=");
-        assert_eq!(result, Some("".to_string()));
+        assert_eq!(result, None);
     }
 
     #[tokio::test]
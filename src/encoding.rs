@@ -0,0 +1,130 @@
+use crate::error::AppError;
+use anyhow::{Context, Result};
+use flate2::write::{GzDecoder, ZlibDecoder};
+use std::io::Write;
+
+const GZIP_MAGIC: [u8; 2] = [0x1f, 0x8b];
+
+// We never send Accept-Encoding, but some mirrors compress anyway. This undoes gzip/deflate
+// chunk by chunk so downloads can keep streaming.
+pub enum BodyDecoder {
+    Identity,
+    Gzip(GzDecoder<Vec<u8>>),
+    Deflate(ZlibDecoder<Vec<u8>>),
+}
+
+impl BodyDecoder {
+    pub fn for_encoding(content_encoding: Option<&str>) -> Result<Self> {
+        match content_encoding.map(|v| v.trim().to_ascii_lowercase()).as_deref() {
+            None | Some("") | Some("identity") => Ok(BodyDecoder::Identity),
+            Some("gzip") | Some("x-gzip") => Ok(BodyDecoder::Gzip(GzDecoder::new(Vec::new()))),
+            Some("deflate") => Ok(BodyDecoder::Deflate(ZlibDecoder::new(Vec::new()))),
+            Some(other) => anyhow::bail!("Unsupported Content-Encoding: {}", other),
+        }
+    }
+
+    // Returns whatever decoded output the chunk completed
+    pub fn feed(&mut self, chunk: &[u8]) -> Result<Vec<u8>> {
+        match self {
+            BodyDecoder::Identity => Ok(chunk.to_vec()),
+            BodyDecoder::Gzip(decoder) => {
+                decoder.write_all(chunk).context("Failed to decompress gzip body")?;
+                Ok(std::mem::take(decoder.get_mut()))
+            }
+            BodyDecoder::Deflate(decoder) => {
+                decoder.write_all(chunk).context("Failed to decompress deflate body")?;
+                Ok(std::mem::take(decoder.get_mut()))
+            }
+        }
+    }
+
+    pub fn finish(self) -> Result<Vec<u8>> {
+        match self {
+            BodyDecoder::Identity => Ok(Vec::new()),
+            BodyDecoder::Gzip(decoder) => decoder.finish().context("Truncated gzip body"),
+            BodyDecoder::Deflate(decoder) => decoder.finish().context("Truncated deflate body"),
+        }
+    }
+}
+
+// Pages are small and never legitimately gzip files, so a gzip magic number is decoded even
+// when the header is missing. Decoding stops once the output passes max_len, so a tiny
+// compressed body cannot expand into gigabytes.
+pub fn decode_html(body: &[u8], content_encoding: Option<&str>, max_len: usize) -> Result<String> {
+    let mut decoder = match BodyDecoder::for_encoding(content_encoding)? {
+        BodyDecoder::Identity if body.starts_with(&GZIP_MAGIC) => BodyDecoder::Gzip(GzDecoder::new(Vec::new())),
+        decoder => decoder,
+    };
+
+    let mut bytes = Vec::new();
+    for chunk in body.chunks(16 * 1024) {
+        bytes.extend(decoder.feed(chunk)?);
+        if bytes.len() > max_len {
+            return Err(AppError::PageTooLarge(max_len).into());
+        }
+    }
+    bytes.extend(decoder.finish()?);
+    if bytes.len() > max_len {
+        return Err(AppError::PageTooLarge(max_len).into());
+    }
+
+    Ok(String::from_utf8_lossy(&bytes).into_owned())
+}
+
+#[cfg(test)]
+pub(crate) fn gzip(data: &[u8]) -> Vec<u8> {
+    let mut encoder = flate2::write::GzEncoder::new(Vec::new(), flate2::Compression::default());
+    encoder.write_all(data).unwrap();
+    encoder.finish().unwrap()
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_decode_html_sniffs_gzip_without_header() {
+        let html = "<html><body>Dune</body></html>";
+        assert_eq!(decode_html(&gzip(html.as_bytes()), None, 1024).unwrap(), html);
+        assert_eq!(decode_html(&gzip(html.as_bytes()), Some("gzip"), 1024).unwrap(), html);
+        assert_eq!(decode_html(html.as_bytes(), None, 1024).unwrap(), html);
+    }
+
+    #[test]
+    fn test_decode_html_deflate() {
+        let mut encoder = flate2::write::ZlibEncoder::new(Vec::new(), flate2::Compression::default());
+        encoder.write_all(b"<p>ok</p>").unwrap();
+        let body = encoder.finish().unwrap();
+        assert_eq!(decode_html(&body, Some("Deflate"), 1024).unwrap(), "<p>ok</p>");
+    }
+
+    #[test]
+    fn test_decode_html_caps_decompressed_size() {
+        // 1 MB of zeros compresses to about 1 KB
+        let bomb = gzip(&vec![0u8; 1024 * 1024]);
+        assert!(bomb.len() < 16 * 1024);
+
+        let err = decode_html(&bomb, None, 64 * 1024).unwrap_err();
+        assert!(matches!(err.downcast_ref::<AppError>(), Some(AppError::PageTooLarge(_))));
+    }
+
+    #[test]
+    fn test_decoder_streams_in_chunks() {
+        let data = "chunked ".repeat(2000);
+        let compressed = gzip(data.as_bytes());
+
+        let mut decoder = BodyDecoder::for_encoding(Some("x-gzip")).unwrap();
+        let mut out = Vec::new();
+        for chunk in compressed.chunks(100) {
+            out.extend(decoder.feed(chunk).unwrap());
+        }
+        out.extend(decoder.finish().unwrap());
+        assert_eq!(out, data.as_bytes());
+    }
+
+    #[test]
+    fn test_unsupported_encoding_is_an_error() {
+        assert!(BodyDecoder::for_encoding(Some("br")).is_err());
+        assert!(matches!(BodyDecoder::for_encoding(Some("identity")).unwrap(), BodyDecoder::Identity));
+    }
+}
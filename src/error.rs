@@ -0,0 +1,170 @@
+use reqwest::StatusCode;
+
+pub const EXIT_SUCCESS: i32 = 0;
+pub const EXIT_FAILURE: i32 = 1;
+pub const EXIT_NO_RESULTS: i32 = 2;
+pub const EXIT_NETWORK: i32 = 3;
+pub const EXIT_DOWNLOAD: i32 = 4;
+pub const EXIT_CONFIG: i32 = 5;
+// 128 + SIGINT, as shells report it
+pub const EXIT_INTERRUPTED: i32 = 130;
+
+pub const EXIT_CODES_HELP: &str = "Exit codes:
+  0  Success
+  1  Unexpected error
+  2  No results or download links found
+  3  Network error or request blocked
+  4  Download failed
+  5  Configuration error
+  130  Interrupted with Ctrl+C";
+
+#[derive(Debug, thiserror::Error)]
+pub enum AppError {
+    #[error("IO error: {0}")]
+    Io(#[from] std::io::Error),
+    #[error("No results found")]
+    NoResults,
+    #[error("No download links found")]
+    NoDownloadLinks,
+    #[error("All {0} download link(s) were filtered out by blocked_sources/allowed_sources or the host block list")]
+    SourcesFiltered(usize),
+    #[error("All {0} result(s) were removed by the size or year filter")]
+    ResultsFiltered(usize),
+    #[error("Network request failed")]
+    Network,
+    #[error("No internet connection: the mirror's address could not be looked up")]
+    Offline,
+    #[error("HTTP error: {0}")]
+    HttpStatus(StatusCode),
+    #[error("Timed out after {0}s across {1} mirror(s)")]
+    Timeout(u64, usize),
+    #[error("No data received for {0}s; the download stalled")]
+    Stalled(u64),
+    #[error("Run exceeded the {0}s deadline")]
+    Deadline(u64),
+    #[error("Page is larger than the {} limit", crate::stats::format_bytes(*.0 as u64))]
+    PageTooLarge(usize),
+    // A parse failure or a block page, as opposed to a search that found nothing
+    #[error("The mirror's page doesn't look like search results: {0}")]
+    UnexpectedPage(String),
+    #[error("Download failed")]
+    Download,
+    // --verify-retry ran out of links
+    #[error("None of the {0} download link(s) gave a file matching the book's md5")]
+    ChecksumMismatch(usize),
+    #[error("Configuration error")]
+    Config,
+    #[error("Interrupted; any partial download was removed")]
+    Interrupted,
+}
+
+impl AppError {
+    pub fn exit_code(&self) -> i32 {
+        match self {
+            AppError::Io(_) => EXIT_FAILURE,
+            AppError::NoResults | AppError::NoDownloadLinks | AppError::SourcesFiltered(_) | AppError::ResultsFiltered(_) => EXIT_NO_RESULTS,
+            AppError::Network | AppError::Offline | AppError::HttpStatus(_) | AppError::Timeout(_, _) | AppError::Stalled(_) | AppError::Deadline(_) | AppError::PageTooLarge(_) | AppError::UnexpectedPage(_) => EXIT_NETWORK,
+            AppError::Download | AppError::ChecksumMismatch(_) => EXIT_DOWNLOAD,
+            AppError::Config => EXIT_CONFIG,
+            AppError::Interrupted => EXIT_INTERRUPTED,
+        }
+    }
+}
+
+// A failed DNS lookup means this machine can't resolve anything right now, which is not the
+// same as a mirror being down or blocking us. hyper reports it as a "dns error" connect error.
+pub fn is_dns_failure(err: &(dyn std::error::Error + 'static)) -> bool {
+    let mut source = Some(err);
+    while let Some(e) = source {
+        let text = e.to_string().to_ascii_lowercase();
+        if text.contains("dns error") || text.contains("failed to lookup address") {
+            return true;
+        }
+        source = e.source();
+    }
+    false
+}
+
+// The AppError a failed request should carry
+pub fn request_error(err: &reqwest::Error) -> AppError {
+    if is_dns_failure(err) {
+        AppError::Offline
+    } else {
+        AppError::Network
+    }
+}
+
+pub fn exit_code(err: &anyhow::Error) -> i32 {
+    // The outermost AppError wins, so a network error inside a download maps to EXIT_DOWNLOAD
+    if let Some(app_error) = err.downcast_ref::<AppError>() {
+        return app_error.exit_code();
+    }
+    
+    if err.downcast_ref::<reqwest::Error>().is_some() {
+        return EXIT_NETWORK;
+    }
+    
+    EXIT_FAILURE
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use anyhow::Context;
+
+    #[test]
+    fn test_exit_code_for_app_errors() {
+        assert_eq!(AppError::NoResults.exit_code(), EXIT_NO_RESULTS);
+        assert_eq!(AppError::NoDownloadLinks.exit_code(), EXIT_NO_RESULTS);
+        assert_eq!(AppError::SourcesFiltered(2).exit_code(), EXIT_NO_RESULTS);
+        assert_eq!(AppError::ResultsFiltered(4).exit_code(), EXIT_NO_RESULTS);
+        assert_eq!(AppError::Network.exit_code(), EXIT_NETWORK);
+        assert_eq!(AppError::Offline.exit_code(), EXIT_NETWORK);
+        assert_eq!(AppError::HttpStatus(StatusCode::FORBIDDEN).exit_code(), EXIT_NETWORK);
+        assert_eq!(AppError::Timeout(45, 3).exit_code(), EXIT_NETWORK);
+        assert_eq!(AppError::Deadline(60).exit_code(), EXIT_NETWORK);
+        assert_eq!(AppError::Stalled(60).exit_code(), EXIT_NETWORK);
+        assert_eq!(AppError::PageTooLarge(10 * 1024 * 1024).exit_code(), EXIT_NETWORK);
+        assert_eq!(AppError::PageTooLarge(10 * 1024 * 1024).to_string(), "Page is larger than the 10.0 MB limit");
+        assert_eq!(AppError::Download.exit_code(), EXIT_DOWNLOAD);
+        assert_eq!(AppError::Config.exit_code(), EXIT_CONFIG);
+        assert_eq!(AppError::Interrupted.exit_code(), EXIT_INTERRUPTED);
+    }
+
+    #[test]
+    fn test_exit_code_through_context_chain() {
+        let err = anyhow::Error::new(AppError::HttpStatus(StatusCode::TOO_MANY_REQUESTS))
+            .context("Search failed");
+        assert_eq!(exit_code(&err), EXIT_NETWORK);
+    }
+
+    #[test]
+    fn test_exit_code_outermost_wins() {
+        let result: anyhow::Result<()> = Err(AppError::HttpStatus(StatusCode::NOT_FOUND).into());
+        let err = result.context(AppError::Download).unwrap_err();
+        assert_eq!(exit_code(&err), EXIT_DOWNLOAD);
+    }
+
+    #[test]
+    fn test_is_dns_failure_walks_sources() {
+        let lookup = std::io::Error::new(std::io::ErrorKind::Other, "failed to lookup address information");
+        let err = anyhow::Error::new(lookup).context("error sending request");
+        assert!(is_dns_failure(err.as_ref()));
+        
+        let refused = std::io::Error::new(std::io::ErrorKind::ConnectionRefused, "connection refused");
+        assert!(!is_dns_failure(&refused));
+    }
+
+    #[test]
+    fn test_exit_code_untyped_error() {
+        let err = anyhow::anyhow!("something odd");
+        assert_eq!(exit_code(&err), EXIT_FAILURE);
+    }
+
+    #[test]
+    fn test_exit_codes_help_lists_codes() {
+        for code in [EXIT_SUCCESS, EXIT_NO_RESULTS, EXIT_NETWORK, EXIT_DOWNLOAD, EXIT_CONFIG, EXIT_INTERRUPTED] {
+            assert!(EXIT_CODES_HELP.contains(&format!("  {}  ", code)));
+        }
+    }
+}
@@ -0,0 +1,149 @@
+use crate::scraper::Book;
+use anyhow::{Context, Result};
+use std::path::Path;
+
+pub fn to_json(books: &[Book]) -> Result<String> {
+    serde_json::to_string_pretty(books).context("Failed to serialize results")
+}
+
+pub fn to_csv(books: &[Book]) -> String {
+    let mut out = String::from("title,author,year,language,format,size,md5,url\n");
+    
+    for book in books {
+        let fields = [
+            book.title.as_str(),
+            book.author.as_deref().unwrap_or(""),
+            book.year.as_deref().unwrap_or(""),
+            book.language.as_deref().unwrap_or(""),
+            book.format.as_deref().unwrap_or(""),
+            book.size.as_deref().unwrap_or(""),
+            book.md5.as_deref().unwrap_or(""),
+            book.url.as_str(),
+        ];
+        let row = fields.iter().map(|f| csv_field(f)).collect::<Vec<_>>().join(",");
+        out.push_str(&row);
+        out.push('\n');
+    }
+    
+    out
+}
+
+// A table for issues, chats and notes; each title links to its md5 page
+pub fn to_markdown(books: &[Book]) -> String {
+    let mut out = String::from("| Title | Author | Year | Format |\n| --- | --- | --- | --- |\n");
+    
+    for book in books {
+        out.push_str(&format!(
+            "| [{}]({}) | {} | {} | {} |\n",
+            markdown_field(&book.title).replace('[', "\\[").replace(']', "\\]"),
+            book.share_url(),
+            markdown_field(book.author.as_deref().unwrap_or("")),
+            markdown_field(book.year.as_deref().unwrap_or("")),
+            markdown_field(book.format.as_deref().unwrap_or("")),
+        ));
+    }
+    
+    out
+}
+
+// Picks CSV for a .csv path, Markdown for .md or .markdown and JSON for anything else
+pub fn write(path: &Path, books: &[Book]) -> Result<()> {
+    let extension = path.extension()
+        .and_then(|e| e.to_str())
+        .map(|e| e.to_ascii_lowercase())
+        .unwrap_or_default();
+    
+    let contents = match extension.as_str() {
+        "csv" => to_csv(books),
+        "md" | "markdown" => to_markdown(books),
+        _ => to_json(books)?,
+    };
+    
+    std::fs::write(path, contents)
+        .with_context(|| format!("Failed to write {}", path.display()))
+}
+
+fn csv_field(value: &str) -> String {
+    if value.contains(|c| matches!(c, ',' | '"' | '\n' | '\r')) {
+        format!("\"{}\"", value.replace('"', "\"\""))
+    } else {
+        value.to_string()
+    }
+}
+
+// A "|" would end the cell and a line break the row
+fn markdown_field(value: &str) -> String {
+    value.split_whitespace().collect::<Vec<_>>().join(" ").replace('|', "\\|")
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::test_support::test_book;
+
+    fn sample_book() -> Book {
+        test_book("Dune, Deluxe \"Edition\"")
+            .author("Frank Herbert")
+            .year("1965")
+            .format("EPUB")
+            .url("https://annas-archive.org/md5/abc")
+            .md5("abc")
+            .build()
+    }
+
+    #[test]
+    fn test_to_csv_quotes_fields() {
+        let csv = to_csv(&[sample_book()]);
+        let mut lines = csv.lines();
+        assert_eq!(lines.next(), Some("title,author,year,language,format,size,md5,url"));
+        assert_eq!(
+            lines.next(),
+            Some("\"Dune, Deluxe \"\"Edition\"\"\",Frank Herbert,1965,,EPUB,,abc,https://annas-archive.org/md5/abc")
+        );
+    }
+
+    #[test]
+    fn test_to_markdown_links_md5_page() {
+        let piped = test_book("[Draft] A | B")
+            .year("1965")
+            .format("EPUB")
+            .url("https://annas-archive.se/md5/DEF")
+            .build();
+        let markdown = to_markdown(&[sample_book(), piped]);
+        let lines: Vec<&str> = markdown.lines().collect();
+        assert_eq!(lines[0], "| Title | Author | Year | Format |");
+        assert_eq!(lines[1], "| --- | --- | --- | --- |");
+        assert_eq!(lines[2], "| [Dune, Deluxe \"Edition\"](https://annas-archive.org/md5/abc) | Frank Herbert | 1965 | EPUB |");
+        assert_eq!(lines[3], "| [\\[Draft\\] A \\| B](https://annas-archive.org/md5/def) |  | 1965 | EPUB |");
+    }
+
+    #[test]
+    fn test_to_json_roundtrip() {
+        let json = to_json(&[sample_book()]).unwrap();
+        let books: Vec<Book> = serde_json::from_str(&json).unwrap();
+        assert_eq!(books.len(), 1);
+        assert_eq!(books[0].md5.as_deref(), Some("abc"));
+    }
+
+    #[test]
+    fn test_write_picks_format_from_extension() {
+        let dir = std::env::temp_dir().join(format!(
+            "annadl_export_test_{}",
+            std::time::SystemTime::now()
+                .duration_since(std::time::UNIX_EPOCH)
+                .unwrap()
+                .as_nanos()
+        ));
+        std::fs::create_dir_all(&dir).unwrap();
+
+        write(&dir.join("results.CSV"), &[sample_book()]).unwrap();
+        write(&dir.join("results.json"), &[sample_book()]).unwrap();
+        write(&dir.join("results.md"), &[sample_book()]).unwrap();
+
+        assert!(std::fs::read_to_string(dir.join("results.CSV")).unwrap().starts_with("title,"));
+        assert!(std::fs::read_to_string(dir.join("results.json")).unwrap().starts_with('['));
+        assert!(std::fs::read_to_string(dir.join("results.md")).unwrap().starts_with("| Title |"));
+
+        std::fs::remove_dir_all(&dir).unwrap();
+    }
+}
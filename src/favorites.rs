@@ -0,0 +1,127 @@
+use crate::config::Config;
+use crate::scraper::Book;
+use anyhow::{Context, Result};
+use serde::{Deserialize, Serialize};
+use std::path::PathBuf;
+
+// Books bookmarked in the TUI, kept with their metadata so the list works offline
+#[derive(Debug, Default, Serialize, Deserialize)]
+pub struct Favorites {
+    #[serde(default)]
+    pub books: Vec<Book>,
+    #[serde(skip)]
+    path: PathBuf,
+}
+
+impl Favorites {
+    pub fn load(config: &Config) -> Result<Self> {
+        Self::load_from(config.favorites_path()?)
+    }
+
+    pub fn load_from(path: PathBuf) -> Result<Self> {
+        let mut favorites = if path.exists() {
+            let contents = std::fs::read_to_string(&path)
+                .context("Failed to read favorites")?;
+            serde_json::from_str::<Favorites>(&contents)
+                .context("Failed to parse favorites JSON")?
+        } else {
+            Favorites::default()
+        };
+
+        favorites.path = path;
+        Ok(favorites)
+    }
+
+    pub fn save(&self) -> Result<()> {
+        if let Some(dir) = self.path.parent() {
+            std::fs::create_dir_all(dir)
+                .context("Failed to create favorites directory")?;
+        }
+
+        let contents = serde_json::to_string_pretty(self)
+            .context("Failed to serialize favorites")?;
+
+        std::fs::write(&self.path, contents)
+            .context("Failed to write favorites")?;
+
+        Ok(())
+    }
+
+    // The same book found on another mirror is still the same favorite
+    pub fn contains(&self, book: &Book) -> bool {
+        let key = book.share_url();
+        self.books.iter().any(|b| b.share_url() == key)
+    }
+
+    // Returns true when the book was added, false when it was removed
+    pub fn toggle(&mut self, book: &Book) -> Result<bool> {
+        let key = book.share_url();
+        let before = self.books.len();
+        self.books.retain(|b| b.share_url() != key);
+        let added = self.books.len() == before;
+        if added {
+            self.books.push(book.clone());
+        }
+        self.save()?;
+        Ok(added)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::test_support::test_book;
+    use std::fs;
+
+    fn temp_favorites_path() -> PathBuf {
+        std::env::temp_dir()
+            .join(format!(
+                "annadl_favorites_test_{}",
+                std::time::SystemTime::now()
+                    .duration_since(std::time::UNIX_EPOCH)
+                    .unwrap()
+                    .as_nanos()
+            ))
+            .join("favorites.json")
+    }
+
+    fn book(url: &str, title: &str) -> Book {
+        test_book(title).author("Frank Herbert").year("1965").format("epub").url(url).build()
+    }
+
+    #[test]
+    fn test_load_missing_file_is_empty() {
+        let favorites = Favorites::load_from(temp_favorites_path()).unwrap();
+        assert!(favorites.books.is_empty());
+    }
+
+    #[test]
+    fn test_toggle_persists_and_removes() {
+        let path = temp_favorites_path();
+        let mut favorites = Favorites::load_from(path.clone()).unwrap();
+        let dune = book("https://annas-archive.org/md5/0123456789abcdef0123456789abcdef", "Dune");
+
+        assert!(favorites.toggle(&dune).unwrap());
+        let reloaded = Favorites::load_from(path.clone()).unwrap();
+        assert!(reloaded.contains(&dune));
+        assert_eq!(reloaded.books[0].author.as_deref(), Some("Frank Herbert"));
+
+        assert!(!favorites.toggle(&dune).unwrap());
+        assert!(Favorites::load_from(path.clone()).unwrap().books.is_empty());
+
+        fs::remove_dir_all(path.parent().unwrap()).unwrap();
+    }
+
+    #[test]
+    fn test_same_book_on_another_mirror_matches() {
+        let path = temp_favorites_path();
+        let mut favorites = Favorites::load_from(path.clone()).unwrap();
+        favorites.toggle(&book("https://annas-archive.org/md5/0123456789abcdef0123456789abcdef", "Dune")).unwrap();
+
+        let mirrored = book("https://annas-archive.se/md5/0123456789ABCDEF0123456789ABCDEF", "Dune");
+        assert!(favorites.contains(&mirrored));
+        assert!(!favorites.contains(&book("https://annas-archive.org/md5/ffffffffffffffffffffffffffffffff", "Other")));
+
+        fs::remove_dir_all(path.parent().unwrap()).unwrap();
+    }
+}
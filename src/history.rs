@@ -0,0 +1,132 @@
+use crate::config::Config;
+use anyhow::{Context, Result};
+use serde::{Deserialize, Serialize};
+use std::path::{Path, PathBuf};
+
+#[derive(Debug, Clone, Serialize, Deserialize, PartialEq)]
+pub struct HistoryEntry {
+    pub md5: String,
+    pub title: String,
+    pub path: PathBuf,
+}
+
+#[derive(Debug, Default, Serialize, Deserialize)]
+pub struct History {
+    #[serde(default)]
+    pub entries: Vec<HistoryEntry>,
+    #[serde(skip)]
+    path: PathBuf,
+}
+
+impl History {
+    pub fn load(config: &Config) -> Result<Self> {
+        Self::load_from(config.history_path()?)
+    }
+
+    pub fn load_from(path: PathBuf) -> Result<Self> {
+        let mut history = if path.exists() {
+            let contents = std::fs::read_to_string(&path)
+                .context("Failed to read download history")?;
+            serde_json::from_str::<History>(&contents)
+                .context("Failed to parse download history JSON")?
+        } else {
+            History::default()
+        };
+
+        history.path = path;
+        Ok(history)
+    }
+
+    pub fn save(&self) -> Result<()> {
+        if let Some(dir) = self.path.parent() {
+            std::fs::create_dir_all(dir)
+                .context("Failed to create history directory")?;
+        }
+
+        let contents = serde_json::to_string_pretty(self)
+            .context("Failed to serialize download history")?;
+
+        std::fs::write(&self.path, contents)
+            .context("Failed to write download history")?;
+
+        Ok(())
+    }
+
+    pub fn record(&mut self, md5: &str, title: &str, path: &Path) -> Result<()> {
+        let md5 = md5.to_lowercase();
+        self.entries.retain(|e| e.md5 != md5);
+        self.entries.push(HistoryEntry {
+            md5,
+            title: title.to_string(),
+            path: path.to_path_buf(),
+        });
+        self.save()
+    }
+
+    pub fn find(&self, md5: &str) -> Option<&HistoryEntry> {
+        self.entries.iter().find(|e| e.md5.eq_ignore_ascii_case(md5))
+    }
+
+    pub fn contains(&self, md5: &str) -> bool {
+        self.find(md5).is_some()
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::fs;
+
+    fn temp_history_path() -> PathBuf {
+        std::env::temp_dir()
+            .join(format!(
+                "annadl_history_test_{}",
+                std::time::SystemTime::now()
+                    .duration_since(std::time::UNIX_EPOCH)
+                    .unwrap()
+                    .as_nanos()
+            ))
+            .join("downloads.json")
+    }
+
+    #[test]
+    fn test_load_missing_file_is_empty() {
+        let path = temp_history_path();
+        let history = History::load_from(path).unwrap();
+        assert!(history.entries.is_empty());
+    }
+
+    #[test]
+    fn test_record_and_lookup_roundtrip() {
+        let path = temp_history_path();
+        let mut history = History::load_from(path.clone()).unwrap();
+
+        history
+            .record("ABCDEF0123456789ABCDEF0123456789", "Dune", Path::new("/books/dune.epub"))
+            .unwrap();
+
+        let reloaded = History::load_from(path.clone()).unwrap();
+        assert!(reloaded.contains("abcdef0123456789abcdef0123456789"));
+        assert_eq!(
+            reloaded.find("abcdef0123456789abcdef0123456789").map(|e| e.path.clone()),
+            Some(PathBuf::from("/books/dune.epub"))
+        );
+        assert!(!reloaded.contains("00000000000000000000000000000000"));
+
+        fs::remove_dir_all(path.parent().unwrap()).unwrap();
+    }
+
+    #[test]
+    fn test_record_replaces_existing_entry() {
+        let path = temp_history_path();
+        let mut history = History::load_from(path.clone()).unwrap();
+
+        history.record("abc", "Old", Path::new("/old.pdf")).unwrap();
+        history.record("abc", "New", Path::new("/new.pdf")).unwrap();
+
+        assert_eq!(history.entries.len(), 1);
+        assert_eq!(history.entries[0].title, "New");
+
+        fs::remove_dir_all(path.parent().unwrap()).unwrap();
+    }
+}
@@ -0,0 +1,214 @@
+use crate::scraper::Book;
+use anyhow::{Context, Result};
+use std::path::Path;
+use std::process::Stdio;
+use tokio::process::Command;
+
+// What a post-download command can refer to, and the environment variable each one becomes
+const PLACEHOLDERS: &[(&str, &str)] = &[
+    ("path", "ANNADL_PATH"),
+    ("title", "ANNADL_TITLE"),
+    ("author", "ANNADL_AUTHOR"),
+    ("format", "ANNADL_FORMAT"),
+    ("md5", "ANNADL_MD5"),
+];
+
+// --post-download / "post_download": run after each file is saved, e.g. "calibredb add {path}"
+#[derive(Debug, Clone, PartialEq)]
+pub struct PostDownload {
+    pub command: String,
+    // A failed command fails the download too; otherwise it is only reported
+    pub required: bool,
+}
+
+impl PostDownload {
+    // Waits for the command and returns what it printed; a non-zero exit is an error
+    pub async fn run(&self, path: &Path, book: Option<&Book>) -> Result<String> {
+        let output = self.command(path, book)?
+            .stdin(Stdio::null())
+            .output()
+            .await
+            .with_context(|| format!("Failed to run post-download command '{}'", self.command))?;
+
+        let printed = format!("{}{}", String::from_utf8_lossy(&output.stdout), String::from_utf8_lossy(&output.stderr));
+        if !output.status.success() {
+            let last_line = printed.lines().rev().find(|line| !line.trim().is_empty()).unwrap_or("no output");
+            anyhow::bail!("Post-download command '{}' failed ({}): {}", self.command, output.status, last_line.trim());
+        }
+
+        Ok(printed)
+    }
+
+    // sh expands the quoted variable references itself
+    #[cfg(not(windows))]
+    fn command(&self, path: &Path, book: Option<&Book>) -> Result<Command> {
+        let mut command = Command::new("sh");
+        command.arg("-c").arg(shell_command(&self.command)).envs(values(path, book));
+        Ok(command)
+    }
+
+    // cmd.exe expands %VAR% before it looks at quotes, so a title could still end the quoted
+    // argument and start a command of its own. Without a shell the program gets each value as
+    // exactly one argument, at the cost of pipes and other shell syntax.
+    #[cfg(windows)]
+    fn command(&self, path: &Path, book: Option<&Book>) -> Result<Command> {
+        let values = values(path, book);
+        let mut words = split_words(&self.command).into_iter().map(|word| fill_in(&word, &values));
+        let program = words.next()
+            .ok_or_else(|| anyhow::anyhow!("Post-download command is empty"))?;
+        let mut command = Command::new(program);
+        command.args(words).envs(values);
+        Ok(command)
+    }
+}
+
+// Runs the hook, if any, after a successful download. Ok(Some(message)) means an optional
+// command failed: the file is kept and counts as downloaded, and the caller reports the message.
+pub async fn after_download(hook: Option<&PostDownload>, path: &Path, book: Option<&Book>, verbose: bool) -> Result<Option<String>> {
+    let hook = match hook {
+        Some(hook) => hook,
+        None => return Ok(None),
+    };
+
+    match hook.run(path, book).await {
+        Ok(printed) => {
+            if verbose {
+                for line in printed.lines() {
+                    eprintln!("[post-download] {}", line);
+                }
+            }
+            Ok(None)
+        }
+        Err(e) if hook.required => Err(e),
+        Err(e) => Ok(Some(format!("{:#}", e))),
+    }
+}
+
+// Placeholders become quoted variable references rather than the values themselves, so a
+// title with quotes or `;` in it reaches the program as one argument and is never run.
+// Don't quote the placeholders yourself.
+#[cfg(not(windows))]
+pub fn shell_command(template: &str) -> String {
+    let mut command = template.to_string();
+    for (name, variable) in PLACEHOLDERS {
+        command = command.replace(&format!("{{{}}}", name), &reference(variable));
+    }
+    command
+}
+
+#[cfg(not(windows))]
+fn reference(variable: &str) -> String {
+    format!("\"${}\"", variable)
+}
+
+// Splits on whitespace outside double quotes, which group words and are dropped
+#[cfg(any(windows, test))]
+fn split_words(command: &str) -> Vec<String> {
+    let mut words = Vec::new();
+    let mut word = String::new();
+    let mut quoted = false;
+    let mut started = false;
+    for c in command.chars() {
+        match c {
+            '"' => {
+                quoted = !quoted;
+                started = true;
+            }
+            c if c.is_whitespace() && !quoted => {
+                if started {
+                    words.push(std::mem::take(&mut word));
+                    started = false;
+                }
+            }
+            c => {
+                word.push(c);
+                started = true;
+            }
+        }
+    }
+    if started {
+        words.push(word);
+    }
+    words
+}
+
+// Puts the values into one already-split word; nothing in a value is interpreted
+#[cfg(any(windows, test))]
+fn fill_in(word: &str, values: &[(&'static str, String)]) -> String {
+    let mut word = word.to_string();
+    for (name, variable) in PLACEHOLDERS {
+        if let Some((_, value)) = values.iter().find(|(v, _)| v == variable) {
+            word = word.replace(&format!("{{{}}}", name), value);
+        }
+    }
+    word
+}
+
+fn values(path: &Path, book: Option<&Book>) -> Vec<(&'static str, String)> {
+    let field = |value: Option<&str>| value.unwrap_or_default().to_string();
+    vec![
+        ("ANNADL_PATH", path.display().to_string()),
+        ("ANNADL_TITLE", field(book.map(|b| b.title.as_str()))),
+        ("ANNADL_AUTHOR", field(book.and_then(|b| b.author.as_deref()))),
+        ("ANNADL_FORMAT", field(book.and_then(|b| b.format.as_deref()))),
+        ("ANNADL_MD5", field(book.and_then(|b| b.md5.as_deref()))),
+    ]
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::test_support::test_book;
+
+    fn book(title: &str) -> Book {
+        test_book(title).author("Frank Herbert").format("epub").url("").build()
+    }
+
+    fn hook(command: &str, required: bool) -> PostDownload {
+        PostDownload { command: command.to_string(), required }
+    }
+
+    #[cfg(not(windows))]
+    #[test]
+    fn test_shell_command_references_variables() {
+        assert_eq!(shell_command("calibredb add {path}"), "calibredb add \"$ANNADL_PATH\"");
+        assert_eq!(shell_command("echo {title} by {author} {unknown}"), "echo \"$ANNADL_TITLE\" by \"$ANNADL_AUTHOR\" {unknown}");
+    }
+
+    #[cfg(not(windows))]
+    #[tokio::test]
+    async fn test_run_passes_values_without_shell_injection() {
+        let title = "Dune\"; echo injected; \"";
+        let printed = hook("printf '%s|%s|%s' {title} {format} {path}", false)
+            .run(Path::new("/tmp/books/Dune.epub"), Some(&book(title)))
+            .await
+            .unwrap();
+        assert_eq!(printed, format!("{}|epub|/tmp/books/Dune.epub", title));
+    }
+
+    #[test]
+    fn test_split_words_keeps_quoted_words_and_values_whole() {
+        assert_eq!(split_words("calibredb add {path}"), vec!["calibredb", "add", "{path}"]);
+        assert_eq!(split_words("  \"C:\\Program Files\\tool.exe\"  --to \"\" {title}"), vec!["C:\\Program Files\\tool.exe", "--to", "", "{title}"]);
+
+        let values = values(Path::new("C:\\Books\\Dune.epub"), Some(&book("Dune\" & calc & \"%PATH%")));
+        let words: Vec<String> = split_words("tool {title} --file={path}").iter().map(|word| fill_in(word, &values)).collect();
+        assert_eq!(words, vec!["tool", "Dune\" & calc & \"%PATH%", "--file=C:\\Books\\Dune.epub"]);
+    }
+
+    #[cfg(not(windows))]
+    #[tokio::test]
+    async fn test_failed_command_is_optional_unless_required() {
+        let path = Path::new("/tmp/books/Dune.epub");
+        let failing = "echo 'library locked' >&2; exit 3";
+
+        let warning = after_download(Some(&hook(failing, false)), path, None, false).await.unwrap();
+        assert!(warning.unwrap().contains("library locked"));
+
+        let err = after_download(Some(&hook(failing, true)), path, None, false).await.unwrap_err();
+        assert!(err.to_string().contains("library locked"));
+
+        assert_eq!(after_download(Some(&hook("true", true)), path, None, false).await.unwrap(), None);
+        assert_eq!(after_download(None, path, None, false).await.unwrap(), None);
+    }
+}
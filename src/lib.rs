@@ -0,0 +1,26 @@
+pub mod browser;
+pub mod citation;
+pub mod client;
+pub mod clipboard;
+pub mod config;
+pub mod downloader;
+pub mod encoding;
+pub mod error;
+pub mod export;
+pub mod favorites;
+pub mod history;
+pub mod hook;
+pub mod naming;
+pub mod network;
+pub mod scraper;
+pub mod stats;
+pub mod tape;
+pub mod version;
+// Local HTTP fixtures for the crate's tests, the binary's included; not part of the API
+#[doc(hidden)]
+pub mod test_support;
+
+pub use client::Client;
+pub use downloader::{Downloader, Progress, Saved};
+pub use error::AppError;
+pub use scraper::{AnnaScraper, Book, DownloadLink, SearchFilters};
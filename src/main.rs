@@ -1,10 +1,10 @@
-mod config;
-mod downloader;
-mod scraper;
 mod ui;
 
+use anna_dl::{browser, citation, clipboard, config, downloader, error, export, favorites, history, hook, naming, network, scraper, stats, tape, version};
+
 use anyhow::{Context, Result};
-use clap::Parser;
+use error::AppError;
+use clap::{Parser, Subcommand};
 use crossterm::{
     event::{DisableMouseCapture, EnableMouseCapture, Event},
     execute,
@@ -14,86 +14,610 @@ use ratatui::{
     backend::CrosstermBackend,
     Terminal,
 };
-use std::io;
+use std::io::{self, IsTerminal};
 use std::path::PathBuf;
+use std::time::Duration;
+use tokio::io::{AsyncBufReadExt, AsyncRead, AsyncReadExt};
 
 #[derive(Parser)]
 #[command(name = "annadl")]
 #[command(about = "A Rust CLI tool for downloading books from Anna's Archive", long_about = None)]
-#[command(version)]
+#[command(version, long_version = version::LONG_VERSION)]
+#[command(after_help = error::EXIT_CODES_HELP)]
 struct Cli {
+    #[command(subcommand)]
+    command: Option<Commands>,
+    
     search_query: Option<String>,
     
-    #[arg(short = 'n', long, default_value = "5", help = "Number of results to show")]
+    #[arg(short = 'n', long, global = true, default_value_t = scraper::DEFAULT_NUM_RESULTS, value_parser = parse_num_results, help = "Number of results to show (1-200)")]
     num_results: usize,
     
-    #[arg(short = 'p', long, help = "Download path (overrides config)")]
+    #[arg(short = 'p', long, global = true, help = "Download path (overrides config)")]
     download_path: Option<PathBuf>,
     
+    #[arg(long, global = true, value_name = "PATH", help = "Write partial downloads here and move them to the download path when complete (overrides config)")]
+    temp_dir: Option<PathBuf>,
+    
     #[arg(long, help = "Set default download path in config")]
     set_path: Option<PathBuf>,
     
+    #[arg(short = 'f', long, global = true, help = "Only show results in this format, e.g. epub (overrides config)")]
+    format: Option<String>,
+    
+    #[arg(long, global = true, value_name = "FORMATS", value_delimiter = ',', help = "When get-list picks a result, take the best of these formats among the top results, e.g. epub,pdf,mobi (overrides config)")]
+    format_priority: Vec<String>,
+    
+    #[arg(short = 'l', long, global = true, help = "Only show results in this language code, e.g. en (overrides config)")]
+    language: Option<String>,
+    
+    #[arg(long, global = true, value_name = "YEAR", help = "Only show books published in YEAR or later")]
+    min_year: Option<u32>,
+    
+    #[arg(long, global = true, value_name = "YEAR", help = "Only show books published in YEAR or earlier")]
+    max_year: Option<u32>,
+    
+    #[arg(long, global = true, help = "Keep books with no known year when --min-year/--max-year is set")]
+    include_unknown_year: bool,
+    
+    #[arg(long, value_name = "FORMAT", help = "Set default format filter in config (empty to clear)")]
+    set_format: Option<String>,
+    
+    #[arg(long, value_name = "LANGUAGE", help = "Set default language filter in config (empty to clear)")]
+    set_language: Option<String>,
+    
     #[arg(short = 'i', long, help = "Interactive mode (default if no query provided)")]
     interactive: bool,
     
     #[arg(long, help = "List current config")]
     config: bool,
+    
+    #[arg(long, global = true, value_name = "PATH", help = "Use this config file instead of the default location")]
+    config_file: Option<PathBuf>,
+    
+    #[arg(long, global = true, value_name = "SECONDS", help = "Abort a non-interactive run (search, resolve and download) after SECONDS")]
+    deadline: Option<u64>,
+    
+    #[arg(short = 'o', long, global = true, value_name = "PATH", conflicts_with = "stdout", help = "Save the download as PATH (a directory keeps the generated name)")]
+    output: Option<PathBuf>,
+    
+    #[arg(long, global = true, help = "Stream the downloaded file to stdout instead of saving it")]
+    stdout: bool,
+    
+    #[arg(long, global = true, value_name = "N", help = "Retry failed requests N times (default 3, 0 to fail fast)")]
+    retries: Option<u32>,
+    
+    #[arg(long, global = true, value_name = "N", default_value = "1", value_parser = clap::value_parser!(u8).range(1..=16), help = "Fetch large files over N parallel connections when the server supports byte ranges")]
+    connections: u8,
+    
+    #[arg(long, global = true, value_name = "TEMPLATE", value_parser = naming::parse_template, help = "Save books as TEMPLATE under the download path, e.g. \"{author}/{title}\" (overrides config)")]
+    name_template: Option<String>,
+    
+    #[arg(long, global = true, value_name = "CMD", help = "Run CMD after each download; {path}, {title}, {author}, {format} and {md5} are filled in, e.g. \"calibredb add {path}\"")]
+    post_download: Option<String>,
+    
+    #[arg(long, global = true, help = "Count a failed --post-download command as a failed download")]
+    post_download_required: bool,
+    
+    #[arg(long, global = true, help = "Check each download against the book's md5; on a mismatch, delete it and try the next link")]
+    verify_retry: bool,
+    
+    #[arg(long, global = true, value_enum, value_name = "PERIOD", help = "Save downloads in a folder per day (2024-06-15) or month (2024-06) under the download path, or off (overrides config)")]
+    date_folders: Option<naming::DateFolders>,
+    
+    #[arg(long, global = true, value_enum, value_name = "POLICY", help = "When the file already exists: overwrite (default), skip, or rename to \"name (1).ext\" (overrides config)")]
+    on_conflict: Option<downloader::ConflictPolicy>,
+    
+    #[arg(long, global = true, value_name = "SECONDS", value_parser = clap::value_parser!(u64).range(1..), help = "Abandon a download after SECONDS without receiving any data (default 60)")]
+    stall_timeout: Option<u64>,
+    
+    #[arg(long, global = true, value_name = "SECONDS", value_parser = clap::value_parser!(u64).range(1..), help = "Give up connecting to a mirror or download host after SECONDS, TLS handshake included (default 30)")]
+    connect_timeout: Option<u64>,
+    
+    #[arg(long, global = true, value_name = "N", help = "Read the download links of the top N results ahead after a TUI search (default 3, 0 turns it off)")]
+    prefetch: Option<usize>,
+    
+    #[arg(long, global = true, value_name = "DIR", conflicts_with = "replay", help = "Save every search and detail page under DIR, for bug reports")]
+    record: Option<PathBuf>,
+    
+    #[arg(long, global = true, value_name = "DIR", help = "Serve search and detail pages from a --record DIR instead of the network")]
+    replay: Option<PathBuf>,
+    
+    #[arg(long, global = true, value_name = "HOST", value_parser = scraper::parse_mirror, help = "Use only this mirror, e.g. annas-archive.se, with no fallback to the others")]
+    mirror: Option<String>,
+    
+    #[arg(long, global = true, help = "Skip TLS certificate checks for mirrors and downloads (unsafe; for mirrors with broken certificates)")]
+    insecure: bool,
+    
+    #[arg(long, global = true, value_name = "UA", help = "Send UA as the User-Agent on every request (empty for the built-in one; overrides config)")]
+    user_agent: Option<String>,
+    
+    #[arg(short = 'v', long, global = true, help = "Log scraping details, such as which page selectors matched, to stderr")]
+    verbose: bool,
+    
+    #[arg(long, global = true, value_enum, value_name = "ORDER", help = "Have the site sort results before they are cut off (default: relevance)")]
+    sort: Option<scraper::ServerSort>,
+    
+    #[arg(long = "param", global = true, value_name = "KEY=VALUE", value_parser = scraper::parse_query_param, help = "Append KEY=VALUE to the search URL (advanced; may break when the site changes)")]
+    params: Vec<(String, String)>,
+    
+    #[arg(short = 'q', long, global = true, help = "Print only the saved path on success and errors on failure")]
+    quiet: bool,
+    
+    #[arg(long, global = true, help = "Skip books that are already in the download history")]
+    skip_existing: bool,
+    
+    #[arg(long, value_enum, value_name = "STYLE", help = "Print a citation for the selected book instead of downloading it")]
+    cite: Option<citation::CitationStyle>,
+}
+
+#[derive(Subcommand)]
+enum Commands {
+    #[command(about = "List search results without downloading anything")]
+    Search {
+        #[arg(help = "Search query; read from stdin when omitted and stdin is piped")]
+        query: Option<String>,
+
+        #[arg(long, help = "Print results as JSON")]
+        json: bool,
+
+        #[arg(long, value_name = "FILE", help = "Write results to FILE (CSV for .csv, a Markdown table for .md, JSON otherwise)")]
+        export: Option<PathBuf>,
+    },
+    #[command(about = "Download a specific book by md5 or detail page URL")]
+    Get {
+        #[arg(value_name = "MD5|URL")]
+        target: String,
+
+        #[arg(long, help = "Report progress, completion and errors as JSON lines on stderr")]
+        json: bool,
+    },
+    #[command(about = "Download the top result for each query in FILE (one per line, # starts a comment)")]
+    GetList {
+        #[arg(value_name = "FILE")]
+        file: PathBuf,
+
+        #[arg(long, help = "Keep going after a failed query and exit 0; failures are still reported")]
+        continue_on_error: bool,
+    },
+    #[command(about = "Show version and build details (include this in bug reports)")]
+    Version {
+        #[arg(long, help = "Print build details as JSON")]
+        json: bool,
+    },
+}
+
+fn parse_num_results(value: &str) -> std::result::Result<usize, String> {
+    let count: usize = value.trim()
+        .parse()
+        .map_err(|_| format!("expected a whole number, got '{}'", value))?;
+    if count < 1 {
+        return Err("must be at least 1".to_string());
+    }
+    Ok(count)
+}
+
+// Returns the count to use and whether it had to be capped
+fn clamp_num_results(requested: usize) -> (usize, bool) {
+    (requested.min(scraper::MAX_NUM_RESULTS), requested > scraper::MAX_NUM_RESULTS)
+}
+
+// The same for --prefetch or "prefetch_count"
+fn clamp_prefetch(requested: usize) -> (usize, bool) {
+    (requested.min(scraper::MAX_PREFETCH_COUNT), requested > scraper::MAX_PREFETCH_COUNT)
+}
+
+// Where the human-readable chatter of a non-interactive run goes
+#[derive(Debug, Clone, Copy, PartialEq)]
+enum Output {
+    Stdout,
+    // stdout carries file data
+    Stderr,
+    // --quiet: only the final path goes to stdout, and errors to stderr
+    Quiet,
+    // get --json: JSON lines on stderr instead of any human-readable output
+    Json,
+}
+
+impl Output {
+    fn new(to_stdout: bool, quiet: bool) -> Self {
+        match (quiet, to_stdout) {
+            (true, _) => Output::Quiet,
+            (false, true) => Output::Stderr,
+            (false, false) => Output::Stdout,
+        }
+    }
+    
+    fn progress_bar(self) -> indicatif::ProgressBar {
+        match self {
+            Output::Quiet | Output::Json => indicatif::ProgressBar::hidden(),
+            _ => downloader::Downloader::progress_bar(),
+        }
+    }
+    
+    // Warnings go out even with --quiet; under --json they become events so stderr stays parseable
+    fn warn(self, message: &str) {
+        match self {
+            Output::Json => ui::progress::JsonEvent::Warning { message: message.to_string() }.emit(),
+            _ => eprintln!("Warning: {}", message),
+        }
+    }
+    
+    // The one line --quiet keeps, so scripts can pick up the file
+    fn saved_path(self, path: &std::path::Path) {
+        match self {
+            Output::Quiet => println!("{}", path.display()),
+            Output::Json => ui::progress::JsonEvent::Complete { path: Some(path), bytes: stats::file_size(path) }.emit(),
+            _ => {}
+        }
+    }
+}
+
+macro_rules! status {
+    ($out:expr, $($arg:tt)*) => {
+        match $out {
+            Output::Stdout => println!($($arg)*),
+            Output::Stderr => eprintln!($($arg)*),
+            Output::Quiet | Output::Json => {}
+        }
+    };
 }
 
 #[tokio::main]
-async fn main() -> Result<()> {
+async fn main() {
+    if let Err(e) = run().await {
+        eprintln!("Error: {:#}", e);
+        std::process::exit(error::exit_code(&e));
+    }
+}
+
+async fn run() -> Result<()> {
     let cli = Cli::parse();
     
-    let mut config = config::Config::load()
-        .context("Failed to load configuration")?;
+    // Needs no config, so it works even when the config file is broken
+    if let Some(Commands::Version { json }) = cli.command {
+        let info = version::build_info();
+        if json {
+            println!("{}", serde_json::to_string_pretty(&info)?);
+        } else {
+            println!("{}", info.human());
+        }
+        return Ok(());
+    }
+    
+    let mut config = config::Config::load_from(cli.config_file.clone())
+        .context(AppError::Config)?;
     
     if cli.config {
-        println!("Current configuration:");
+        println!("Current configuration ({}):", config.file_path().context(AppError::Config)?.display());
         println!("  Download path: {}", 
             config.download_path.as_ref()
                 .map(|p| p.display().to_string())
                 .unwrap_or_else(|| "Not set (uses ./assets)".to_string())
         );
+        println!("  Temp dir: {}",
+            config.temp_dir(None)
+                .map(|p| p.display().to_string())
+                .unwrap_or_else(|| "Not set (uses download path)".to_string())
+        );
+        println!("  Default format: {}", config.default_format.as_deref().unwrap_or("Not set (any)"));
+        println!("  Format priority: {}", match config.format_priority(Vec::new()) {
+            priority if priority.is_empty() => "Not set (top result)".to_string(),
+            priority => priority.join(", "),
+        });
+        println!("  Default language: {}", config.default_language.as_deref().map(scraper::language_label).unwrap_or_else(|| "Not set (any)".to_string()));
+        println!("  Default sort: {}", config.default_sort.unwrap_or_default().label());
+        println!("  Remember view: {}", config.remember_view);
+        println!("  Retries: {}", config.retries(None));
+        println!("  Stall timeout: {}s", config.stall_timeout(None).as_secs());
+        println!("  Connect timeout: {}s", config.connect_timeout(None).as_secs());
+        println!("  Prefetch: {}", match config.prefetch_count(None) {
+            0 => "Off".to_string(),
+            count => format!("top {} results", count),
+        });
+        println!("  On conflict: {}", config.on_conflict.map(|p| p.label()).unwrap_or("Not set (overwrite; the TUI asks)"));
+        println!("  Date folders: {}", match config.date_folders {
+            naming::DateFolders::Off => "Off (flat)",
+            period => period.label(),
+        });
+        println!("  Name template: {}", config.name_template.as_deref().unwrap_or("Not set (\"Title - Author\")"));
+        println!("  User agent: {}", config.user_agent(None).as_deref().unwrap_or("Not set (built-in)"));
+        println!("  Post-download: {}", match config.post_download(None, false) {
+            Some(hook) if hook.required => format!("{} (required)", hook.command),
+            Some(hook) => hook.command,
+            None => "Not set".to_string(),
+        });
+        println!("  Verify and retry: {}", config.verify_retry);
+        println!("  IPFS gateway: {}", config.ipfs_gateway.as_deref().unwrap_or("Not set (links used as listed)"));
+        println!("  Blocked sources: {}", list_or(&config.blocked_sources, "None"));
+        println!("  Allowed sources: {}", list_or(&config.allowed_sources, "Any"));
+        println!("  Blocked hosts: {} ({})", list_or(&config.blocked_hosts, "None"), config.block_list_path()?.display());
+        println!("  Search selectors: {}", list_or(&config.search_selectors, "Not set (built-in)"));
+        println!("  Link selectors: {}", list_or(&config.link_selectors, "Not set (built-in)"));
         return Ok(());
     }
     
     if let Some(path) = cli.set_path {
-        config.set_download_path(path)?;
+        config.set_download_path(path).context(AppError::Config)?;
         println!("Download path updated successfully!");
         return Ok(());
     }
     
+    if let Some(format) = cli.set_format {
+        config.set_default_format(&format).context(AppError::Config)?;
+        println!("Default format updated successfully!");
+        return Ok(());
+    }
+    
+    if let Some(language) = cli.set_language {
+        config.set_default_language(&language).context(AppError::Config)?;
+        println!("Default language updated successfully!");
+        return Ok(());
+    }
+    
     let download_path = config.download_path(cli.download_path.clone());
     
-    if let Some(query) = cli.search_query {
-        if cli.interactive {
-            run_tui(config, download_path).await?;
-        } else {
-            run_non_interactive(query, cli.num_results, download_path).await?;
+    // Start-up warnings, before the command has picked its output
+    let warnings = match &cli.command {
+        Some(Commands::Get { json: true, .. }) => Output::Json,
+        _ => Output::Stderr,
+    };
+    
+    let (num_results, capped) = clamp_num_results(cli.num_results);
+    if capped && !cli.quiet {
+        warnings.warn(&format!("--num-results {} is above the limit; showing at most {}", cli.num_results, scraper::MAX_NUM_RESULTS));
+    }
+    
+    let requested_prefetch = config.prefetch_count(cli.prefetch);
+    let (prefetch, prefetch_capped) = clamp_prefetch(requested_prefetch);
+    if prefetch_capped && !cli.quiet {
+        warnings.warn(&format!("prefetch count {} is above the limit; reading ahead at most {}", requested_prefetch, scraper::MAX_PREFETCH_COUNT));
+    }
+    
+    // Shown even with --quiet: this silently weakens every connection of the run
+    if cli.insecure {
+        warnings.warn("--insecure disables TLS certificate checks. Pages and files can be read or altered in transit; use it only for a mirror you trust.");
+    }
+    
+    let name_template = match cli.name_template.clone() {
+        Some(template) => Some(template),
+        None => config.name_template.as_deref()
+            .map(naming::parse_template)
+            .transpose()
+            .map_err(|e| anyhow::anyhow!("Invalid \"name_template\" in config: {}", e))
+            .context(AppError::Config)?,
+    };
+    
+    // A typo in one selector shouldn't stop annadl; the built-in selectors still apply
+    let mut selectors = config.custom_selectors();
+    for selector in selectors.take_invalid() {
+        warnings.warn(&format!("ignoring invalid CSS selector {:?} in config", selector));
+    }
+    
+    if let (Some(min), Some(max)) = (cli.min_year, cli.max_year) {
+        if min > max {
+            anyhow::bail!("--min-year {} is after --max-year {}", min, max);
         }
-    } else {
-        // No query provided, run TUI
-        run_tui(config, download_path).await?;
+    }
+    
+    let filters = scraper::SearchFilters {
+        format: config.format_filter(cli.format.clone()),
+        language: config.language_filter(cli.language.clone()),
+        min_year: cli.min_year,
+        max_year: cli.max_year,
+        include_unknown_year: cli.include_unknown_year,
+        sort: cli.sort,
+        extra_params: cli.params.clone(),
+        ..Default::default()
+    };
+    
+    let network = network::NetworkOptions {
+        retries: config.retries(cli.retries),
+        verbose: cli.verbose,
+        sources: config.source_filter(),
+        selectors,
+        mirror: cli.mirror.clone(),
+        connections: cli.connections as usize,
+        stall_timeout: config.stall_timeout(cli.stall_timeout),
+        connect_timeout: config.connect_timeout(cli.connect_timeout),
+        prefetch,
+        temp_dir: config.temp_dir(cli.temp_dir.clone()),
+        on_conflict: cli.on_conflict.or(config.on_conflict),
+        name_template,
+        date_folders: cli.date_folders.unwrap_or(config.date_folders),
+        insecure: cli.insecure,
+        user_agent: config.user_agent(cli.user_agent.clone()),
+        ipfs_gateway: config.ipfs_gateway.clone(),
+        post_download: config.post_download(cli.post_download.clone(), cli.post_download_required),
+        verify_retry: cli.verify_retry || config.verify_retry,
+        tape: match (cli.record.clone(), cli.replay.clone()) {
+            (Some(dir), _) => Some(tape::Tape::Record(dir)),
+            (None, Some(dir)) => Some(tape::Tape::Replay(dir)),
+            (None, None) => None,
+        },
+    };
+    
+    // Loaded next to the config file, so --config-file keeps a separate history
+    let history = history::History::load(&config).unwrap_or_default();
+    
+    match cli.command {
+        Some(Commands::Search { query, json, export }) => {
+            let query = match query {
+                Some(query) => query,
+                None => stdin_query().await?
+                    .ok_or_else(|| anyhow::anyhow!("No search query; pass one, e.g. annadl search \"dune\", or pipe it on stdin"))?,
+            };
+            return with_deadline(cli.deadline, run_search(query, num_results, filters, json, export, cli.quiet, &network)).await;
+        }
+        Some(Commands::Get { target, json }) => {
+            let (download_path, output_name) = resolve_output(cli.output.as_deref(), download_path)?;
+            let out = if json { Output::Json } else { Output::new(cli.stdout, cli.quiet) };
+            let result = with_deadline(cli.deadline, run_get(target, download_path, output_name, out, cli.stdout, history, &network)).await;
+            // The error line replaces main's "Error: ..." so stderr stays pure JSON
+            if let (Output::Json, Err(e)) = (out, &result) {
+                ui::progress::JsonEvent::Error { message: format!("{:#}", e), exit_code: error::exit_code(e) }.emit();
+                std::process::exit(error::exit_code(e));
+            }
+            return result;
+        }
+        Some(Commands::GetList { file, continue_on_error }) => {
+            let options = ListOptions {
+                download_path,
+                filters,
+                format_priority: config.format_priority(cli.format_priority.clone()),
+                skip_existing: cli.skip_existing,
+                continue_on_error,
+                quiet: cli.quiet,
+                history,
+                network,
+            };
+            return with_deadline(cli.deadline, run_get_list(file, options)).await;
+        }
+        Some(Commands::Version { .. }) | None => {}
+    }
+    
+    let search_query = match cli.search_query.clone() {
+        Some(query) => Some(query),
+        None if !cli.interactive => stdin_query().await?,
+        None => None,
+    };
+    
+    // No query provided, or -i: run the TUI if this terminal can show it
+    if search_query.is_none() || cli.interactive {
+        let term = std::env::var("TERM").ok();
+        match (tui_unsupported(io::stdin().is_terminal(), io::stdout().is_terminal(), term.as_deref()), &search_query) {
+            (None, _) => return run_tui(config, download_path, num_results, network).await,
+            (Some(reason), None) => anyhow::bail!(
+                "The interactive UI can't run here ({}). Pass a query instead, e.g. annadl search \"dune\"",
+                reason
+            ),
+            (Some(reason), Some(_)) => {
+                if !cli.quiet {
+                    eprintln!("Note: the interactive UI can't run here ({}); continuing without it", reason);
+                }
+            }
+        }
+    }
+    
+    if let Some(query) = search_query {
+        let (download_path, output_name) = resolve_output(cli.output.as_deref(), download_path)?;
+        let options = NonInteractiveOptions {
+            num_results,
+            download_path,
+            output_name,
+            filters,
+            to_stdout: cli.stdout,
+            quiet: cli.quiet,
+            skip_existing: cli.skip_existing,
+            cite: cli.cite,
+            history,
+            network,
+        };
+        with_deadline(cli.deadline, run_non_interactive(query, options)).await?;
     }
     
     Ok(())
 }
 
-async fn run_tui(config: config::Config, download_path: PathBuf) -> Result<()> {
+// `echo dune | annadl`: without a query argument, a piped stdin's first line is the query.
+// None when stdin is a terminal (the TUI's job) or sends nothing.
+async fn stdin_query() -> Result<Option<String>> {
+    if io::stdin().is_terminal() {
+        return Ok(None);
+    }
+    
+    let line = read_line_unbuffered(&mut tokio::io::stdin()).await
+        .context("Failed to read the query from stdin")?;
+    Ok(Some(line).filter(|line| !line.trim().is_empty()))
+}
+
+// One byte at a time, so the book number on the next line is still there for the prompt
+async fn read_line_unbuffered<R: AsyncRead + Unpin>(reader: &mut R) -> Result<String> {
+    let mut line = Vec::new();
+    let mut byte = [0u8; 1];
+    while reader.read(&mut byte).await? == 1 && byte[0] != b'\n' {
+        line.push(byte[0]);
+    }
+    Ok(String::from_utf8_lossy(&line).trim_end_matches('\r').to_string())
+}
+
+// Why the TUI can't be drawn, if it can't: it needs a real terminal for keys and the alternate screen
+fn tui_unsupported(stdin_tty: bool, stdout_tty: bool, term: Option<&str>) -> Option<&'static str> {
+    if !stdout_tty {
+        Some("stdout is not a terminal")
+    } else if !stdin_tty {
+        Some("stdin is not a terminal")
+    } else if term == Some("dumb") {
+        Some("TERM=dumb")
+    } else {
+        None
+    }
+}
+
+// Dropping the run on timeout or Ctrl+C cancels in-flight requests, and the downloader removes
+// the partial file
+async fn with_deadline<F>(deadline: Option<u64>, run: F) -> Result<()>
+where
+    F: std::future::Future<Output = Result<()>>,
+{
+    let timed = async {
+        match deadline {
+            Some(secs) => tokio::time::timeout(Duration::from_secs(secs), run)
+                .await
+                .map_err(|_| AppError::Deadline(secs))?,
+            None => run.await,
+        }
+    };
+    
+    let ctrl_c = async {
+        // Without a handler, keep the default behaviour rather than "interrupting" at once
+        if tokio::signal::ctrl_c().await.is_err() {
+            std::future::pending::<()>().await;
+        }
+    };
+    
+    until_interrupted(ctrl_c, timed).await
+}
+
+async fn until_interrupted<I, F>(interrupt: I, run: F) -> Result<()>
+where
+    I: std::future::Future<Output = ()>,
+    F: std::future::Future<Output = Result<()>>,
+{
+    tokio::select! {
+        result = run => result,
+        _ = interrupt => Err(AppError::Interrupted.into()),
+    }
+}
+
+async fn run_tui(config: config::Config, download_path: PathBuf, num_results: usize, network: network::NetworkOptions) -> Result<()> {
     setup_terminal()?;
     
-    let result = run_app(config, download_path).await;
+    let result = run_app(config, download_path, num_results, network).await;
     
     restore_terminal()?;
     
-    result
+    let mut app = result?;
+    for line in &app.debug_log {
+        eprintln!("[debug] {}", line);
+    }
+    if let Err(e) = app.save_ui_prefs() {
+        eprintln!("Warning: failed to save UI preferences: {:#}", e);
+    }
+    println!("{}", app.stats.summary());
+    Ok(())
 }
 
-async fn run_app(config: config::Config, download_path: PathBuf) -> Result<()> {
+async fn run_app(config: config::Config, download_path: PathBuf, num_results: usize, network: network::NetworkOptions) -> Result<ui::App> {
     let backend = CrosstermBackend::new(io::stdout());
     let mut terminal = Terminal::new(backend)?;
     
     let mut app = ui::App::new(config, download_path);
+    // -n sets the first search's size; + and - adjust it from there
+    app.num_results = num_results;
+    // Debug lines on stderr would tear the TUI; the app keeps its own and they are printed on exit
+    app.verbose = network.verbose;
+    app.network = network::NetworkOptions { verbose: false, ..network };
     
     // Process commands in background
     let mut command_rx = {
@@ -107,75 +631,82 @@ async fn run_app(config: config::Config, download_path: PathBuf) -> Result<()> {
     // Main loop
     loop {
         terminal.draw(|f| app.draw(f))?;
+        app.sync_cover(&mut terminal)?;
         
         // Check for commands
-        if let Ok(command) = command_rx.try_recv() {
+        while let Ok(command) = command_rx.try_recv() {
             match command {
-                ui::AppCommand::Search(query, filters, num_results) => {
-                    let scraper = scraper::AnnaScraper::new()?;
-                    match scraper.search(&query, &filters, num_results).await {
-                        Ok(books) => {
-                            app.books = books;
-                            app.mode = ui::AppMode::Results;
-                            app.selected_book_index = 0;
-                        }
-                        Err(e) => {
-                            app.error_message = format!("Search error: {}", e);
-                            app.mode = ui::AppMode::Error(app.error_message.clone());
-                        }
-                    }
-                }
-                ui::AppCommand::FetchDownloadLinks(book_url) => {
-                    let scraper = scraper::AnnaScraper::new()?;
-                    match scraper.get_book_details(&book_url).await {
-                        Ok(links) => {
-                            app.download_links = links;
-                            app.mode = ui::AppMode::DownloadSelection;
-                            app.download_link_index = 0;
-                        }
-                        Err(e) => {
-                            app.error_message = format!("Error fetching links: {}", e);
-                            app.mode = ui::AppMode::Error(app.error_message.clone());
-                        }
-                    }
-                }
-                ui::AppCommand::Download(url, _link_index) => {
-                    let downloader = downloader::Downloader::new(app.download_path.clone())?;
-                    match downloader.download(&url, None).await {
-                        Ok(path) => {
-                            app.downloading_message = format!("Download complete: {}", path.display());
-                            app.mode = ui::AppMode::Search;
-                            app.query.clear();
-                            app.books.clear();
-                            app.download_links.clear();
-                        }
-                        Err(e) => {
-                            app.error_message = format!("Download failed: {}", e);
-                            app.mode = ui::AppMode::Error(app.error_message.clone());
-                        }
-                    }
-                }
                 ui::AppCommand::ShowError(msg) => {
+                    app.loading_more = false;
                     app.error_message = msg;
                     app.mode = ui::AppMode::Error(app.error_message.clone());
                 }
                 ui::AppCommand::CompleteDownload(path) => {
-                    app.downloading_message = format!("✓ Downloaded to: {}", path.display());
-                    app.mode = ui::AppMode::Search;
+                    app.finish_download(path);
+                }
+                ui::AppCommand::SearchBatch(search_id, books) => {
+                    app.append_results(search_id, books);
+                }
+                ui::AppCommand::SearchComplete(search_id, books) => {
+                    app.finish_results(search_id, books);
+                }
+                ui::AppCommand::ResultsFiltered(count) => {
+                    app.show_no_results(Some(count));
+                }
+                ui::AppCommand::Offline => {
+                    app.loading_more = false;
+                    app.show_offline();
+                }
+                ui::AppCommand::LinksFetched(links, metadata) => {
+                    app.book_metadata = metadata;
+                    app.set_links(links);
+                }
+                ui::AppCommand::LinksRefreshed(links, metadata) => {
+                    app.apply_refreshed_links(links, metadata);
+                }
+                ui::AppCommand::LinksRefreshFailed(message) => {
+                    app.refresh_failed(message);
+                }
+                ui::AppCommand::DownloadProgress(progress) => {
+                    app.download_progress = progress;
+                }
+                ui::AppCommand::QueueItemFinished(index, result) => {
+                    app.finish_queue_item(index, result);
+                }
+                ui::AppCommand::PostDownloadFailed(message) => {
+                    app.post_download_failed(message);
+                }
+                ui::AppCommand::CoverLoaded(url, cover) => {
+                    app.cover_loaded(url, cover);
+                }
+                ui::AppCommand::LinksPrefetched(search_id, url, result) => {
+                    app.links_prefetched(search_id, url, result);
                 }
             }
         }
         
-        // Handle input
-        if let Event::Key(key) = crossterm::event::read()? {
-            match app.handle_keypress(key).await? {
-                ui::ControlFlow::Exit => break,
-                ui::ControlFlow::Continue => continue,
+        app.tick = app.tick.wrapping_add(1);
+        
+        // Handle input without blocking so background progress keeps rendering
+        if crossterm::event::poll(Duration::from_millis(100))? {
+            if let Event::Key(key) = crossterm::event::read()? {
+                match app.handle_keypress(key).await? {
+                    ui::ControlFlow::Exit => break,
+                    ui::ControlFlow::Continue => continue,
+                }
             }
         }
     }
     
-    Ok(())
+    Ok(app)
+}
+
+fn list_or(items: &[String], empty: &str) -> String {
+    if items.is_empty() {
+        empty.to_string()
+    } else {
+        items.join(", ")
+    }
 }
 
 fn setup_terminal() -> Result<()> {
@@ -192,39 +723,86 @@ fn restore_terminal() -> Result<()> {
     Ok(())
 }
 
-async fn run_non_interactive(query: String, num_results: usize, download_path: PathBuf) -> Result<()> {
-    println!("🔍 Searching for: {}", query);
+// Splits -o into the directory to save in and an optional file name;
+// a bare name lands in the download path, an existing directory keeps the generated name
+fn resolve_output(output: Option<&std::path::Path>, download_path: PathBuf) -> Result<(PathBuf, Option<String>)> {
+    let output = match output {
+        Some(output) => config::expand_path(output),
+        None => return Ok((download_path, None)),
+    };
+    
+    let raw = output.to_string_lossy();
+    if output.is_dir() || raw.ends_with('/') || raw.ends_with(std::path::MAIN_SEPARATOR) {
+        return Ok((output, None));
+    }
+    
+    let name = match output.file_name() {
+        Some(name) => downloader::sanitize_filename(&name.to_string_lossy()),
+        None => anyhow::bail!("Invalid --output path '{}': expected a file name or directory", output.display()),
+    };
+    
+    let dir = match output.parent() {
+        Some(parent) if !parent.as_os_str().is_empty() => parent.to_path_buf(),
+        _ => download_path,
+    };
+    
+    Ok((dir, Some(name)))
+}
+
+struct NonInteractiveOptions {
+    num_results: usize,
+    download_path: PathBuf,
+    output_name: Option<String>,
+    filters: scraper::SearchFilters,
+    to_stdout: bool,
+    quiet: bool,
+    skip_existing: bool,
+    cite: Option<citation::CitationStyle>,
+    history: history::History,
+    network: network::NetworkOptions,
+}
+
+async fn run_non_interactive(query: String, options: NonInteractiveOptions) -> Result<()> {
+    let NonInteractiveOptions {
+        num_results,
+        download_path,
+        output_name,
+        filters,
+        to_stdout,
+        quiet,
+        skip_existing,
+        cite,
+        mut history,
+        network,
+    } = options;
+    let out = Output::new(to_stdout, quiet);
+    
+    let query = scraper::normalize_query(&query)
+        .ok_or_else(|| anyhow::anyhow!("Search query is empty; please provide some search terms"))?;
     
-    let scraper = scraper::AnnaScraper::new()
+    status!(out, "🔍 Searching for: {}", query);
+    
+    let mut stats = stats::SessionStats::new();
+    let scraper = network.scraper()
         .context("Failed to create scraper")?;
     
-    let books = scraper.search(&query, &scraper::SearchFilters::default(), num_results)
+    let books = scraper.search(&query, &filters, num_results)
         .await
         .context("Search failed")?;
+    stats.record_search();
     
     if books.is_empty() {
-        println!("❌ No results found");
-        return Ok(());
+        return Err(AppError::NoResults.into());
     }
     
-    println!("\n📚 Found {} results:\n", books.len());
-    
-    for (i, book) in books.iter().enumerate() {
-        println!("  {}. {}", i + 1, book.title);
-        println!("     Author: {}", book.author.as_deref().unwrap_or("Unknown"));
-        println!("     Year: {} | Language: {} | Format: {} | Size: {}",
-            book.year.as_deref().unwrap_or("Unknown"),
-            book.language.as_deref().unwrap_or("Unknown"),
-            book.format.as_deref().unwrap_or("Unknown"),
-            book.size.as_deref().unwrap_or("Unknown")
-        );
-        println!();
-    }
+    status!(out, "\n📚 Found {} results:\n", books.len());
+    print_books(&books, out);
     
-    println!("Select a book to download (1-{}), or press Ctrl+C to cancel:", books.len());
+    status!(out, "Select a book to download (1-{}), or press Ctrl+C to cancel:", books.len());
     
+    // Async, so Ctrl+C at the prompt is still noticed
     let mut input = String::new();
-    io::stdin().read_line(&mut input)?;
+    tokio::io::BufReader::new(tokio::io::stdin()).read_line(&mut input).await?;
     
     let selection: usize = input.trim().parse()
         .context("Invalid selection")?;
@@ -234,88 +812,815 @@ async fn run_non_interactive(query: String, num_results: usize, download_path: P
     }
     
     let selected_book = &books[selection - 1];
-    println!("\n🔗 Fetching download links for '{}'...", selected_book.title);
+    
+    if let Some(style) = cite {
+        let text = citation::format(selected_book, style);
+        println!("\n{}", text);
+        if clipboard::copy(&text).is_ok() && out != Output::Quiet {
+            eprintln!("📋 Citation copied to clipboard");
+        }
+        return Ok(());
+    }
+    
+    if let Some(entry) = selected_book.md5.as_deref().and_then(|md5| history.find(md5)) {
+        status!(out, "\nℹ️  Already downloaded to: {}", entry.path.display());
+        if skip_existing {
+            status!(out, "Skipping (--skip-existing)");
+            out.saved_path(&entry.path);
+            return Ok(());
+        }
+    }
+    status!(out, "\n🔗 Fetching download links for '{}'...", selected_book.title);
     
     let download_links = scraper.get_book_details(&selected_book.url)
         .await
         .context("Failed to fetch download links")?;
+    stats.record_view();
     
     if download_links.is_empty() {
-        println!("❌ No download links found");
-        return Ok(());
+        return Err(AppError::NoDownloadLinks.into());
     }
     
-    println!("\n📥 Available download links:\n");
+    status!(out, "\n📥 Available download links:\n");
     
     for (i, link) in download_links.iter().enumerate() {
-        println!("  {}. {}", i + 1, link.text);
-        println!("     Source: {} | URL: {}", link.source, &link.url[..50.min(link.url.len())]);
+        status!(out, "  {}. {}", i + 1, link.text);
+        status!(out, "     Source: {} | URL: {}", link.source, scraper::truncate_chars(&link.url, scraper::LINK_URL_CHARS));
     }
     
     // Try to auto-select LibGen link
-    let selected_link = download_links.iter()
-        .find(|l| l.text.to_lowercase().contains("libgen"))
-        .or_else(|| download_links.first())
+    let selected_link = scraper::preferred_link(&download_links)
         .ok_or_else(|| anyhow::anyhow!("No download link available"))?;
     
-    println!("\n⬇️  Downloading from: {}...", selected_link.text);
+    status!(out, "\n⬇️  Downloading from: {}...", selected_link.text);
+    
+    // An explicit -o name wins over the template, folders included
+    let (download_path, filename) = match output_name {
+        Some(name) => (download_path, name),
+        None => {
+            let (folder, name) = network.book_path(selected_book);
+            (download_path.join(folder), name)
+        }
+    };
     
-    let downloader = downloader::Downloader::new(download_path)
+    let downloader = network.downloader(download_path)
         .context("Failed to create downloader")?;
     
-    let filename = format!(
-        "{} - {}",
-        selected_book.title.chars().take(50).collect::<String>(),
-        selected_book.author.as_deref().unwrap_or("Unknown")
-    );
+    if to_stdout {
+        let pb = out.progress_bar();
+        pb.set_message(format!("Streaming {}", filename));
+        
+        let mut stdout = tokio::io::stdout();
+        let written = downloader.download_to(&selected_link.url, &mut stdout, |progress| {
+            downloader::Downloader::update_progress_bar(&pb, &progress);
+        })
+            .await
+            .context(AppError::Download)?;
+        
+        pb.finish_and_clear();
+        stats.record_download(written);
+        status!(out, "\n✅ Streamed {} bytes to stdout", written);
+        status!(out, "{}", stats.summary());
+        return Ok(());
+    }
     
-    let path = downloader.download(&selected_link.url, Some(&filename))
-        .await
-        .context("Download failed")?;
+    let path = match save_links(out, &network, &downloader, &download_links, Some(&filename), selected_book.md5.as_deref()).await? {
+        downloader::Saved::Written(path) => path,
+        downloader::Saved::Skipped(path) => {
+            status!(out, "\n⏭️  Already there, skipped: {}", path.display());
+            out.saved_path(&path);
+            return Ok(());
+        }
+    };
+    stats.record_download(stats::file_size(&path));
+    
+    if let Some(md5) = selected_book.md5.as_deref() {
+        if let Err(e) = history.record(md5, &selected_book.title, &path) {
+            out.warn(&format!("failed to update download history: {:#}", e));
+        }
+    }
+    run_post_download(out, &network, &path, Some(selected_book)).await?;
     
-    println!("\n✅ Download complete: {}", path.display());
+    status!(out, "\n✅ Download complete: {}", path.display());
+    status!(out, "{}", stats.summary());
+    out.saved_path(&path);
     
     Ok(())
 }
 
-#[derive(Debug, thiserror::Error)]
-enum AppError {
-    #[error("IO error: {0}")]
-    Io(#[from] std::io::Error),
+// Saves to disk, with a progress bar unless --quiet
+async fn save(out: Output, downloader: &downloader::Downloader, url: &str, filename: Option<&str>) -> Result<downloader::Saved> {
+    match out {
+        Output::Quiet => downloader.download(url, filename).await,
+        Output::Json => {
+            let mut reporter = ui::progress::JsonProgress::default();
+            downloader.download_with_progress(url, filename, |progress| reporter.report(&progress)).await
+        }
+        _ => ui::progress::download_with_bar(downloader, url, filename).await,
+    }
 }
 
-#[cfg(test)]
-mod tests {
-    use super::*;
-    use clap::CommandFactory;
-
-    #[test]
-    fn test_cli_parse_no_args() {
-        let cli = Cli::try_parse_from(&["annadl"]).unwrap();
-        assert!(cli.search_query.is_none());
-        assert_eq!(cli.num_results, 5);
-        assert!(!cli.interactive);
-        assert!(!cli.config);
+// Saves the preferred link. With --verify-retry and a known md5, each file is checked and a
+// mismatch is deleted before the next link is tried, in source-priority order; a link whose
+// transfer fails is passed over the same way.
+async fn save_links(
+    out: Output,
+    network: &network::NetworkOptions,
+    downloader: &downloader::Downloader,
+    links: &[scraper::DownloadLink],
+    filename: Option<&str>,
+    md5: Option<&str>,
+) -> Result<downloader::Saved> {
+    let md5 = match md5.filter(|_| network.verify_retry) {
+        Some(md5) => md5,
+        None => {
+            let link = scraper::preferred_link(links).ok_or(AppError::NoDownloadLinks)?;
+            return save(out, downloader, &link.url, filename).await.context(AppError::Download);
+        }
+    };
+    
+    let ranked = scraper::links_by_priority(links);
+    let mut mismatches = 0;
+    let mut last_error = None;
+    for (i, link) in ranked.iter().enumerate() {
+        if i > 0 {
+            status!(out, "⬇️  Trying the next link: {}...", link.text);
+        }
+        let path = match save(out, downloader, &link.url, filename).await {
+            Ok(downloader::Saved::Written(path)) => path,
+            // --on-conflict skip kept a file that was already there: not this link's to check or delete
+            Ok(skipped) => return Ok(skipped),
+            Err(e) => {
+                out.warn(&format!("{} ({}) failed: {:#}", link.text, link.source, e));
+                last_error = Some(e);
+                continue;
+            }
+        };
+        
+        let actual = downloader::file_md5(&path).await.context(AppError::Download)?;
+        if actual.eq_ignore_ascii_case(md5) {
+            status!(out, "🔒 MD5 verified; the file came from {} ({})", link.source, link.text);
+            return Ok(downloader::Saved::Written(path));
+        }
+        mismatches += 1;
+        status!(out, "⚠️  {} ({}) sent a file with md5 {}, expected {}; deleting it", link.text, link.source, actual, md5.to_lowercase());
+        if let Err(e) = std::fs::remove_file(&path) {
+            out.warn(&format!("failed to delete {}: {}", path.display(), e));
+        }
     }
-
-    #[test]
-    fn test_cli_parse_search_query() {
-        let cli = Cli::try_parse_from(&["annadl", "rust programming"]).unwrap();
-        assert_eq!(cli.search_query, Some("rust programming".to_string()));
-        assert_eq!(cli.num_results, 5);
+    
+    // Only transfer failures: report the last one rather than a checksum nobody computed
+    match last_error {
+        Some(e) if mismatches == 0 => Err(e.context(AppError::Download)),
+        _ => Err(AppError::ChecksumMismatch(ranked.len()).into()),
     }
+}
 
-    #[test]
-    fn test_cli_parse_num_results_short() {
-        let cli = Cli::try_parse_from(&["annadl", "test", "-n", "10"]).unwrap();
-        assert_eq!(cli.num_results, 10);
+fn print_books(books: &[scraper::Book], out: Output) {
+    for (i, book) in books.iter().enumerate() {
+        status!(out, "  {}. {}", i + 1, book.title);
+        status!(out, "     Author: {}", book.author.as_deref().unwrap_or("Unknown"));
+        status!(out, "     Year: {} | Language: {} | Format: {} | Size: {}",
+            book.year.as_deref().unwrap_or("Unknown"),
+            book.language.as_deref().map(scraper::language_name).unwrap_or("Unknown"),
+            book.format.as_deref().unwrap_or("Unknown"),
+            book.size.as_deref().unwrap_or("Unknown")
+        );
+        if let Some(md5) = book.md5.as_deref() {
+            status!(out, "     MD5: {}", md5);
+        }
+        status!(out, "");
     }
+}
 
-    #[test]
-    fn test_cli_parse_num_results_long() {
-        let cli = Cli::try_parse_from(&["annadl", "test", "--num-results", "20"]).unwrap();
-        assert_eq!(cli.num_results, 20);
-    }
+async fn run_search(
+    query: String,
+    num_results: usize,
+    filters: scraper::SearchFilters,
+    json: bool,
+    export_path: Option<PathBuf>,
+    quiet: bool,
+    network: &network::NetworkOptions,
+) -> Result<()> {
+    let query = scraper::normalize_query(&query)
+        .ok_or_else(|| anyhow::anyhow!("Search query is empty; please provide some search terms"))?;
+    
+    let scraper = network.scraper()
+        .context("Failed to create scraper")?;
+    
+    let books = scraper.search(&query, &filters, num_results)
+        .await
+        .context("Search failed")?;
+    
+    if books.is_empty() {
+        return Err(AppError::NoResults.into());
+    }
+    
+    if let Some(path) = export_path {
+        export::write(&path, &books)?;
+        if !quiet {
+            eprintln!("💾 Exported {} results to {}", books.len(), path.display());
+        }
+    }
+    
+    // The results are this command's output, so --quiet only drops the header
+    if json {
+        println!("{}", export::to_json(&books)?);
+    } else {
+        if !quiet {
+            println!("📚 Found {} results for: {}\n", books.len(), query);
+        }
+        print_books(&books, Output::Stdout);
+    }
+    
+    Ok(())
+}
+
+async fn run_get(
+    target: String,
+    download_path: PathBuf,
+    output_name: Option<String>,
+    out: Output,
+    to_stdout: bool,
+    mut history: history::History,
+    network: &network::NetworkOptions,
+) -> Result<()> {
+    let url = scraper::detail_url(&target)
+        .ok_or_else(|| anyhow::anyhow!("Expected a 32-character md5 or a detail page URL, got '{}'", target))?;
+    
+    let scraper = network.scraper()
+        .context("Failed to create scraper")?;
+    
+    status!(out, "🔗 Fetching download links for {}...", url);
+    
+    let mut stats = stats::SessionStats::new();
+    let download_links = scraper.get_book_details(&url)
+        .await
+        .context("Failed to fetch download links")?;
+    stats.record_view();
+    
+    let selected_link = scraper::preferred_link(&download_links)
+        .ok_or(AppError::NoDownloadLinks)?;
+    
+    status!(out, "⬇️  Downloading from: {}...", selected_link.text);
+    
+    let downloader = network.downloader(download_path)
+        .context("Failed to create downloader")?;
+    
+    if to_stdout {
+        let pb = out.progress_bar();
+        let mut reporter = ui::progress::JsonProgress::default();
+        let mut stdout = tokio::io::stdout();
+        let written = downloader.download_to(&selected_link.url, &mut stdout, |progress| {
+            match out {
+                Output::Json => reporter.report(&progress),
+                _ => downloader::Downloader::update_progress_bar(&pb, &progress),
+            }
+        })
+            .await
+            .context(AppError::Download)?;
+        
+        pb.finish_and_clear();
+        stats.record_download(written);
+        status!(out, "\n✅ Streamed {} bytes to stdout", written);
+        status!(out, "{}", stats.summary());
+        if out == Output::Json {
+            ui::progress::JsonEvent::Complete { path: None, bytes: written }.emit();
+        }
+        return Ok(());
+    }
+    
+    let path = match save_links(out, network, &downloader, &download_links, output_name.as_deref(), scraper::extract_md5(&url).as_deref()).await? {
+        downloader::Saved::Written(path) => path,
+        downloader::Saved::Skipped(path) => {
+            status!(out, "\n⏭️  Already there, skipped: {}", path.display());
+            out.saved_path(&path);
+            return Ok(());
+        }
+    };
+    stats.record_download(stats::file_size(&path));
+    
+    if let Some(md5) = scraper::extract_md5(&url) {
+        let title = path.file_name()
+            .map(|n| n.to_string_lossy().to_string())
+            .unwrap_or_else(|| md5.clone());
+        if let Err(e) = history.record(&md5, &title, &path) {
+            out.warn(&format!("failed to update download history: {:#}", e));
+        }
+    }
+    run_post_download(out, network, &path, None).await?;
+    
+    status!(out, "\n✅ Download complete: {}", path.display());
+    status!(out, "{}", stats.summary());
+    out.saved_path(&path);
+    
+    Ok(())
+}
+
+// One query per line; blank lines and lines starting with # are ignored
+fn parse_query_list(contents: &str) -> Vec<String> {
+    contents.lines()
+        .map(str::trim)
+        .filter(|line| !line.is_empty() && !line.starts_with('#'))
+        .map(str::to_string)
+        .collect()
+}
+
+struct ListOptions {
+    download_path: PathBuf,
+    filters: scraper::SearchFilters,
+    format_priority: Vec<String>,
+    skip_existing: bool,
+    continue_on_error: bool,
+    quiet: bool,
+    history: history::History,
+    network: network::NetworkOptions,
+}
+
+enum ListOutcome {
+    Downloaded(PathBuf),
+    Skipped(PathBuf),
+}
+
+async fn run_get_list(file: PathBuf, options: ListOptions) -> Result<()> {
+    let ListOptions {
+        download_path,
+        filters,
+        format_priority,
+        skip_existing,
+        continue_on_error,
+        quiet,
+        mut history,
+        network,
+    } = options;
+    let out = Output::new(false, quiet);
+    
+    let contents = std::fs::read_to_string(&file)
+        .with_context(|| format!("Failed to read query list {}", file.display()))?;
+    let queries = parse_query_list(&contents);
+    if queries.is_empty() {
+        anyhow::bail!("No queries found in {}", file.display());
+    }
+    
+    let scraper = network.scraper()
+        .context("Failed to create scraper")?;
+    let mut stats = stats::SessionStats::new();
+    let mut names = naming::BatchNames::default();
+    
+    let mut outcomes: Vec<(String, Result<ListOutcome>)> = Vec::new();
+    for (i, query) in queries.iter().enumerate() {
+        status!(out, "[{}/{}] 🔍 {}", i + 1, queries.len(), query);
+        
+        let outcome = download_top_result(query, &scraper, &network, &download_path, &filters, &format_priority, &mut history, &mut names, skip_existing, out, &mut stats).await;
+        match &outcome {
+            Ok(ListOutcome::Downloaded(path)) => {
+                status!(out, "  ✅ {}", path.display());
+                out.saved_path(path);
+            }
+            Ok(ListOutcome::Skipped(path)) => {
+                status!(out, "  ⏭️  Already downloaded: {}", path.display());
+                out.saved_path(path);
+            }
+            Err(e) => eprintln!("  ❌ {}: {:#}", query, e),
+        }
+        
+        let failed = outcome.is_err();
+        outcomes.push((query.clone(), outcome));
+        if failed && !continue_on_error {
+            break;
+        }
+    }
+    
+    status!(out, "\n{}", list_summary(&outcomes, queries.len()));
+    status!(out, "{}", stats.summary());
+    
+    if continue_on_error {
+        return Ok(());
+    }
+    
+    // Without --continue-on-error the run stopped at its only failure, whose exit code we keep
+    match outcomes.pop() {
+        Some((query, Err(e))) => Err(e.context(format!("Query '{}' failed", query))),
+        _ => Ok(()),
+    }
+}
+
+// How far down the results --format-priority looks for a better format
+const FORMAT_PRIORITY_CANDIDATES: usize = 10;
+
+async fn download_top_result(
+    query: &str,
+    scraper: &scraper::AnnaScraper,
+    network: &network::NetworkOptions,
+    download_path: &std::path::Path,
+    filters: &scraper::SearchFilters,
+    format_priority: &[String],
+    history: &mut history::History,
+    names: &mut naming::BatchNames,
+    skip_existing: bool,
+    out: Output,
+    stats: &mut stats::SessionStats,
+) -> Result<ListOutcome> {
+    let query = scraper::normalize_query(query)
+        .ok_or_else(|| anyhow::anyhow!("Search query is empty"))?;
+    
+    // The configured format and language filters do the selecting; the top match wins, unless
+    // a format priority looks further down for a better format
+    let candidates = if format_priority.is_empty() { 1 } else { FORMAT_PRIORITY_CANDIDATES };
+    let books = scraper.search(&query, filters, candidates)
+        .await
+        .context("Search failed")?;
+    stats.record_search();
+    let book = scraper::pick_by_format(&books, format_priority).ok_or(AppError::NoResults)?;
+    if let Some(rank) = books.iter().position(|b| std::ptr::eq(b, book)).filter(|&rank| rank > 0) {
+        status!(out, "  📘 Taking result #{} for its format ({})", rank + 1, book.format.as_deref().unwrap_or("unknown"));
+    }
+    
+    if skip_existing {
+        if let Some(entry) = book.md5.as_deref().and_then(|md5| history.find(md5)) {
+            return Ok(ListOutcome::Skipped(entry.path.clone()));
+        }
+    }
+    
+    let links = scraper.get_book_details(&book.url)
+        .await
+        .context("Failed to fetch download links")?;
+    stats.record_view();
+    if links.is_empty() {
+        return Err(AppError::NoDownloadLinks.into());
+    }
+    
+    // Per book, since a name template can put each one in its own folder
+    let (folder, name) = network.book_path(book);
+    let name = names.unique(&folder, &name, book);
+    let downloader = network.downloader(download_path.join(folder))
+        .context("Failed to create downloader")?;
+    let path = match save_links(out, network, &downloader, &links, Some(&name), book.md5.as_deref()).await? {
+        downloader::Saved::Written(path) => path,
+        downloader::Saved::Skipped(path) => return Ok(ListOutcome::Skipped(path)),
+    };
+    stats.record_download(stats::file_size(&path));
+    
+    if let Some(md5) = book.md5.as_deref() {
+        if let Err(e) = history.record(md5, &book.title, &path) {
+            out.warn(&format!("failed to update download history: {:#}", e));
+        }
+    }
+    run_post_download(out, network, &path, Some(book)).await?;
+    
+    Ok(ListOutcome::Downloaded(path))
+}
+
+// Only a required command's failure fails the download; the file is kept either way.
+// The command's own output is shown with -v, but never among --json events.
+async fn run_post_download(out: Output, network: &network::NetworkOptions, path: &std::path::Path, book: Option<&scraper::Book>) -> Result<()> {
+    let verbose = network.verbose && out != Output::Json;
+    let warning = hook::after_download(network.post_download.as_ref(), path, book, verbose)
+        .await
+        .context(AppError::Download)?;
+    if let Some(warning) = warning {
+        out.warn(&warning);
+    }
+    Ok(())
+}
+
+fn list_summary(outcomes: &[(String, Result<ListOutcome>)], total: usize) -> String {
+    let downloaded = outcomes.iter().filter(|(_, o)| matches!(o, Ok(ListOutcome::Downloaded(_)))).count();
+    let skipped = outcomes.iter().filter(|(_, o)| matches!(o, Ok(ListOutcome::Skipped(_)))).count();
+    let failed: Vec<_> = outcomes.iter()
+        .filter_map(|(query, o)| o.as_ref().err().map(|e| (query, e)))
+        .collect();
+    
+    let mut summary = format!("📋 {} downloaded, {} skipped, {} failed", downloaded, skipped, failed.len());
+    if outcomes.len() < total {
+        summary.push_str(&format!(", {} not attempted", total - outcomes.len()));
+    }
+    for (query, e) in failed {
+        summary.push_str(&format!("\n  ❌ {}: {:#}", query, e));
+    }
+    summary
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use anna_dl::test_support::{http_response, http_response_with, serve_once};
+    use clap::CommandFactory;
+
+    #[test]
+    fn test_cli_parse_no_args() {
+        let cli = Cli::try_parse_from(&["annadl"]).unwrap();
+        assert!(cli.search_query.is_none());
+        assert_eq!(cli.num_results, 5);
+        assert!(!cli.interactive);
+        assert!(!cli.config);
+        assert!(!cli.stdout);
+    }
+
+    #[test]
+    fn test_cli_parse_output() {
+        let cli = Cli::try_parse_from(&["annadl", "dune", "-o", "dune.epub"]).unwrap();
+        assert_eq!(cli.output, Some(PathBuf::from("dune.epub")));
+        assert!(Cli::try_parse_from(&["annadl", "dune", "-o", "dune.epub", "--stdout"]).is_err());
+    }
+
+    #[test]
+    fn test_resolve_output() {
+        let downloads = PathBuf::from("/books");
+        assert_eq!(resolve_output(None, downloads.clone()).unwrap(), (downloads.clone(), None));
+        
+        // A bare name goes into the download path; content type may still add an extension
+        assert_eq!(
+            resolve_output(Some(std::path::Path::new("dune")), downloads.clone()).unwrap(),
+            (downloads.clone(), Some("dune".to_string()))
+        );
+        assert_eq!(
+            resolve_output(Some(std::path::Path::new("/tmp/sub/what?.pdf")), downloads.clone()).unwrap(),
+            (PathBuf::from("/tmp/sub"), Some("what_.pdf".to_string()))
+        );
+        
+        let dir = std::env::temp_dir();
+        assert_eq!(resolve_output(Some(&dir), downloads.clone()).unwrap(), (dir, None));
+        assert_eq!(
+            resolve_output(Some(std::path::Path::new("/tmp/new-dir/")), downloads.clone()).unwrap(),
+            (PathBuf::from("/tmp/new-dir/"), None)
+        );
+        assert!(resolve_output(Some(std::path::Path::new("/annadl-missing/..")), downloads).is_err());
+    }
+
+    #[test]
+    fn test_cli_parse_format_priority() {
+        let cli = Cli::try_parse_from(&["annadl", "get-list", "books.txt", "--format-priority", "epub,pdf,mobi"]).unwrap();
+        assert_eq!(cli.format_priority, vec!["epub", "pdf", "mobi"]);
+        assert!(Cli::try_parse_from(&["annadl", "dune"]).unwrap().format_priority.is_empty());
+    }
+    
+    #[test]
+    fn test_cli_parse_retries() {
+        let cli = Cli::try_parse_from(&["annadl", "get", "0123456789abcdef0123456789abcdef", "--retries", "0"]).unwrap();
+        assert_eq!(cli.retries, Some(0));
+        assert_eq!(Cli::try_parse_from(&["annadl", "dune"]).unwrap().retries, None);
+    }
+
+    #[test]
+    fn test_cli_parse_connections() {
+        assert_eq!(Cli::try_parse_from(&["annadl", "dune"]).unwrap().connections, 1);
+        assert_eq!(Cli::try_parse_from(&["annadl", "get", "x", "--connections", "4"]).unwrap().connections, 4);
+        assert!(Cli::try_parse_from(&["annadl", "dune", "--connections", "0"]).is_err());
+        assert!(Cli::try_parse_from(&["annadl", "dune", "--connections", "17"]).is_err());
+    }
+
+    #[test]
+    fn test_cli_parse_record_and_replay() {
+        let cli = Cli::try_parse_from(&["annadl", "search", "dune", "--record", "/tmp/tape"]).unwrap();
+        assert_eq!(cli.record, Some(PathBuf::from("/tmp/tape")));
+        let cli = Cli::try_parse_from(&["annadl", "dune", "--replay", "/tmp/tape"]).unwrap();
+        assert_eq!(cli.replay, Some(PathBuf::from("/tmp/tape")));
+        assert!(Cli::try_parse_from(&["annadl", "dune", "--record", "a", "--replay", "b"]).is_err());
+    }
+
+    #[test]
+    fn test_cli_parse_verbose() {
+        assert!(!Cli::try_parse_from(&["annadl", "dune"]).unwrap().verbose);
+        assert!(Cli::try_parse_from(&["annadl", "search", "dune", "-v"]).unwrap().verbose);
+        assert!(Cli::try_parse_from(&["annadl", "--verbose", "dune"]).unwrap().verbose);
+    }
+
+    #[test]
+    fn test_tui_unsupported() {
+        assert_eq!(tui_unsupported(true, true, Some("xterm-256color")), None);
+        // Windows consoles don't set TERM
+        assert_eq!(tui_unsupported(true, true, None), None);
+        assert_eq!(tui_unsupported(true, false, Some("xterm")), Some("stdout is not a terminal"));
+        assert_eq!(tui_unsupported(false, true, Some("xterm")), Some("stdin is not a terminal"));
+        assert_eq!(tui_unsupported(true, true, Some("dumb")), Some("TERM=dumb"));
+    }
+
+    #[test]
+    fn test_cli_parse_insecure() {
+        assert!(Cli::try_parse_from(&["annadl", "dune", "--insecure"]).unwrap().insecure);
+        assert!(!Cli::try_parse_from(&["annadl", "dune"]).unwrap().insecure);
+    }
+
+    #[test]
+    fn test_cli_parse_name_template() {
+        let cli = Cli::try_parse_from(&["annadl", "dune", "--name-template", "{author}/{title}"]).unwrap();
+        assert_eq!(cli.name_template.as_deref(), Some("{author}/{title}"));
+        assert!(Cli::try_parse_from(&["annadl", "dune", "--name-template", "../{title}"]).is_err());
+        assert!(Cli::try_parse_from(&["annadl", "dune", "--name-template", "{publisher}"]).is_err());
+    }
+
+    #[test]
+    fn test_cli_parse_user_agent() {
+        let cli = Cli::try_parse_from(&["annadl", "dune", "--user-agent", "Mozilla/5.0 (test)"]).unwrap();
+        assert_eq!(cli.user_agent.as_deref(), Some("Mozilla/5.0 (test)"));
+        let cli = Cli::try_parse_from(&["annadl", "get", "abc", "--user-agent", ""]).unwrap();
+        assert_eq!(cli.user_agent.as_deref(), Some(""));
+        assert!(Cli::try_parse_from(&["annadl", "dune"]).unwrap().user_agent.is_none());
+    }
+
+    #[test]
+    fn test_cli_parse_date_folders() {
+        let cli = Cli::try_parse_from(&["annadl", "dune", "--date-folders", "daily"]).unwrap();
+        assert_eq!(cli.date_folders, Some(naming::DateFolders::Daily));
+        // "off" keeps a single run flat when the config groups by date
+        let cli = Cli::try_parse_from(&["annadl", "dune", "--date-folders", "off"]).unwrap();
+        assert_eq!(cli.date_folders, Some(naming::DateFolders::Off));
+        assert_eq!(Cli::try_parse_from(&["annadl", "dune"]).unwrap().date_folders, None);
+    }
+    
+    #[test]
+    fn test_cli_parse_on_conflict() {
+        let cli = Cli::try_parse_from(&["annadl", "dune", "--on-conflict", "rename"]).unwrap();
+        assert_eq!(cli.on_conflict, Some(downloader::ConflictPolicy::Rename));
+        assert_eq!(Cli::try_parse_from(&["annadl", "dune"]).unwrap().on_conflict, None);
+        assert!(Cli::try_parse_from(&["annadl", "dune", "--on-conflict", "ask"]).is_err());
+    }
+
+    #[test]
+    fn test_cli_parse_mirror() {
+        let cli = Cli::try_parse_from(&["annadl", "dune", "--mirror", "annas-archive.se"]).unwrap();
+        assert_eq!(cli.mirror.as_deref(), Some("https://annas-archive.se"));
+        assert_eq!(Cli::try_parse_from(&["annadl", "dune"]).unwrap().mirror, None);
+        assert!(Cli::try_parse_from(&["annadl", "dune", "--mirror", "not a host"]).is_err());
+    }
+
+    #[test]
+    fn test_cli_parse_year_range() {
+        let cli = Cli::try_parse_from(&["annadl", "dune", "--min-year", "1990", "--max-year", "2005", "--include-unknown-year"]).unwrap();
+        assert_eq!((cli.min_year, cli.max_year), (Some(1990), Some(2005)));
+        assert!(cli.include_unknown_year);
+        
+        let cli = Cli::try_parse_from(&["annadl", "dune"]).unwrap();
+        assert_eq!((cli.min_year, cli.max_year), (None, None));
+        assert!(!cli.include_unknown_year);
+        assert!(Cli::try_parse_from(&["annadl", "dune", "--min-year", "soon"]).is_err());
+    }
+
+    #[test]
+    fn test_cli_parse_temp_dir() {
+        let cli = Cli::try_parse_from(&["annadl", "dune", "--temp-dir", "/tmp/parts"]).unwrap();
+        assert_eq!(cli.temp_dir, Some(PathBuf::from("/tmp/parts")));
+        assert_eq!(Cli::try_parse_from(&["annadl", "dune"]).unwrap().temp_dir, None);
+    }
+
+    #[test]
+    fn test_cli_parse_stall_timeout() {
+        let cli = Cli::try_parse_from(&["annadl", "dune", "--stall-timeout", "120"]).unwrap();
+        assert_eq!(cli.stall_timeout, Some(120));
+        assert_eq!(Cli::try_parse_from(&["annadl", "dune"]).unwrap().stall_timeout, None);
+        assert!(Cli::try_parse_from(&["annadl", "dune", "--stall-timeout", "0"]).is_err());
+    }
+
+    #[test]
+    fn test_cli_parse_verify_retry() {
+        assert!(Cli::try_parse_from(&["annadl", "get", "0123456789abcdef0123456789abcdef", "--verify-retry"]).unwrap().verify_retry);
+        assert!(!Cli::try_parse_from(&["annadl", "dune"]).unwrap().verify_retry);
+    }
+    
+    #[test]
+    fn test_cli_parse_post_download() {
+        let cli = Cli::try_parse_from(&["annadl", "dune", "--post-download", "calibredb add {path}", "--post-download-required"]).unwrap();
+        assert_eq!(cli.post_download.as_deref(), Some("calibredb add {path}"));
+        assert!(cli.post_download_required);
+
+        let cli = Cli::try_parse_from(&["annadl", "dune"]).unwrap();
+        assert_eq!(cli.post_download, None);
+        assert!(!cli.post_download_required);
+    }
+
+    #[test]
+    fn test_cli_parse_connect_timeout() {
+        let cli = Cli::try_parse_from(&["annadl", "dune", "--connect-timeout", "5"]).unwrap();
+        assert_eq!(cli.connect_timeout, Some(5));
+        assert_eq!(Cli::try_parse_from(&["annadl", "dune"]).unwrap().connect_timeout, None);
+        assert!(Cli::try_parse_from(&["annadl", "dune", "--connect-timeout", "0"]).is_err());
+    }
+
+    #[test]
+    fn test_cli_parse_prefetch() {
+        assert_eq!(Cli::try_parse_from(&["annadl", "--prefetch", "0"]).unwrap().prefetch, Some(0));
+        assert_eq!(Cli::try_parse_from(&["annadl"]).unwrap().prefetch, None);
+    }
+
+    #[test]
+    fn test_cli_parse_sort() {
+        let cli = Cli::try_parse_from(&["annadl", "search", "dune", "--sort", "oldest"]).unwrap();
+        assert_eq!(cli.sort, Some(scraper::ServerSort::Oldest));
+
+        let cli = Cli::try_parse_from(&["annadl", "dune"]).unwrap();
+        assert_eq!(cli.sort, None);
+
+        assert!(Cli::try_parse_from(&["annadl", "dune", "--sort", "popular"]).is_err());
+    }
+
+    #[test]
+    fn test_cli_parse_params() {
+        let cli = Cli::try_parse_from(&["annadl", "search", "dune", "--param", "sort=newest", "--param", "src=lgli"]).unwrap();
+        assert_eq!(cli.params, [("sort".to_string(), "newest".to_string()), ("src".to_string(), "lgli".to_string())]);
+
+        assert!(Cli::try_parse_from(&["annadl", "dune", "--param", "sort"]).is_err());
+        assert!(Cli::try_parse_from(&["annadl", "dune", "--param", "a b=c"]).is_err());
+    }
+
+    #[test]
+    fn test_cli_parse_deadline() {
+        let cli = Cli::try_parse_from(&["annadl", "get", "0123456789abcdef0123456789abcdef", "--deadline", "30"]).unwrap();
+        assert_eq!(cli.deadline, Some(30));
+
+        let cli = Cli::try_parse_from(&["annadl", "dune"]).unwrap();
+        assert_eq!(cli.deadline, None);
+    }
+
+    #[tokio::test]
+    async fn test_with_deadline_aborts_slow_run() {
+        let err = with_deadline(Some(0), async {
+            tokio::time::sleep(Duration::from_secs(5)).await;
+            Ok(())
+        })
+            .await
+            .unwrap_err();
+        assert!(matches!(err.downcast_ref::<AppError>(), Some(AppError::Deadline(0))));
+        assert_eq!(error::exit_code(&err), error::EXIT_NETWORK);
+    }
+
+    #[tokio::test]
+    async fn test_until_interrupted_cancels_run() {
+        let err = until_interrupted(async {}, std::future::pending()).await.unwrap_err();
+        assert!(matches!(err.downcast_ref::<AppError>(), Some(AppError::Interrupted)));
+        assert_eq!(error::exit_code(&err), error::EXIT_INTERRUPTED);
+    }
+
+    #[tokio::test]
+    async fn test_until_interrupted_lets_run_finish() {
+        let result = until_interrupted(std::future::pending(), async { Ok(()) }).await;
+        assert!(result.is_ok());
+    }
+
+    #[tokio::test]
+    async fn test_with_deadline_passes_through_result() {
+        assert!(with_deadline(None, async { Ok(()) }).await.is_ok());
+        let err = with_deadline(Some(5), async { Err(AppError::NoResults.into()) }).await.unwrap_err();
+        assert!(matches!(err.downcast_ref::<AppError>(), Some(AppError::NoResults)));
+    }
+
+    #[test]
+    fn test_cli_parse_skip_existing_flag() {
+        let cli = Cli::try_parse_from(&["annadl", "dune", "--skip-existing"]).unwrap();
+        assert!(cli.skip_existing);
+    }
+
+    #[test]
+    fn test_cli_parse_filter_flags() {
+        let cli = Cli::try_parse_from(&["annadl", "dune", "-f", "epub", "--language", "en"]).unwrap();
+        assert_eq!(cli.format.as_deref(), Some("epub"));
+        assert_eq!(cli.language.as_deref(), Some("en"));
+    }
+
+    #[test]
+    fn test_cli_parse_set_format_and_language() {
+        let cli = Cli::try_parse_from(&["annadl", "--set-format", "pdf"]).unwrap();
+        assert_eq!(cli.set_format.as_deref(), Some("pdf"));
+
+        let cli = Cli::try_parse_from(&["annadl", "--set-language", ""]).unwrap();
+        assert_eq!(cli.set_language.as_deref(), Some(""));
+    }
+
+    #[test]
+    fn test_cli_parse_cite_flag() {
+        let cli = Cli::try_parse_from(&["annadl", "paper", "--cite", "bibtex"]).unwrap();
+        assert_eq!(cli.cite, Some(citation::CitationStyle::Bibtex));
+
+        let cli = Cli::try_parse_from(&["annadl", "paper", "--cite", "apa"]).unwrap();
+        assert_eq!(cli.cite, Some(citation::CitationStyle::Apa));
+
+        assert!(Cli::try_parse_from(&["annadl", "paper", "--cite", "mla"]).is_err());
+    }
+
+    #[test]
+    fn test_cli_parse_stdout_flag() {
+        let cli = Cli::try_parse_from(&["annadl", "rust book", "--stdout"]).unwrap();
+        assert!(cli.stdout);
+    }
+
+    #[test]
+    fn test_cli_parse_search_query() {
+        let cli = Cli::try_parse_from(&["annadl", "rust programming"]).unwrap();
+        assert_eq!(cli.search_query, Some("rust programming".to_string()));
+        assert_eq!(cli.num_results, 5);
+    }
+
+    #[test]
+    fn test_cli_parse_num_results_short() {
+        let cli = Cli::try_parse_from(&["annadl", "test", "-n", "10"]).unwrap();
+        assert_eq!(cli.num_results, 10);
+    }
+
+    #[test]
+    fn test_cli_parse_num_results_long() {
+        let cli = Cli::try_parse_from(&["annadl", "test", "--num-results", "20"]).unwrap();
+        assert_eq!(cli.num_results, 20);
+    }
 
     #[test]
     fn test_cli_parse_download_path_short() {
@@ -383,15 +1688,214 @@ mod tests {
         assert!(about.is_some());
     }
 
+    #[test]
+    fn test_cli_help_documents_exit_codes() {
+        let cmd = Cli::command();
+        let after_help = cmd.get_after_help().map(|s| s.to_string()).unwrap_or_default();
+        assert!(after_help.contains("Exit codes"));
+    }
+
+    #[test]
+    fn test_cli_parse_search_subcommand() {
+        let cli = Cli::try_parse_from(&["annadl", "search", "dune", "--json", "-n", "10"]).unwrap();
+        assert_eq!(cli.num_results, 10);
+        match cli.command {
+            Some(Commands::Search { query, json, export }) => {
+                assert_eq!(query.as_deref(), Some("dune"));
+                assert!(json);
+                assert!(export.is_none());
+            }
+            _ => panic!("expected search subcommand"),
+        }
+    }
+
+    #[test]
+    fn test_cli_parse_search_without_query() {
+        let cli = Cli::try_parse_from(&["annadl", "search", "--json"]).unwrap();
+        assert!(matches!(cli.command, Some(Commands::Search { query: None, json: true, .. })));
+    }
+
+    #[tokio::test]
+    async fn test_read_line_unbuffered_leaves_the_next_line() {
+        let mut input: &[u8] = b"dune messiah\r\n2\n";
+        assert_eq!(read_line_unbuffered(&mut input).await.unwrap(), "dune messiah");
+        assert_eq!(input, b"2\n");
+        assert_eq!(read_line_unbuffered(&mut input).await.unwrap(), "2");
+        assert_eq!(read_line_unbuffered(&mut input).await.unwrap(), "");
+    }
+
+    #[test]
+    fn test_cli_parse_get_subcommand() {
+        let cli = Cli::try_parse_from(&["annadl", "get", "abcdef0123456789abcdef0123456789", "-p", "/tmp/books"]).unwrap();
+        assert_eq!(cli.download_path, Some(PathBuf::from("/tmp/books")));
+        assert!(matches!(cli.command, Some(Commands::Get { ref target, json: false }) if target == "abcdef0123456789abcdef0123456789"));
+
+        let cli = Cli::try_parse_from(&["annadl", "get", "abcdef0123456789abcdef0123456789", "--json"]).unwrap();
+        assert!(matches!(cli.command, Some(Commands::Get { json: true, .. })));
+    }
+
+    #[test]
+    fn test_cli_parse_quiet_flag() {
+        let cli = Cli::try_parse_from(&["annadl", "dune", "-q"]).unwrap();
+        assert!(cli.quiet);
+        let cli = Cli::try_parse_from(&["annadl", "search", "dune", "--json", "--quiet"]).unwrap();
+        assert!(cli.quiet);
+    }
+
+    #[test]
+    fn test_output_quiet_wins() {
+        assert_eq!(Output::new(false, false), Output::Stdout);
+        assert_eq!(Output::new(true, false), Output::Stderr);
+        assert_eq!(Output::new(true, true), Output::Quiet);
+        assert_eq!(Output::new(false, true), Output::Quiet);
+    }
+
+    #[test]
+    fn test_cli_parse_get_list_subcommand() {
+        let cli = Cli::try_parse_from(&["annadl", "get-list", "queries.txt", "--continue-on-error", "--skip-existing"]).unwrap();
+        assert!(cli.skip_existing);
+        assert!(matches!(
+            cli.command,
+            Some(Commands::GetList { ref file, continue_on_error: true }) if file == &PathBuf::from("queries.txt")
+        ));
+    }
+
+    #[test]
+    fn test_parse_query_list_skips_comments_and_blanks() {
+        let contents = "# reading list\nDune\n\n  Neuromancer  \n   # indented comment\r\nFoundation\r\n";
+        assert_eq!(parse_query_list(contents), vec!["Dune", "Neuromancer", "Foundation"]);
+        assert!(parse_query_list("# nothing here\n\n").is_empty());
+    }
+
+    #[test]
+    fn test_list_summary_reports_each_outcome() {
+        let outcomes = vec![
+            ("Dune".to_string(), Ok(ListOutcome::Downloaded(PathBuf::from("dune.epub")))),
+            ("Emma".to_string(), Ok(ListOutcome::Skipped(PathBuf::from("emma.epub")))),
+            ("xyzzy".to_string(), Err(AppError::NoResults.into())),
+        ];
+        
+        let summary = list_summary(&outcomes, 5);
+        assert!(summary.starts_with("📋 1 downloaded, 1 skipped, 1 failed, 2 not attempted"));
+        assert!(summary.contains("❌ xyzzy: No results found"));
+    }
+
+    #[test]
+    fn test_cli_parse_version_subcommand() {
+        let cli = Cli::try_parse_from(&["annadl", "version", "--json"]).unwrap();
+        assert!(matches!(cli.command, Some(Commands::Version { json: true })));
+
+        // The root flag keeps working alongside the subcommand
+        let err = Cli::try_parse_from(&["annadl", "--version"]).err().unwrap();
+        assert_eq!(err.kind(), clap::error::ErrorKind::DisplayVersion);
+    }
+
+    #[test]
+    fn test_cli_bare_query_still_supported() {
+        let cli = Cli::try_parse_from(&["annadl", "dune messiah"]).unwrap();
+        assert!(cli.command.is_none());
+        assert_eq!(cli.search_query.as_deref(), Some("dune messiah"));
+    }
+
+    #[test]
+    fn test_cli_parse_config_file_flag() {
+        let cli = Cli::try_parse_from(&["annadl", "--config-file", "/tmp/alt.json", "--config"]).unwrap();
+        assert_eq!(cli.config_file, Some(PathBuf::from("/tmp/alt.json")));
+        assert!(cli.config);
+
+        let cli = Cli::try_parse_from(&["annadl", "search", "dune", "--config-file", "alt.json"]).unwrap();
+        assert_eq!(cli.config_file, Some(PathBuf::from("alt.json")));
+    }
+
     #[test]
     fn test_cli_invalid_num_results() {
         let result = Cli::try_parse_from(&["annadl", "-n", "not-a-number"]);
         assert!(result.is_err());
     }
 
+    #[test]
+    fn test_cli_num_results_boundaries() {
+        assert!(Cli::try_parse_from(&["annadl", "dune", "-n", "0"]).is_err());
+        assert!(Cli::try_parse_from(&["annadl", "dune", "--num-results=-3"]).is_err());
+        assert_eq!(Cli::try_parse_from(&["annadl", "dune", "-n", "1"]).unwrap().num_results, 1);
+        assert_eq!(Cli::try_parse_from(&["annadl", "dune", "-n", "500"]).unwrap().num_results, 500);
+    }
+
+    #[test]
+    fn test_clamp_num_results() {
+        assert_eq!(clamp_num_results(1), (1, false));
+        assert_eq!(clamp_num_results(200), (200, false));
+        assert_eq!(clamp_num_results(201), (200, true));
+        assert_eq!(parse_num_results("0").unwrap_err(), "must be at least 1");
+    }
+
+    #[test]
+    fn test_clamp_prefetch() {
+        assert_eq!(clamp_prefetch(0), (0, false));
+        assert_eq!(clamp_prefetch(10), (10, false));
+        assert_eq!(clamp_prefetch(500), (10, true));
+    }
+
     #[test]
     fn test_cli_default_num_results() {
         let cli = Cli::try_parse_from(&["annadl"]).unwrap();
         assert_eq!(cli.num_results, 5); // Default value
     }
+    
+    // md5 of b"book"
+    const BOOK_MD5: &str = "821f03288846297c2cf43c34766a38f7";
+    
+    fn mirror_link(base: &str) -> scraper::DownloadLink {
+        scraper::DownloadLink { text: "Mirror".to_string(), url: format!("{}/book.epub", base), source: "Mirror".to_string() }
+    }
+    
+    async fn save_verified(dir: &std::path::Path, links: &[scraper::DownloadLink]) -> Result<downloader::Saved> {
+        let network = network::NetworkOptions { verify_retry: true, ..Default::default() };
+        let downloader = downloader::Downloader::new(dir.to_path_buf()).unwrap().with_max_retries(0);
+        save_links(Output::Quiet, &network, &downloader, links, Some("book.epub"), Some(BOOK_MD5)).await
+    }
+    
+    #[tokio::test]
+    async fn test_save_links_deletes_a_mismatch_and_takes_the_next_link() {
+        let dir = std::env::temp_dir().join(format!("annadl_verify_next_{}", std::process::id()));
+        let links = [
+            mirror_link(&serve_once(http_response(b"not the book")).await),
+            mirror_link(&serve_once(http_response(b"book")).await),
+        ];
+        
+        let saved = save_verified(&dir, &links).await.unwrap();
+        assert_eq!(saved, downloader::Saved::Written(dir.join("book.epub")));
+        assert_eq!(std::fs::read(saved.path()).unwrap(), b"book");
+        
+        let _ = std::fs::remove_dir_all(&dir);
+    }
+    
+    #[tokio::test]
+    async fn test_save_links_moves_past_a_failed_transfer() {
+        let dir = std::env::temp_dir().join(format!("annadl_verify_failed_{}", std::process::id()));
+        let links = [
+            mirror_link(&serve_once(http_response_with(404, "Not Found", &[], b"")).await),
+            mirror_link(&serve_once(http_response(b"book")).await),
+        ];
+        
+        let saved = save_verified(&dir, &links).await.unwrap();
+        assert_eq!(std::fs::read(saved.path()).unwrap(), b"book");
+        
+        let _ = std::fs::remove_dir_all(&dir);
+    }
+    
+    #[tokio::test]
+    async fn test_save_links_gives_up_when_no_link_matches() {
+        let dir = std::env::temp_dir().join(format!("annadl_verify_none_{}", std::process::id()));
+        let links = [
+            mirror_link(&serve_once(http_response(b"not the book")).await),
+            mirror_link(&serve_once(http_response(b"nor this")).await),
+        ];
+        
+        let err = save_verified(&dir, &links).await.unwrap_err();
+        assert!(matches!(err.downcast_ref::<AppError>(), Some(AppError::ChecksumMismatch(2))), "{:#}", err);
+        assert!(!dir.join("book.epub").exists());
+        
+        let _ = std::fs::remove_dir_all(&dir);
+    }
 }
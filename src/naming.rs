@@ -0,0 +1,288 @@
+use crate::downloader::sanitize_filename;
+use crate::scraper::{truncate_bytes, truncate_chars, Book};
+use serde::{Deserialize, Serialize};
+use std::collections::HashMap;
+use std::path::{Path, PathBuf};
+use std::time::SystemTime;
+
+// What a name template can refer to, e.g. "{author}/{title}"
+const FIELDS: &[&str] = &["title", "author", "year", "format", "language", "md5"];
+
+// Each folder or file name stays well inside the usual 255-byte limit
+const SEGMENT_MAX_BYTES: usize = 200;
+
+// For clap and the config: only known fields, and no part that could leave the download directory
+pub fn parse_template(value: &str) -> Result<String, String> {
+    let template = value.trim();
+    if template.is_empty() {
+        return Err("the template is empty".to_string());
+    }
+    if template.starts_with('/') || template.starts_with('\\') || template.contains(':') {
+        return Err(format!("'{}' must be relative to the download directory", template));
+    }
+
+    for segment in template.split('/') {
+        match segment.trim() {
+            "" => return Err(format!("'{}' has an empty folder name", template)),
+            "." | ".." => return Err(format!("'{}' may not use '{}' as a folder", template, segment.trim())),
+            _ => {}
+        }
+
+        let mut rest = segment;
+        while let Some(start) = rest.find('{') {
+            let end = rest[start..].find('}')
+                .ok_or_else(|| format!("'{}' has an unclosed '{{'", template))?;
+            let field = &rest[start + 1..start + end];
+            if !FIELDS.contains(&field) {
+                return Err(format!("unknown field {{{}}}; expected one of {}", field, field_list()));
+            }
+            rest = &rest[start + end + 1..];
+        }
+    }
+
+    Ok(template.to_string())
+}
+
+fn field_list() -> String {
+    FIELDS.iter().map(|f| format!("{{{}}}", f)).collect::<Vec<_>>().join(", ")
+}
+
+// The folder under the download directory and the file name (no extension) a book is saved as.
+// Without a template that is the download directory itself and Book::file_stem.
+// Segments are filled in and sanitized one at a time, so a "/" in a title never adds a folder.
+pub fn book_path(book: &Book, template: Option<&str>) -> (PathBuf, String) {
+    let template = match template {
+        Some(template) => template,
+        None => return (PathBuf::new(), book.file_stem()),
+    };
+
+    let mut segments: Vec<String> = template.split('/').map(|segment| render_segment(segment, book)).collect();
+    let name = segments.pop().unwrap_or_default();
+
+    // The extension is always added for the file, so "{title}.{format}" doesn't get it twice
+    let name = match book.format.as_deref() {
+        Some(format) => name.strip_suffix(&format!(".{}", format)).map(str::to_string).unwrap_or(name),
+        None => name,
+    };
+
+    (segments.iter().collect(), name)
+}
+
+// One pass, so a title that happens to contain "{author}" is left as written
+fn render_segment(segment: &str, book: &Book) -> String {
+    let mut rendered = String::new();
+    let mut rest = segment;
+    while let Some(start) = rest.find('{') {
+        let end = match rest[start..].find('}') {
+            Some(end) => start + end,
+            None => break,
+        };
+        rendered.push_str(&rest[..start]);
+        rendered.push_str(&field_value(book, &rest[start + 1..end]));
+        rest = &rest[end + 1..];
+    }
+    rendered.push_str(rest);
+
+    let cleaned = sanitize_filename(&rendered);
+    truncate_bytes(&cleaned, SEGMENT_MAX_BYTES).trim_end().to_string()
+}
+
+// --date-folders or "date_folders": a folder per day or month (UTC) under the download directory,
+// above any folders from the name template
+#[derive(Debug, Clone, Copy, PartialEq, Default, Serialize, Deserialize, clap::ValueEnum)]
+#[serde(rename_all = "lowercase")]
+pub enum DateFolders {
+    #[default]
+    Off,
+    // "2024-06-15"
+    Daily,
+    // "2024-06"
+    Monthly,
+}
+
+impl DateFolders {
+    pub fn label(self) -> &'static str {
+        match self {
+            DateFolders::Off => "off",
+            DateFolders::Daily => "daily",
+            DateFolders::Monthly => "monthly",
+        }
+    }
+
+    // Empty when off, so joining it leaves the path as it was
+    pub fn folder(self, now: SystemTime) -> PathBuf {
+        let seconds = now.duration_since(std::time::UNIX_EPOCH).map(|d| d.as_secs()).unwrap_or(0);
+        let (year, month, day) = civil_date((seconds / 86400) as i64);
+        match self {
+            DateFolders::Off => PathBuf::new(),
+            DateFolders::Daily => PathBuf::from(format!("{:04}-{:02}-{:02}", year, month, day)),
+            DateFolders::Monthly => PathBuf::from(format!("{:04}-{:02}", year, month)),
+        }
+    }
+}
+
+// Year, month and day of a count of days since the Unix epoch (Howard Hinnant's civil_from_days)
+fn civil_date(days: i64) -> (i64, u32, u32) {
+    let z = days + 719468;
+    let era = (if z >= 0 { z } else { z - 146096 }) / 146097;
+    let doe = z - era * 146097;
+    let yoe = (doe - doe / 1460 + doe / 36524 - doe / 146096) / 365;
+    let doy = doe - (365 * yoe + yoe / 4 - yoe / 100);
+    let mp = (5 * doy + 2) / 153;
+    let day = (doy - (153 * mp + 2) / 5 + 1) as u32;
+    let month = (if mp < 10 { mp + 3 } else { mp - 9 }) as u32;
+    let year = yoe + era * 400 + if month <= 2 { 1 } else { 0 };
+    (year, month, day)
+}
+
+// Names handed out during one batch, so two different books that come out as the same
+// "Title - Unknown" don't overwrite each other within a run
+#[derive(Debug, Default)]
+pub struct BatchNames {
+    // (folder, lowercased stem and format) -> the md5 or URL of the book that has it
+    taken: HashMap<(PathBuf, String), String>,
+}
+
+impl BatchNames {
+    // The same book always gets its name back; another book gets " (<first 8 of md5>)" added,
+    // or " (2)", " (3)"… when there is no md5
+    pub fn unique(&mut self, folder: &Path, stem: &str, book: &Book) -> String {
+        let owner = book.md5.clone().unwrap_or_else(|| book.url.clone());
+        let format = book.format.as_deref().unwrap_or("").to_lowercase();
+        let mut candidate = stem.to_string();
+        let mut attempt = 1;
+
+        loop {
+            let key = (folder.to_path_buf(), format!("{}.{}", candidate.to_lowercase(), format));
+            match self.taken.get(&key) {
+                None => {
+                    self.taken.insert(key, owner);
+                    return candidate;
+                }
+                Some(taken_by) if *taken_by == owner => return candidate,
+                Some(_) => {}
+            }
+
+            attempt += 1;
+            candidate = match book.md5.as_deref() {
+                Some(md5) if attempt == 2 => format!("{} ({})", stem, truncate_chars(md5, 8)),
+                _ => format!("{} ({})", stem, attempt),
+            };
+        }
+    }
+
+    pub fn clear(&mut self) {
+        self.taken.clear();
+    }
+}
+
+fn field_value(book: &Book, field: &str) -> String {
+    let value = match field {
+        "title" => Some(book.title.as_str()),
+        "author" => book.author.as_deref(),
+        "year" => book.year.as_deref(),
+        "format" => book.format.as_deref(),
+        "language" => book.language.as_deref(),
+        "md5" => book.md5.as_deref(),
+        _ => None,
+    };
+
+    match value.map(str::trim) {
+        Some(value) if !value.is_empty() => value.to_string(),
+        _ => "Unknown".to_string(),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::test_support::{test_book, BookBuilder};
+    use std::path::Path;
+
+    fn book() -> BookBuilder {
+        test_book("Dune")
+            .author("Frank Herbert")
+            .year("1965")
+            .language("en")
+            .format("epub")
+            .url("https://annas-archive.org/md5/0123456789abcdef0123456789abcdef")
+            .md5("0123456789abcdef0123456789abcdef")
+    }
+
+    #[test]
+    fn test_parse_template() {
+        assert_eq!(parse_template(" {author}/{title} ").unwrap(), "{author}/{title}");
+        assert!(parse_template("{year}/{author} - {title}.{format}").is_ok());
+        assert!(parse_template("").is_err());
+        assert!(parse_template("/books/{title}").is_err());
+        assert!(parse_template("C:/books/{title}").is_err());
+        assert!(parse_template("../{title}").is_err());
+        assert!(parse_template("{author}/./{title}").is_err());
+        assert!(parse_template("{author}//{title}").is_err());
+        assert!(parse_template("{publisher}/{title}").unwrap_err().contains("unknown field {publisher}"));
+        assert!(parse_template("{author/{title}").is_err());
+    }
+
+    #[test]
+    fn test_book_path_without_template_is_file_stem() {
+        let (dir, name) = book_path(&book().build(), None);
+        assert_eq!(dir, PathBuf::new());
+        assert_eq!(name, "Dune - Frank Herbert");
+    }
+
+    #[test]
+    fn test_book_path_builds_folders() {
+        let (dir, name) = book_path(&book().build(), Some("{author}/{year}/{title}.{format}"));
+        assert_eq!(dir, Path::new("Frank Herbert").join("1965"));
+        assert_eq!(name, "Dune");
+
+        let unknown = book().author(None).year(None).build();
+        let (dir, name) = book_path(&unknown, Some("{author}/{title} ({year})"));
+        assert_eq!(dir, Path::new("Unknown"));
+        assert_eq!(name, "Dune (Unknown)");
+    }
+
+    #[test]
+    fn test_date_folders() {
+        let now = std::time::UNIX_EPOCH + std::time::Duration::from_secs(784111777); // Sun, 06 Nov 1994 08:49:37 GMT
+        assert_eq!(DateFolders::Off.folder(now), PathBuf::new());
+        assert_eq!(DateFolders::Daily.folder(now), Path::new("1994-11-06"));
+        assert_eq!(DateFolders::Monthly.folder(now), Path::new("1994-11"));
+        // Leap day, and the last second of a year
+        assert_eq!(DateFolders::Daily.folder(std::time::UNIX_EPOCH + std::time::Duration::from_secs(951782400)), Path::new("2000-02-29"));
+        assert_eq!(DateFolders::Daily.folder(std::time::UNIX_EPOCH + std::time::Duration::from_secs(1704067199)), Path::new("2023-12-31"));
+    }
+
+    #[test]
+    fn test_batch_names_keep_same_name_books_apart() {
+        let mut names = BatchNames::default();
+        let folder = Path::new("");
+        let first = book().author(None).md5("aaaaaaaa11112222aaaaaaaa11112222").build();
+        let second = book().author(None).md5("bbbbbbbb33334444bbbbbbbb33334444").build();
+        let (_, stem) = book_path(&first, None);
+        assert_eq!(stem, book_path(&second, None).1);
+
+        assert_eq!(names.unique(folder, &stem, &first), "Dune - Unknown");
+        assert_eq!(names.unique(folder, &stem, &second), "Dune - Unknown (bbbbbbbb)");
+        // Asking again for a book gives it the same name, in any order
+        assert_eq!(names.unique(folder, &stem, &first), "Dune - Unknown");
+        assert_eq!(names.unique(folder, &stem, &second), "Dune - Unknown (bbbbbbbb)");
+
+        // Without an md5 the books are numbered; other formats and folders don't collide
+        let no_md5 = |url: &str| book().md5(None).url(url).build();
+        assert_eq!(names.unique(folder, "Dune", &no_md5("a")), "Dune");
+        assert_eq!(names.unique(folder, "Dune", &no_md5("b")), "Dune (2)");
+        assert_eq!(names.unique(folder, "dune", &no_md5("c")), "dune (3)");
+        assert_eq!(names.unique(folder, "Dune", &book().md5(None).url("d").format("pdf").build()), "Dune");
+        assert_eq!(names.unique(Path::new("Frank Herbert"), "Dune", &no_md5("e")), "Dune");
+    }
+
+    #[test]
+    fn test_book_path_values_cannot_escape_or_nest() {
+        let hostile = test_book("AC/DC: Live").author("..").build();
+        let (dir, name) = book_path(&hostile, Some("{author}/{title}"));
+        assert_eq!(dir, Path::new("download"));
+        assert_eq!(name, "AC_DC_ Live");
+        assert!(dir.components().all(|c| matches!(c, std::path::Component::Normal(_))));
+    }
+}
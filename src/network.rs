@@ -0,0 +1,208 @@
+use crate::downloader::{ConflictPolicy, Downloader, DEFAULT_STALL_TIMEOUT};
+use crate::hook::PostDownload;
+use crate::naming::{self, DateFolders};
+use crate::scraper::{AnnaScraper, Book, CustomSelectors, SourceFilter, DEFAULT_CONNECT_TIMEOUT, DEFAULT_MAX_RETRIES, DEFAULT_PREFETCH_COUNT};
+use crate::tape::Tape;
+use anyhow::{Context, Result};
+use std::path::PathBuf;
+use std::time::{Duration, SystemTime};
+
+// Request settings shared by every search, detail fetch and download in a run
+#[derive(Debug, Clone)]
+pub struct NetworkOptions {
+    pub retries: u32,
+    pub verbose: bool,
+    pub sources: SourceFilter,
+    // "search_selectors" / "link_selectors" from the config
+    pub selectors: CustomSelectors,
+    // --mirror: the only site searched, instead of the built-in list with fallback
+    pub mirror: Option<String>,
+    pub connections: usize,
+    // Downloads give up after this long without receiving data
+    pub stall_timeout: Duration,
+    // --connect-timeout: a host that can't be reached in this long is given up on (TLS included),
+    // independent of the page timeout and the download stall timeout
+    pub connect_timeout: Duration,
+    // --temp-dir: partial files are written here and moved into place when complete
+    pub temp_dir: Option<PathBuf>,
+    // --on-conflict or "on_conflict"; None overwrites, except that the TUI asks first
+    pub on_conflict: Option<ConflictPolicy>,
+    // --name-template or "name_template": folders and file name for books saved under the download path
+    pub name_template: Option<String>,
+    // --date-folders or "date_folders"
+    pub date_folders: DateFolders,
+    // --insecure: accept expired or self-signed certificates from mirrors
+    pub insecure: bool,
+    // --user-agent or "user_agent"; None keeps the clients' built-in User-Agent
+    pub user_agent: Option<String>,
+    // From "ipfs_gateway" in the config
+    pub ipfs_gateway: Option<String>,
+    // --post-download or "post_download", run by the caller once a file is saved
+    pub post_download: Option<PostDownload>,
+    // --verify-retry or "verify_retry": check saved files against the book's md5, and try the
+    // next link when one doesn't match
+    pub verify_retry: bool,
+    // --prefetch or "prefetch_count": book pages the TUI reads ahead after a search; 0 turns it off
+    pub prefetch: usize,
+    // --record / --replay; only pages, downloads always go to the network
+    pub tape: Option<Tape>,
+}
+
+impl Default for NetworkOptions {
+    fn default() -> Self {
+        Self {
+            retries: DEFAULT_MAX_RETRIES,
+            verbose: false,
+            sources: SourceFilter::default(),
+            selectors: CustomSelectors::default(),
+            mirror: None,
+            connections: 1,
+            stall_timeout: DEFAULT_STALL_TIMEOUT,
+            connect_timeout: DEFAULT_CONNECT_TIMEOUT,
+            temp_dir: None,
+            on_conflict: None,
+            name_template: None,
+            date_folders: DateFolders::Off,
+            insecure: false,
+            user_agent: None,
+            ipfs_gateway: None,
+            post_download: None,
+            verify_retry: false,
+            prefetch: DEFAULT_PREFETCH_COUNT,
+            tape: None,
+        }
+    }
+}
+
+impl NetworkOptions {
+    pub fn scraper(&self) -> Result<AnnaScraper> {
+        let client = self.apply_user_agent(AnnaScraper::client_builder())
+            .connect_timeout(self.connect_timeout)
+            .danger_accept_invalid_certs(self.insecure)
+            .build()
+            .context("Failed to create HTTP client")?;
+        
+        Ok(AnnaScraper::from_client(client)
+            .with_max_retries(self.retries)
+            .with_verbose(self.verbose)
+            .with_source_filter(self.sources.clone())
+            .with_selectors(self.selectors.clone())
+            .with_mirrors(self.mirror.iter().cloned().collect())
+            .with_ipfs_gateway(self.ipfs_gateway.clone())
+            .with_tape(self.tape.clone()))
+    }
+    
+    pub fn downloader(&self, download_path: PathBuf) -> Result<Downloader> {
+        let client = self.apply_user_agent(Downloader::client_builder())
+            .connect_timeout(self.connect_timeout)
+            .danger_accept_invalid_certs(self.insecure)
+            .build()
+            .context("Failed to create HTTP client")?;
+        
+        Ok(Downloader::from_client(download_path, client)
+            .with_max_retries(self.retries)
+            .with_connections(self.connections)
+            .with_stall_timeout(self.stall_timeout)
+            .with_temp_dir(self.temp_dir.clone())
+            .with_conflict_policy(self.on_conflict.unwrap_or_default()))
+    }
+    
+    // The folder below the download path and the file name (no extension) a book is saved as:
+    // the dated folder, if any, then the name template's folders
+    pub fn book_path(&self, book: &Book) -> (PathBuf, String) {
+        self.book_path_at(book, SystemTime::now())
+    }
+    
+    // The same, dated by `now` instead of the clock
+    pub fn book_path_at(&self, book: &Book, now: SystemTime) -> (PathBuf, String) {
+        let (folder, name) = naming::book_path(book, self.name_template.as_deref());
+        (self.date_folders.folder(now).join(folder), name)
+    }
+    
+    // Set on the client, so retries, mirror fallbacks and detail pages all send it too
+    fn apply_user_agent(&self, builder: reqwest::ClientBuilder) -> reqwest::ClientBuilder {
+        match self.user_agent {
+            Some(ref agent) => builder.user_agent(agent.clone()),
+            None => builder,
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::scraper::SearchFilters;
+    use crate::test_support::{http_response, serve_capture, test_book};
+
+    #[test]
+    fn test_default_retries() {
+        let options = NetworkOptions::default();
+        assert_eq!(options.retries, 3);
+        assert!(!options.verbose);
+        assert!(!options.insecure);
+        assert_eq!(options.connections, 1);
+        assert_eq!(options.stall_timeout, Duration::from_secs(60));
+        assert_eq!(options.connect_timeout, Duration::from_secs(30));
+        assert_eq!(options.prefetch, 3);
+        assert_eq!(options.date_folders, DateFolders::Off);
+    }
+
+    #[test]
+    fn test_book_path_puts_date_folder_above_template_folders() {
+        let book = test_book("Dune")
+            .author("Frank Herbert")
+            .format("epub")
+            .url("https://annas-archive.org/md5/abc")
+            .build();
+        assert_eq!(NetworkOptions::default().book_path(&book), (PathBuf::new(), "Dune - Frank Herbert".to_string()));
+
+        let options = NetworkOptions {
+            date_folders: DateFolders::Monthly,
+            name_template: Some("{author}/{title}".to_string()),
+            ..Default::default()
+        };
+        let now = std::time::UNIX_EPOCH + Duration::from_secs(784111777); // Sun, 06 Nov 1994 08:49:37 GMT
+        let (folder, name) = options.book_path_at(&book, now);
+        assert_eq!(folder, PathBuf::from("1994-11").join("Frank Herbert"));
+        assert_eq!(name, "Dune");
+    }
+
+    #[test]
+    fn test_builds_clients() {
+        let options = NetworkOptions { retries: 0, verbose: true, ..Default::default() };
+        assert!(options.scraper().is_ok());
+        assert!(options.downloader(std::env::temp_dir()).is_ok());
+
+        let options = NetworkOptions { insecure: true, ..Default::default() };
+        assert!(options.scraper().is_ok());
+        assert!(options.downloader(std::env::temp_dir()).is_ok());
+    }
+
+    #[tokio::test]
+    async fn test_pinned_mirror_is_searched() {
+        let (base, request) = serve_capture(http_response(include_str!("../tests/fixtures/search_no_results.html").as_bytes())).await;
+        let options = NetworkOptions { mirror: Some(base), ..Default::default() };
+
+        let books = options.scraper().unwrap().search("dune", &SearchFilters::default(), 5).await.unwrap();
+        assert!(books.is_empty());
+        assert!(request.await.unwrap().starts_with("GET /search?q=dune "));
+    }
+
+    #[tokio::test]
+    async fn test_user_agent_override_reaches_scraper_and_downloader() {
+        let options = NetworkOptions { retries: 0, user_agent: Some("annadl-custom/1.0".to_string()), ..Default::default() };
+
+        // Reached only after the first mirror refuses the connection
+        let (base, request) = serve_capture(http_response(include_str!("../tests/fixtures/search_no_results.html").as_bytes())).await;
+        let scraper = options.scraper().unwrap().with_mirrors(vec!["http://127.0.0.1:1".to_string(), base]);
+        scraper.search("dune", &SearchFilters::default(), 5).await.unwrap();
+        assert!(request.await.unwrap().to_lowercase().contains("user-agent: annadl-custom/1.0"));
+
+        let (base, request) = serve_capture(http_response(b"book")).await;
+        let dir = std::env::temp_dir().join(format!("annadl_network_ua_{}", std::process::id()));
+        let downloader = options.downloader(dir.clone()).unwrap();
+        downloader.download_with_progress(&format!("{}/book.epub", base), Some("book.epub"), |_| {}).await.unwrap();
+        assert!(request.await.unwrap().to_lowercase().contains("user-agent: annadl-custom/1.0"));
+        let _ = std::fs::remove_dir_all(dir);
+    }
+}
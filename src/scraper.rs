@@ -1,3 +1,6 @@
+use crate::encoding;
+use crate::error::AppError;
+use crate::tape::Tape;
 use anyhow::{Context, Result};
 use scraper::{Html, Selector};
 use serde::{Deserialize, Serialize};
@@ -8,6 +11,127 @@ pub struct SearchFilters {
     pub format: Option<String>,
     pub language: Option<String>,
     pub max_size_mb: Option<f64>,
+    // Publication year range, inclusive; like the size limit it is applied after parsing
+    pub min_year: Option<u32>,
+    pub max_year: Option<u32>,
+    // Books without a readable year pass a year range only when this is set
+    pub include_unknown_year: bool,
+    // Sent as &sort=; None keeps the site's relevance order
+    pub sort: Option<ServerSort>,
+    // Raw key=value pairs appended to the search URL (--param)
+    pub extra_params: Vec<(String, String)>,
+}
+
+impl SearchFilters {
+    pub fn has_year_range(&self) -> bool {
+        self.min_year.is_some() || self.max_year.is_some()
+    }
+    
+    pub fn year_permits(&self, year: Option<&str>) -> bool {
+        if !self.has_year_range() {
+            return true;
+        }
+        match year.and_then(parse_year) {
+            Some(year) => self.min_year.map_or(true, |min| year >= min) && self.max_year.map_or(true, |max| year <= max),
+            None => self.include_unknown_year,
+        }
+    }
+    
+    // "1990-2005", "1990-" or "-1980", the same form the TUI filter field accepts
+    pub fn year_label(&self) -> Option<String> {
+        if !self.has_year_range() {
+            return None;
+        }
+        let bound = |year: Option<u32>| year.map(|y| y.to_string()).unwrap_or_default();
+        Some(format!("{}-{}", bound(self.min_year), bound(self.max_year)))
+    }
+}
+
+// The first four-digit run, so "1965", "c. 1965" and "1965-03" all read as 1965
+pub fn parse_year(text: &str) -> Option<u32> {
+    text.split(|c: char| !c.is_ascii_digit())
+        .find(|part| part.len() == 4)?
+        .parse()
+        .ok()
+}
+
+// Parses "1990-2005", "1990-", "-1980" or a single "1990"; None when the text is not a range
+pub fn parse_year_range(text: &str) -> Option<(Option<u32>, Option<u32>)> {
+    let text = text.trim();
+    let bound = |part: &str| -> Option<Option<u32>> {
+        let part = part.trim();
+        if part.is_empty() {
+            Some(None)
+        } else {
+            part.parse().ok().map(Some)
+        }
+    };
+    
+    let (min, max) = match text.split_once('-') {
+        Some((min, max)) => (bound(min)?, bound(max)?),
+        None => {
+            let year = bound(text)?;
+            (year, year)
+        }
+    };
+    match (min, max) {
+        (None, None) => None,
+        (Some(min), Some(max)) if min > max => None,
+        range => Some(range),
+    }
+}
+
+#[derive(Debug, Clone, Copy, PartialEq, Default, Serialize, Deserialize, clap::ValueEnum)]
+#[serde(rename_all = "lowercase")]
+pub enum SortMode {
+    #[default]
+    Relevance,
+    Popular,
+    Newest,
+    Size,
+    Title,
+}
+
+impl SortMode {
+    pub fn next(self) -> Self {
+        match self {
+            SortMode::Relevance => SortMode::Popular,
+            SortMode::Popular => SortMode::Newest,
+            SortMode::Newest => SortMode::Size,
+            SortMode::Size => SortMode::Title,
+            SortMode::Title => SortMode::Relevance,
+        }
+    }
+    
+    pub fn label(self) -> &'static str {
+        match self {
+            SortMode::Relevance => "relevance",
+            SortMode::Popular => "popular",
+            SortMode::Newest => "newest",
+            SortMode::Size => "size",
+            SortMode::Title => "title",
+        }
+    }
+}
+
+// Orders Anna's Archive applies before the result page is cut off, unlike SortMode
+#[derive(Debug, Clone, Copy, PartialEq, clap::ValueEnum)]
+pub enum ServerSort {
+    Newest,
+    Oldest,
+    Largest,
+    Smallest,
+}
+
+impl ServerSort {
+    pub fn param(self) -> &'static str {
+        match self {
+            ServerSort::Newest => "newest",
+            ServerSort::Oldest => "oldest",
+            ServerSort::Largest => "largest",
+            ServerSort::Smallest => "smallest",
+        }
+    }
 }
 
 #[derive(Debug, Clone, Serialize, Deserialize)]
@@ -19,51 +143,526 @@ pub struct Book {
     pub format: Option<String>,
     pub size: Option<String>,
     pub url: String,
+    #[serde(default)]
+    pub md5: Option<String>,
+    // Access count shown on some result blocks; 0 when the page doesn't say
+    #[serde(default)]
+    pub downloads: u64,
+    // The thumbnail on the result card, shown in the TUI preview on terminals that draw images
+    #[serde(default)]
+    pub cover_url: Option<String>,
 }
 
+// Leaves room in a 255-byte filename for the extension, a " (N)" suffix and ".part"
+const FILE_STEM_MAX_BYTES: usize = 200;
+const FILE_STEM_AUTHOR_CHARS: usize = 60;
+// The title is only cut below this when the author alone wouldn't fit otherwise
+const FILE_STEM_MIN_TITLE_CHARS: usize = 10;
+
+impl Book {
+    // "{title} - {author}" without an extension, title capped at 50 characters and author at 60.
+    // Multi-byte text can still overflow the byte budget: the title gives way first, then the author.
+    pub fn file_stem(&self) -> String {
+        let title = truncate_chars(&self.title, 50);
+        let author = truncate_chars(self.author.as_deref().unwrap_or("Unknown"), FILE_STEM_AUTHOR_CHARS);
+        
+        let budget = FILE_STEM_MAX_BYTES - " - ".len();
+        let min_title = truncate_chars(title, FILE_STEM_MIN_TITLE_CHARS).len();
+        let author = truncate_bytes(author, budget - min_title);
+        let title = truncate_bytes(title, budget - author.len());
+        format!("{} - {}", title, author)
+    }
+    
+    // Canonical annas-archive.org page for sharing, whichever mirror the book was found on
+    pub fn share_url(&self) -> String {
+        match self.md5.clone().or_else(|| extract_md5(&self.url)) {
+            Some(md5) => format!("{}/md5/{}", DEFAULT_MIRRORS[0], md5.to_lowercase()),
+            None => self.url.clone(),
+        }
+    }
+}
+
+// ISO 639-1 codes as the site's language filter uses them
+const LANGUAGE_NAMES: &[(&str, &str)] = &[
+    ("ar", "Arabic"), ("bg", "Bulgarian"), ("bn", "Bengali"), ("ca", "Catalan"),
+    ("cs", "Czech"), ("da", "Danish"), ("de", "German"), ("el", "Greek"),
+    ("en", "English"), ("eo", "Esperanto"), ("es", "Spanish"), ("et", "Estonian"),
+    ("fa", "Persian"), ("fi", "Finnish"), ("fr", "French"), ("he", "Hebrew"),
+    ("hi", "Hindi"), ("hr", "Croatian"), ("hu", "Hungarian"), ("id", "Indonesian"),
+    ("it", "Italian"), ("ja", "Japanese"), ("ko", "Korean"), ("la", "Latin"),
+    ("lt", "Lithuanian"), ("lv", "Latvian"), ("nl", "Dutch"), ("no", "Norwegian"),
+    ("pl", "Polish"), ("pt", "Portuguese"), ("ro", "Romanian"), ("ru", "Russian"),
+    ("sk", "Slovak"), ("sl", "Slovenian"), ("sr", "Serbian"), ("sv", "Swedish"),
+    ("th", "Thai"), ("tr", "Turkish"), ("uk", "Ukrainian"), ("vi", "Vietnamese"),
+    ("zh", "Chinese"),
+];
+
+// "fr" -> "French" for display; names and unknown codes come back unchanged
+pub fn language_name(code: &str) -> &str {
+    LANGUAGE_NAMES.iter()
+        .find(|(c, _)| c.eq_ignore_ascii_case(code.trim()))
+        .map(|(_, name)| *name)
+        .unwrap_or(code)
+}
+
+// "en" -> "English (en)", keeping the code that filters take
+pub fn language_label(code: &str) -> String {
+    match language_name(code) {
+        name if name == code => code.to_string(),
+        name => format!("{} ({})", name, code),
+    }
+}
+
+// Link URLs in the TUI and CLI link lists are cut to this many characters
+pub const LINK_URL_CHARS: usize = 50;
+
+// Text is only ever shortened through these two or the TUI's truncate_to_width (terminal
+// columns); slicing a &str at a computed length can land inside a character and panic.
+
+// Cuts on a char boundary, so accented and CJK text is never split mid-character
+pub fn truncate_chars(text: &str, max_chars: usize) -> &str {
+    match text.char_indices().nth(max_chars) {
+        Some((end, _)) => &text[..end],
+        None => text,
+    }
+}
+
+// The longest prefix of at most `max_bytes` that ends on a char boundary
+pub fn truncate_bytes(text: &str, max_bytes: usize) -> &str {
+    if text.len() <= max_bytes {
+        return text;
+    }
+    let mut end = max_bytes;
+    while !text.is_char_boundary(end) {
+        end -= 1;
+    }
+    &text[..end]
+}
+
+const DEFAULT_MIRRORS: [&str; 3] = [
+    "https://annas-archive.org",
+    "https://annas-archive.se",
+    "https://annas-archive.li",
+];
+
+// Results handed to a streaming caller at a time
+const SEARCH_BATCH_SIZE: usize = 5;
+const DEFAULT_TOTAL_TIMEOUT: Duration = Duration::from_secs(45);
+// TCP connect plus TLS handshake; a dead mirror fails after this instead of the whole request timeout
+pub const DEFAULT_CONNECT_TIMEOUT: Duration = Duration::from_secs(30);
+
+// Real search and detail pages are well under 1 MB
+pub const DEFAULT_MAX_PAGE_BYTES: usize = 10 * 1024 * 1024;
+pub const DEFAULT_MAX_RETRIES: u32 = 3;
+// -n and the TUI's first search, when nothing else is asked for
+pub const DEFAULT_NUM_RESULTS: usize = 5;
+// Keeps one search from scraping hundreds of result pages' worth of entries
+pub const MAX_NUM_RESULTS: usize = 200;
+// Top results whose book pages the TUI reads ahead after a search
+pub const DEFAULT_PREFETCH_COUNT: usize = 3;
+// Read-ahead is for the few books likely to be opened next, not a crawl of every result
+pub const MAX_PREFETCH_COUNT: usize = 10;
+// Gap between read-ahead requests, which go one at a time so they never burst
+pub const PREFETCH_DELAY: Duration = Duration::from_millis(750);
+pub(crate) const RETRY_BASE_DELAY: Duration = Duration::from_millis(500);
+pub(crate) const MAX_RETRY_AFTER: Duration = Duration::from_secs(30);
+
 pub struct AnnaScraper {
     client: reqwest::Client,
+    mirrors: Vec<String>,
+    total_timeout: Duration,
+    max_retries: u32,
+    verbose: bool,
+    sources: SourceFilter,
+    max_page_bytes: usize,
+    tape: Option<Tape>,
+    // e.g. "https://dweb.link"; IPFS links are rewritten to fetch through it
+    ipfs_gateway: Option<String>,
+    selectors: CustomSelectors,
+}
+
+// Public gateways recognised even when the link uses a path other than /ipfs/
+const IPFS_GATEWAYS: &[&str] = &[
+    "ipfs.io",
+    "dweb.link",
+    "cloudflare-ipfs.com",
+    "gateway.pinata.cloud",
+    "w3s.link",
+    "4everland.io",
+];
+
+// Download sources to drop, matched case-insensitively against DownloadLink::source
+#[derive(Debug, Clone, Default, PartialEq)]
+pub struct SourceFilter {
+    pub blocked: Vec<String>,
+    // When non-empty, only these sources are kept
+    pub allowed: Vec<String>,
+    // Host patterns from the block list file, matched against each link's URL
+    pub blocked_hosts: Vec<String>,
+}
+
+impl SourceFilter {
+    pub fn permits(&self, source: &str) -> bool {
+        let matches = |list: &[String]| list.iter().any(|s| s.trim().eq_ignore_ascii_case(source));
+        (self.allowed.is_empty() || matches(&self.allowed)) && !matches(&self.blocked)
+    }
+    
+    // Links that don't parse as URLs have no host to match and are kept
+    pub fn blocks_host(&self, url: &str) -> bool {
+        let host = match reqwest::Url::parse(url).ok().and_then(|u| u.host_str().map(str::to_ascii_lowercase)) {
+            Some(host) => host,
+            None => return false,
+        };
+        self.blocked_hosts.iter().any(|pattern| host_matches(pattern, &host))
+    }
+    
+    pub fn apply(&self, links: Vec<DownloadLink>) -> Vec<DownloadLink> {
+        links.into_iter()
+            .filter(|link| self.permits(&link.source) && !self.blocks_host(&link.url))
+            .collect()
+    }
+}
+
+// One pattern per line; blank lines and lines starting with # are skipped. A pasted URL
+// is cut down to its host, so "https://dead.example/books" blocks dead.example.
+pub fn parse_block_list(text: &str) -> Vec<String> {
+    text.lines()
+        .map(str::trim)
+        .filter(|line| !line.is_empty() && !line.starts_with('#'))
+        .map(|line| {
+            let line = line.split_once("://").map_or(line, |(_, rest)| rest);
+            line.split('/').next().unwrap_or(line).to_ascii_lowercase()
+        })
+        .filter(|pattern| !pattern.is_empty())
+        .collect()
+}
+
+// "example.com" matches the host and its subdomains; a pattern with * is matched as a glob
+// against the whole host, so "*.example.com" leaves example.com itself alone
+fn host_matches(pattern: &str, host: &str) -> bool {
+    if !pattern.contains('*') {
+        return host == pattern || host.ends_with(&format!(".{}", pattern));
+    }
+    
+    let parts: Vec<&str> = pattern.split('*').collect();
+    let (first, last) = (parts[0], parts[parts.len() - 1]);
+    if host.len() < first.len() + last.len() || !host.starts_with(first) || !host.ends_with(last) {
+        return false;
+    }
+    let mut rest = &host[first.len()..host.len() - last.len()];
+    for part in &parts[1..parts.len() - 1] {
+        match rest.find(part) {
+            Some(at) => rest = &rest[at + part.len()..],
+            None => return false,
+        }
+    }
+    true
+}
+
+// CSS selectors from the config, tried before the built-in ones, so a change to the site's
+// markup can be patched without waiting for a release
+#[derive(Debug, Clone, Default, PartialEq)]
+pub struct CustomSelectors {
+    // Result links on the search page, e.g. "a.js-vim-focus.custom-a"
+    pub search: Vec<String>,
+    // Download links anywhere on the book page
+    pub links: Vec<String>,
+}
+
+impl CustomSelectors {
+    // Drops the selectors that don't parse and returns them, so the caller can warn once
+    pub fn take_invalid(&mut self) -> Vec<String> {
+        let mut invalid = Vec::new();
+        for list in [&mut self.search, &mut self.links] {
+            list.retain(|selector| {
+                let valid = Selector::parse(selector).is_ok();
+                if !valid {
+                    invalid.push(selector.clone());
+                }
+                valid
+            });
+        }
+        invalid
+    }
+}
+
+// Stable, so Relevance keeps the order the site returned. Ties on the main key are broken by
+// title (or, for Title, newest first), and books equal on both stay in relevance order, so the
+// same results always sort the same way.
+pub fn sort_books(books: &mut [Book], mode: SortMode) {
+    let title = |book: &Book| book.title.to_lowercase();
+    let year = |book: &Book| book.year.as_deref().and_then(|y| y.parse::<u32>().ok());
+    
+    match mode {
+        SortMode::Relevance => {}
+        SortMode::Popular => books.sort_by(|a, b| {
+            b.downloads.cmp(&a.downloads).then_with(|| title(a).cmp(&title(b)))
+        }),
+        SortMode::Newest => books.sort_by(|a, b| {
+            year(b).cmp(&year(a)).then_with(|| title(a).cmp(&title(b)))
+        }),
+        SortMode::Size => books.sort_by(|a, b| {
+            let size = |book: &Book| book.size.as_deref()
+                .and_then(AnnaScraper::parse_size_mb)
+                .unwrap_or(f64::MAX);
+            size(a).partial_cmp(&size(b))
+                .unwrap_or(std::cmp::Ordering::Equal)
+                .then_with(|| title(a).cmp(&title(b)))
+        }),
+        SortMode::Title => books.sort_by(|a, b| {
+            title(a).cmp(&title(b)).then_with(|| year(b).cmp(&year(a)))
+        }),
+    }
+}
+
+pub fn extract_md5(url: &str) -> Option<String> {
+    let re = regex::Regex::new(r"/md5/([0-9a-fA-F]{32})").ok()?;
+    re.captures(url)
+        .and_then(|caps| caps.get(1))
+        .map(|m| m.as_str().to_lowercase())
+}
+
+// Accepts a bare md5 or a full URL and returns the detail page URL to fetch
+pub fn detail_url(target: &str) -> Option<String> {
+    let target = target.trim();
+    
+    if target.len() == 32 && target.chars().all(|c| c.is_ascii_hexdigit()) {
+        return Some(format!("{}/md5/{}", DEFAULT_MIRRORS[0], target.to_lowercase()));
+    }
+    
+    if target.starts_with("http://") || target.starts_with("https://") {
+        return Some(target.to_string());
+    }
+    
+    None
+}
+
+// Parses a --param value; keys must be plain tokens since they go into the URL unescaped
+pub fn parse_query_param(param: &str) -> std::result::Result<(String, String), String> {
+    let (key, value) = param
+        .split_once('=')
+        .ok_or_else(|| format!("expected key=value, got '{}'", param))?;
+    let key = key.trim();
+    
+    if key.is_empty() || !key.chars().all(|c| c.is_ascii_alphanumeric() || matches!(c, '_' | '-' | '.')) {
+        return Err(format!("invalid parameter name '{}' (use letters, digits, '_', '-' or '.')", key));
+    }
+    
+    Ok((key.to_string(), value.to_string()))
+}
+
+// Parses a --mirror value into a base URL: "annas-archive.se" becomes "https://annas-archive.se"
+pub fn parse_mirror(value: &str) -> std::result::Result<String, String> {
+    let value = value.trim().trim_end_matches('/');
+    let with_scheme = if value.contains("://") {
+        value.to_string()
+    } else {
+        format!("https://{}", value)
+    };
+    
+    let url = reqwest::Url::parse(&with_scheme)
+        .map_err(|e| format!("'{}' is not a host or URL: {}", value, e))?;
+    if !matches!(url.scheme(), "http" | "https") {
+        return Err(format!("'{}' must use http or https", value));
+    }
+    if url.path() != "/" || url.query().is_some() || url.fragment().is_some() {
+        return Err(format!("'{}' should be just the mirror's address, without a path", value));
+    }
+    
+    // A bare word is almost always a typo, not a mirror on the local network
+    let host = url.host_str().unwrap_or_default();
+    if !host.contains('.') && !host.contains(':') && host != "localhost" {
+        return Err(format!("'{}' doesn't look like a domain, e.g. annas-archive.se", value));
+    }
+    
+    Ok(url.origin().ascii_serialization())
+}
+
+pub fn normalize_query(query: &str) -> Option<String> {
+    let mut trimmed = query.trim();
+    
+    // Strip one layer of accidental shell quoting
+    for quote in ['"', '\''] {
+        if trimmed.len() >= 2 && trimmed.starts_with(quote) && trimmed.ends_with(quote) {
+            trimmed = trimmed[1..trimmed.len() - 1].trim();
+            break;
+        }
+    }
+    
+    let normalized = trimmed.split_whitespace().collect::<Vec<_>>().join(" ");
+    if normalized.is_empty() {
+        None
+    } else {
+        Some(normalized)
+    }
 }
 
 impl AnnaScraper {
     pub fn new() -> Result<Self> {
-        let client = reqwest::Client::builder()
-            .timeout(Duration::from_secs(30))
-            .user_agent(Self::random_user_agent())
+        let client = Self::client_builder()
             .build()
             .context("Failed to create HTTP client")?;
         
-        Ok(Self { client })
+        Ok(Self::from_client(client))
+    }
+    
+    // The settings new() uses, for callers that need to adjust the transport before building
+    pub fn client_builder() -> reqwest::ClientBuilder {
+        reqwest::Client::builder()
+            .timeout(Duration::from_secs(30))
+            .connect_timeout(DEFAULT_CONNECT_TIMEOUT)
+            .user_agent(Self::random_user_agent())
+    }
+    
+    // Uses the caller's client as-is (proxy, headers, timeouts); new() is the usual default
+    pub fn from_client(client: reqwest::Client) -> Self {
+        Self {
+            client,
+            mirrors: DEFAULT_MIRRORS.iter().map(|m| m.to_string()).collect(),
+            total_timeout: DEFAULT_TOTAL_TIMEOUT,
+            max_retries: DEFAULT_MAX_RETRIES,
+            verbose: false,
+            sources: SourceFilter::default(),
+            max_page_bytes: DEFAULT_MAX_PAGE_BYTES,
+            tape: None,
+            ipfs_gateway: None,
+            selectors: CustomSelectors::default(),
+        }
+    }
+    
+    pub fn with_mirrors(mut self, mirrors: Vec<String>) -> Self {
+        if !mirrors.is_empty() {
+            self.mirrors = mirrors;
+        }
+        self
+    }
+    
+    pub fn with_total_timeout(mut self, total_timeout: Duration) -> Self {
+        self.total_timeout = total_timeout;
+        self
+    }
+    
+    pub fn with_max_retries(mut self, max_retries: u32) -> Self {
+        self.max_retries = max_retries;
+        self
+    }
+    
+    // Logs parsing decisions, such as which fallback selector matched, to stderr
+    pub fn with_verbose(mut self, verbose: bool) -> Self {
+        self.verbose = verbose;
+        self
+    }
+    
+    // Applies to both the bytes received and the decompressed page
+    pub fn with_max_page_bytes(mut self, max_page_bytes: usize) -> Self {
+        self.max_page_bytes = max_page_bytes;
+        self
+    }
+    
+    // Public gateways are often slow; links labelled IPFS are fetched through this one instead
+    pub fn with_ipfs_gateway(mut self, gateway: Option<String>) -> Self {
+        self.ipfs_gateway = gateway
+            .map(|g| g.trim().trim_end_matches('/').to_string())
+            .filter(|g| !g.is_empty());
+        self
+    }
+    
+    pub fn with_source_filter(mut self, sources: SourceFilter) -> Self {
+        self.sources = sources;
+        self
+    }
+    
+    pub fn with_selectors(mut self, selectors: CustomSelectors) -> Self {
+        self.selectors = selectors;
+        self
+    }
+    
+    pub fn with_tape(mut self, tape: Option<Tape>) -> Self {
+        self.tape = tape;
+        self
+    }
+    
+    fn debug(&self, message: &str) {
+        if self.verbose {
+            eprintln!("[debug] {}", message);
+        }
     }
     
     pub async fn search(&self, query: &str, filters: &SearchFilters, max_results: usize) -> Result<Vec<Book>> {
-        let mut search_url = format!("https://annas-archive.org/search?q={}",
+        self.search_streaming(query, filters, max_results, |_| {}).await
+    }
+    
+    // Hands the books to `on_batch` SEARCH_BATCH_SIZE at a time, then returns them all. The
+    // page is fetched and parsed whole first, so the batches only pace how the TUI fills in.
+    pub async fn search_streaming<F>(
+        &self,
+        query: &str,
+        filters: &SearchFilters,
+        max_results: usize,
+        mut on_batch: F,
+    ) -> Result<Vec<Book>>
+    where
+        F: FnMut(&[Book]),
+    {
+        let mut search_path = format!("/search?q={}",
             urlencoding::encode(query));
         
         if let Some(ref fmt) = filters.format {
-             search_url.push_str(&format!("&ext={}", urlencoding::encode(fmt)));
+             search_path.push_str(&format!("&ext={}", urlencoding::encode(fmt)));
         }
 
         if let Some(ref lang) = filters.language {
-             search_url.push_str(&format!("&lang={}", urlencoding::encode(lang)));
+             search_path.push_str(&format!("&lang={}", urlencoding::encode(lang)));
         }
 
-        let html = self.fetch_html(&search_url).await?;
-        let mut books = self.parse_search_results(&html, max_results * 2).await?;
+        if let Some(sort) = filters.sort {
+            search_path.push_str(&format!("&sort={}", sort.param()));
+        }
+        
+        for (key, value) in &filters.extra_params {
+            search_path.push_str(&format!("&{}={}", key, urlencoding::encode(value)));
+        }
 
-        // Post-filtering for size
-        if let Some(max_mb) = filters.max_size_mb {
-            books.retain(|b| {
-                if let Some(ref s) = b.size {
-                     Self::parse_size_mb(s).map(|v| v <= max_mb).unwrap_or(true)
-                } else {
-                    true
+        let (mirror, parsed) = self.fetch_search_results(&search_path, max_results * 2).await?;
+        
+        let mut books: Vec<Book> = Vec::new();
+        let mut emitted = 0;
+        let mut dropped = 0;
+        
+        for mut book in parsed {
+            if books.len() >= max_results {
+                break;
+            }
+            
+            // Post-filtering for size and year
+            if let (Some(max_mb), Some(size)) = (filters.max_size_mb, book.size.as_deref()) {
+                if Self::parse_size_mb(size).map(|v| v > max_mb).unwrap_or(false) {
+                    dropped += 1;
+                    continue;
                 }
-            });
+            }
+            if !filters.year_permits(book.year.as_deref()) {
+                dropped += 1;
+                continue;
+            }
+            
+            // Point results at the mirror that actually answered
+            book.url = Self::rebase_url(&book.url, &mirror);
+            books.push(book);
+            
+            if books.len() - emitted == SEARCH_BATCH_SIZE {
+                on_batch(&books[emitted..]);
+                emitted = books.len();
+            }
         }
-
-        if books.len() > max_results {
-            books.truncate(max_results);
+        
+        if books.len() > emitted {
+            on_batch(&books[emitted..]);
+        }
+        
+        // The site did find something; say so rather than report an empty search
+        if books.is_empty() && dropped > 0 {
+            return Err(AppError::ResultsFiltered(dropped).into());
         }
 
         Ok(books)
@@ -87,38 +686,326 @@ impl AnnaScraper {
     }
     
     pub async fn get_book_details(&self, book_url: &str) -> Result<Vec<DownloadLink>> {
-        let html = self.fetch_html(book_url).await?;
-        self.parse_download_links(&html).await
+        let (links, _) = self.get_book_details_with_metadata(book_url).await?;
+        Ok(links)
     }
     
-    async fn fetch_html(&self, url: &str) -> Result<String> {
-        let response = self.client
-            .get(url)
-            .send()
-            .await
-            .context("Failed to fetch URL")?;
+    // The same fetch, also reading the edition and page count the detail page lists
+    pub async fn get_book_details_with_metadata(&self, book_url: &str) -> Result<(Vec<DownloadLink>, BookMetadata)> {
+        let (page_url, html) = match self.mirror_path(book_url) {
+            Some(path) => {
+                let (mirror, html) = self.fetch_with_fallback(&path).await?;
+                (format!("{}{}", mirror, path), html)
+            }
+            None => {
+                let html = tokio::time::timeout(self.total_timeout, self.fetch_html(book_url, self.total_timeout))
+                    .await
+                    .map_err(|_| AppError::Timeout(self.total_timeout.as_secs(), 1))??;
+                (book_url.to_string(), html)
+            }
+        };
+        let links = self.parse_download_links(&html, &page_url).await?;
+        let metadata = parse_book_metadata(&html);
+        
+        let found = links.len();
+        let by_host = links.iter().filter(|link| self.sources.blocks_host(&link.url)).count();
+        let links = self.sources.apply(links);
+        if by_host > 0 {
+            self.debug(&format!("host block list dropped {} of {} links", by_host, found));
+        }
+        if found > 0 && links.is_empty() {
+            return Err(AppError::SourcesFiltered(found).into());
+        }
+        if links.len() + by_host < found {
+            self.debug(&format!("source filter dropped {} of {} links", found - links.len() - by_host, found));
+        }
+        
+        Ok((links, metadata))
+    }
+    
+    // e.g. ["LibGen", "Mirror"]: where a book can be fetched from, without downloading it
+    pub async fn list_sources(&self, book_url: &str) -> Result<Vec<String>> {
+        let links = self.get_book_details(book_url).await?;
+        Ok(distinct_sources(&links))
+    }
+    
+    // Tries each mirror in turn, sharing one wall-clock budget across all attempts
+    async fn fetch_with_fallback(&self, path: &str) -> Result<(String, String)> {
+        let deadline = tokio::time::Instant::now() + self.total_timeout;
+        let mut last_error = None;
+        
+        for (i, mirror) in self.mirrors.iter().enumerate() {
+            let remaining = deadline.saturating_duration_since(tokio::time::Instant::now());
+            if remaining.is_zero() {
+                break;
+            }
+            
+            // Leave a fair share of the budget for the mirrors still to try
+            let mirrors_left = (self.mirrors.len() - i) as u32;
+            let attempt_budget = remaining / mirrors_left;
+            
+            let url = format!("{}{}", mirror, path);
+            match tokio::time::timeout(attempt_budget, self.fetch_html(&url, attempt_budget)).await {
+                Ok(Ok(html)) => return Ok((mirror.clone(), html)),
+                Ok(Err(e)) => last_error = Some(e),
+                Err(_) => last_error = Some(AppError::Timeout(attempt_budget.as_secs(), 1).into()),
+            }
+        }
+        
+        Err(self.fallback_error(last_error, deadline))
+    }
+    
+    // Like fetch_with_fallback, but a mirror whose results look malformed (mostly missing
+    // author, year, format and the rest) doesn't end the search: the next mirrors are tried
+    // within the same budget and the best set wins. A complete or empty page stops there, so a
+    // healthy primary mirror is still the only one asked.
+    async fn fetch_search_results(&self, path: &str, max_results: usize) -> Result<(String, Vec<Book>)> {
+        let deadline = tokio::time::Instant::now() + self.total_timeout;
+        let mut best: Option<(String, Vec<Book>)> = None;
+        let mut last_error = None;
+        // A mirror that answered with the wrong page says more than a later one that didn't answer
+        let mut unexpected = None;
+        
+        for (i, mirror) in self.mirrors.iter().enumerate() {
+            let remaining = deadline.saturating_duration_since(tokio::time::Instant::now());
+            if remaining.is_zero() {
+                break;
+            }
+            let attempt_budget = remaining / (self.mirrors.len() - i) as u32;
+            
+            let url = format!("{}{}", mirror, path);
+            let html = match tokio::time::timeout(attempt_budget, self.fetch_html(&url, attempt_budget)).await {
+                Ok(Ok(html)) => html,
+                Ok(Err(e)) => {
+                    last_error = Some(e);
+                    continue;
+                }
+                Err(_) => {
+                    last_error = Some(AppError::Timeout(attempt_budget.as_secs(), 1).into());
+                    continue;
+                }
+            };
+            
+            let books = self.parse_search_results(&html, max_results).await?;
+            // No results from a page that isn't a results page at all: say so, and ask the next mirror
+            if books.is_empty() {
+                if let Some(problem) = page_problem(&html) {
+                    self.debug(&format!("warning: search page from {} looks wrong ({}); trying the next mirror", mirror, problem));
+                    unexpected.get_or_insert(AppError::UnexpectedPage(problem));
+                    continue;
+                }
+            }
+            let settled = books.is_empty() || looks_complete(&books);
+            if best.as_ref().map_or(true, |(_, kept)| result_quality(&books) > result_quality(kept)) {
+                best = Some((mirror.clone(), books));
+            }
+            if settled {
+                break;
+            }
+            self.debug(&format!("results from {} look incomplete; trying the next mirror", mirror));
+        }
         
+        match (best, unexpected) {
+            (Some(best), _) => Ok(best),
+            (None, Some(unexpected)) => Err(unexpected.into()),
+            (None, None) => Err(self.fallback_error(last_error, deadline)),
+        }
+    }
+    
+    fn fallback_error(&self, last_error: Option<anyhow::Error>, deadline: tokio::time::Instant) -> anyhow::Error {
+        match last_error {
+            Some(e) if tokio::time::Instant::now() < deadline => e,
+            Some(e) => e.context(AppError::Timeout(self.total_timeout.as_secs(), self.mirrors.len())),
+            None => AppError::Timeout(self.total_timeout.as_secs(), self.mirrors.len()).into(),
+        }
+    }
+    
+    fn mirror_path(&self, url: &str) -> Option<String> {
+        self.mirrors
+            .iter()
+            .map(|m| m.as_str())
+            .chain(DEFAULT_MIRRORS.iter().copied())
+            .find_map(|m| url.strip_prefix(m))
+            .filter(|path| path.starts_with('/'))
+            .map(|path| path.to_string())
+    }
+    
+    fn rebase_url(url: &str, mirror: &str) -> String {
+        DEFAULT_MIRRORS
+            .iter()
+            .find_map(|m| url.strip_prefix(m))
+            .map(|path| format!("{}{}", mirror, path))
+            .unwrap_or_else(|| url.to_string())
+    }
+    
+    // budget is how long the caller will wait; a retry that can't finish within it isn't started
+    async fn fetch_html(&self, url: &str, budget: Duration) -> Result<String> {
+        match &self.tape {
+            Some(tape) if tape.is_replay() => {
+                self.debug(&format!("replaying {} from {}", url, tape.page_path(url).display()));
+                return tape.replay(url);
+            }
+            Some(tape) => {
+                let html = self.fetch_html_live(url, budget).await?;
+                tape.record(url, &html)?;
+                self.debug(&format!("recorded {} to {}", url, tape.page_path(url).display()));
+                Ok(html)
+            }
+            None => self.fetch_html_live(url, budget).await,
+        }
+    }
+    
+    async fn fetch_html_live(&self, url: &str, budget: Duration) -> Result<String> {
+        let deadline = tokio::time::Instant::now() + budget;
+        let mut attempt = 0;
+        
+        loop {
+            // Exponential backoff, unless a 429 told us exactly how long to wait
+            let backoff = RETRY_BASE_DELAY * 2u32.pow(attempt.min(6));
+            
+            let response = match self.client.get(url).send().await {
+                Ok(response) => response,
+                Err(e) if attempt < self.max_retries && (e.is_connect() || e.is_timeout()) => {
+                    attempt += 1;
+                    tokio::time::sleep(backoff).await;
+                    continue;
+                }
+                Err(e) => {
+                    let error = crate::error::request_error(&e);
+                    return Err(anyhow::Error::new(e).context(error));
+                }
+            };
+            
+            let status = response.status();
+            if status.is_success() {
+                let content_encoding = response.headers()
+                    .get(reqwest::header::CONTENT_ENCODING)
+                    .and_then(|v| v.to_str().ok())
+                    .map(str::to_string);
+                let body = self.read_capped(response).await?;
+                return encoding::decode_html(&body, content_encoding.as_deref(), self.max_page_bytes);
+            }
+            
+            let retryable = status == reqwest::StatusCode::TOO_MANY_REQUESTS || status.is_server_error();
+            if !retryable || attempt >= self.max_retries {
+                return Err(AppError::HttpStatus(status).into());
+            }
+            
+            let delay = response.headers()
+                .get(reqwest::header::RETRY_AFTER)
+                .and_then(|v| v.to_str().ok())
+                .and_then(|v| Self::parse_retry_after(v, std::time::SystemTime::now()))
+                .map(|d| d.min(MAX_RETRY_AFTER))
+                .unwrap_or(backoff);
+            
+            // Sleeping past the budget would only time out; let the next mirror have the time
+            if delay >= deadline.saturating_duration_since(tokio::time::Instant::now()) {
+                self.debug(&format!("{} asked to wait {}s, longer than this mirror has left; giving up on it", url, delay.as_secs()));
+                return Err(AppError::HttpStatus(status).into());
+            }
+            
+            attempt += 1;
+            tokio::time::sleep(delay).await;
+        }
+    }
+    
+    // Image bytes for Book::cover_url, held to the same size cap as a page. Not retried:
+    // a missing cover only leaves the preview without a picture.
+    pub async fn fetch_cover(&self, url: &str) -> Result<Vec<u8>> {
+        let response = self.client.get(url).send().await.map_err(|e| {
+            let error = crate::error::request_error(&e);
+            anyhow::Error::new(e).context(error)
+        })?;
         if !response.status().is_success() {
-            anyhow::bail!("HTTP error: {}", response.status());
+            return Err(AppError::HttpStatus(response.status()).into());
+        }
+        self.read_capped(response).await
+    }
+    
+    // Stops reading as soon as the page passes the cap instead of buffering all of it
+    async fn read_capped(&self, mut response: reqwest::Response) -> Result<Vec<u8>> {
+        if response.content_length().map_or(false, |len| len > self.max_page_bytes as u64) {
+            return Err(AppError::PageTooLarge(self.max_page_bytes).into());
+        }
+        
+        let mut body = Vec::new();
+        while let Some(chunk) = response.chunk().await.context("Failed to read response body")? {
+            if body.len() + chunk.len() > self.max_page_bytes {
+                return Err(AppError::PageTooLarge(self.max_page_bytes).into());
+            }
+            body.extend_from_slice(&chunk);
+        }
+        
+        Ok(body)
+    }
+    
+    // Retry-After is either delay-seconds or an IMF-fixdate like "Sun, 06 Nov 1994 08:49:37 GMT"
+    pub(crate) fn parse_retry_after(value: &str, now: std::time::SystemTime) -> Option<Duration> {
+        let value = value.trim();
+        
+        if let Ok(seconds) = value.parse::<u64>() {
+            return Some(Duration::from_secs(seconds));
+        }
+        
+        let parts: Vec<&str> = value.split_whitespace().collect();
+        if parts.len() != 6 || parts[5] != "GMT" {
+            return None;
         }
         
-        response.text().await.context("Failed to read response body")
+        let day: i64 = parts[1].parse().ok()?;
+        let month = ["Jan", "Feb", "Mar", "Apr", "May", "Jun", "Jul", "Aug", "Sep", "Oct", "Nov", "Dec"]
+            .iter()
+            .position(|m| *m == parts[2])? as i64 + 1;
+        let year: i64 = parts[3].parse().ok()?;
+        
+        let time: Vec<i64> = parts[4].split(':').filter_map(|t| t.parse().ok()).collect();
+        if time.len() != 3 {
+            return None;
+        }
+        
+        // Days since the Unix epoch (Howard Hinnant's days_from_civil)
+        let y = if month <= 2 { year - 1 } else { year };
+        let era = (if y >= 0 { y } else { y - 399 }) / 400;
+        let yoe = y - era * 400;
+        let mp = (month + 9) % 12;
+        let doy = (153 * mp + 2) / 5 + day - 1;
+        let doe = yoe * 365 + yoe / 4 - yoe / 100 + doy;
+        let days = era * 146097 + doe - 719468;
+        
+        let target = days * 86400 + time[0] * 3600 + time[1] * 60 + time[2];
+        let now = now.duration_since(std::time::UNIX_EPOCH).ok()?.as_secs() as i64;
+        
+        Some(Duration::from_secs((target - now).max(0) as u64))
     }
     
     async fn parse_search_results(&self, html: &str, max_results: usize) -> Result<Vec<Book>> {
+        let (books, matched) = self.parse_search_results_traced(html, max_results);
+        
+        match matched {
+            Some(selector) => self.debug(&format!("search results: selector {:?} matched, {} books parsed", selector, books.len())),
+            None => self.debug("search results: no result selector matched"),
+        }
+        
+        Ok(books)
+    }
+    
+    // Also returns the fallback selector that found the result links
+    fn parse_search_results_traced(&self, html: &str, max_results: usize) -> (Vec<Book>, Option<String>) {
         let document = Html::parse_document(html);
         
-        // Multiple fallback selectors for book links
-        let selectors = [
+        // Multiple fallback selectors for book links; configured ones go first
+        let builtin = [
             "a.js-vim-focus.custom-a",
             "a[href*='md5']",
             ".book-title a",
             "a[href*='book']",
         ];
+        let selectors: Vec<&str> = self.selectors.search.iter().map(String::as_str).chain(builtin).collect();
         
         let mut books = Vec::new();
+        let mut matched = None;
         
-        for selector_str in &selectors {
+        for selector_str in selectors {
             if let Ok(selector) = Selector::parse(selector_str) {
                 let elements: Vec<_> = document.select(&selector).take(max_results * 2).collect();
                 
@@ -128,20 +1015,55 @@ impl AnnaScraper {
                             books.push(book);
                         }
                     }
+                    matched = Some(selector_str.to_string());
                     break;
                 }
             }
         }
         
-        Ok(books)
+        (books, matched)
     }
     
-    async fn parse_download_links(&self, html: &str) -> Result<Vec<DownloadLink>> {
+    async fn parse_download_links(&self, html: &str, page_url: &str) -> Result<Vec<DownloadLink>> {
+        let (links, matched) = self.parse_download_links_traced(html, page_url);
+        
+        match matched {
+            Some(selector) => self.debug(&format!("download links: {:?} matched, {} links parsed", selector, links.len())),
+            None => self.debug("download links: no download section or link selector matched"),
+        }
+        
+        Ok(links)
+    }
+    
+    // Also returns the selector that found the links: a configured one, a section, or "page-wide fallback"
+    fn parse_download_links_traced(&self, html: &str, page_url: &str) -> (Vec<DownloadLink>, Option<String>) {
         let document = Html::parse_document(html);
+        // Relative hrefs are resolved against the page they came from
+        let base = reqwest::Url::parse(page_url).ok();
         let mut links = Vec::new();
+        let mut matched = None;
+        
+        // Configured selectors replace the built-in lookup whenever they find anything
+        let mut seen_urls = std::collections::HashSet::new();
+        for selector_str in &self.selectors.links {
+            if let Ok(selector) = Selector::parse(selector_str) {
+                for element in document.select(&selector) {
+                    if let Some(link) = self.extract_download_link(element, base.as_ref()) {
+                        if seen_urls.insert(link.url.clone()) {
+                            links.push(link);
+                            matched.get_or_insert_with(|| selector_str.clone());
+                        }
+                    }
+                }
+            }
+        }
+        if !links.is_empty() {
+            return (links, matched);
+        }
         
         // Look for external download section
         let section_selectors = [
+            "#md5-panel-downloads",
             "#external-downloads",
             ".external-downloads",
             "[data-section='downloads']",
@@ -150,7 +1072,11 @@ impl AnnaScraper {
         for selector_str in &section_selectors {
             if let Ok(selector) = Selector::parse(selector_str) {
                 if let Some(section) = document.select(&selector).next() {
-                    links.extend(self.extract_links_from_section(&section));
+                    let found = self.extract_links_from_section(&section, base.as_ref());
+                    if !found.is_empty() && matched.is_none() {
+                        matched = Some(selector_str.to_string());
+                    }
+                    links.extend(found);
                 }
             }
         }
@@ -165,12 +1091,10 @@ impl AnnaScraper {
                 ".download-link",
             ];
             
-            let mut seen_urls = std::collections::HashSet::new();
-
             for selector_str in &link_selectors {
                 if let Ok(selector) = Selector::parse(selector_str) {
                     for element in document.select(&selector) {
-                        if let Some(link) = self.extract_download_link(element) {
+                        if let Some(link) = self.extract_download_link(element, base.as_ref()) {
                             if seen_urls.insert(link.url.clone()) {
                                 links.push(link);
                             }
@@ -178,14 +1102,27 @@ impl AnnaScraper {
                     }
                 }
             }
+            
+            if !links.is_empty() {
+                matched = Some("page-wide fallback".to_string());
+            }
         }
         
-        Ok(links)
+        (links, matched)
     }
     
     fn extract_book_info(&self, element: &scraper::ElementRef, _document: &Html) -> Option<Book> {
         let href = element.value().attr("href")?.to_string();
-        let title = element.text().collect::<String>().trim().to_string();
+        // Current result cards wrap the metadata lines and an <h3> title in the link
+        let title = Selector::parse("h3")
+            .ok()
+            .and_then(|selector| element.select(&selector).next())
+            .unwrap_or(*element)
+            .text()
+            .collect::<String>()
+            .split_whitespace()
+            .collect::<Vec<_>>()
+            .join(" ");
         
         if title.is_empty() {
             return None;
@@ -195,14 +1132,20 @@ impl AnnaScraper {
         let container = self.find_book_container(*element)?;
         let container_text = container.text().collect::<String>();
         
+        let url = format!("https://annas-archive.org{}", href);
+        
         Some(Book {
             title: title.clone(),
-            author: self.extract_author(&container_text, &title),
+            author: self.extract_author_structured(element)
+                .unwrap_or_else(|| self.extract_author(&container_text, &title)),
             year: self.extract_year(&container_text),
             language: self.extract_language(&container_text),
             format: self.extract_format(&container_text),
             size: self.extract_size(&container_text),
-            url: format!("https://annas-archive.org{}", href),
+            md5: extract_md5(&url),
+            downloads: self.extract_downloads(&container_text),
+            cover_url: extract_cover_url(element).or_else(|| extract_cover_url(&container)),
+            url,
         })
     }
     
@@ -226,7 +1169,34 @@ impl AnnaScraper {
         None
     }
     
+    // Current cards give the author its own line after the <h3> title and the publisher line.
+    // Reading that line avoids the whole-card heuristics below, which can pick up pieces of a
+    // title that wraps across lines. Returns None for cards without an <h3>, and Some(None)
+    // for current cards that list no author.
+    fn extract_author_structured(&self, element: &scraper::ElementRef) -> Option<Option<String>> {
+        let selector = Selector::parse("h3").ok()?;
+        let heading = element.select(&selector).next()?;
+        
+        // The publisher line is italic too but only truncates; the author line clamps to two lines
+        let author = heading.next_siblings()
+            .filter_map(scraper::ElementRef::wrap)
+            .filter(|line| {
+                let classes: Vec<&str> = line.value().classes().collect();
+                classes.contains(&"italic") && classes.iter().any(|c| c.contains("line-clamp"))
+            })
+            .map(|line| line.text().collect::<String>().split_whitespace().collect::<Vec<_>>().join(" "))
+            .find(|line| !line.is_empty())
+            .and_then(|line| Self::join_authors(&line));
+        
+        Some(author)
+    }
+    
     fn extract_author(&self, text: &str, exclude: &str) -> Option<String> {
+        // Prefer the segment right before a language tag, e.g. "Author A, Author B [en]"
+        if let Some(authors) = self.extract_author_before_lang(text, exclude) {
+            return Some(authors);
+        }
+        
         // Look for author patterns in text
         let lines: Vec<&str> = text.lines().collect();
         for line in lines {
@@ -234,14 +1204,58 @@ impl AnnaScraper {
             if line.is_empty() || line == exclude { continue; }
             // Author usually appears as a name without brackets or special chars
             if line.len() < 50 && !line.starts_with('[') && !line.contains("http") {
-                if line.chars().all(|c| c.is_alphabetic() || c.is_whitespace() || c == ',' || c == '.') {
-                    return Some(line.to_string());
+                if line.chars().all(|c| c.is_alphabetic() || c.is_whitespace() || c == ',' || c == '.' || c == '&') {
+                    return Self::join_authors(line);
                 }
             }
         }
         None
     }
     
+    fn extract_author_before_lang(&self, text: &str, exclude: &str) -> Option<String> {
+        let re = regex::Regex::new(r"(?m)^[ \t]*([^\[\n]+?)[ \t]*\[[a-z]{2,3}\]").ok()?;
+        
+        for caps in re.captures_iter(text) {
+            let mut segment = caps.get(1)?.as_str().trim();
+            
+            // Drop the title when it shares the line with the author
+            if !exclude.is_empty() {
+                if let Some(rest) = segment.strip_prefix(exclude) {
+                    segment = rest.trim_start_matches(|c: char| c.is_whitespace() || c == '-' || c == ':' || c == ',');
+                }
+            }
+            
+            // A lone word such as "English [en]" is the language label, not an author
+            if segment.is_empty() || (segment.split_whitespace().count() < 2 && !segment.contains(',')) {
+                continue;
+            }
+            
+            if let Some(authors) = Self::join_authors(segment) {
+                return Some(authors);
+            }
+        }
+        
+        None
+    }
+    
+    fn join_authors(segment: &str) -> Option<String> {
+        let re = regex::Regex::new(r"\s*(?:,|&|;|\band\b)\s*").ok()?;
+        let mut authors: Vec<&str> = Vec::new();
+        
+        for author in re.split(segment) {
+            let author = author.trim();
+            if !author.is_empty() && !authors.contains(&author) {
+                authors.push(author);
+            }
+        }
+        
+        if authors.is_empty() {
+            None
+        } else {
+            Some(authors.join(", "))
+        }
+    }
+    
     fn extract_year(&self, text: &str) -> Option<String> {
         let re = regex::Regex::new(r"\b(19|20)\d{2}\b").ok()?;
         re.find(text).map(|m| m.as_str().to_string())
@@ -253,8 +1267,38 @@ impl AnnaScraper {
     }
     
     fn extract_format(&self, text: &str) -> Option<String> {
-        let re = regex::Regex::new(r"\b(EPUB|PDF|MOBI|AZW3|TXT|DOC|DOCX)\b").ok()?;
-        re.find(text).map(|m| m.as_str().to_string())
+        let re = regex::Regex::new(r"(?i)\b(EPUB|PDF|MOBI|AZW3|TXT|DOCX?|DJVU|FB2|CBZ|CBR)\b").ok()?;
+        re.find(text).map(|m| m.as_str().to_uppercase())
+    }
+    
+    fn extract_downloads(&self, text: &str) -> u64 {
+        let patterns = [
+            r"(?i)(\d[\d,.]*\s*[km]?)\s*(?:downloads|downloaded|views)\b",
+            r"(?i)(?:downloads|views)\s*:?\s*(\d[\d,.]*\s*[km]?)",
+        ];
+        
+        for pattern in &patterns {
+            if let Ok(re) = regex::Regex::new(pattern) {
+                if let Some(count) = re.captures(text).and_then(|c| Self::parse_count(&c[1])) {
+                    return count;
+                }
+            }
+        }
+        
+        0
+    }
+    
+    // "1,234" -> 1234, "1.2k" -> 1200, "3M" -> 3000000
+    fn parse_count(raw: &str) -> Option<u64> {
+        let raw = raw.trim().to_lowercase();
+        let (number, multiplier) = match raw.chars().last()? {
+            'k' => (raw[..raw.len() - 1].trim().to_string(), 1_000.0),
+            'm' => (raw[..raw.len() - 1].trim().to_string(), 1_000_000.0),
+            _ => (raw.clone(), 1.0),
+        };
+        
+        let value: f64 = number.replace(',', "").parse().ok()?;
+        Some((value * multiplier).round() as u64)
     }
     
     fn extract_size(&self, text: &str) -> Option<String> {
@@ -262,7 +1306,7 @@ impl AnnaScraper {
         re.find(text).map(|m| m.as_str().to_string())
     }
     
-    fn extract_links_from_section(&self, section: &scraper::ElementRef) -> Vec<DownloadLink> {
+    fn extract_links_from_section(&self, section: &scraper::ElementRef, base: Option<&reqwest::Url>) -> Vec<DownloadLink> {
         let mut links = Vec::new();
         let mut seen_urls = std::collections::HashSet::new();
         
@@ -271,12 +1315,13 @@ impl AnnaScraper {
             "a[href*='download']",
             "a.download-link",
             "a[href*='mirror']",
+            "a.js-download-link",
         ];
         
         for selector_str in &link_selectors {
             if let Ok(selector) = Selector::parse(selector_str) {
                 for element in section.select(&selector) {
-                    if let Some(link) = self.extract_download_link(element) {
+                    if let Some(link) = self.extract_download_link(element, base) {
                         if seen_urls.insert(link.url.clone()) {
                             links.push(link);
                         }
@@ -288,19 +1333,42 @@ impl AnnaScraper {
         links
     }
     
-    fn extract_download_link(&self, element: scraper::ElementRef) -> Option<DownloadLink> {
-        let href = element.value().attr("href")?.to_string();
+    fn extract_download_link(&self, element: scraper::ElementRef, base: Option<&reqwest::Url>) -> Option<DownloadLink> {
+        let href = element.value().attr("href")?.trim();
         let text = element.text().collect::<String>().trim().to_string();
+        let url = Self::resolve_href(href, base)?;
+        let source = self.detect_source(&url);
+        let url = match self.ipfs_gateway.as_deref() {
+            Some(gateway) if source == "IPFS" => rewrite_ipfs_url(&url, gateway).unwrap_or(url),
+            _ => url,
+        };
         
         Some(DownloadLink {
             text,
-            url: href.clone(),
-            source: self.detect_source(&href),
+            source,
+            url,
         })
     }
     
+    fn resolve_href(href: &str, base: Option<&reqwest::Url>) -> Option<String> {
+        if href.is_empty() {
+            return None;
+        }
+        
+        match reqwest::Url::parse(href) {
+            Ok(_) => Some(href.to_string()),
+            Err(_) => match base {
+                Some(base) => base.join(href).ok().map(|url| url.to_string()),
+                None => Some(href.to_string()),
+            },
+        }
+    }
+    
     fn detect_source(&self, href: &str) -> String {
-        if href.contains("libgen") {
+        // First: gateway links carry a ?filename= that may mention any other source
+        if is_ipfs_url(href) {
+            "IPFS".to_string()
+        } else if href.contains("libgen") {
             "LibGen".to_string()
         } else if href.contains("annas") {
             "Anna's Archive".to_string()
@@ -337,9 +1405,231 @@ impl DownloadLink {
     }
 }
 
+// The first result in the best format available, e.g. ["epub", "pdf"] takes an EPUB from
+// anywhere in the list over a PDF at the top. With no match, or no priority, the top result.
+pub fn pick_by_format<'a>(books: &'a [Book], priority: &[String]) -> Option<&'a Book> {
+    let normalize = |format: &str| format.trim().trim_start_matches('.').to_ascii_lowercase();
+    priority.iter()
+        .map(|wanted| normalize(wanted))
+        .find_map(|wanted| books.iter().find(|book| book.format.as_deref().map(normalize).as_deref() == Some(wanted.as_str())))
+        .or_else(|| books.first())
+}
+
+// Prefers a LibGen mirror, otherwise the first link on the page
+pub fn preferred_link(links: &[DownloadLink]) -> Option<&DownloadLink> {
+    preferred_source_index(links)
+        .map(|i| &links[i])
+        .or_else(|| links.first())
+}
+
+// Every link, the one preferred_link picks first and the rest in page order
+pub fn links_by_priority(links: &[DownloadLink]) -> Vec<&DownloadLink> {
+    let first = preferred_source_index(links).unwrap_or(0);
+    links.get(first).into_iter()
+        .chain(links.iter().enumerate().filter(|(i, _)| *i != first).map(|(_, link)| link))
+        .collect()
+}
+
+// Share of the metadata a result card filled in, from 0.0 (title only) to 1.0
+fn completeness(book: &Book) -> f64 {
+    let fields = [
+        book.author.is_some(),
+        book.year.is_some(),
+        book.language.is_some(),
+        book.format.is_some(),
+        book.size.is_some(),
+        book.md5.is_some(),
+    ];
+    fields.iter().filter(|filled| **filled).count() as f64 / fields.len() as f64
+}
+
+// Compared as a tuple: cards that look complete count first, so a pile of bare titles never
+// beats one full card; the total completeness breaks ties
+fn result_quality(books: &[Book]) -> (usize, f64) {
+    let complete = books.iter().filter(|book| completeness(book) >= COMPLETE_RESULTS).count();
+    (complete, books.iter().map(completeness).sum())
+}
+
+// Below this average completeness a result page is treated as malformed
+const COMPLETE_RESULTS: f64 = 0.5;
+
+fn looks_complete(books: &[Book]) -> bool {
+    !books.is_empty() && books.iter().map(completeness).sum::<f64>() / books.len() as f64 >= COMPLETE_RESULTS
+}
+
+// A real results page, even an empty one, has a header, search form and footer
+const MIN_PAGE_ELEMENTS: usize = 10;
+// Titles of error, block and challenge pages that mirrors or their CDNs serve with a 200
+const BLOCK_PAGE_TITLES: &[&str] = &["error", "blocked", "access denied", "forbidden", "captcha", "just a moment", "attention required", "ddos"];
+
+// Why a page that parsed to no results probably isn't an empty search, or None when it looks
+// like one. The HTML parser never fails, so broken markup only shows up as a thin document.
+fn page_problem(html: &str) -> Option<String> {
+    let document = Html::parse_document(html);
+    let title = Selector::parse("title").ok()
+        .and_then(|selector| document.select(&selector).next())
+        .map(|title| title.text().collect::<String>().trim().to_string())
+        .unwrap_or_default();
+    // The query is in a results page's title, so "Trial and Error" mustn't count as an error page
+    let lower = title.to_lowercase();
+    if !lower.starts_with("search") && BLOCK_PAGE_TITLES.iter().any(|word| lower.contains(word)) {
+        return Some(format!("its title is \"{}\"", truncate_chars(&title, 60)));
+    }
+
+    if !html.to_ascii_lowercase().contains("<body") {
+        return Some("it has no <body>".to_string());
+    }
+    let elements = document.root_element().descendants().filter(|node| node.value().is_element()).count();
+    if elements < MIN_PAGE_ELEMENTS {
+        return Some(format!("it has only {} HTML elements", elements));
+    }
+    None
+}
+
+// The first http(s) <img> inside the element; lazy-loading placeholders (data: URIs) are skipped
+fn extract_cover_url(element: &scraper::ElementRef) -> Option<String> {
+    let selector = Selector::parse("img[src]").ok()?;
+    element.select(&selector)
+        .filter_map(|img| img.value().attr("src"))
+        .map(str::trim)
+        .find_map(|src| {
+            if src.starts_with("https://") || src.starts_with("http://") {
+                Some(src.to_string())
+            } else {
+                src.strip_prefix("//").map(|rest| format!("https://{}", rest))
+            }
+        })
+}
+
+// The LibGen mirror preferred_link would pick, without its fallback to the first link
+pub fn preferred_source_index(links: &[DownloadLink]) -> Option<usize> {
+    links.iter().position(|l| l.text.to_lowercase().contains("libgen"))
+}
+
+// Path (/ipfs/<cid>), subdomain (<cid>.ipfs.<host>) and known-gateway links
+pub fn is_ipfs_url(url: &str) -> bool {
+    let parsed = match reqwest::Url::parse(url) {
+        Ok(parsed) => parsed,
+        Err(_) => return url.starts_with("ipfs://"),
+    };
+    if parsed.scheme() == "ipfs" || parsed.path().starts_with("/ipfs/") {
+        return true;
+    }
+    
+    let host = parsed.host_str().unwrap_or("").to_ascii_lowercase();
+    host.contains(".ipfs.") || IPFS_GATEWAYS.iter().any(|g| host == *g || host.ends_with(&format!(".{}", g)))
+}
+
+// The same content through `gateway`, as <gateway>/ipfs/<cid>/<rest>; None if no CID is found
+pub fn rewrite_ipfs_url(url: &str, gateway: &str) -> Option<String> {
+    let parsed = reqwest::Url::parse(url).ok()?;
+    let host = parsed.host_str().unwrap_or("");
+    
+    let path = if parsed.scheme() == "ipfs" {
+        format!("/ipfs/{}{}", host, parsed.path())
+    } else if parsed.path().starts_with("/ipfs/") {
+        parsed.path().to_string()
+    } else {
+        let (cid, _) = host.split_once(".ipfs.")?;
+        format!("/ipfs/{}{}", cid, parsed.path())
+    };
+    let path = path.trim_end_matches('/');
+    
+    Some(match parsed.query() {
+        Some(query) => format!("{}{}?{}", gateway.trim_end_matches('/'), path, query),
+        None => format!("{}{}", gateway.trim_end_matches('/'), path),
+    })
+}
+
+// Details only the book page has; None when the page doesn't say
+#[derive(Debug, Clone, Default, PartialEq, Serialize)]
+pub struct BookMetadata {
+    pub edition: Option<String>,
+    pub pages: Option<u32>,
+}
+
+// Reads the page's visible text, e.g. "20th Anniversary Edition" from the title or "352 pages".
+// Text nodes are joined by newlines, which the patterns don't cross, so a year in one element
+// and "Pages:" in the next can't run together.
+pub fn parse_book_metadata(html: &str) -> BookMetadata {
+    let document = Html::parse_document(html);
+    let text = match Selector::parse("main").ok().and_then(|s| document.select(&s).next()) {
+        Some(main) => main.text().collect::<Vec<_>>().join("\n"),
+        None => document.root_element().text().collect::<Vec<_>>().join("\n"),
+    };
+    
+    let edition = regex::Regex::new(
+        r"(?i)\b(?:(?:\d{1,3}(?:st|nd|rd|th)|first|second|third|fourth|fifth|sixth|seventh|eighth|ninth|tenth|revised|updated|expanded|international|anniversary)[ \t]+){1,3}(?:edition|ed\.)",
+    )
+        .ok()
+        .and_then(|re| re.find(&text).map(|m| m.as_str().to_string()));
+    let pages = [r"(?i)\bpages:[ \t]*(\d{1,5})\b", r"(?i)\b(\d{1,5})[ \t]*(?:pages|pp)\b"]
+        .iter()
+        .filter_map(|pattern| regex::Regex::new(pattern).ok()?.captures(&text)?.get(1)?.as_str().parse::<u32>().ok())
+        .find(|&pages| pages > 0);
+    
+    BookMetadata { edition, pages }
+}
+
+// Each source once, in the order the page lists it
+pub fn distinct_sources(links: &[DownloadLink]) -> Vec<String> {
+    let mut sources: Vec<String> = Vec::new();
+    for link in links {
+        if !sources.contains(&link.source) {
+            sources.push(link.source.clone());
+        }
+    }
+    sources
+}
+
 #[cfg(test)]
 mod tests {
     use super::*;
+    use crate::test_support::{http_response, http_response_unsized, http_response_with, serve_capture, serve_hanging, serve_once, serve_sequence, test_book};
+
+    #[test]
+    fn test_truncate_chars_keeps_multibyte_characters_whole() {
+        assert_eq!(truncate_chars("Les Misérables", 10), "Les Misér");
+        assert_eq!(truncate_chars("三体：地球往事", 2), "三体");
+        assert_eq!(truncate_chars("short", 50), "short");
+        assert_eq!(truncate_chars("", 3), "");
+    }
+
+    #[test]
+    fn test_file_stem_with_non_ascii_title() {
+        let book = test_book(&"三".repeat(60)).author("刘慈欣").build();
+        
+        let stem = book.file_stem();
+        assert_eq!(stem, format!("{} - 刘慈欣", "三".repeat(50)));
+        assert!(std::str::from_utf8(stem.as_bytes()).is_ok());
+        
+        let accented = test_book(&format!("{}é", "a".repeat(49))).author("刘慈欣").build();
+        assert_eq!(accented.file_stem(), format!("{}é - 刘慈欣", "a".repeat(49)));
+    }
+
+    #[test]
+    fn test_file_stem_caps_long_authors_and_titles() {
+        let authors = (0..200).map(|i| format!("Author Number {}", i)).collect::<Vec<_>>().join(", ");
+        let book = test_book(&"T".repeat(500)).author(authors.as_str()).build();
+        assert_eq!(book.file_stem(), format!("{} - {}", "T".repeat(50), &authors[..60]));
+        
+        // In CJK both caps are still over the byte budget: the title shrinks before the author
+        let cjk = test_book(&"三".repeat(500)).author("刘".repeat(500).as_str()).build();
+        let stem = cjk.file_stem();
+        assert!(stem.len() <= FILE_STEM_MAX_BYTES, "{} bytes", stem.len());
+        let (title, author) = stem.split_once(" - ").unwrap();
+        assert_eq!(title, "三".repeat(FILE_STEM_MIN_TITLE_CHARS));
+        assert!(author.chars().all(|c| c == '刘'));
+        assert!(author.chars().count() > FILE_STEM_MIN_TITLE_CHARS);
+    }
+
+    #[test]
+    fn test_truncate_bytes_keeps_whole_chars() {
+        assert_eq!(truncate_bytes("abc", 10), "abc");
+        assert_eq!(truncate_bytes("abc", 2), "ab");
+        assert_eq!(truncate_bytes("三体", 4), "三");
+        assert_eq!(truncate_bytes("三体", 2), "");
+    }
 
     #[test]
     fn test_extract_year() {
@@ -349,6 +1639,19 @@ mod tests {
         assert_eq!(scraper.extract_year("No Year Here"), None);
     }
 
+    #[test]
+    fn test_language_name() {
+        assert_eq!(language_name("en"), "English");
+        assert_eq!(language_name("FR"), "French");
+        assert_eq!(language_name("zh"), "Chinese");
+        // Already a name, or a code we don't know: shown as-is
+        assert_eq!(language_name("English"), "English");
+        assert_eq!(language_name("xx"), "xx");
+
+        assert_eq!(language_label("en"), "English (en)");
+        assert_eq!(language_label("xx"), "xx");
+    }
+
     #[test]
     fn test_extract_language() {
         let scraper = AnnaScraper::new().unwrap();
@@ -382,6 +1685,53 @@ mod tests {
         assert_eq!(scraper.detect_source("http://unknown.com"), "Unknown");
     }
 
+    #[test]
+    fn test_detect_source_recognises_ipfs_gateways() {
+        let scraper = AnnaScraper::new().unwrap();
+        let cid = "bafykbzacedtbmzflvgqlzjbqhshztcb2yowc5xyjn6d6hdkl3jpwgt5mwtw3q";
+        let urls = [
+            format!("https://ipfs.io/ipfs/{}?filename=book.epub", cid),
+            format!("https://cloudflare-ipfs.com/ipfs/{}", cid),
+            format!("https://{}.ipfs.dweb.link/?filename=book.epub", cid),
+            format!("https://my-gateway.example/ipfs/{}", cid),
+            format!("https://gateway.pinata.cloud/ipfs/{}", cid),
+            // The filename mentions libgen, but the link is still an IPFS one
+            format!("https://ipfs.io/ipfs/{}?filename=libgen.li%20book.pdf", cid),
+        ];
+        for url in &urls {
+            assert_eq!(scraper.detect_source(url), "IPFS", "{}", url);
+        }
+        assert_eq!(scraper.detect_source("https://example.com/ipfs-guide"), "Unknown");
+        assert_eq!(scraper.detect_source("https://notipfs.io/file"), "Unknown");
+    }
+
+    #[test]
+    fn test_rewrite_ipfs_url() {
+        let gateway = "https://gw.example/";
+        assert_eq!(
+            rewrite_ipfs_url("https://ipfs.io/ipfs/bafyabc?filename=book.epub", gateway).as_deref(),
+            Some("https://gw.example/ipfs/bafyabc?filename=book.epub")
+        );
+        assert_eq!(
+            rewrite_ipfs_url("https://bafyabc.ipfs.dweb.link/dir/book.epub", gateway).as_deref(),
+            Some("https://gw.example/ipfs/bafyabc/dir/book.epub")
+        );
+        assert_eq!(rewrite_ipfs_url("https://dweb.link/about", gateway), None);
+    }
+
+    #[test]
+    fn test_ipfs_gateway_rewrites_only_ipfs_links() {
+        let scraper = AnnaScraper::new().unwrap().with_ipfs_gateway(Some("https://gw.example/".to_string()));
+        let html = r#"<div id="md5-panel-downloads">
+            <a class="js-download-link" href="https://cloudflare-ipfs.com/ipfs/bafyabc?filename=b.epub">IPFS Gateway #1</a>
+            <a class="js-download-link" href="https://libgen.li/ads.php?md5=abc">Libgen.li</a>
+        </div>"#;
+        let (links, _) = scraper.parse_download_links_traced(html, "https://annas-archive.org/md5/abc");
+        let urls: Vec<&str> = links.iter().map(|l| l.url.as_str()).collect();
+        assert!(urls.contains(&"https://gw.example/ipfs/bafyabc?filename=b.epub"), "{:?}", urls);
+        assert!(urls.contains(&"https://libgen.li/ads.php?md5=abc"), "{:?}", urls);
+    }
+
     #[tokio::test]
     async fn test_parse_search_results() {
         let scraper = AnnaScraper::new().unwrap();
@@ -415,20 +1765,278 @@ mod tests {
         // Existing selectors: "a.js-vim-focus.custom-a"
         // This matches our mock.
 
-        assert_eq!(books.len(), 2);
+        assert_eq!(books.len(), 2);
+
+        assert_eq!(books[0].title, "Test Book");
+        assert_eq!(books[0].url, "https://annas-archive.org/md5/12345");
+        // extract_year regex: r"\b(19|20)\d{2}\b"
+        assert_eq!(books[0].year.as_deref(), Some("2023"));
+        // extract_language regex: r"(\w+)\s+\[([a-z]{2})\]" -> matches "English [en]"
+        assert_eq!(books[0].language.as_deref(), Some("English"));
+        assert_eq!(books[0].format.as_deref(), Some("PDF"));
+        assert_eq!(books[0].size.as_deref(), Some("1.5MB"));
+
+        assert_eq!(books[1].title, "Another Book");
+        assert_eq!(books[1].author.as_deref(), Some("John Doe"));
+        assert_eq!(books[1].format.as_deref(), Some("EPUB"));
+    }
+
+    #[tokio::test]
+    async fn test_parse_download_links_resolves_relative_urls() {
+        let scraper = AnnaScraper::new().unwrap();
+        let html = r#"
+        <html>
+            <body>
+                <div id="external-downloads">
+                    <a href="/slow_download/abc/0/0" class="download-link">Slow Partner Server #1</a>
+                    <a href="get.php?md5=abc" class="download-link">Libgen mirror</a>
+                    <a href="//libgen.li/ads.php?md5=abc" class="download-link">Libgen.li</a>
+                </div>
+            </body>
+        </html>
+        "#;
+
+        let links = scraper.parse_download_links(html, "https://annas-archive.se/md5/abc").await.unwrap();
+        let url_of = |text: &str| links.iter().find(|l| l.text == text).map(|l| l.url.as_str());
+        assert_eq!(links.len(), 3);
+        assert_eq!(url_of("Slow Partner Server #1"), Some("https://annas-archive.se/slow_download/abc/0/0"));
+        assert_eq!(url_of("Libgen mirror"), Some("https://annas-archive.se/md5/get.php?md5=abc"));
+        assert_eq!(url_of("Libgen.li"), Some("https://libgen.li/ads.php?md5=abc"));
+        assert!(links.iter().all(|l| l.url.starts_with("https://")));
+    }
+
+    #[tokio::test]
+    async fn test_replay_serves_recorded_pages_offline() {
+        let dir = std::env::temp_dir().join(format!("annadl_replay_test_{}", std::time::SystemTime::now().duration_since(std::time::UNIX_EPOCH).unwrap().as_nanos()));
+        let html = include_str!("../tests/fixtures/search_results.html");
+        let base = serve_once(http_response(html.as_bytes())).await;
+        
+        let recorder = AnnaScraper::new().unwrap()
+            .with_mirrors(vec![base.clone()])
+            .with_tape(Some(Tape::Record(dir.clone())));
+        let recorded = recorder.search("pragmatic", &SearchFilters::default(), 10).await.unwrap();
+        
+        // The server is gone: only served once
+        let replayer = AnnaScraper::new().unwrap()
+            .with_mirrors(vec![base.clone()])
+            .with_max_retries(0)
+            .with_tape(Some(Tape::Replay(dir.clone())));
+        let replayed = replayer.search("pragmatic", &SearchFilters::default(), 10).await.unwrap();
+        assert_eq!(replayed.len(), recorded.len());
+        assert_eq!(replayed[0].title, recorded[0].title);
+        
+        assert!(replayer.search("dune", &SearchFilters::default(), 10).await.is_err());
+        
+        std::fs::remove_dir_all(&dir).unwrap();
+    }
+    
+    struct ExpectedBook {
+        title: &'static str,
+        author: Option<&'static str>,
+        year: Option<&'static str>,
+        language: Option<&'static str>,
+        format: Option<&'static str>,
+        size: Option<&'static str>,
+        md5: &'static str,
+        cover: Option<&'static str>,
+    }
+
+    #[tokio::test]
+    async fn test_parse_search_results_fixtures() {
+        let scraper = AnnaScraper::new().unwrap();
+        let cases: Vec<(&str, &str, Vec<ExpectedBook>)> = vec![
+            ("search_results", include_str!("../tests/fixtures/search_results.html"), vec![
+                ExpectedBook {
+                    title: "The Pragmatic Programmer: Your Journey to Mastery, 20th Anniversary Edition",
+                    author: Some("David Thomas, Andrew Hunt"),
+                    year: Some("2019"),
+                    language: Some("English"),
+                    format: Some("EPUB"),
+                    size: Some("2.1MB"),
+                    md5: "4a9c3c8a4e8c5e5f7a0c2b1d9e8f7a6b",
+                    cover: Some("https://covers.example.org/pragmatic.jpg"),
+                },
+                ExpectedBook {
+                    title: "Dune",
+                    author: Some("Frank Herbert"),
+                    year: Some("1990"),
+                    language: Some("English"),
+                    format: Some("PDF"),
+                    size: Some("1.5MB"),
+                    md5: "0f1e2d3c4b5a69788796a5b4c3d2e1f0",
+                    cover: Some("https://covers.example.org/dune.jpg"),
+                },
+                ExpectedBook {
+                    title: "Der Process",
+                    author: Some("Franz Kafka"),
+                    year: Some("1925"),
+                    language: Some("German"),
+                    format: Some("MOBI"),
+                    size: Some("0.4MB"),
+                    md5: "9b8a7c6d5e4f30211203f4e5d6c7b8a9",
+                    cover: Some("https://covers.example.org/process.jpg"),
+                },
+            ]),
+            // The whole-card heuristics would report "Pride" as the author of the wrapped title
+            ("search_results_wrapped", include_str!("../tests/fixtures/search_results_wrapped.html"), vec![
+                ExpectedBook {
+                    title: "Pride and Prejudice",
+                    author: Some("Jane Austen"),
+                    year: Some("2003"),
+                    language: Some("English"),
+                    format: Some("EPUB"),
+                    size: Some("0.6MB"),
+                    md5: "1a2b3c4d5e6f708192a3b4c5d6e7f809",
+                    cover: None,
+                },
+                ExpectedBook {
+                    title: "Frankenstein; or, The Modern Prometheus",
+                    author: Some("Mary Wollstonecraft Shelley"),
+                    year: Some("1994"),
+                    language: Some("English"),
+                    format: Some("PDF"),
+                    size: Some("1.2MB"),
+                    md5: "f0e1d2c3b4a5968778695a4b3c2d1e0f",
+                    cover: None,
+                },
+                // A publisher line without a year must not be mistaken for the author
+                ExpectedBook {
+                    title: "Beowulf",
+                    author: None,
+                    year: None,
+                    language: Some("English"),
+                    format: Some("EPUB"),
+                    size: Some("0.3MB"),
+                    md5: "0a1b2c3d4e5f60718293a4b5c6d7e8f9",
+                    cover: None,
+                },
+            ]),
+            ("search_no_results", include_str!("../tests/fixtures/search_no_results.html"), vec![]),
+        ];
+        
+        for (name, html, expected) in cases {
+            let books = scraper.parse_search_results(html, 10).await.unwrap();
+            assert_eq!(books.len(), expected.len(), "{}: result count", name);
+            
+            for (book, want) in books.iter().zip(&expected) {
+                assert_eq!(book.title, want.title, "{}", name);
+                assert_eq!(book.author.as_deref(), want.author, "{}: {}", name, want.title);
+                assert_eq!(book.year.as_deref(), want.year, "{}: {}", name, want.title);
+                assert_eq!(book.language.as_deref(), want.language, "{}: {}", name, want.title);
+                assert_eq!(book.format.as_deref(), want.format, "{}: {}", name, want.title);
+                assert_eq!(book.size.as_deref(), want.size, "{}: {}", name, want.title);
+                assert_eq!(book.md5.as_deref(), Some(want.md5), "{}: {}", name, want.title);
+                assert_eq!(book.cover_url.as_deref(), want.cover, "{}: {}", name, want.title);
+                assert!(book.url.to_lowercase().ends_with(&format!("/md5/{}", want.md5)), "{}: {}", name, book.url);
+            }
+        }
+    }
+
+    #[test]
+    fn test_traced_parsing_reports_matched_selector() {
+        let scraper = AnnaScraper::new().unwrap();
+        
+        let (books, matched) = scraper.parse_search_results_traced(include_str!("../tests/fixtures/search_results.html"), 10);
+        assert_eq!(books.len(), 3);
+        assert_eq!(matched.as_deref(), Some("a.js-vim-focus.custom-a"));
+        
+        let (books, matched) = scraper.parse_search_results_traced(include_str!("../tests/fixtures/search_no_results.html"), 10);
+        assert!(books.is_empty());
+        assert_eq!(matched, None);
+        
+        let cases = [
+            (include_str!("../tests/fixtures/book_detail.html"), Some("#md5-panel-downloads")),
+            (include_str!("../tests/fixtures/book_detail_legacy.html"), Some("#external-downloads")),
+            (r#"<a href="https://libgen.li/ads.php?md5=abc">Libgen</a>"#, Some("page-wide fallback")),
+            ("<p>nothing here</p>", None),
+        ];
+        for (html, expected) in cases {
+            let (_, matched) = scraper.parse_download_links_traced(html, "https://annas-archive.org/md5/abc");
+            assert_eq!(matched.as_deref(), expected);
+        }
+    }
+
+    #[test]
+    fn test_custom_selectors_are_tried_first() {
+        let html = r#"<div class="book-item hit"><a class="item" href="/md5/0123456789abcdef0123456789abcdef">Dune</a></div>
+            <div id="md5-panel-downloads"><a href="https://libgen.li/ads.php?md5=abc">Libgen</a></div>
+            <span class="get"><a href="https://files.example.com/dune.epub">Direct</a></span>"#;
+        let scraper = AnnaScraper::new().unwrap().with_selectors(CustomSelectors {
+            search: vec!["div.hit a.item".to_string()],
+            links: vec!["span.get a".to_string()],
+        });
+        
+        let (books, matched) = scraper.parse_search_results_traced(html, 10);
+        assert_eq!(books.len(), 1);
+        assert_eq!(matched.as_deref(), Some("div.hit a.item"));
+        
+        let (links, matched) = scraper.parse_download_links_traced(html, "https://annas-archive.org/md5/abc");
+        assert_eq!(matched.as_deref(), Some("span.get a"));
+        assert_eq!(links.len(), 1);
+        assert_eq!(links[0].url, "https://files.example.com/dune.epub");
+        
+        // A configured selector that finds nothing falls back to the built-in lookup
+        let scraper = AnnaScraper::new().unwrap().with_selectors(CustomSelectors {
+            search: vec![".gone".to_string()],
+            links: vec![".gone".to_string()],
+        });
+        assert_eq!(scraper.parse_search_results_traced(html, 10).1.as_deref(), Some("a[href*='md5']"));
+        assert_eq!(scraper.parse_download_links_traced(html, "https://annas-archive.org/md5/abc").1.as_deref(), Some("#md5-panel-downloads"));
+    }
 
-        assert_eq!(books[0].title, "Test Book");
-        assert_eq!(books[0].url, "https://annas-archive.org/md5/12345");
-        // extract_year regex: r"\b(19|20)\d{2}\b"
-        assert_eq!(books[0].year.as_deref(), Some("2023"));
-        // extract_language regex: r"(\w+)\s+\[([a-z]{2})\]" -> matches "English [en]"
-        assert_eq!(books[0].language.as_deref(), Some("English"));
-        assert_eq!(books[0].format.as_deref(), Some("PDF"));
-        assert_eq!(books[0].size.as_deref(), Some("1.5MB"));
+    #[test]
+    fn test_take_invalid_selectors() {
+        let mut selectors = CustomSelectors {
+            search: vec!["a.result".to_string(), "a[href=".to_string()],
+            links: vec![">>".to_string(), "#downloads a".to_string()],
+        };
+        assert_eq!(selectors.take_invalid(), ["a[href=", ">>"]);
+        assert_eq!(selectors.search, ["a.result"]);
+        assert_eq!(selectors.links, ["#downloads a"]);
+    }
 
-        assert_eq!(books[1].title, "Another Book");
-        assert_eq!(books[1].author.as_deref(), Some("John Doe"));
-        assert_eq!(books[1].format.as_deref(), Some("EPUB"));
+    #[tokio::test]
+    async fn test_parse_download_links_fixtures() {
+        let scraper = AnnaScraper::new().unwrap();
+        let cases: Vec<(&str, &str, &str, Vec<(&str, &str, &str)>)> = vec![
+            (
+                "book_detail",
+                include_str!("../tests/fixtures/book_detail.html"),
+                "https://annas-archive.org/md5/4a9c3c8a4e8c5e5f7a0c2b1d9e8f7a6b",
+                vec![
+                    ("Libgen.li", "https://libgen.li/ads.php?md5=4a9c3c8a4e8c5e5f7a0c2b1d9e8f7a6b", "LibGen"),
+                    ("Slow Partner Server #1", "https://annas-archive.org/slow_download/4a9c3c8a4e8c5e5f7a0c2b1d9e8f7a6b/0/0", "Anna's Archive"),
+                    ("Slow Partner Server #2", "https://annas-archive.org/slow_download/4a9c3c8a4e8c5e5f7a0c2b1d9e8f7a6b/0/1", "Anna's Archive"),
+                    ("Libgen.rs Non-Fiction", "http://library.lol/main/4A9C3C8A4E8C5E5F7A0C2B1D9E8F7A6B", "Unknown"),
+                    ("Z-Library", "https://z-lib.gs/md5/4a9c3c8a4e8c5e5f7a0c2b1d9e8f7a6b", "Unknown"),
+                ],
+            ),
+            (
+                "book_detail_legacy",
+                include_str!("../tests/fixtures/book_detail_legacy.html"),
+                "https://annas-archive.se/md5/0f1e2d3c4b5a69788796a5b4c3d2e1f0",
+                vec![
+                    ("Libgen.rs", "http://libgen.rs/book/index.php?md5=0F1E2D3C4B5A69788796A5B4C3D2E1F0", "LibGen"),
+                    ("Fast Partner Server #1", "https://annas-archive.org/fast_download/0f1e2d3c4b5a69788796a5b4c3d2e1f0/0/0", "Anna's Archive"),
+                ],
+            ),
+        ];
+        
+        for (name, html, page_url, expected) in cases {
+            let links = scraper.parse_download_links(html, page_url).await.unwrap();
+            let got: Vec<(&str, &str, &str)> = links
+                .iter()
+                .map(|l| (l.text.as_str(), l.url.as_str(), l.source.as_str()))
+                .collect();
+            assert_eq!(got, expected, "{}", name);
+            assert_eq!(preferred_link(&links).map(|l| l.text.as_str()), Some(expected[0].0), "{}", name);
+        }
+    }
+
+    #[test]
+    fn test_resolve_href_without_base() {
+        assert_eq!(AnnaScraper::resolve_href("/slow_download/x", None), Some("/slow_download/x".to_string()));
+        assert_eq!(AnnaScraper::resolve_href("", None), None);
     }
 
     #[tokio::test]
@@ -447,7 +2055,7 @@ mod tests {
         // selector "#external-downloads" matches.
         // inside, "a.download-link" matches.
 
-        let links = scraper.parse_download_links(html).await.unwrap();
+        let links = scraper.parse_download_links(html, "https://annas-archive.org/md5/abc").await.unwrap();
         assert_eq!(links.len(), 2);
         assert_eq!(links[0].text, "Libgen.li");
         assert_eq!(links[0].source, "LibGen");
@@ -519,6 +2127,38 @@ mod tests {
         assert!(result.is_some() || result == Some("PDF".to_string()));
     }
 
+    #[test]
+    fn test_extract_author_table() {
+        let scraper = AnnaScraper::new().unwrap();
+        let cases = [
+            ("Title\nJane Austen [en]\n2020", "Title", Some("Jane Austen")),
+            ("Title\nAuthor A, Author B, Author C [en]", "Title", Some("Author A, Author B, Author C")),
+            ("Title\nBrian Kernighan & Dennis Ritchie [en]", "Title", Some("Brian Kernighan, Dennis Ritchie")),
+            ("Title\nDavid Thomas and Andrew Hunt [en]", "Title", Some("David Thomas, Andrew Hunt")),
+            ("The Pragmatic Programmer David Thomas, Andrew Hunt [en]", "The Pragmatic Programmer", Some("David Thomas, Andrew Hunt")),
+            ("Title\nEnglish [en]\nJohn Doe", "Title", Some("John Doe")),
+            ("Title\n2023\n1.5MB", "Title", None),
+        ];
+
+        for (text, title, expected) in cases {
+            assert_eq!(
+                scraper.extract_author(text, title).as_deref(),
+                expected,
+                "input: {:?}",
+                text
+            );
+        }
+    }
+
+    #[test]
+    fn test_join_authors_dedupes_and_trims() {
+        assert_eq!(
+            AnnaScraper::join_authors(" Ann Lee ,  Bob Ray & Ann Lee "),
+            Some("Ann Lee, Bob Ray".to_string())
+        );
+        assert_eq!(AnnaScraper::join_authors(" , & "), None);
+    }
+
     #[test]
     fn test_download_link_is_reliable() {
         let link = DownloadLink {
@@ -591,7 +2231,7 @@ mod tests {
             </body>
         </html>
         "#;
-        let links = scraper.parse_download_links(html).await.unwrap();
+        let links = scraper.parse_download_links(html, "https://annas-archive.org/md5/abc").await.unwrap();
         assert_eq!(links.len(), 0);
     }
 
@@ -605,7 +2245,7 @@ mod tests {
             </body>
         </html>
         "#;
-        let links = scraper.parse_download_links(html).await.unwrap();
+        let links = scraper.parse_download_links(html, "https://annas-archive.org/md5/abc").await.unwrap();
         assert_eq!(links.len(), 0);
     }
 
@@ -627,6 +2267,720 @@ mod tests {
         assert!(valid_agents.contains(&agent1.as_str()));
     }
 
+    #[test]
+    fn test_extract_downloads() {
+        let scraper = AnnaScraper::new().unwrap();
+        assert_eq!(scraper.extract_downloads("English [en], pdf, 2.1MB\n1,234 downloads"), 1234);
+        assert_eq!(scraper.extract_downloads("Downloads: 56"), 56);
+        assert_eq!(scraper.extract_downloads("viewed often, 1.2k views"), 1200);
+        assert_eq!(scraper.extract_downloads("No popularity info here"), 0);
+    }
+
+    #[test]
+    fn test_parse_count() {
+        assert_eq!(AnnaScraper::parse_count("1,234"), Some(1234));
+        assert_eq!(AnnaScraper::parse_count("3M"), Some(3_000_000));
+        assert_eq!(AnnaScraper::parse_count("k"), None);
+    }
+
+    #[test]
+    fn test_sort_books() {
+        let mut books = vec![
+            test_book("beta").year("2001").size("2GB").build(),
+            test_book("Alpha").size("500KB").downloads(900).build(),
+            test_book("gamma").year("2020").downloads(40).build(),
+        ];
+        let titles = |mode: SortMode| {
+            let mut sorted = books.clone();
+            sort_books(&mut sorted, mode);
+            sorted.into_iter().map(|b| b.title).collect::<Vec<_>>()
+        };
+
+        assert_eq!(titles(SortMode::Relevance), vec!["beta", "Alpha", "gamma"]);
+        assert_eq!(titles(SortMode::Popular), vec!["Alpha", "gamma", "beta"]);
+        assert_eq!(titles(SortMode::Newest), vec!["gamma", "beta", "Alpha"]);
+        assert_eq!(titles(SortMode::Size), vec!["Alpha", "beta", "gamma"]);
+        assert_eq!(titles(SortMode::Title), vec!["Alpha", "beta", "gamma"]);
+    }
+
+    #[test]
+    fn test_sort_books_breaks_ties_deterministically() {
+        let mut books = vec![
+            test_book("Zeta").year("2001").size("1MB").build(),
+            test_book("alpha").year("2001").size("1MB").build(),
+            test_book("Mid").year("1999").size("1MB").build(),
+            test_book("alpha").year("2010").size("1MB").build(),
+        ];
+        let order = |mode: SortMode| {
+            let mut sorted = books.clone();
+            sort_books(&mut sorted, mode);
+            sorted.into_iter().map(|b| format!("{} {}", b.title, b.year.unwrap_or_default())).collect::<Vec<_>>()
+        };
+
+        assert_eq!(order(SortMode::Newest), ["alpha 2010", "alpha 2001", "Zeta 2001", "Mid 1999"]);
+        assert_eq!(order(SortMode::Size), ["alpha 2001", "alpha 2010", "Mid 1999", "Zeta 2001"]);
+        assert_eq!(order(SortMode::Popular), order(SortMode::Size));
+        assert_eq!(order(SortMode::Title), ["alpha 2010", "alpha 2001", "Mid 1999", "Zeta 2001"]);
+
+        // Equal on every key: the relevance order is kept
+        let mut twins = vec![test_book("Dune").url("a").build(), test_book("dune").url("b").build()];
+        sort_books(&mut twins, SortMode::Newest);
+        assert_eq!(twins[0].url, "a");
+    }
+
+    #[test]
+    fn test_sort_mode_cycles() {
+        let mut mode = SortMode::default();
+        for _ in 0..5 {
+            mode = mode.next();
+        }
+        assert_eq!(mode, SortMode::Relevance);
+        assert_eq!(SortMode::Newest.label(), "newest");
+    }
+
+    #[test]
+    fn test_preferred_link() {
+        let link = |text: &str| DownloadLink {
+            text: text.to_string(),
+            url: format!("https://example.com/{}", text),
+            source: "Other".to_string(),
+        };
+        let links = vec![link("Slow partner"), link("Libgen.li")];
+        assert_eq!(preferred_link(&links).map(|l| l.text.as_str()), Some("Libgen.li"));
+        assert_eq!(preferred_link(&links[..1]).map(|l| l.text.as_str()), Some("Slow partner"));
+        assert!(preferred_link(&[]).is_none());
+        assert_eq!(preferred_source_index(&links), Some(1));
+        assert_eq!(preferred_source_index(&links[..1]), None);
+    }
+
+    #[test]
+    fn test_parse_retry_after() {
+        let now = std::time::UNIX_EPOCH + Duration::from_secs(784111777); // Sun, 06 Nov 1994 08:49:37 GMT
+        assert_eq!(AnnaScraper::parse_retry_after("120", now), Some(Duration::from_secs(120)));
+        assert_eq!(
+            AnnaScraper::parse_retry_after("Sun, 06 Nov 1994 08:50:07 GMT", now),
+            Some(Duration::from_secs(30))
+        );
+        assert_eq!(
+            AnnaScraper::parse_retry_after("Sun, 06 Nov 1994 08:00:00 GMT", now),
+            Some(Duration::ZERO)
+        );
+        assert_eq!(AnnaScraper::parse_retry_after("soon", now), None);
+    }
+
+    #[tokio::test]
+    async fn test_fetch_html_honors_retry_after_on_429() {
+        let base = serve_sequence(vec![
+            http_response_with(429, "Too Many Requests", &[("Retry-After", "1")], b""),
+            http_response(b"<html>ok</html>"),
+        ]).await;
+        let scraper = AnnaScraper::new().unwrap();
+
+        let started = std::time::Instant::now();
+        let html = scraper.fetch_html(&format!("{}/search?q=x", base), DEFAULT_TOTAL_TIMEOUT).await.unwrap();
+
+        assert!(html.contains("ok"));
+        assert!(started.elapsed() >= Duration::from_millis(900));
+    }
+
+    #[tokio::test]
+    async fn test_fetch_html_gives_up_after_max_retries() {
+        let base = serve_sequence(vec![
+            http_response_with(429, "Too Many Requests", &[("Retry-After", "0")], b""),
+            http_response_with(429, "Too Many Requests", &[("Retry-After", "0")], b""),
+        ]).await;
+        let scraper = AnnaScraper::new().unwrap().with_max_retries(1);
+
+        let err = scraper.fetch_html(&format!("{}/search?q=x", base), DEFAULT_TOTAL_TIMEOUT).await.unwrap_err();
+        assert!(matches!(
+            err.downcast_ref::<AppError>(),
+            Some(AppError::HttpStatus(status)) if *status == reqwest::StatusCode::TOO_MANY_REQUESTS
+        ));
+    }
+
+    #[tokio::test]
+    async fn test_retry_after_longer_than_the_budget_moves_to_the_next_mirror() {
+        let limited = serve_once(http_response_with(429, "Too Many Requests", &[("Retry-After", "20")], b"")).await;
+        let healthy = serve_once(http_response(b"<html>ok</html>")).await;
+        let scraper = AnnaScraper::new().unwrap()
+            .with_mirrors(vec![limited, healthy.clone()])
+            .with_total_timeout(Duration::from_secs(10));
+
+        let started = std::time::Instant::now();
+        let (mirror, html) = scraper.fetch_with_fallback("/search?q=x").await.unwrap();
+
+        assert_eq!(mirror, healthy);
+        assert!(html.contains("ok"));
+        assert!(started.elapsed() < Duration::from_secs(3));
+    }
+
+    #[test]
+    fn test_rebase_url() {
+        assert_eq!(
+            AnnaScraper::rebase_url("https://annas-archive.org/md5/abc", "https://annas-archive.se"),
+            "https://annas-archive.se/md5/abc"
+        );
+        assert_eq!(
+            AnnaScraper::rebase_url("http://libgen.rs/book", "https://annas-archive.se"),
+            "http://libgen.rs/book"
+        );
+    }
+
+    #[tokio::test]
+    async fn test_search_streaming_emits_batches() {
+        let mut html = String::from("<html><body>");
+        for i in 0..12 {
+            html.push_str(&format!(
+                r#"<div class="book-item"><a href="/md5/{:032x}" class="js-vim-focus custom-a">Book {}</a> PDF, {}MB</div>"#,
+                i, i, if i == 3 { 900 } else { 1 }
+            ));
+        }
+        html.push_str("</body></html>");
+        
+        let base = serve_once(http_response(html.as_bytes())).await;
+        let scraper = AnnaScraper::new().unwrap().with_mirrors(vec![base.clone()]);
+        let filters = SearchFilters { max_size_mb: Some(100.0), ..Default::default() };
+        
+        let mut batches: Vec<Vec<String>> = Vec::new();
+        let books = scraper.search_streaming("book", &filters, 8, |batch| {
+            batches.push(batch.iter().map(|b| b.title.clone()).collect());
+        }).await.unwrap();
+        
+        assert_eq!(batches.iter().map(|b| b.len()).collect::<Vec<_>>(), [5, 3]);
+        // The oversized book is filtered out before it is streamed
+        assert!(!batches.concat().contains(&"Book 3".to_string()));
+        assert_eq!(books.len(), 8);
+        assert_eq!(batches.concat(), books.iter().map(|b| b.title.clone()).collect::<Vec<_>>());
+        assert!(books.iter().all(|b| b.url.starts_with(&base)));
+    }
+    
+    #[test]
+    fn test_parse_mirror() {
+        assert_eq!(parse_mirror("annas-archive.se").unwrap(), "https://annas-archive.se");
+        assert_eq!(parse_mirror(" https://annas-archive.li/ ").unwrap(), "https://annas-archive.li");
+        assert_eq!(parse_mirror("http://localhost:8080").unwrap(), "http://localhost:8080");
+        assert_eq!(parse_mirror("Annas-Archive.SE").unwrap(), "https://annas-archive.se");
+        assert!(parse_mirror("annas").is_err());
+        assert!(parse_mirror("ftp://annas-archive.se").is_err());
+        assert!(parse_mirror("annas-archive.se/search?q=dune").is_err());
+        assert!(parse_mirror("").is_err());
+    }
+    
+    #[test]
+    fn test_parse_year() {
+        assert_eq!(parse_year("1965"), Some(1965));
+        assert_eq!(parse_year("c. 1965"), Some(1965));
+        assert_eq!(parse_year("1965-03-01"), Some(1965));
+        assert_eq!(parse_year("Unknown"), None);
+        assert_eq!(parse_year("65"), None);
+    }
+    
+    #[test]
+    fn test_parse_year_range() {
+        assert_eq!(parse_year_range("1990-2005"), Some((Some(1990), Some(2005))));
+        assert_eq!(parse_year_range(" 2010- "), Some((Some(2010), None)));
+        assert_eq!(parse_year_range("-1980"), Some((None, Some(1980))));
+        assert_eq!(parse_year_range("1999"), Some((Some(1999), Some(1999))));
+        assert_eq!(parse_year_range(""), None);
+        assert_eq!(parse_year_range("-"), None);
+        assert_eq!(parse_year_range("2005-1990"), None);
+        assert_eq!(parse_year_range("recent"), None);
+    }
+    
+    #[test]
+    fn test_year_permits() {
+        let filters = SearchFilters { min_year: Some(1990), max_year: Some(2005), ..Default::default() };
+        assert!(filters.year_permits(Some("1990")));
+        assert!(filters.year_permits(Some("2005")));
+        assert!(!filters.year_permits(Some("1989")));
+        assert!(!filters.year_permits(Some("2006")));
+        assert!(!filters.year_permits(None));
+        assert!(!filters.year_permits(Some("Unknown")));
+        
+        let filters = SearchFilters { include_unknown_year: true, ..filters };
+        assert!(filters.year_permits(Some("Unknown")));
+        assert!(!filters.year_permits(Some("1800")));
+        
+        // Without a range every book passes, dated or not
+        assert!(SearchFilters::default().year_permits(None));
+        assert_eq!(SearchFilters::default().year_label(), None);
+        assert_eq!(SearchFilters { min_year: Some(2010), ..Default::default() }.year_label().as_deref(), Some("2010-"));
+    }
+    
+    #[tokio::test]
+    async fn test_search_applies_year_range() {
+        let html = r#"<html><body>
+            <div class="book-item"><a href="/md5/0123456789abcdef0123456789abcdef" class="js-vim-focus custom-a">Old</a> EPUB, 1MB, 1971</div>
+            <div class="book-item"><a href="/md5/fedcba9876543210fedcba9876543210" class="js-vim-focus custom-a">New</a> EPUB, 1MB, 2015</div>
+            <div class="book-item"><a href="/md5/00000000000000000000000000000000" class="js-vim-focus custom-a">Undated</a> EPUB, 1MB</div>
+        </body></html>"#;
+        let filters = SearchFilters { min_year: Some(2000), ..Default::default() };
+        
+        let base = serve_once(http_response(html.as_bytes())).await;
+        let scraper = AnnaScraper::new().unwrap().with_mirrors(vec![base]);
+        let books = scraper.search("book", &filters, 5).await.unwrap();
+        assert_eq!(books.iter().map(|b| b.title.as_str()).collect::<Vec<_>>(), ["New"]);
+        
+        let base = serve_once(http_response(html.as_bytes())).await;
+        let scraper = AnnaScraper::new().unwrap().with_mirrors(vec![base]);
+        let filters = SearchFilters { include_unknown_year: true, ..filters };
+        let books = scraper.search("book", &filters, 5).await.unwrap();
+        assert_eq!(books.iter().map(|b| b.title.as_str()).collect::<Vec<_>>(), ["New", "Undated"]);
+    }
+    
+    // Stands in for a machine with no network: every lookup fails
+    struct NoDns;
+    
+    impl reqwest::dns::Resolve for NoDns {
+        fn resolve(&self, _name: reqwest::dns::Name) -> reqwest::dns::Resolving {
+            Box::pin(async { Err("failed to lookup address information: Temporary failure in name resolution".into()) })
+        }
+    }
+    
+    #[tokio::test]
+    async fn test_dns_failure_is_reported_as_offline() {
+        let client = AnnaScraper::client_builder()
+            .dns_resolver(std::sync::Arc::new(NoDns))
+            .build()
+            .unwrap();
+        let scraper = AnnaScraper::from_client(client)
+            .with_mirrors(vec!["http://annas-archive.test".to_string()])
+            .with_max_retries(0);
+        
+        let err = scraper.search("dune", &SearchFilters::default(), 5).await.unwrap_err();
+        assert!(matches!(err.downcast_ref::<AppError>(), Some(AppError::Offline)));
+        assert_eq!(crate::error::exit_code(&err), crate::error::EXIT_NETWORK);
+    }
+    
+    #[tokio::test]
+    async fn test_refused_connection_is_not_offline() {
+        let listener = std::net::TcpListener::bind("127.0.0.1:0").unwrap();
+        let base = format!("http://{}", listener.local_addr().unwrap());
+        drop(listener);
+        
+        let scraper = AnnaScraper::new().unwrap().with_mirrors(vec![base]).with_max_retries(0);
+        let err = scraper.search("dune", &SearchFilters::default(), 5).await.unwrap_err();
+        assert!(matches!(err.downcast_ref::<AppError>(), Some(AppError::Network)));
+    }
+    
+    #[tokio::test]
+    async fn test_search_reports_results_dropped_by_size_filter() {
+        let html = r#"<html><body>
+            <div class="book-item"><a href="/md5/0123456789abcdef0123456789abcdef" class="js-vim-focus custom-a">Atlas</a> PDF, 900MB</div>
+            <div class="book-item"><a href="/md5/fedcba9876543210fedcba9876543210" class="js-vim-focus custom-a">Atlas II</a> PDF, 1.2GB</div>
+        </body></html>"#;
+        
+        let base = serve_once(http_response(html.as_bytes())).await;
+        let scraper = AnnaScraper::new().unwrap().with_mirrors(vec![base]);
+        let filters = SearchFilters { max_size_mb: Some(100.0), ..Default::default() };
+        
+        let err = scraper.search("atlas", &filters, 5).await.unwrap_err();
+        assert!(matches!(err.downcast_ref::<AppError>(), Some(AppError::ResultsFiltered(2))));
+    }
+
+    #[test]
+    fn test_source_filter_permits() {
+        let filter = SourceFilter {
+            blocked: vec!["unknown".to_string()],
+            ..Default::default()
+        };
+        assert!(filter.permits("LibGen"));
+        assert!(!filter.permits("Unknown"));
+
+        let filter = SourceFilter {
+            blocked: vec!["Mirror".to_string()],
+            allowed: vec!["LibGen".to_string(), " mirror ".to_string()],
+            ..Default::default()
+        };
+        assert!(filter.permits("LibGen"));
+        assert!(!filter.permits("Anna's Archive"));
+        // Blocking wins over allowing
+        assert!(!filter.permits("Mirror"));
+    }
+
+    #[test]
+    fn test_parse_block_list() {
+        let patterns = parse_block_list("# dead mirrors\n\n  Dead.Example  \nhttps://malware.test/books?id=1\n*.cdn.example\n");
+        assert_eq!(patterns, ["dead.example", "malware.test", "*.cdn.example"]);
+    }
+    
+    #[test]
+    fn test_source_filter_blocks_hosts() {
+        let filter = SourceFilter {
+            blocked_hosts: vec!["dead.example".to_string(), "*.cdn.example".to_string(), "mirror*.test".to_string()],
+            ..Default::default()
+        };
+        assert!(filter.blocks_host("https://dead.example/file.epub"));
+        assert!(filter.blocks_host("https://dl.DEAD.example/file.epub"));
+        assert!(!filter.blocks_host("https://notdead.example/file.epub"));
+        assert!(filter.blocks_host("http://eu.cdn.example/file"));
+        assert!(!filter.blocks_host("http://cdn.example/file"));
+        assert!(filter.blocks_host("http://mirror3.test/file"));
+        assert!(!filter.blocks_host("http://www.mirror3.test/file"));
+        assert!(!filter.blocks_host("not a url"));
+        
+        let links = vec![
+            DownloadLink { text: "a".to_string(), url: "https://dead.example/a".to_string(), source: "LibGen".to_string() },
+            DownloadLink { text: "b".to_string(), url: "https://alive.example/b".to_string(), source: "LibGen".to_string() },
+        ];
+        let kept = filter.apply(links);
+        assert_eq!(kept.len(), 1);
+        assert_eq!(kept[0].text, "b");
+    }
+    
+    #[tokio::test]
+    async fn test_get_book_details_applies_source_filter() {
+        let html = include_str!("../tests/fixtures/book_detail.html");
+        
+        let base = serve_once(http_response(html.as_bytes())).await;
+        let scraper = AnnaScraper::new().unwrap()
+            .with_mirrors(vec![base.clone()])
+            .with_source_filter(SourceFilter { allowed: vec!["libgen".to_string()], ..Default::default() });
+        let links = scraper.get_book_details(&format!("{}/md5/abc", base)).await.unwrap();
+        assert!(!links.is_empty());
+        assert!(links.iter().all(|link| link.source == "LibGen"));
+        
+        let base = serve_once(http_response(html.as_bytes())).await;
+        let scraper = AnnaScraper::new().unwrap()
+            .with_mirrors(vec![base.clone()])
+            .with_source_filter(SourceFilter { allowed: vec!["nowhere".to_string()], ..Default::default() });
+        let err = scraper.get_book_details(&format!("{}/md5/abc", base)).await.unwrap_err();
+        assert!(matches!(err.downcast_ref::<AppError>(), Some(AppError::SourcesFiltered(5))));
+    }
+
+    #[test]
+    fn test_parse_book_metadata() {
+        let metadata = parse_book_metadata(include_str!("../tests/fixtures/book_detail.html"));
+        assert_eq!(metadata.edition.as_deref(), Some("20th Anniversary Edition"));
+        assert_eq!(metadata.pages, Some(352));
+        
+        let metadata = parse_book_metadata("<main><div>Second edition, 2001</div><div>Pages: 1024</div></main>");
+        assert_eq!(metadata.edition.as_deref(), Some("Second edition"));
+        assert_eq!(metadata.pages, Some(1024));
+        
+        // Download link text and bare numbers are not mistaken for either
+        let metadata = parse_book_metadata("<main><a>Slow Partner Server #1</a> 2.1MB, 2019</main>");
+        assert_eq!(metadata, BookMetadata::default());
+    }
+    
+    #[tokio::test]
+    async fn test_get_book_details_with_metadata() {
+        let html = include_str!("../tests/fixtures/book_detail.html");
+        let base = serve_once(http_response(html.as_bytes())).await;
+        let scraper = AnnaScraper::new().unwrap().with_mirrors(vec![base.clone()]);
+        
+        let (links, metadata) = scraper.get_book_details_with_metadata(&format!("{}/md5/abc", base)).await.unwrap();
+        assert!(!links.is_empty());
+        assert_eq!(metadata.pages, Some(352));
+    }
+    
+    #[test]
+    fn test_distinct_sources_keeps_page_order() {
+        let link = |source: &str| DownloadLink { text: source.to_string(), url: String::new(), source: source.to_string() };
+        let links = [link("Mirror"), link("LibGen"), link("Mirror"), link("LibGen"), link("Unknown")];
+        assert_eq!(distinct_sources(&links), ["Mirror", "LibGen", "Unknown"]);
+        assert!(distinct_sources(&[]).is_empty());
+    }
+
+    #[tokio::test]
+    async fn test_list_sources_dedupes_detail_links() {
+        let html = include_str!("../tests/fixtures/book_detail.html");
+        let base = serve_once(http_response(html.as_bytes())).await;
+        let scraper = AnnaScraper::new().unwrap().with_mirrors(vec![base.clone()]);
+        
+        // Five links: Libgen.li, then two slow servers on the local mirror, library.lol and
+        // Z-Library, which all come out as Unknown
+        let sources = scraper.list_sources(&format!("{}/md5/abc", base)).await.unwrap();
+        assert_eq!(sources, ["LibGen", "Unknown"]);
+    }
+
+    #[tokio::test]
+    async fn test_from_client_uses_supplied_client() {
+        let (base, request) = serve_capture(http_response(include_str!("../tests/fixtures/search_no_results.html").as_bytes())).await;
+        let mut headers = reqwest::header::HeaderMap::new();
+        headers.insert("x-annadl-test", reqwest::header::HeaderValue::from_static("injected"));
+        let client = reqwest::Client::builder().default_headers(headers).build().unwrap();
+        
+        let scraper = AnnaScraper::from_client(client).with_mirrors(vec![base]);
+        scraper.search("dune", &SearchFilters::default(), 5).await.unwrap();
+        
+        assert!(request.await.unwrap().to_lowercase().contains("x-annadl-test: injected"));
+    }
+
+    #[tokio::test]
+    async fn test_search_decodes_gzipped_page() {
+        let page = crate::encoding::gzip(include_str!("../tests/fixtures/search_results.html").as_bytes());
+        
+        // Announced with Content-Encoding, and sent bare by a misconfigured mirror
+        for headers in [&[("Content-Encoding", "gzip")][..], &[][..]] {
+            let base = serve_once(http_response_with(200, "OK", headers, &page)).await;
+            let scraper = AnnaScraper::new().unwrap().with_mirrors(vec![base]);
+            let books = scraper.search("dune", &SearchFilters::default(), 10).await.unwrap();
+            assert_eq!(books.len(), 3, "headers: {:?}", headers);
+            assert_eq!(books[1].title, "Dune");
+        }
+    }
+
+    #[tokio::test]
+    async fn test_page_over_size_cap_is_rejected() {
+        let page = format!("<html><body>{}</body></html>", "x".repeat(4096));
+        
+        // Declared too large up front, and too large only once streamed
+        for response in [http_response(page.as_bytes()), http_response_unsized(page.as_bytes())] {
+            let base = serve_once(response).await;
+            let scraper = AnnaScraper::new().unwrap()
+                .with_mirrors(vec![base])
+                .with_max_page_bytes(1024);
+            let err = scraper.search("dune", &SearchFilters::default(), 5).await.unwrap_err();
+            assert!(
+                err.chain().any(|e| matches!(e.downcast_ref::<AppError>(), Some(AppError::PageTooLarge(1024)))),
+                "{:#}", err
+            );
+        }
+    }
+
+    #[test]
+    fn test_mirror_path() {
+        let scraper = AnnaScraper::new().unwrap()
+            .with_mirrors(vec!["http://127.0.0.1:1".to_string()]);
+        assert_eq!(scraper.mirror_path("http://127.0.0.1:1/md5/abc"), Some("/md5/abc".to_string()));
+        assert_eq!(scraper.mirror_path("https://annas-archive.li/md5/abc"), Some("/md5/abc".to_string()));
+        assert_eq!(scraper.mirror_path("http://libgen.rs/book"), None);
+    }
+
+    #[tokio::test]
+    async fn test_fetch_with_fallback_uses_next_mirror_after_timeout() {
+        let slow = serve_hanging().await;
+        let fast = serve_once(http_response(b"<html>ok</html>")).await;
+        let scraper = AnnaScraper::new().unwrap()
+            .with_mirrors(vec![slow, fast.clone()])
+            .with_total_timeout(Duration::from_secs(2));
+
+        let (mirror, html) = scraper.fetch_with_fallback("/search?q=x").await.unwrap();
+        assert_eq!(mirror, fast);
+        assert!(html.contains("ok"));
+    }
+
+    #[test]
+    fn test_links_by_priority_puts_preferred_link_first() {
+        let link = |text: &str| DownloadLink { text: text.to_string(), url: format!("https://example.com/{}", text), source: "Mirror".to_string() };
+        let links = vec![link("Slow #1"), link("Libgen.li"), link("IPFS")];
+        let ranked: Vec<&str> = links_by_priority(&links).iter().map(|l| l.text.as_str()).collect();
+        assert_eq!(ranked, ["Libgen.li", "Slow #1", "IPFS"]);
+        assert_eq!(links_by_priority(&links)[0].text, preferred_link(&links).unwrap().text);
+        
+        let links = vec![link("Slow #1"), link("IPFS")];
+        assert_eq!(links_by_priority(&links).len(), 2);
+        assert!(links_by_priority(&[]).is_empty());
+    }
+
+    #[test]
+    fn test_pick_by_format_follows_priority() {
+        let book = |title: &str, format: Option<&str>| test_book(title).format(format).build();
+        let books = vec![book("Dune", Some("PDF")), book("Dune", None), book("Dune", Some("EPUB")), book("Dune", Some("mobi"))];
+        let priority = |formats: &[&str]| formats.iter().map(|f| f.to_string()).collect::<Vec<_>>();
+
+        assert_eq!(pick_by_format(&books, &priority(&["epub", "pdf"])).unwrap().format.as_deref(), Some("EPUB"));
+        assert_eq!(pick_by_format(&books, &priority(&[" .MOBI", "epub"])).unwrap().format.as_deref(), Some("mobi"));
+        // Nothing in a wanted format, or no priority at all: the top result
+        assert_eq!(pick_by_format(&books, &priority(&["djvu"])).unwrap().format.as_deref(), Some("PDF"));
+        assert_eq!(pick_by_format(&books, &[]).unwrap().format.as_deref(), Some("PDF"));
+        assert!(pick_by_format(&[], &priority(&["epub"])).is_none());
+    }
+
+    // Title-only cards, as a mirror serving a broken or stripped page might return
+    const BARE_RESULTS: &str = r#"<html><body>
+        <div class="book-item"><a href="/md5/0f1e2d3c4b5a69788796a5b4c3d2e1f0"><h3>Dune</h3></a></div>
+    </body></html>"#;
+
+    #[test]
+    fn test_result_quality_prefers_fuller_results() {
+        let full = test_book("Dune")
+            .author("Frank Herbert")
+            .year("1990")
+            .language("en")
+            .format("epub")
+            .size("1.5MB")
+            .md5("0f1e2d3c4b5a69788796a5b4c3d2e1f0")
+            .build();
+        let partial = test_book("Dune").year("1990").size("1.5MB").build();
+        let bare = test_book("Dune").build();
+        assert!(result_quality(&[full.clone()]) > result_quality(&[bare.clone()]));
+        assert!(result_quality(&[partial.clone()]) > result_quality(&[bare.clone()]));
+        // Volume alone can't outweigh a complete card
+        assert!(result_quality(&[full.clone()]) > result_quality(&[bare.clone(), bare.clone(), bare.clone()]));
+        assert!(result_quality(&[full.clone()]) > result_quality(&[partial.clone(), partial.clone()]));
+        assert!(result_quality(&[full.clone(), full.clone()]) > result_quality(&[full.clone()]));
+        assert!(looks_complete(&[full]));
+        assert!(!looks_complete(&[bare]));
+        assert!(!looks_complete(&[]));
+    }
+
+    #[tokio::test]
+    async fn test_search_prefers_mirror_with_complete_results() {
+        let broken = serve_once(http_response(BARE_RESULTS.as_bytes())).await;
+        let healthy = serve_once(http_response(include_str!("../tests/fixtures/search_results.html").as_bytes())).await;
+        let scraper = AnnaScraper::new().unwrap()
+            .with_mirrors(vec![broken, healthy.clone()]);
+
+        let books = scraper.search("dune", &SearchFilters::default(), 10).await.unwrap();
+        assert_eq!(books.len(), 3);
+        assert!(books.iter().all(|book| book.url.starts_with(&healthy)));
+    }
+
+    #[tokio::test]
+    async fn test_search_keeps_incomplete_results_when_no_mirror_does_better() {
+        let broken = serve_once(http_response(BARE_RESULTS.as_bytes())).await;
+        let scraper = AnnaScraper::new().unwrap()
+            .with_mirrors(vec![broken.clone(), "http://127.0.0.1:1".to_string()])
+            .with_total_timeout(Duration::from_secs(2));
+
+        let books = scraper.search("dune", &SearchFilters::default(), 10).await.unwrap();
+        assert_eq!(books.len(), 1);
+        assert_eq!(books[0].title, "Dune");
+        assert!(books[0].url.starts_with(&broken));
+    }
+
+    #[test]
+    fn test_page_problem_tells_broken_pages_from_empty_results() {
+        assert_eq!(page_problem(include_str!("../tests/fixtures/search_no_results.html")), None);
+        assert_eq!(page_problem("<html><head><title>Just a moment...</title></head><body></body></html>").as_deref(), Some("its title is \"Just a moment...\""));
+        assert_eq!(page_problem("<html><head><title>502 Bad Gateway Error</title></head></html>").as_deref(), Some("its title is \"502 Bad Gateway Error\""));
+        assert_eq!(page_problem("<html><p>half a page").as_deref(), Some("it has no <body>"));
+        assert_eq!(page_problem("<html><body><p>Loading</p></body></html>").as_deref(), Some("it has only 4 HTML elements"));
+        // A search for "error" is still a results page
+        let searched = include_str!("../tests/fixtures/search_no_results.html").replace("qwxzvyk", "Trial and Error");
+        assert_eq!(page_problem(&searched), None);
+    }
+
+    #[tokio::test]
+    async fn test_search_reports_block_page_instead_of_no_results() {
+        let blocked = serve_once(http_response(b"<html><head><title>Access denied</title></head><body>Blocked</body></html>")).await;
+        let scraper = AnnaScraper::new().unwrap()
+            .with_mirrors(vec![blocked, "http://127.0.0.1:1".to_string()])
+            .with_max_retries(0);
+
+        let err = scraper.search("dune", &SearchFilters::default(), 10).await.unwrap_err();
+        assert!(matches!(err.downcast_ref::<AppError>(), Some(AppError::UnexpectedPage(problem)) if problem == "its title is \"Access denied\""), "{:#}", err);
+        assert_eq!(crate::error::exit_code(&err), crate::error::EXIT_NETWORK);
+    }
+
+    #[tokio::test]
+    async fn test_search_moves_past_block_page() {
+        let blocked = serve_once(http_response(b"<html><head><title>Attention Required! | Cloudflare</title></head><body></body></html>")).await;
+        let empty = serve_once(http_response(include_str!("../tests/fixtures/search_no_results.html").as_bytes())).await;
+        let scraper = AnnaScraper::new().unwrap().with_mirrors(vec![blocked, empty]);
+
+        // The second mirror genuinely found nothing, which is not an error
+        assert!(scraper.search("dune", &SearchFilters::default(), 10).await.unwrap().is_empty());
+    }
+
+    #[tokio::test]
+    async fn test_fetch_with_fallback_bounded_by_total_deadline() {
+        let scraper = AnnaScraper::new().unwrap()
+            .with_mirrors(vec![serve_hanging().await, serve_hanging().await])
+            .with_total_timeout(Duration::from_millis(600));
+
+        let started = std::time::Instant::now();
+        let err = scraper.fetch_with_fallback("/search?q=x").await.unwrap_err();
+
+        assert!(started.elapsed() < Duration::from_secs(2));
+        assert!(matches!(err.downcast_ref::<AppError>(), Some(AppError::Timeout(_, _))));
+    }
+
+    #[test]
+    fn test_detail_url() {
+        assert_eq!(
+            detail_url("ABCDEF0123456789ABCDEF0123456789"),
+            Some("https://annas-archive.org/md5/abcdef0123456789abcdef0123456789".to_string())
+        );
+        assert_eq!(
+            detail_url(" https://annas-archive.se/md5/abc "),
+            Some("https://annas-archive.se/md5/abc".to_string())
+        );
+        assert_eq!(detail_url("not-an-md5"), None);
+        assert_eq!(detail_url("abc123"), None);
+    }
+
+    #[test]
+    fn test_extract_md5() {
+        assert_eq!(
+            extract_md5("https://annas-archive.org/md5/0123456789ABCDEF0123456789abcdef"),
+            Some("0123456789abcdef0123456789abcdef".to_string())
+        );
+        assert_eq!(extract_md5("https://annas-archive.org/md5/12345"), None);
+        assert_eq!(extract_md5("https://annas-archive.org/search?q=md5"), None);
+    }
+
+    #[test]
+    fn test_share_url() {
+        let hash = "0123456789abcdef0123456789abcdef";
+        let book = |url: &str, md5: Option<&str>| test_book("Dune").url(url).md5(md5).build();
+        let canonical = format!("https://annas-archive.org/md5/{}", hash);
+
+        assert_eq!(book("https://annas-archive.se/md5/x", Some(hash)).share_url(), canonical);
+        // Found on a mirror without an md5 field: rebuilt from the URL
+        assert_eq!(book(&format!("https://annas-archive.li/md5/{}", hash.to_uppercase()), None).share_url(), canonical);
+        assert_eq!(book("https://example.com/book", None).share_url(), "https://example.com/book");
+    }
+
+    #[test]
+    fn test_parse_query_param() {
+        assert_eq!(parse_query_param("sort=newest"), Ok(("sort".to_string(), "newest".to_string())));
+        assert_eq!(parse_query_param("q=a=b & c"), Ok(("q".to_string(), "a=b & c".to_string())));
+        assert_eq!(parse_query_param("src="), Ok(("src".to_string(), String::new())));
+        assert!(parse_query_param("sort").is_err());
+        assert!(parse_query_param("=x").is_err());
+        assert!(parse_query_param("a&b=c").is_err());
+    }
+
+    #[tokio::test]
+    async fn test_search_appends_extra_params() {
+        let (base, request) = serve_capture(http_response(include_str!("../tests/fixtures/search_no_results.html").as_bytes())).await;
+        let scraper = AnnaScraper::new().unwrap().with_mirrors(vec![base]);
+        let filters = SearchFilters {
+            extra_params: vec![("sort".to_string(), "newest".to_string()), ("src".to_string(), "lgli & zlib".to_string())],
+            ..Default::default()
+        };
+        scraper.search("dune", &filters, 5).await.unwrap();
+        
+        let request_line = request.await.unwrap().lines().next().unwrap().to_string();
+        assert!(request_line.contains("/search?q=dune&sort=newest&src=lgli%20%26%20zlib "), "{}", request_line);
+    }
+
+    #[tokio::test]
+    async fn test_search_sends_server_sort() {
+        let (base, request) = serve_capture(http_response(include_str!("../tests/fixtures/search_no_results.html").as_bytes())).await;
+        let scraper = AnnaScraper::new().unwrap().with_mirrors(vec![base]);
+        let filters = SearchFilters {
+            format: Some("epub".to_string()),
+            sort: Some(ServerSort::Largest),
+            ..Default::default()
+        };
+        scraper.search("dune", &filters, 5).await.unwrap();
+        
+        let request_line = request.await.unwrap().lines().next().unwrap().to_string();
+        assert!(request_line.contains("/search?q=dune&ext=epub&sort=largest "), "{}", request_line);
+    }
+
+    #[test]
+    fn test_normalize_query() {
+        let cases = [
+            ("rust programming", Some("rust programming")),
+            ("  rust   programming \t", Some("rust programming")),
+            ("\"dune\"", Some("dune")),
+            ("'  the hobbit '", Some("the hobbit")),
+            ("\"unbalanced", Some("\"unbalanced")),
+            ("   ", None),
+            ("\"\"", None),
+            ("", None),
+        ];
+
+        for (input, expected) in cases {
+            assert_eq!(normalize_query(input).as_deref(), expected, "input: {:?}", input);
+        }
+    }
+
     #[test]
     fn test_parse_size_mb() {
         assert_eq!(AnnaScraper::parse_size_mb("1.5MB"), Some(1.5));
@@ -0,0 +1,132 @@
+use std::path::Path;
+use std::time::{Duration, Instant};
+
+// Counters for one run, printed when the session ends
+#[derive(Debug, Clone)]
+pub struct SessionStats {
+    started: Instant,
+    pub searches: u32,
+    pub books_viewed: u32,
+    pub downloads: u32,
+    pub bytes: u64,
+}
+
+impl Default for SessionStats {
+    fn default() -> Self {
+        Self {
+            started: Instant::now(),
+            searches: 0,
+            books_viewed: 0,
+            downloads: 0,
+            bytes: 0,
+        }
+    }
+}
+
+impl SessionStats {
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    pub fn record_search(&mut self) {
+        self.searches += 1;
+    }
+
+    pub fn record_view(&mut self) {
+        self.books_viewed += 1;
+    }
+
+    pub fn record_download(&mut self, bytes: u64) {
+        self.downloads += 1;
+        self.bytes += bytes;
+    }
+
+    pub fn elapsed(&self) -> Duration {
+        self.started.elapsed()
+    }
+
+    // e.g. "Session: 2 searches, 3 books viewed, 1 file downloaded (4.2 MB) in 3m 12s"
+    pub fn summary(&self) -> String {
+        self.summary_for(self.elapsed())
+    }
+
+    fn summary_for(&self, elapsed: Duration) -> String {
+        format!(
+            "Session: {}, {}, {} ({}) in {}",
+            plural(self.searches, "search", "searches"),
+            plural(self.books_viewed, "book viewed", "books viewed"),
+            plural(self.downloads, "file downloaded", "files downloaded"),
+            format_bytes(self.bytes),
+            format_duration(elapsed)
+        )
+    }
+}
+
+fn plural(count: u32, one: &str, many: &str) -> String {
+    format!("{} {}", count, if count == 1 { one } else { many })
+}
+
+pub fn format_duration(elapsed: Duration) -> String {
+    let secs = elapsed.as_secs();
+    match (secs / 3600, secs % 3600 / 60, secs % 60) {
+        (0, 0, s) => format!("{}s", s),
+        (0, m, s) => format!("{}m {}s", m, s),
+        (h, m, _) => format!("{}h {}m", h, m),
+    }
+}
+
+// Size of a finished download; 0 if the file has already gone
+pub fn file_size(path: &Path) -> u64 {
+    std::fs::metadata(path).map(|m| m.len()).unwrap_or(0)
+}
+
+pub fn format_bytes(bytes: u64) -> String {
+    const UNITS: [&str; 4] = ["B", "KB", "MB", "GB"];
+    let mut value = bytes as f64;
+    let mut unit = 0;
+    while value >= 1024.0 && unit < UNITS.len() - 1 {
+        value /= 1024.0;
+        unit += 1;
+    }
+    if unit == 0 {
+        format!("{} {}", bytes, UNITS[0])
+    } else {
+        format!("{:.1} {}", value, UNITS[unit])
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_summary_counts_and_pluralizes() {
+        let mut stats = SessionStats::new();
+        stats.record_search();
+        stats.record_search();
+        stats.record_view();
+        stats.record_download(5 * 1024 * 1024);
+
+        assert_eq!(
+            stats.summary_for(Duration::from_secs(192)),
+            "Session: 2 searches, 1 book viewed, 1 file downloaded (5.0 MB) in 3m 12s"
+        );
+        assert_eq!(
+            SessionStats::new().summary_for(Duration::from_secs(4)),
+            "Session: 0 searches, 0 books viewed, 0 files downloaded (0 B) in 4s"
+        );
+    }
+
+    #[test]
+    fn test_format_duration() {
+        assert_eq!(format_duration(Duration::from_secs(59)), "59s");
+        assert_eq!(format_duration(Duration::from_secs(3725)), "1h 2m");
+    }
+
+    #[test]
+    fn test_format_bytes() {
+        assert_eq!(format_bytes(512), "512 B");
+        assert_eq!(format_bytes(1536), "1.5 KB");
+        assert_eq!(format_bytes(5 * 1024 * 1024), "5.0 MB");
+    }
+}
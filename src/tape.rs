@@ -0,0 +1,92 @@
+use anyhow::{Context, Result};
+use std::io::Write;
+use std::path::{Path, PathBuf};
+
+// Saves every search and detail page (--record) or serves saved pages instead of the network
+// (--replay), so a parsing bug can be reproduced from a user's recording. Files are named by
+// a hash of the URL; index.tsv maps each hash back to its URL.
+#[derive(Debug, Clone, PartialEq)]
+pub enum Tape {
+    Record(PathBuf),
+    Replay(PathBuf),
+}
+
+impl Tape {
+    pub fn dir(&self) -> &Path {
+        match self {
+            Tape::Record(dir) | Tape::Replay(dir) => dir,
+        }
+    }
+    
+    pub fn is_replay(&self) -> bool {
+        matches!(self, Tape::Replay(_))
+    }
+    
+    pub fn page_path(&self, url: &str) -> PathBuf {
+        self.dir().join(format!("{:016x}.html", fnv1a(url)))
+    }
+    
+    pub fn replay(&self, url: &str) -> Result<String> {
+        let path = self.page_path(url);
+        std::fs::read_to_string(&path)
+            .with_context(|| format!("No recording of {} in {}", url, self.dir().display()))
+    }
+    
+    pub fn record(&self, url: &str, html: &str) -> Result<()> {
+        let dir = self.dir();
+        std::fs::create_dir_all(dir)
+            .with_context(|| format!("Failed to create recording directory {}", dir.display()))?;
+        
+        let path = self.page_path(url);
+        std::fs::write(&path, html)
+            .with_context(|| format!("Failed to record page to {}", path.display()))?;
+        
+        let mut index = std::fs::OpenOptions::new()
+            .create(true)
+            .append(true)
+            .open(dir.join("index.tsv"))
+            .context("Failed to update recording index")?;
+        writeln!(index, "{}\t{}", path.file_name().unwrap_or_default().to_string_lossy(), url)
+            .context("Failed to update recording index")?;
+        
+        Ok(())
+    }
+}
+
+// FNV-1a: tiny and, unlike std's hasher, stable across Rust versions and platforms
+fn fnv1a(text: &str) -> u64 {
+    text.bytes().fold(0xcbf29ce484222325, |hash, byte| {
+        (hash ^ byte as u64).wrapping_mul(0x100000001b3)
+    })
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn temp_dir(prefix: &str) -> PathBuf {
+        std::env::temp_dir().join(format!("{}_{}", prefix, std::time::SystemTime::now().duration_since(std::time::UNIX_EPOCH).unwrap().as_nanos()))
+    }
+
+    #[test]
+    fn test_fnv1a_is_stable() {
+        assert_eq!(fnv1a(""), 0xcbf29ce484222325);
+        assert_eq!(fnv1a("a"), 0xaf63dc4c8601ec8c);
+    }
+
+    #[test]
+    fn test_record_then_replay() {
+        let dir = temp_dir("annadl_tape_test");
+        let url = "https://annas-archive.org/search?q=dune";
+
+        Tape::Record(dir.clone()).record(url, "<html>dune</html>").unwrap();
+        let replay = Tape::Replay(dir.clone());
+        assert_eq!(replay.replay(url).unwrap(), "<html>dune</html>");
+        assert!(replay.replay("https://annas-archive.org/search?q=emma").is_err());
+
+        let index = std::fs::read_to_string(dir.join("index.tsv")).unwrap();
+        assert!(index.ends_with(&format!("\t{}\n", url)));
+
+        std::fs::remove_dir_all(&dir).unwrap();
+    }
+}
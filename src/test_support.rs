@@ -0,0 +1,204 @@
+use crate::scraper::Book;
+use tokio::io::{AsyncReadExt, AsyncWriteExt};
+
+// The one place tests make a Book: a title, a URL derived from it, and nothing else until a
+// setter fills it in. The optional fields take a value or an Option, e.g. .year("1965").
+pub fn test_book(title: &str) -> BookBuilder {
+    BookBuilder(Book {
+        title: title.to_string(),
+        author: None,
+        year: None,
+        language: None,
+        format: None,
+        size: None,
+        url: format!("https://annas-archive.org/md5/{}", title),
+        md5: None,
+        downloads: 0,
+        cover_url: None,
+    })
+}
+
+pub struct BookBuilder(Book);
+
+fn owned<'a>(value: impl Into<Option<&'a str>>) -> Option<String> {
+    value.into().map(str::to_string)
+}
+
+impl BookBuilder {
+    pub fn author<'a>(mut self, author: impl Into<Option<&'a str>>) -> Self {
+        self.0.author = owned(author);
+        self
+    }
+
+    pub fn year<'a>(mut self, year: impl Into<Option<&'a str>>) -> Self {
+        self.0.year = owned(year);
+        self
+    }
+
+    pub fn language<'a>(mut self, language: impl Into<Option<&'a str>>) -> Self {
+        self.0.language = owned(language);
+        self
+    }
+
+    pub fn format<'a>(mut self, format: impl Into<Option<&'a str>>) -> Self {
+        self.0.format = owned(format);
+        self
+    }
+
+    pub fn size<'a>(mut self, size: impl Into<Option<&'a str>>) -> Self {
+        self.0.size = owned(size);
+        self
+    }
+
+    pub fn url(mut self, url: &str) -> Self {
+        self.0.url = url.to_string();
+        self
+    }
+
+    pub fn md5<'a>(mut self, md5: impl Into<Option<&'a str>>) -> Self {
+        self.0.md5 = owned(md5);
+        self
+    }
+
+    pub fn downloads(mut self, downloads: u64) -> Self {
+        self.0.downloads = downloads;
+        self
+    }
+
+    pub fn cover_url<'a>(mut self, cover_url: impl Into<Option<&'a str>>) -> Self {
+        self.0.cover_url = owned(cover_url);
+        self
+    }
+
+    pub fn build(self) -> Book {
+        self.0
+    }
+}
+
+pub fn http_response(body: &[u8]) -> Vec<u8> {
+    http_response_with(200, "OK", &[], body)
+}
+
+pub fn http_response_with(status: u16, reason: &str, headers: &[(&str, &str)], body: &[u8]) -> Vec<u8> {
+    let mut head = format!("HTTP/1.1 {} {}\r\nContent-Length: {}\r\nConnection: close\r\n", status, reason, body.len());
+    for (name, value) in headers {
+        head.push_str(&format!("{}: {}\r\n", name, value));
+    }
+    head.push_str("\r\n");
+
+    let mut response = head.into_bytes();
+    response.extend_from_slice(body);
+    response
+}
+
+// No Content-Length: the body runs until the connection closes
+pub fn http_response_unsized(body: &[u8]) -> Vec<u8> {
+    let mut response = b"HTTP/1.1 200 OK\r\nConnection: close\r\n\r\n".to_vec();
+    response.extend_from_slice(body);
+    response
+}
+
+// Serves each canned response to one connection, in order
+pub async fn serve_sequence(responses: Vec<Vec<u8>>) -> String {
+    let listener = tokio::net::TcpListener::bind("127.0.0.1:0").await.unwrap();
+    let addr = listener.local_addr().unwrap();
+
+    tokio::spawn(async move {
+        for response in responses {
+            if let Ok((mut socket, _)) = listener.accept().await {
+                let mut buf = [0u8; 4096];
+                let _ = socket.read(&mut buf).await;
+                let _ = socket.write_all(&response).await;
+                let _ = socket.shutdown().await;
+            }
+        }
+    });
+
+    format!("http://{}", addr)
+}
+
+pub async fn serve_once(response: Vec<u8>) -> String {
+    serve_sequence(vec![response]).await
+}
+
+// Serves one response and hands back the raw request head, for asserting on URLs and headers
+pub async fn serve_capture(response: Vec<u8>) -> (String, tokio::task::JoinHandle<String>) {
+    let listener = tokio::net::TcpListener::bind("127.0.0.1:0").await.unwrap();
+    let addr = listener.local_addr().unwrap();
+
+    let request = tokio::spawn(async move {
+        let (mut socket, _) = listener.accept().await.unwrap();
+        let mut buf = [0u8; 4096];
+        let n = socket.read(&mut buf).await.unwrap_or(0);
+        let _ = socket.write_all(&response).await;
+        let _ = socket.shutdown().await;
+        String::from_utf8_lossy(&buf[..n]).to_string()
+    });
+
+    (format!("http://{}", addr), request)
+}
+
+// Accepts connections but never answers, to exercise timeouts
+pub async fn serve_hanging() -> String {
+    serve_hanging_after(Vec::new()).await
+}
+
+// Sends `start` (e.g. headers and the first bytes of a body) and then holds the connection
+// open without another byte, like a transfer that stalled
+pub async fn serve_hanging_after(start: Vec<u8>) -> String {
+    let listener = tokio::net::TcpListener::bind("127.0.0.1:0").await.unwrap();
+    let addr = listener.local_addr().unwrap();
+
+    tokio::spawn(async move {
+        let mut open = Vec::new();
+        while let Ok((mut socket, _)) = listener.accept().await {
+            if !start.is_empty() {
+                let mut buf = [0u8; 4096];
+                let _ = socket.read(&mut buf).await;
+                let _ = socket.write_all(&start).await;
+            }
+            open.push(socket);
+        }
+    });
+
+    format!("http://{}", addr)
+}
+
+// Serves `body` to any number of connections, honouring "Range: bytes=a-b" with a 206.
+// The returned counter tracks how many ranged requests arrived.
+pub async fn serve_ranges(body: Vec<u8>) -> (String, std::sync::Arc<std::sync::atomic::AtomicUsize>) {
+    let listener = tokio::net::TcpListener::bind("127.0.0.1:0").await.unwrap();
+    let addr = listener.local_addr().unwrap();
+    let body = std::sync::Arc::new(body);
+    let ranged = std::sync::Arc::new(std::sync::atomic::AtomicUsize::new(0));
+    let counter = ranged.clone();
+
+    tokio::spawn(async move {
+        while let Ok((mut socket, _)) = listener.accept().await {
+            let body = body.clone();
+            let counter = counter.clone();
+            tokio::spawn(async move {
+                let mut buf = [0u8; 4096];
+                let n = socket.read(&mut buf).await.unwrap_or(0);
+                let request = String::from_utf8_lossy(&buf[..n]).to_lowercase();
+                let range = request.lines()
+                    .find_map(|line| line.strip_prefix("range: bytes="))
+                    .and_then(|spec| spec.trim().split_once('-'))
+                    .and_then(|(start, end)| Some((start.parse::<usize>().ok()?, end.parse::<usize>().ok()?)));
+
+                let response = match range {
+                    Some((start, end)) => {
+                        counter.fetch_add(1, std::sync::atomic::Ordering::SeqCst);
+                        let content_range = format!("bytes {}-{}/{}", start, end, body.len());
+                        http_response_with(206, "Partial Content", &[("Content-Range", &content_range)], &body[start..=end])
+                    }
+                    None => http_response_with(200, "OK", &[("Accept-Ranges", "bytes")], &body),
+                };
+                let _ = socket.write_all(&response).await;
+                let _ = socket.shutdown().await;
+            });
+        }
+    });
+
+    (format!("http://{}", addr), ranged)
+}
@@ -1,19 +1,35 @@
-use crate::config::Config;
-use crate::downloader::Downloader;
-use crate::scraper::{AnnaScraper, Book, DownloadLink, SearchFilters};
-use anyhow::Result;
+use crate::browser;
+use crate::citation::{self, CitationStyle};
+use crate::clipboard;
+use crate::config::{Config, Theme, UiPrefs};
+use crate::downloader::{ConflictPolicy, Downloader, Progress, Saved};
+use crate::error::AppError;
+use crate::export;
+use crate::favorites::Favorites;
+use crate::history::History;
+use crate::hook;
+use crate::network::NetworkOptions;
+use crate::scraper::{self, Book, BookMetadata, DownloadLink, SearchFilters, SortMode};
+use crate::stats::{file_size, format_bytes, format_duration, SessionStats};
+use super::cover::{self, Cover};
+use super::queue::{DownloadQueue, QueueStatus};
+use anyhow::{Context, Result};
 use crossterm::event::{self, Event, KeyCode, KeyEvent, KeyModifiers};
+use futures::future::BoxFuture;
 use ratatui::{
     backend::Backend,
     layout::{Alignment, Constraint, Direction, Layout, Margin, Rect},
     style::{Color, Modifier, Style},
     text::{Line, Span, Text},
-    widgets::{Block, Borders, List, ListItem, ListState, Paragraph, Scrollbar, ScrollbarOrientation, ScrollbarState, Wrap},
+    widgets::{Block, Borders, Gauge, List, ListItem, ListState, Paragraph, Scrollbar, ScrollbarOrientation, ScrollbarState, Wrap},
     Frame, Terminal,
 };
-use std::io;
-use std::path::PathBuf;
+use std::collections::HashMap;
+use std::io::{self, Write};
+use std::path::{Path, PathBuf};
+use std::sync::Arc;
 use tokio::sync::mpsc;
+use unicode_width::{UnicodeWidthChar, UnicodeWidthStr};
 
 pub enum AppMode {
     Search,
@@ -22,7 +38,29 @@ pub enum AppMode {
     Downloading,
     Error(String),
     Help,
+    About,
     Filters,
+    // The book page loaded fine but lists nothing to download
+    NoLinks,
+    // Bookmarked books, browsed and downloaded like results
+    Favorites,
+    // The chosen download would replace this file; asks before going ahead
+    ConfirmOverwrite(PathBuf),
+    // A queue finished with failures: lists them and offers to retry just those
+    QueueSummary,
+}
+
+#[derive(Debug, Clone, Copy, PartialEq)]
+pub enum Phase {
+    Searching,
+    FetchingLinks,
+    Downloading,
+}
+
+enum CoverState {
+    Loading,
+    Ready(Cover),
+    Failed,
 }
 
 pub struct App {
@@ -32,7 +70,13 @@ pub struct App {
     pub books: Vec<Book>,
     pub selected_book_index: usize,
     pub download_links: Vec<DownloadLink>,
+    // Edition and page count from the selected book's page, shown with its links
+    pub book_metadata: BookMetadata,
     pub download_link_index: usize,
+    // Set by `d` in the results: start on the LibGen link as soon as the links arrive
+    pub quick_download: bool,
+    // `r` on the links screen re-reads the book page; the current list stays usable meanwhile
+    pub refreshing_links: bool,
     pub download_path: PathBuf,
     pub error_message: String,
     pub results_scroll: usize,
@@ -40,26 +84,122 @@ pub struct App {
     pub command_tx: mpsc::UnboundedSender<AppCommand>,
     pub command_rx: mpsc::UnboundedReceiver<AppCommand>,
     pub downloading_message: String,
+    // Folder and file name the running download is saved as; a rename on conflict may still change it
+    pub download_destination: Option<PathBuf>,
+    pub status_message: String,
+    pub phase: Phase,
+    pub download_progress: Progress,
+    pub tick: usize,
+    pub history: History,
+    pub favorites: Favorites,
+    // The book list holds favorites, so going back from links returns there
+    pub showing_favorites: bool,
+    // The error screen is the offline notice, so r can run the search again
+    pub offline: bool,
+    pub show_preview: bool,
+    pub theme: Theme,
+    // None when the terminal can't draw images; the preview then says so instead of showing covers
+    pub graphics: Option<cover::Protocol>,
+    covers: HashMap<String, CoverState>,
+    // Where the frame just drawn left room for the selected book's cover, and which cover it was
+    cover_slot: Option<(String, Rect)>,
+    // What is on screen now, so an unchanged cover isn't sent again every frame
+    painted_cover: Option<(String, Rect)>,
+    // Links read ahead for the top results, by book URL; each is used once, then fetched live
+    link_cache: HashMap<String, (Vec<DownloadLink>, BookMetadata)>,
+    prefetch_task: Option<tokio::task::JoinHandle<()>>,
+    // --verbose: debug lines can't go to stderr under the TUI, so they are kept for after it exits
+    pub verbose: bool,
+    pub debug_log: Vec<String>,
+    pub queue: DownloadQueue,
+    // The running download, kept so it can be cancelled without quitting
+    pub current_task: Option<tokio::task::JoinHandle<()>>,
+    pub network: NetworkOptions,
+    // What download tasks fetch links and files through; tests put a fake here
+    pub transfer: Arc<dyn Transfer>,
+    // Citations, share links and exports go here; tests swap it so the real clipboard is left alone
+    pub copy_to_clipboard: fn(&str) -> Result<()>,
+    pub stats: SessionStats,
     pub filters: SearchFilters,
+    pub sort_mode: SortMode,
+    pub search_results: Vec<Book>,
+    // How many results a search asks for; + and - in the results change it and search again
+    pub num_results: usize,
+    // More streamed results are still on the way
+    pub loading_more: bool,
+    // Bumped by every search; results tagged with an older one are dropped
+    pub search_id: u64,
+    // Narrow the fetched results in place, without searching again
+    pub view_format: Option<String>,
+    pub view_language: Option<String>,
+    // Digits typed in results, e.g. "12" then Enter jumps to book 12
+    pub jump_input: String,
     pub filter_input_idx: usize,
     pub filter_format_input: String,
     pub filter_language_input: String,
     pub filter_size_input: String,
+    pub filter_year_input: String,
 }
 
 #[derive(Debug, Clone)]
 pub enum AppCommand {
-    Search(String, SearchFilters, usize),
-    FetchDownloadLinks(String),
-    Download(String, usize),
     ShowError(String),
-    CompleteDownload(PathBuf),
+    CompleteDownload(Saved),
+    // Tagged with the search they belong to, so a superseded search can't add to the new one
+    SearchBatch(u64, Vec<Book>),
+    SearchComplete(u64, Vec<Book>),
+    // None when the cover couldn't be fetched or decoded
+    CoverLoaded(String, Option<Cover>),
+    // A book page read ahead after a search, by search id and book URL
+    LinksPrefetched(u64, String, std::result::Result<(Vec<DownloadLink>, BookMetadata), String>),
+    // The site found this many books, but the size or year filter dropped them all
+    ResultsFiltered(usize),
+    // The search failed because no address could be looked up
+    Offline,
+    LinksFetched(Vec<DownloadLink>, BookMetadata),
+    LinksRefreshed(Vec<DownloadLink>, BookMetadata),
+    LinksRefreshFailed(String),
+    DownloadProgress(Progress),
+    QueueItemFinished(usize, std::result::Result<Saved, String>),
+    // The file was saved but an optional --post-download command failed
+    PostDownloadFailed(String),
 }
 
 impl App {
     pub fn new(config: Config, download_path: PathBuf) -> Self {
         let (tx, rx) = mpsc::unbounded_channel();
         
+        let filters = SearchFilters {
+            format: config.format_filter(None),
+            language: config.language_filter(None),
+            ..Default::default()
+        };
+        let filter_format_input = filters.format.clone().unwrap_or_default();
+        let filter_language_input = filters.language.clone().unwrap_or_default();
+        // A configured default_sort is kept on every start; otherwise the last session's sort returns
+        let sort_mode = config.default_sort.or(config.ui.sort).unwrap_or_default();
+        let show_preview = config.ui.show_preview.unwrap_or(true);
+        let theme = config.ui.theme;
+        let network = NetworkOptions {
+            retries: config.retries(None),
+            sources: config.source_filter(),
+            selectors: config.custom_selectors(),
+            stall_timeout: config.stall_timeout(None),
+            connect_timeout: config.connect_timeout(None),
+            prefetch: config.prefetch_count(None),
+            temp_dir: config.temp_dir(None),
+            on_conflict: config.on_conflict,
+            name_template: config.name_template.clone(),
+            date_folders: config.date_folders,
+            user_agent: config.user_agent(None),
+            ipfs_gateway: config.ipfs_gateway.clone(),
+            post_download: config.post_download(None, false),
+            ..Default::default()
+        };
+        // Kept next to the config file, which --config-file (and tests) can move
+        let history = History::load(&config).unwrap_or_default();
+        let favorites = Favorites::load(&config).unwrap_or_default();
+        
         Self {
             config,
             mode: AppMode::Search,
@@ -67,6 +207,9 @@ impl App {
             books: Vec::new(),
             selected_book_index: 0,
             download_links: Vec::new(),
+            book_metadata: BookMetadata::default(),
+            quick_download: false,
+            refreshing_links: false,
             download_link_index: 0,
             download_path,
             error_message: String::new(),
@@ -75,11 +218,45 @@ impl App {
             command_tx: tx,
             command_rx: rx,
             downloading_message: String::new(),
-            filters: SearchFilters::default(),
+            download_destination: None,
+            status_message: String::new(),
+            phase: Phase::Searching,
+            download_progress: Progress::default(),
+            tick: 0,
+            history,
+            favorites,
+            showing_favorites: false,
+            offline: false,
+            show_preview,
+            theme,
+            graphics: cover::Protocol::detect(),
+            covers: HashMap::new(),
+            cover_slot: None,
+            painted_cover: None,
+            link_cache: HashMap::new(),
+            prefetch_task: None,
+            verbose: false,
+            debug_log: Vec::new(),
+            queue: DownloadQueue::default(),
+            current_task: None,
+            network,
+            transfer: Arc::new(NetworkTransfer),
+            copy_to_clipboard: clipboard::copy,
+            stats: SessionStats::new(),
+            filters,
+            sort_mode,
+            search_results: Vec::new(),
+            num_results: scraper::DEFAULT_NUM_RESULTS,
+            loading_more: false,
+            search_id: 0,
+            view_format: None,
+            view_language: None,
+            jump_input: String::new(),
             filter_input_idx: 0,
-            filter_format_input: String::new(),
-            filter_language_input: String::new(),
+            filter_format_input,
+            filter_language_input,
             filter_size_input: String::new(),
+            filter_year_input: String::new(),
         }
     }
 
@@ -97,6 +274,14 @@ impl App {
     }
 
     pub async fn handle_keypress(&mut self, key: KeyEvent) -> Result<ControlFlow> {
+        self.clamp_selection();
+        // F2 opens the about overlay from any of the browsing screens
+        if key.code == KeyCode::F(2)
+            && matches!(self.mode, AppMode::Search | AppMode::Results | AppMode::DownloadSelection)
+        {
+            self.mode = AppMode::About;
+            return Ok(ControlFlow::Continue);
+        }
         match self.mode {
             AppMode::Search => self.handle_search_input(key).await,
             AppMode::Results => self.handle_results_navigation(key).await,
@@ -104,7 +289,12 @@ impl App {
             AppMode::Error(_) => self.handle_error(key).await,
             AppMode::Downloading => self.handle_downloading(key).await,
             AppMode::Help => self.handle_help(key).await,
+            AppMode::About => self.handle_about(key).await,
+            AppMode::NoLinks => self.handle_no_links(key).await,
+            AppMode::Favorites => self.handle_favorites(key).await,
             AppMode::Filters => self.handle_filters(key).await,
+            AppMode::ConfirmOverwrite(_) => self.handle_confirm_overwrite(key).await,
+            AppMode::QueueSummary => self.handle_queue_summary(key).await,
         }
     }
 
@@ -115,7 +305,17 @@ impl App {
             }
             KeyCode::Enter => {
                 if !self.query.is_empty() {
-                    self.perform_search().await?;
+                    match scraper::normalize_query(&self.query) {
+                        Some(query) => {
+                            self.query = query;
+                            self.perform_search().await?;
+                        }
+                        None => {
+                            self.query.clear();
+                            self.error_message = "Please enter a search query".to_string();
+                            self.mode = AppMode::Error(self.error_message.clone());
+                        }
+                    }
                 }
             }
             KeyCode::Char('f') if key.modifiers.contains(KeyModifiers::CONTROL) => {
@@ -123,6 +323,7 @@ impl App {
             }
             KeyCode::Char(c) => {
                 self.query.push(c);
+                self.status_message.clear();
             }
             KeyCode::Backspace => {
                 self.query.pop();
@@ -133,14 +334,22 @@ impl App {
             KeyCode::F(1) => {
                 self.mode = AppMode::Help;
             }
+            KeyCode::F(3) => {
+                self.show_favorites();
+            }
             _ => {}
         }
         Ok(ControlFlow::Continue)
     }
 
     async fn handle_results_navigation(&mut self, key: KeyEvent) -> Result<ControlFlow> {
+        if self.handle_jump_key(key) {
+            return Ok(ControlFlow::Continue);
+        }
+
         match key.code {
             KeyCode::Down | KeyCode::Char('j') => {
+                self.status_message.clear();
                 if self.selected_book_index < self.books.len().saturating_sub(1) {
                     self.selected_book_index += 1;
                     if self.selected_book_index >= self.results_scroll + 10 {
@@ -149,6 +358,7 @@ impl App {
                 }
             }
             KeyCode::Up | KeyCode::Char('k') => {
+                self.status_message.clear();
                 if self.selected_book_index > 0 {
                     self.selected_book_index = self.selected_book_index.saturating_sub(1);
                     if self.selected_book_index < self.results_scroll {
@@ -165,20 +375,462 @@ impl App {
                 self.mode = AppMode::Search;
                 self.query.clear();
                 self.books.clear();
+                self.search_results.clear();
                 self.selected_book_index = 0;
                 self.results_scroll = 0;
+                self.showing_favorites = false;
+                self.status_message.clear();
             }
             KeyCode::Char('c') if key.modifiers.contains(KeyModifiers::CONTROL) => {
                 return Ok(ControlFlow::Exit);
             }
+            KeyCode::Char('c') => {
+                self.copy_citation(CitationStyle::Bibtex);
+            }
+            KeyCode::Char('C') => {
+                self.copy_citation(CitationStyle::Apa);
+            }
+            KeyCode::Char('y') => {
+                self.copy_share_link();
+            }
+            KeyCode::Char('e') => {
+                self.export_markdown();
+            }
+            KeyCode::Char('b') => {
+                self.toggle_favorite();
+            }
+            KeyCode::Char('p') => {
+                self.show_preview = !self.show_preview;
+            }
+            KeyCode::Char('t') => {
+                self.theme = self.theme.next();
+                self.status_message = format!("Theme: {}", self.theme.label());
+            }
+            KeyCode::Char('a') => {
+                if let Some(book) = self.books.get(self.selected_book_index) {
+                    let added = self.queue.toggle(book);
+                    self.status_message = format!(
+                        "{} '{}' ({} queued, D to start)",
+                        if added { "Queued" } else { "Unqueued" },
+                        book.title,
+                        self.queue.pending()
+                    );
+                }
+            }
+            KeyCode::Char('d') => {
+                if !self.books.is_empty() {
+                    self.fetch_download_links().await?;
+                    // After the fetch, which clears it; the links only arrive on a later loop
+                    self.quick_download = true;
+                }
+            }
+            KeyCode::Char('D') => {
+                if self.queue.pending() > 0 {
+                    self.queue.running = true;
+                    self.advance_queue();
+                }
+            }
+            KeyCode::Char('f') => {
+                let formats = self.search_results.iter().filter_map(|book| book.format.clone());
+                self.view_format = next_view_value(formats, &self.view_format);
+                self.apply_sort();
+                self.status_message = self.view_status("format", &self.view_format);
+            }
+            KeyCode::Char('l') => {
+                let languages = self.search_results.iter().filter_map(|book| book.language.clone());
+                self.view_language = next_view_value(languages, &self.view_language);
+                self.apply_sort();
+                self.status_message = self.view_status("language", &self.view_language);
+            }
+            KeyCode::Char('s') => {
+                self.sort_mode = self.sort_mode.next();
+                self.apply_sort();
+                self.status_message = format!("Sorted by {}", self.sort_mode.label());
+                self.persist_view();
+            }
+            KeyCode::Char('S') => {
+                self.sort_mode = SortMode::Relevance;
+                self.apply_sort();
+                self.status_message = "Back to the site's relevance order".to_string();
+                self.persist_view();
+            }
+            KeyCode::Char('+') => {
+                self.change_result_count(true).await?;
+            }
+            KeyCode::Char('-') => {
+                self.change_result_count(false).await?;
+            }
             KeyCode::F(1) => {
                 self.mode = AppMode::Help;
             }
+            KeyCode::F(3) => {
+                self.show_favorites();
+            }
             _ => {}
         }
         Ok(ControlFlow::Continue)
     }
 
+    // Returns true when the key belonged to a number being typed
+    fn handle_jump_key(&mut self, key: KeyEvent) -> bool {
+        match key.code {
+            KeyCode::Char(c) if c.is_ascii_digit() && key.modifiers.is_empty() => {
+                if self.jump_input.len() < 4 {
+                    self.jump_input.push(c);
+                }
+                true
+            }
+            KeyCode::Backspace if !self.jump_input.is_empty() => {
+                self.jump_input.pop();
+                true
+            }
+            KeyCode::Esc if !self.jump_input.is_empty() => {
+                self.jump_input.clear();
+                true
+            }
+            KeyCode::Enter if !self.jump_input.is_empty() => {
+                let input = std::mem::take(&mut self.jump_input);
+                match input.parse::<usize>() {
+                    Ok(n) if n >= 1 && n <= self.books.len() => {
+                        self.selected_book_index = n - 1;
+                        if self.selected_book_index < self.results_scroll || self.selected_book_index >= self.results_scroll + 10 {
+                            self.results_scroll = self.selected_book_index.saturating_sub(9);
+                        }
+                        self.status_message.clear();
+                    }
+                    _ => {
+                        self.status_message = format!("No result #{} (1-{})", input, self.books.len());
+                    }
+                }
+                true
+            }
+            _ => {
+                self.jump_input.clear();
+                false
+            }
+        }
+    }
+
+    pub fn set_results(&mut self, books: Vec<Book>) {
+        self.search_results = books;
+        self.apply_sort();
+    }
+
+    // Shows the first batch right away and adds later ones without moving the highlight
+    pub fn append_results(&mut self, search_id: u64, batch: Vec<Book>) {
+        let searching = matches!(self.mode, AppMode::Downloading) && self.phase == Phase::Searching;
+        if search_id != self.search_id || (!searching && !self.loading_more) {
+            return;
+        }
+
+        let selected_url = self.books.get(self.selected_book_index).map(|book| book.url.clone());
+        self.search_results.extend(batch);
+        self.rebuild_view();
+
+        if let Some(index) = selected_url.and_then(|url| self.books.iter().position(|book| book.url == url)) {
+            self.selected_book_index = index;
+            if index < self.results_scroll || index >= self.results_scroll + 10 {
+                self.results_scroll = index.saturating_sub(9);
+            }
+        }
+
+        self.loading_more = true;
+        if searching {
+            self.mode = AppMode::Results;
+        }
+    }
+
+    // Keeps every index inside its list, so an empty or shrunken list is never indexed out of range
+    pub fn clamp_selection(&mut self) {
+        self.selected_book_index = self.selected_book_index.min(self.books.len().saturating_sub(1));
+        if self.results_scroll > self.selected_book_index {
+            self.results_scroll = self.selected_book_index;
+        } else if self.selected_book_index >= self.results_scroll + 10 {
+            self.results_scroll = self.selected_book_index - 9;
+        }
+        self.download_link_index = self.download_link_index.min(self.download_links.len().saturating_sub(1));
+
+        // Nothing to pick from; fall back to the results list
+        if matches!(self.mode, AppMode::DownloadSelection) && (self.download_links.is_empty() || self.books.is_empty()) {
+            self.mode = self.list_mode();
+        }
+    }
+
+    pub fn set_links(&mut self, links: Vec<DownloadLink>) {
+        if links.is_empty() {
+            self.status_message.clear();
+            self.mode = AppMode::NoLinks;
+            return;
+        }
+        self.download_links = links;
+        self.download_link_index = 0;
+        self.mode = AppMode::DownloadSelection;
+        
+        if std::mem::take(&mut self.quick_download) {
+            match scraper::preferred_source_index(&self.download_links) {
+                Some(index) => {
+                    self.download_link_index = index;
+                    self.perform_download();
+                }
+                None => {
+                    self.status_message = "No LibGen link for this book; pick a download".to_string();
+                }
+            }
+        }
+    }
+
+    // Swaps in a re-read link list, keeping the highlight on the same link if it is still listed
+    pub fn apply_refreshed_links(&mut self, links: Vec<DownloadLink>, metadata: BookMetadata) {
+        if !std::mem::take(&mut self.refreshing_links) || !matches!(self.mode, AppMode::DownloadSelection) {
+            return;
+        }
+        
+        let selected_url = self.download_links.get(self.download_link_index).map(|link| link.url.clone());
+        self.book_metadata = metadata;
+        self.set_links(links);
+        if let Some(index) = selected_url.and_then(|url| self.download_links.iter().position(|link| link.url == url)) {
+            self.download_link_index = index;
+        }
+        if matches!(self.mode, AppMode::DownloadSelection) {
+            self.status_message = format!("Links refreshed: {} found", self.download_links.len());
+        }
+    }
+
+    pub fn refresh_failed(&mut self, message: String) {
+        if std::mem::take(&mut self.refreshing_links) {
+            self.status_message = format!("Refresh failed: {}", message);
+        }
+    }
+
+    pub fn finish_results(&mut self, search_id: u64, books: Vec<Book>) {
+        if search_id != self.search_id {
+            return;
+        }
+        if self.loading_more {
+            // Every book already arrived in a batch
+            self.loading_more = false;
+            self.start_prefetch();
+            return;
+        }
+        if books.is_empty() {
+            self.show_no_results(None);
+            return;
+        }
+        self.set_results(books);
+        self.mode = AppMode::Results;
+        self.start_prefetch();
+    }
+
+    // Reads the top results' book pages in the background, one request at a time with a pause
+    // between them, so picking one of them opens its links without waiting
+    fn start_prefetch(&mut self) {
+        if let Some(task) = self.prefetch_task.take() {
+            task.abort();
+        }
+        let count = self.network.prefetch;
+        if count == 0 || self.showing_favorites {
+            return;
+        }
+
+        let books: Vec<&Book> = self.books.iter()
+            .take(count)
+            .filter(|book| !self.link_cache.contains_key(&book.url))
+            .collect();
+        if books.is_empty() {
+            return;
+        }
+        let titles = books.iter().map(|book| book.title.as_str()).collect::<Vec<_>>().join(", ");
+        let urls: Vec<String> = books.iter().map(|book| book.url.clone()).collect();
+        self.debug(format!("prefetching links for {} of {} results: {}", urls.len(), self.books.len(), titles));
+
+        let search_id = self.search_id;
+        let network = self.network.clone();
+        let transfer = self.transfer.clone();
+        let tx = self.command_tx.clone();
+        self.prefetch_task = Some(tokio::spawn(async move {
+            for (i, url) in urls.into_iter().enumerate() {
+                if i > 0 {
+                    tokio::time::sleep(scraper::PREFETCH_DELAY).await;
+                }
+                let result = transfer.details(&network, &url).await.map_err(|e| format!("{:#}", e));
+                let _ = tx.send(AppCommand::LinksPrefetched(search_id, url, result));
+            }
+        }));
+    }
+
+    // Pages read ahead for an earlier search are dropped: its results are no longer on screen
+    pub fn links_prefetched(&mut self, search_id: u64, url: String, result: std::result::Result<(Vec<DownloadLink>, BookMetadata), String>) {
+        if search_id != self.search_id {
+            self.debug(format!("prefetched {} for an earlier search; ignored", url));
+            return;
+        }
+        match result {
+            // An empty page is left for the live fetch, which explains it
+            Ok((links, _)) if links.is_empty() => self.debug(format!("prefetched {}: no links", url)),
+            Ok((links, metadata)) => {
+                self.debug(format!("prefetched {}: {} links", url, links.len()));
+                self.link_cache.insert(url, (links, metadata));
+            }
+            Err(e) => self.debug(format!("prefetch of {} failed: {}", url, e)),
+        }
+    }
+
+    fn debug(&mut self, message: String) {
+        if self.verbose {
+            self.debug_log.push(message);
+        }
+    }
+
+    // An empty search gets next steps instead of a bare "no results"
+    pub fn show_no_results(&mut self, filtered_out: Option<usize>) {
+        self.set_results(Vec::new());
+        self.error_message = self.no_results_message(filtered_out);
+        self.mode = AppMode::Error(self.error_message.clone());
+    }
+
+    // Told apart from a mirror being down, since the fix is on the user's side
+    pub fn show_offline(&mut self) {
+        self.offline = true;
+        self.error_message = "No internet connection.\n\nThe mirrors' addresses could not be looked up, so this is your network, not the site being down or blocking you.\nCheck your connection, then press r to retry.".to_string();
+        self.mode = AppMode::Error(self.error_message.clone());
+    }
+
+    fn no_results_message(&self, filtered_out: Option<usize>) -> String {
+        let mut lines = vec![match filtered_out {
+            Some(count) => format!("The site found {} result(s) for \"{}\", but the size or year filter removed them all.", count, self.query),
+            None => format!("No results found for \"{}\".", self.query),
+        }];
+        let summary = self.filter_summary();
+        if let Some(ref summary) = summary {
+            lines.push(format!("Active filters: {}", summary));
+        }
+
+        lines.push(String::new());
+        if summary.is_some() {
+            lines.push("• Remove or loosen the filters (Ctrl+F on the search screen)".to_string());
+        }
+        lines.push("• Check the spelling, or search for fewer words".to_string());
+        lines.push("• Search again later or on another mirror".to_string());
+        lines.join("\n")
+    }
+
+    fn apply_sort(&mut self) {
+        self.rebuild_view();
+        self.selected_book_index = 0;
+        self.results_scroll = 0;
+    }
+
+    // books is search_results narrowed by the view filters, then sorted
+    fn rebuild_view(&mut self) {
+        let keep = |value: &Option<String>, wanted: &Option<String>| match wanted {
+            Some(wanted) => value.as_deref().map_or(false, |v| v.eq_ignore_ascii_case(wanted)),
+            None => true,
+        };
+        self.books = self.search_results.iter()
+            .filter(|book| keep(&book.format, &self.view_format) && keep(&book.language, &self.view_language))
+            .cloned()
+            .collect();
+        scraper::sort_books(&mut self.books, self.sort_mode);
+    }
+
+    fn view_status(&self, label: &str, value: &Option<String>) -> String {
+        match value {
+            Some(value) => format!("Showing {} {} ({} of {} results)", label, value, self.books.len(), self.search_results.len()),
+            None => format!("Showing every {}", label),
+        }
+    }
+
+    fn view_summary(&self) -> Option<String> {
+        let parts: Vec<&str> = [self.view_format.as_deref(), self.view_language.as_deref()]
+            .into_iter()
+            .flatten()
+            .collect();
+        if parts.is_empty() {
+            None
+        } else {
+            Some(format!("Showing {}", parts.join(", ")))
+        }
+    }
+
+    // Called on quit so the next start looks the same
+    pub fn save_ui_prefs(&mut self) -> Result<()> {
+        let prefs = UiPrefs {
+            show_preview: Some(self.show_preview),
+            sort: Some(self.sort_mode),
+            theme: self.theme,
+        };
+        self.config.save_ui(prefs)?;
+        Ok(())
+    }
+
+    // Saves sort/filters as config defaults if remember_view is enabled
+    fn persist_view(&mut self) {
+        if let Err(e) = self.config.remember_view(&self.filters, self.sort_mode) {
+            self.status_message = format!("Could not save view preferences: {}", e);
+        }
+    }
+
+    fn copy_citation(&mut self, style: CitationStyle) {
+        let book = match self.books.get(self.selected_book_index) {
+            Some(book) => book,
+            None => return,
+        };
+
+        let text = citation::format(book, style);
+        match (self.copy_to_clipboard)(&text) {
+            Ok(()) => {
+                self.status_message = format!("Citation for '{}' copied to clipboard", book.title);
+            }
+            Err(e) => {
+                self.error_message = format!("Could not copy citation ({}):\n\n{}", e, text);
+                self.mode = AppMode::Error(self.error_message.clone());
+            }
+        }
+    }
+
+    fn copy_share_link(&mut self) {
+        let book = match self.books.get(self.selected_book_index) {
+            Some(book) => book,
+            None => return,
+        };
+
+        let link = book.share_url();
+        match (self.copy_to_clipboard)(&link) {
+            Ok(()) => {
+                self.status_message = format!("Link copied: {}", link);
+            }
+            Err(e) => {
+                self.error_message = format!("Could not copy link ({}):\n\n{}", e, link);
+                self.mode = AppMode::Error(self.error_message.clone());
+            }
+        }
+    }
+
+    // The results as shown (view filters and sort applied); saved to a file without a clipboard tool
+    fn export_markdown(&mut self) {
+        if self.books.is_empty() {
+            return;
+        }
+
+        let markdown = export::to_markdown(&self.books);
+        let count = match self.books.len() {
+            1 => "1 result".to_string(),
+            n => format!("{} results", n),
+        };
+        self.status_message = match (self.copy_to_clipboard)(&markdown) {
+            Ok(()) => format!("Copied {} as Markdown", count),
+            Err(_) => {
+                let path = self.download_path.join(MARKDOWN_EXPORT_FILE);
+                match std::fs::create_dir_all(&self.download_path).map_err(anyhow::Error::from)
+                    .and_then(|_| export::write(&path, &self.books))
+                {
+                    Ok(()) => format!("No clipboard tool; saved {} to {}", count, path.display()),
+                    Err(e) => format!("Could not export results: {:#}", e),
+                }
+            }
+        };
+    }
+
     async fn handle_download_selection(&mut self, key: KeyEvent) -> Result<ControlFlow> {
         match key.code {
             KeyCode::Down | KeyCode::Char('j') => {
@@ -191,13 +843,20 @@ impl App {
             }
             KeyCode::Enter => {
                 if !self.download_links.is_empty() {
-                    self.perform_download().await?;
+                    self.perform_download();
                 }
             }
             KeyCode::Esc => {
-                self.mode = AppMode::Results;
+                self.mode = self.list_mode();
                 self.download_links.clear();
                 self.download_link_index = 0;
+                self.refreshing_links = false;
+            }
+            KeyCode::Char('a') => {
+                self.queue_all_formats();
+            }
+            KeyCode::Char('r') => {
+                self.refresh_links();
             }
             KeyCode::Char('c') if key.modifiers.contains(KeyModifiers::CONTROL) => {
                 return Ok(ControlFlow::Exit);
@@ -215,25 +874,296 @@ impl App {
             KeyCode::Esc | KeyCode::Enter => {
                 self.mode = AppMode::Search;
                 self.error_message.clear();
+                self.offline = false;
+            }
+            KeyCode::Char('r') if self.offline => {
+                self.offline = false;
+                self.error_message.clear();
+                self.perform_search().await?;
+            }
+            KeyCode::Char('c') if key.modifiers.contains(KeyModifiers::CONTROL) => {
+                return Ok(ControlFlow::Exit);
+            }
+            _ => {}
+        }
+        Ok(ControlFlow::Continue)
+    }
+
+    // Results keys apply unchanged; only leaving and un-bookmarking differ
+    async fn handle_favorites(&mut self, key: KeyEvent) -> Result<ControlFlow> {
+        match key.code {
+            KeyCode::Char('b') => {
+                self.toggle_favorite();
+                self.set_results(self.favorites.books.clone());
+                if self.books.is_empty() {
+                    self.mode = AppMode::Search;
+                    self.showing_favorites = false;
+                }
+                Ok(ControlFlow::Continue)
+            }
+            KeyCode::F(3) => {
+                self.handle_results_navigation(KeyEvent::new(KeyCode::Esc, KeyModifiers::NONE)).await
+            }
+            _ => self.handle_results_navigation(key).await,
+        }
+    }
+
+    fn list_mode(&self) -> AppMode {
+        if self.showing_favorites {
+            AppMode::Favorites
+        } else {
+            AppMode::Results
+        }
+    }
+
+    // Replaces the current results with the bookmarked books
+    fn show_favorites(&mut self) {
+        if self.favorites.books.is_empty() {
+            self.status_message = "No favorites yet; press b on a result to add one".to_string();
+            return;
+        }
+        self.status_message.clear();
+        self.showing_favorites = true;
+        self.set_results(self.favorites.books.clone());
+        self.mode = AppMode::Favorites;
+    }
+
+    fn toggle_favorite(&mut self) {
+        let book = match self.books.get(self.selected_book_index) {
+            Some(book) => book.clone(),
+            None => return,
+        };
+
+        self.status_message = match self.favorites.toggle(&book) {
+            Ok(true) => format!("Bookmarked '{}' ({} favorites, F3 to view)", book.title, self.favorites.books.len()),
+            Ok(false) => format!("Removed '{}' from favorites", book.title),
+            Err(e) => format!("Could not save favorites: {}", e),
+        };
+    }
+
+    async fn handle_confirm_overwrite(&mut self, key: KeyEvent) -> Result<ControlFlow> {
+        match key.code {
+            KeyCode::Char('c') if key.modifiers.contains(KeyModifiers::CONTROL) => {
+                return Ok(ControlFlow::Exit);
+            }
+            KeyCode::Char('o') => self.start_download(ConflictPolicy::Overwrite),
+            KeyCode::Char('r') => self.start_download(ConflictPolicy::Rename),
+            KeyCode::Char('s') | KeyCode::Esc => {
+                self.mode = AppMode::DownloadSelection;
+            }
+            _ => {}
+        }
+        Ok(ControlFlow::Continue)
+    }
+
+    async fn handle_queue_summary(&mut self, key: KeyEvent) -> Result<ControlFlow> {
+        match key.code {
+            KeyCode::Char('c') if key.modifiers.contains(KeyModifiers::CONTROL) => {
+                return Ok(ControlFlow::Exit);
+            }
+            KeyCode::Char('r') => {
+                if self.queue.retry_failed() > 0 {
+                    self.queue.running = true;
+                    self.advance_queue();
+                }
             }
+            KeyCode::Enter | KeyCode::Esc => self.close_queue(),
+            _ => {}
+        }
+        Ok(ControlFlow::Continue)
+    }
+
+    async fn handle_no_links(&mut self, key: KeyEvent) -> Result<ControlFlow> {
+        match key.code {
             KeyCode::Char('c') if key.modifiers.contains(KeyModifiers::CONTROL) => {
                 return Ok(ControlFlow::Exit);
             }
+            KeyCode::Char('r') => {
+                self.fetch_download_links().await?;
+            }
+            KeyCode::Char('o') => {
+                self.open_book_page();
+            }
+            KeyCode::Esc | KeyCode::Enter => {
+                self.status_message.clear();
+                self.mode = self.list_mode();
+            }
             _ => {}
         }
         Ok(ControlFlow::Continue)
     }
 
+    // Failing to open is reported in place so the retry/back options stay on screen
+    fn open_book_page(&mut self) {
+        let url = match self.books.get(self.selected_book_index) {
+            Some(book) => book.url.clone(),
+            None => return,
+        };
+
+        self.status_message = match browser::open(&url) {
+            Ok(()) => format!("Opened {}", url),
+            Err(e) => format!("Could not open a browser ({}); the page is {}", e, url),
+        };
+    }
+
     async fn handle_downloading(&mut self, key: KeyEvent) -> Result<ControlFlow> {
         match key.code {
             KeyCode::Char('c') if key.modifiers.contains(KeyModifiers::CONTROL) => {
                 return Ok(ControlFlow::Exit);
             }
+            KeyCode::Char('x') if self.phase == Phase::Downloading => {
+                self.skip_current_download();
+            }
             _ => {}
         }
         Ok(ControlFlow::Continue)
     }
 
+    // Cancels only the file in flight; the guard in the downloader removes the partial file
+    fn skip_current_download(&mut self) {
+        if let Some(task) = self.current_task.take() {
+            task.abort();
+        }
+
+        if self.queue.running {
+            if let Some(index) = self.queue.current() {
+                self.queue.finish(index, QueueStatus::Skipped);
+            }
+            self.advance_queue();
+        } else {
+            self.status_message = "Download cancelled".to_string();
+            self.mode = AppMode::DownloadSelection;
+        }
+    }
+
+    // Queues the selected book plus every other result with the same title in a format not yet queued
+    fn queue_all_formats(&mut self) {
+        let current = match self.books.get(self.selected_book_index) {
+            Some(book) => book.clone(),
+            None => return,
+        };
+
+        let title = current.title.trim().to_lowercase();
+        let mut editions = vec![current.clone()];
+        editions.extend(
+            self.search_results.iter()
+                .filter(|book| book.url != current.url && book.title.trim().to_lowercase() == title)
+                .cloned(),
+        );
+
+        if self.queue.add_formats(&editions) == 0 {
+            self.status_message = format!("Every format of '{}' is already queued", current.title);
+            return;
+        }
+
+        self.download_links.clear();
+        self.download_link_index = 0;
+        self.queue.running = true;
+        self.advance_queue();
+    }
+
+    fn advance_queue(&mut self) {
+        match self.queue.start_next() {
+            Some(index) => self.spawn_queue_download(index),
+            None => {
+                self.queue.running = false;
+                if self.queue.failed().next().is_some() {
+                    self.mode = AppMode::QueueSummary;
+                } else {
+                    self.close_queue();
+                }
+            }
+        }
+    }
+
+    fn close_queue(&mut self) {
+        self.status_message = if self.queue.by_format {
+            self.queue.format_summary()
+        } else {
+            self.queue.summary()
+        };
+        self.queue.by_format = false;
+        self.queue.clear_finished();
+        self.mode = self.list_mode();
+    }
+
+    pub fn finish_queue_item(&mut self, index: usize, result: std::result::Result<Saved, String>) {
+        let book = match self.queue.items.get(index) {
+            Some(item) => item.book.clone(),
+            None => return,
+        };
+
+        let mut downloaded = None;
+        let mut history_error = None;
+        let status = match result {
+            Ok(Saved::Written(path)) => {
+                if let Some(md5) = book.md5.as_deref() {
+                    if let Err(e) = self.history.record(md5, &book.title, &path) {
+                        history_error = Some(format!("Could not save download history: {}", e));
+                    }
+                }
+                downloaded = Some(file_size(&path));
+                QueueStatus::Done(path)
+            }
+            // A file that was already there isn't a new download
+            Ok(Saved::Skipped(_)) => QueueStatus::Skipped,
+            Err(e) => QueueStatus::Failed(e),
+        };
+
+        if self.queue.finish(index, status) {
+            if let Some(bytes) = downloaded {
+                self.stats.record_download(bytes);
+            }
+            self.current_task = None;
+            self.advance_queue();
+            // After advancing, so the queue summary doesn't replace it
+            if let Some(message) = history_error {
+                self.post_download_failed(message);
+            }
+        }
+    }
+
+    fn spawn_queue_download(&mut self, index: usize) {
+        let book = self.queue.items[index].book.clone();
+        self.mode = AppMode::Downloading;
+        self.phase = Phase::Downloading;
+        self.download_progress = Progress::default();
+        self.downloading_message = format!("[{}/{}] Downloading: {}", index + 1, self.queue.items.len(), book.title);
+        let (folder, stem) = self.network.book_path(&book);
+        let stem = self.queue.names.unique(&folder, &stem, &book);
+        let dir = self.download_path.join(folder);
+        let filename = format!("{}.{}", stem, book.format.as_deref().unwrap_or("unknown"));
+        self.download_destination = Some(dir.join(&filename));
+
+        // A queue can't stop to ask, so it keeps both files unless a policy says otherwise
+        let network = NetworkOptions {
+            on_conflict: Some(self.network.on_conflict.unwrap_or(ConflictPolicy::Rename)),
+            ..self.network.clone()
+        };
+        let tx = self.command_tx.clone();
+        let transfer = self.transfer.clone();
+
+        self.current_task = Some(tokio::spawn(async move {
+            let progress_tx = tx.clone();
+            let result = download_book(&*transfer, &book, dir, &filename, &network, Box::new(move |progress| {
+                let _ = progress_tx.send(AppCommand::DownloadProgress(progress));
+            }))
+                .await;
+            let (result, warning) = match result {
+                Ok(Saved::Written(path)) => match post_download(&network, &path, &book).await {
+                    Ok(warning) => (Ok(Saved::Written(path)), warning),
+                    Err(e) => (Err(format!("{:#}", e)), None),
+                },
+                Ok(skipped) => (Ok(skipped), None),
+                Err(e) => (Err(format!("{:#}", e)), None),
+            };
+            let _ = tx.send(AppCommand::QueueItemFinished(index, result));
+            if let Some(warning) = warning {
+                let _ = tx.send(AppCommand::PostDownloadFailed(warning));
+            }
+        }));
+    }
+
     async fn handle_filters(&mut self, key: KeyEvent) -> Result<ControlFlow> {
         match key.code {
             KeyCode::Esc => {
@@ -259,14 +1189,19 @@ impl App {
                     self.filter_size_input.trim().parse::<f64>().ok()
                 };
 
+                let (min_year, max_year) = scraper::parse_year_range(&self.filter_year_input).unwrap_or((None, None));
+                self.filters.min_year = min_year;
+                self.filters.max_year = max_year;
+
+                self.persist_view();
                 self.mode = AppMode::Search;
             }
             KeyCode::Tab | KeyCode::Down => {
-                self.filter_input_idx = (self.filter_input_idx + 1) % 3;
+                self.filter_input_idx = (self.filter_input_idx + 1) % 4;
             }
             KeyCode::BackTab | KeyCode::Up => {
                 self.filter_input_idx = if self.filter_input_idx == 0 {
-                    2
+                    3
                 } else {
                     self.filter_input_idx - 1
                 };
@@ -279,6 +1214,7 @@ impl App {
                     0 => self.filter_format_input.push(c),
                     1 => self.filter_language_input.push(c),
                     2 => self.filter_size_input.push(c),
+                    3 => self.filter_year_input.push(c),
                     _ => {}
                 }
             }
@@ -287,6 +1223,7 @@ impl App {
                     0 => { self.filter_format_input.pop(); },
                     1 => { self.filter_language_input.pop(); },
                     2 => { self.filter_size_input.pop(); },
+                    3 => { self.filter_year_input.pop(); },
                     _ => {}
                 }
             }
@@ -314,15 +1251,39 @@ impl App {
         Ok(ControlFlow::Continue)
     }
 
-    pub fn draw(&mut self, f: &mut Frame) {
-        match &self.mode {
-            AppMode::Search => self.draw_search(f),
-            AppMode::Results => self.draw_results(f),
+    async fn handle_about(&mut self, key: KeyEvent) -> Result<ControlFlow> {
+        match key.code {
+            KeyCode::Char('c') if key.modifiers.contains(KeyModifiers::CONTROL) => {
+                return Ok(ControlFlow::Exit);
+            }
+            KeyCode::Esc | KeyCode::F(2) => {
+                self.mode = AppMode::Search;
+            }
+            _ => {}
+        }
+        Ok(ControlFlow::Continue)
+    }
+
+    pub fn draw(&mut self, f: &mut Frame) {
+        self.clamp_selection();
+        self.cover_slot = None;
+        match &self.mode {
+            AppMode::Search => self.draw_search(f),
+            AppMode::Results => self.draw_results(f),
             AppMode::DownloadSelection => self.draw_download_selection(f),
             AppMode::Error(msg) => self.draw_error(f, msg),
             AppMode::Downloading => self.draw_downloading(f),
             AppMode::Help => self.draw_help(f),
+            AppMode::About => self.draw_about(f),
+            AppMode::NoLinks => self.draw_no_links(f),
+            AppMode::Favorites => self.draw_results(f),
             AppMode::Filters => self.draw_filters(f),
+            AppMode::ConfirmOverwrite(path) => self.draw_confirm_overwrite(f, path),
+            AppMode::QueueSummary => self.draw_queue_summary(f),
+        }
+
+        if self.theme == Theme::Mono {
+            strip_colors(f.buffer_mut());
         }
     }
 
@@ -337,37 +1298,105 @@ impl App {
             ])
             .split(f.size());
 
-        let title = Paragraph::new("Anna's Archive Downloader")
-            .style(Style::default().fg(Color::Cyan).add_modifier(Modifier::BOLD))
-            .alignment(Alignment::Center);
-        f.render_widget(title, chunks[0]);
+        self.draw_header(f, chunks[0], "Anna's Archive Downloader");
 
         let input = Paragraph::new(self.query.as_str())
-            .block(Block::default().borders(Borders::ALL).title("Search Query (Enter: search, Ctrl+F: filters, Ctrl+C: quit, F1: Help)"))
+            .block(Block::default().borders(Borders::ALL).title("Search Query (Enter: search, Ctrl+F: filters, F3: favorites, Ctrl+C: quit, F1: Help)"))
             .style(Style::default().fg(Color::White));
         f.render_widget(input, chunks[1]);
 
-        let mut filter_text = String::new();
+        let filter_text = self.filter_summary().unwrap_or_else(|| "No active filters".to_string());
+
+        let filters_info = Paragraph::new(filter_text)
+             .block(Block::default().borders(Borders::ALL).title("Active Filters"))
+             .style(Style::default().fg(Color::Yellow));
+        f.render_widget(filters_info, chunks[2]);
+
+        if !self.status_message.is_empty() {
+            let status = Paragraph::new(self.status_message.as_str())
+                .style(Style::default().fg(Color::Gray))
+                .wrap(Wrap { trim: true });
+            f.render_widget(status, chunks[3]);
+        }
+    }
+
+    fn filter_summary(&self) -> Option<String> {
+        let mut parts = Vec::new();
         if let Some(ref fmt) = self.filters.format {
-            filter_text.push_str(&format!("Format: {} | ", fmt));
+            parts.push(format!("Format: {}", fmt));
         }
         if let Some(ref lang) = self.filters.language {
-            filter_text.push_str(&format!("Lang: {} | ", lang));
+            parts.push(format!("Lang: {}", scraper::language_label(lang)));
         }
         if let Some(size) = self.filters.max_size_mb {
-            filter_text.push_str(&format!("Size < {}MB | ", size));
+            parts.push(format!("Size < {}MB", size));
+        }
+        if let Some(years) = self.filters.year_label() {
+            parts.push(format!("Years: {}", years));
         }
 
-        if filter_text.is_empty() {
-            filter_text = "No active filters".to_string();
+        if parts.is_empty() {
+            None
         } else {
-            filter_text = filter_text.trim_end_matches(" | ").to_string();
+            Some(parts.join(" | "))
         }
+    }
 
-        let filters_info = Paragraph::new(filter_text)
-             .block(Block::default().borders(Borders::ALL).title("Active Filters"))
-             .style(Style::default().fg(Color::Yellow));
-        f.render_widget(filters_info, chunks[2]);
+    // Mode, result count, filters and a spinner while a network operation runs
+    fn header_status(&self) -> String {
+        let mode = match self.mode {
+            AppMode::Search => "Search",
+            AppMode::Results => "Results",
+            AppMode::DownloadSelection => "Download links",
+            AppMode::Downloading => match self.phase {
+                Phase::Searching => "Searching",
+                Phase::FetchingLinks => "Fetching links",
+                Phase::Downloading => "Downloading",
+            },
+            AppMode::Error(_) => "Error",
+            AppMode::Help => "Help",
+            AppMode::About => "About",
+            AppMode::NoLinks => "No download links",
+            AppMode::Favorites => "Favorites",
+            AppMode::Filters => "Filters",
+            AppMode::ConfirmOverwrite(_) => "File exists",
+            AppMode::QueueSummary => "Queue finished",
+        };
+
+        let mut parts = Vec::new();
+        if matches!(self.mode, AppMode::Downloading) {
+            parts.push(format!("{} {}", spinner_frame(self.tick), mode));
+        } else {
+            parts.push(mode.to_string());
+        }
+        if !self.books.is_empty() {
+            parts.push(format!("{} results", self.books.len()));
+        }
+        if self.loading_more {
+            parts.push(format!("{} loading more…", spinner_frame(self.tick)));
+        }
+        parts.push(self.filter_summary().unwrap_or_else(|| "No filters".to_string()));
+        if let Some(view) = self.view_summary() {
+            parts.push(view);
+        }
+
+        parts.join(" · ")
+    }
+
+    fn draw_header(&self, f: &mut Frame, area: Rect, title: &str) {
+        let width = area.width as usize;
+        let lines = vec![
+            Line::from(Span::styled(
+                truncate_to_width(title, width),
+                Style::default().fg(Color::Cyan).add_modifier(Modifier::BOLD),
+            )),
+            Line::from(Span::styled(
+                truncate_to_width(&self.header_status(), width),
+                Style::default().fg(Color::Gray),
+            )),
+        ];
+
+        f.render_widget(Paragraph::new(lines).alignment(Alignment::Center), area);
     }
 
     fn draw_filters(&self, f: &mut Frame) {
@@ -378,6 +1407,7 @@ impl App {
                 Constraint::Length(3), // Format
                 Constraint::Length(3), // Language
                 Constraint::Length(3), // Size
+                Constraint::Length(3), // Year
                 Constraint::Min(0),
             ])
             .split(f.size());
@@ -405,10 +1435,16 @@ impl App {
             .style(size_style);
         f.render_widget(size_input, chunks[3]);
 
+        let year_style = if self.filter_input_idx == 3 { Style::default().fg(Color::Yellow) } else { Style::default().fg(Color::White) };
+        let year_input = Paragraph::new(self.filter_year_input.as_str())
+            .block(Block::default().borders(Borders::ALL).title("Years (e.g. 1990-2005, 2010-, -1980)"))
+            .style(year_style);
+        f.render_widget(year_input, chunks[4]);
+
         let footer = Paragraph::new("Press Enter to apply, Esc to cancel, Tab/Arrow keys to navigate")
             .style(Style::default().fg(Color::Gray))
             .alignment(Alignment::Center);
-        f.render_widget(footer, chunks[4]);
+        f.render_widget(footer, chunks[5]);
     }
 
     fn draw_results(&mut self, f: &mut Frame) {
@@ -421,12 +1457,25 @@ impl App {
             ])
             .split(f.size());
 
-        let header = Paragraph::new(format!("Search Results for: {}", self.query))
-            .style(Style::default().fg(Color::Cyan).add_modifier(Modifier::BOLD))
-            .alignment(Alignment::Center);
-        f.render_widget(header, chunks[0]);
+        let title = if self.showing_favorites {
+            format!("Favorites: {} books (sorted by {})", self.favorites.books.len(), self.sort_mode.label())
+        } else {
+            format!("Search Results for: {} (sorted by {})", self.query, self.sort_mode.label())
+        };
+        self.draw_header(f, chunks[0], &title);
 
-        let results_area = chunks[1];
+        // The preview pane only fits on wide terminals; otherwise the list keeps the full width
+        let (results_area, preview_area) = if self.show_preview && chunks[1].width >= PREVIEW_MIN_WIDTH {
+            let columns = Layout::default()
+                .direction(Direction::Horizontal)
+                .constraints([Constraint::Percentage(60), Constraint::Percentage(40)])
+                .split(chunks[1]);
+            (columns[0], Some(columns[1]))
+        } else {
+            (chunks[1], None)
+        };
+        // Inside the list borders
+        let text_width = results_area.width.saturating_sub(2) as usize;
         let items: Vec<ListItem> = self.books.iter()
             .skip(self.results_scroll)
             .take(10)
@@ -439,27 +1488,70 @@ impl App {
                     Style::default().fg(Color::White)
                 };
 
-                let lines = vec![
-                    Line::from(vec![
-                        Span::styled(format!("{}. ", real_index + 1), style),
-                        Span::styled(&book.title, style.add_modifier(Modifier::BOLD)),
-                    ]),
+                let downloaded = book.md5.as_deref()
+                    .map(|md5| self.history.contains(md5))
+                    .unwrap_or(false);
+                let mut badge = String::new();
+                if downloaded {
+                    badge.push('✓');
+                }
+                if self.queue.contains(book) {
+                    badge.push('+');
+                }
+                if self.favorites.contains(book) {
+                    badge.push('★');
+                }
+                if !badge.is_empty() {
+                    badge.push(' ');
+                }
+
+                let number = format!("{}. ", real_index + 1);
+                let (format_tag, format_color) = format_badge(book.format.as_deref());
+                let title_width = text_width.saturating_sub(number.width() + badge.width() + format_tag.width());
+                let author_width = text_width.saturating_sub("  Author: ".width());
+
+                // The highlighted entry gets its full title, wrapped onto extra lines
+                let title_lines = if real_index == self.selected_book_index {
+                    wrap_to_width(&book.title, title_width, 3)
+                } else {
+                    vec![truncate_to_width(&book.title, title_width)]
+                };
+                let indent = " ".repeat(number.width() + badge.width() + format_tag.width());
+
+                let mut lines = Vec::new();
+                for (line_index, title) in title_lines.into_iter().enumerate() {
+                    if line_index == 0 {
+                        lines.push(Line::from(vec![
+                            Span::styled(number.clone(), style),
+                            Span::styled(badge.clone(), Style::default().fg(Color::Green).add_modifier(Modifier::BOLD)),
+                            Span::styled(format_tag.clone(), Style::default().fg(format_color)),
+                            Span::styled(title, style.add_modifier(Modifier::BOLD)),
+                        ]));
+                    } else {
+                        lines.push(Line::from(vec![
+                            Span::raw(indent.clone()),
+                            Span::styled(title, style.add_modifier(Modifier::BOLD)),
+                        ]));
+                    }
+                }
+
+                lines.extend(vec![
                     Line::from(vec![
                         Span::raw("  Author: "),
-                        Span::raw(book.author.as_deref().unwrap_or("Unknown")),
+                        Span::raw(truncate_to_width(book.author.as_deref().unwrap_or("Unknown"), author_width)),
                     ]),
                     Line::from(vec![
                         Span::raw("  Year: "),
                         Span::raw(book.year.as_deref().unwrap_or("Unknown")),
                         Span::raw(" | Language: "),
-                        Span::raw(book.language.as_deref().unwrap_or("Unknown")),
+                        Span::raw(book.language.as_deref().map(scraper::language_name).unwrap_or("Unknown")),
                         Span::raw(" | Format: "),
                         Span::raw(book.format.as_deref().unwrap_or("Unknown")),
                         Span::raw(" | Size: "),
                         Span::raw(book.size.as_deref().unwrap_or("Unknown")),
                     ]),
                     Line::from(""),
-                ];
+                ]);
 
                 ListItem::new(Text::from(lines))
             })
@@ -473,34 +1565,112 @@ impl App {
         list_state.select(Some(self.selected_book_index.saturating_sub(self.results_scroll)));
         f.render_stateful_widget(list, results_area, &mut list_state);
 
-        let footer_text = format!(
-            "Showing {} of {} books | Press Enter to see download options",
-            self.books.len().min(self.results_scroll + 10) - self.results_scroll,
-            self.books.len()
-        );
+        if let (Some(area), Some(book)) = (preview_area, self.books.get(self.selected_book_index)) {
+            let block = Block::default().borders(Borders::ALL).title("Details (p to hide)");
+            let mut text_area = block.inner(area);
+            f.render_widget(block, area);
+
+            // Room at the top for the cover; sync_cover draws the image itself once the frame is out
+            if let (Some(_), Some(url)) = (self.graphics, book.cover_url.as_ref()) {
+                let rows = COVER_ROWS.min(text_area.height / 2);
+                let cover_area = Rect { height: rows, ..text_area };
+                text_area = Rect { y: text_area.y + rows, height: text_area.height - rows, ..text_area };
+
+                let placeholder = match self.covers.get(url) {
+                    Some(CoverState::Ready(_)) => "",
+                    Some(CoverState::Failed) => "No cover available",
+                    _ => "Loading cover...",
+                };
+                f.render_widget(Paragraph::new(placeholder).style(Style::default().fg(Color::DarkGray)), cover_area);
+                self.cover_slot = Some((url.clone(), cover_area));
+            }
+
+            let preview = Paragraph::new(Text::from(self.preview_lines(book)))
+                .wrap(Wrap { trim: false });
+            f.render_widget(preview, text_area);
+        }
+
+        let footer_text = if !self.jump_input.is_empty() {
+            format!("Go to #{} (Enter: jump, Esc: cancel)", self.jump_input)
+        } else if self.status_message.is_empty() {
+            format!(
+                "Showing {} of {} books | +/-: up to {} | Enter: download options | d: quick download | s: sort | f/l: format/language | p: details | c/C: copy BibTeX/APA | y: copy link",
+                self.books.len().min(self.results_scroll + 10).saturating_sub(self.results_scroll),
+                self.books.len(),
+                self.num_results
+            )
+        } else {
+            self.status_message.clone()
+        };
         let footer = Paragraph::new(footer_text)
             .style(Style::default().fg(Color::Gray))
             .alignment(Alignment::Center);
         f.render_widget(footer, chunks[2]);
     }
 
+    fn preview_lines(&self, book: &Book) -> Vec<Line<'static>> {
+        let label = Style::default().fg(Color::Cyan).add_modifier(Modifier::BOLD);
+        let field = |name: &str, value: Option<&str>| {
+            Line::from(vec![
+                Span::styled(format!("{}: ", name), label),
+                Span::raw(value.unwrap_or("Unknown").to_string()),
+            ])
+        };
+
+        let mut lines = vec![
+            Line::from(Span::styled(book.title.clone(), Style::default().fg(Color::Yellow).add_modifier(Modifier::BOLD))),
+            Line::from(""),
+            field("Author", book.author.as_deref()),
+            field("Year", book.year.as_deref()),
+            field("Language", book.language.as_deref().map(scraper::language_name)),
+            field("Format", book.format.as_deref()),
+            field("Size", book.size.as_deref()),
+            field("MD5", book.md5.as_deref()),
+            field("Downloads", (book.downloads > 0).then(|| book.downloads.to_string()).as_deref()),
+            field("URL", Some(book.url.as_str())),
+        ];
+
+        if book.cover_url.is_some() && self.graphics.is_none() {
+            lines.push(Line::from(Span::styled(
+                "Cover: no image support in this terminal (Kitty or iTerm2 protocol needed)".to_string(),
+                Style::default().fg(Color::DarkGray),
+            )));
+        }
+
+        if let Some(entry) = book.md5.as_deref().and_then(|md5| self.history.find(md5)) {
+            lines.push(Line::from(""));
+            lines.push(Line::from(Span::styled(
+                format!("✓ Downloaded to {}", entry.path.display()),
+                Style::default().fg(Color::Green),
+            )));
+        }
+
+        lines
+    }
+
     fn draw_download_selection(&self, f: &mut Frame) {
         let chunks = Layout::default()
             .direction(Direction::Vertical)
             .constraints([
-                Constraint::Length(8),
+                Constraint::Length(10),
                 Constraint::Min(10),
+                Constraint::Length(1),
             ])
             .split(f.size());
 
-        let book = &self.books[self.selected_book_index];
+        let book = match self.books.get(self.selected_book_index) {
+            Some(book) => book,
+            None => return,
+        };
         let book_info = vec![
             Line::from(vec![Span::raw("Title: "), Span::styled(&book.title, Style::default().fg(Color::Yellow).add_modifier(Modifier::BOLD))]),
             Line::from(vec![Span::raw("Author: "), Span::raw(book.author.as_deref().unwrap_or("Unknown"))]),
             Line::from(vec![Span::raw("Year: "), Span::raw(book.year.as_deref().unwrap_or("Unknown"))]),
-            Line::from(vec![Span::raw("Language: "), Span::raw(book.language.as_deref().unwrap_or("Unknown"))]),
+            Line::from(vec![Span::raw("Language: "), Span::raw(book.language.as_deref().map(scraper::language_name).unwrap_or("Unknown"))]),
             Line::from(vec![Span::raw("Format: "), Span::raw(book.format.as_deref().unwrap_or("Unknown"))]),
             Line::from(vec![Span::raw("Size: "), Span::raw(book.size.as_deref().unwrap_or("Unknown"))]),
+            Line::from(vec![Span::raw("Edition: "), Span::raw(self.book_metadata.edition.as_deref().unwrap_or("Unknown"))]),
+            Line::from(vec![Span::raw("Pages: "), Span::raw(self.book_metadata.pages.map(|p| p.to_string()).unwrap_or_else(|| "Unknown".to_string()))]),
         ];
 
         let info_panel = Paragraph::new(Text::from(book_info))
@@ -526,7 +1696,7 @@ impl App {
                         Span::raw("  Source: "),
                         Span::raw(&link.source),
                         Span::raw(" | URL: "),
-                        Span::raw(&link.url[..50.min(link.url.len())]),
+                        Span::raw(scraper::truncate_chars(&link.url, scraper::LINK_URL_CHARS)),
                     ]),
                     Line::from(""),
                 ];
@@ -536,9 +1706,16 @@ impl App {
             .collect();
 
         let list = List::new(items)
-            .block(Block::default().borders(Borders::ALL).title("Download Links (k/j to navigate, Enter to download, Esc to go back)"))
+            .block(Block::default().borders(Borders::ALL).title("Download Links (k/j to navigate, Enter to download, a for all formats, r to refresh, Esc to go back)"))
             .highlight_style(Style::default().bg(Color::DarkGray));
         f.render_widget(list, chunks[1]);
+
+        let status = if self.refreshing_links {
+            format!("{} {}", spinner_frame(self.tick), self.status_message)
+        } else {
+            self.status_message.clone()
+        };
+        f.render_widget(Paragraph::new(status).style(Style::default().fg(Color::Gray)), chunks[2]);
     }
 
     fn draw_error(&self, f: &mut Frame, error: &str) {
@@ -546,36 +1723,170 @@ impl App {
             .borders(Borders::ALL)
             .style(Style::default().fg(Color::Red));
 
+        let mut error_text = vec![
+            Line::from(""),
+            Line::from(Span::styled("ERROR", Style::default().fg(Color::Red).add_modifier(Modifier::BOLD))),
+            Line::from(""),
+        ];
+        // Multi-line messages (suggestions, an uncopied citation) keep their line breaks
+        error_text.extend(error.lines().map(|line| Line::from(line.to_string())));
+        error_text.push(Line::from(""));
+        error_text.push(Line::from("Press ESC or Enter to return to search"));
+
+        // A fifth of the screen, or taller when the message needs it; the slack absorbs wrapping
+        let area = f.size();
+        let height = (error_text.len() as u16 + 4).max(area.height / 5).min(area.height);
+        let rect = Rect { y: area.y + (area.height - height) / 2, height, ..area };
+
+        let error_paragraph = Paragraph::new(Text::from(error_text))
+            .block(block)
+            .alignment(Alignment::Center)
+            .wrap(Wrap { trim: true });
+        f.render_widget(error_paragraph, rect);
+    }
+
+    fn draw_queue_summary(&self, f: &mut Frame) {
+        let block = Block::default()
+            .borders(Borders::ALL)
+            .style(Style::default().fg(Color::Yellow))
+            .title("Queue finished");
+
         let chunks = Layout::default()
             .direction(Direction::Vertical)
             .constraints([
+                Constraint::Percentage(15),
+                Constraint::Percentage(70),
+                Constraint::Percentage(15),
+            ])
+            .split(f.size());
+
+        let (downloaded, skipped, failed) = self.queue.counts();
+        let mut text = vec![
+            Line::from(""),
+            Line::from(format!(
+                "Downloaded: {}   Skipped: {}   Failed: {}   Time: {}",
+                downloaded, skipped, failed, format_duration(self.queue.elapsed())
+            )),
+            Line::from(""),
+            Line::from(Span::styled("Failed:", Style::default().fg(Color::Red).add_modifier(Modifier::BOLD))),
+        ];
+        for (book, error) in self.queue.failed() {
+            let format = book.format.as_deref().map(|f| format!(" ({})", f.to_uppercase())).unwrap_or_default();
+            text.push(Line::from(format!("{}{}: {}", book.title, format, error)));
+        }
+        text.push(Line::from(""));
+        text.push(Line::from(vec![
+            Span::styled("r", Style::default().fg(Color::Green)),
+            Span::raw(format!(" Retry the {} failed   ", failed)),
+            Span::styled("Enter", Style::default().fg(Color::Green)),
+            Span::raw("/"),
+            Span::styled("Esc", Style::default().fg(Color::Green)),
+            Span::raw(" Back to the results"),
+        ]));
+
+        let paragraph = Paragraph::new(Text::from(text))
+            .block(block)
+            .alignment(Alignment::Center)
+            .wrap(Wrap { trim: true });
+        f.render_widget(paragraph, chunks[1]);
+    }
+
+    fn draw_confirm_overwrite(&self, f: &mut Frame, path: &std::path::Path) {
+        let block = Block::default()
+            .borders(Borders::ALL)
+            .style(Style::default().fg(Color::Yellow))
+            .title("File already exists");
+
+        let chunks = Layout::default()
+            .direction(Direction::Vertical)
+            .constraints([
+                Constraint::Percentage(30),
                 Constraint::Percentage(40),
-                Constraint::Percentage(20),
-                Constraint::Percentage(40),
+                Constraint::Percentage(30),
             ])
             .split(f.size());
 
-        let error_text = vec![
+        let renamed = crate::downloader::free_path(path);
+        let name = |p: &std::path::Path| p.file_name().map(|n| n.to_string_lossy().to_string()).unwrap_or_default();
+        let text = vec![
             Line::from(""),
-            Line::from(Span::styled("ERROR", Style::default().fg(Color::Red).add_modifier(Modifier::BOLD))),
+            Line::from(Span::styled(name(path), Style::default().add_modifier(Modifier::BOLD))),
+            Line::from(format!("is already in {}", path.parent().map(|p| p.display().to_string()).unwrap_or_default())),
+            Line::from(""),
+            Line::from(vec![
+                Span::styled("o", Style::default().fg(Color::Green)),
+                Span::raw(" Overwrite   "),
+                Span::styled("r", Style::default().fg(Color::Green)),
+                Span::raw(format!(" Save as {}   ", name(&renamed))),
+                Span::styled("s", Style::default().fg(Color::Green)),
+                Span::raw("/"),
+                Span::styled("Esc", Style::default().fg(Color::Green)),
+                Span::raw(" Skip"),
+            ]),
+        ];
+
+        let paragraph = Paragraph::new(Text::from(text))
+            .block(block)
+            .alignment(Alignment::Center)
+            .wrap(Wrap { trim: true });
+        f.render_widget(paragraph, chunks[1]);
+    }
+
+    fn draw_no_links(&self, f: &mut Frame) {
+        let block = Block::default()
+            .borders(Borders::ALL)
+            .style(Style::default().fg(Color::Yellow))
+            .title("No download links");
+
+        let chunks = Layout::default()
+            .direction(Direction::Vertical)
+            .constraints([
+                Constraint::Percentage(25),
+                Constraint::Percentage(50),
+                Constraint::Percentage(25),
+            ])
+            .split(f.size());
+
+        let title = self.books.get(self.selected_book_index).map(|book| book.title.as_str()).unwrap_or("This book");
+        let mut text = vec![
             Line::from(""),
-            Line::from(error),
+            Line::from(Span::styled(title.to_string(), Style::default().add_modifier(Modifier::BOLD))),
             Line::from(""),
-            Line::from("Press ESC or Enter to return to search"),
+            Line::from("The book page loaded, but it lists no external downloads."),
+            Line::from("Some records are metadata only; this is not a network problem."),
+            Line::from(""),
+            Line::from(vec![
+                Span::styled("r", Style::default().fg(Color::Green)),
+                Span::raw(" Retry   "),
+                Span::styled("o", Style::default().fg(Color::Green)),
+                Span::raw(" Open the page in a browser   "),
+                Span::styled("Esc", Style::default().fg(Color::Green)),
+                Span::raw(" Back to results"),
+            ]),
         ];
+        if !self.status_message.is_empty() {
+            text.push(Line::from(""));
+            text.push(Line::from(self.status_message.as_str()));
+        }
 
-        let error_paragraph = Paragraph::new(Text::from(error_text))
+        let paragraph = Paragraph::new(Text::from(text))
             .block(block)
             .alignment(Alignment::Center)
             .wrap(Wrap { trim: true });
-        f.render_widget(error_paragraph, chunks[1]);
+        f.render_widget(paragraph, chunks[1]);
     }
 
     fn draw_downloading(&self, f: &mut Frame) {
+        let title = match self.phase {
+            Phase::Searching => "Searching",
+            Phase::FetchingLinks => "Fetching Links",
+            Phase::Downloading => "Downloading",
+        };
+
         let block = Block::default()
             .borders(Borders::ALL)
             .style(Style::default().fg(Color::Yellow))
-            .title("Downloading");
+            .title(title);
 
         let chunks = Layout::default()
             .direction(Direction::Vertical)
@@ -586,11 +1897,73 @@ impl App {
             ])
             .split(f.size());
 
+        let header_area = Rect { height: chunks[0].height.min(3), ..chunks[0] };
+        self.draw_header(f, header_area, "Anna's Archive Downloader");
+
+        if self.phase == Phase::Downloading {
+            let inner = block.inner(chunks[1]);
+            f.render_widget(block, chunks[1]);
+
+            let rows = Layout::default()
+                .direction(Direction::Vertical)
+                .constraints([
+                    Constraint::Length(1),
+                    Constraint::Length(1),
+                    Constraint::Length(1),
+                    Constraint::Length(1),
+                    Constraint::Min(0),
+                ])
+                .split(inner);
+
+            let message = Paragraph::new(Span::styled(self.downloading_message.as_str(), Style::default().fg(Color::Yellow).add_modifier(Modifier::BOLD)))
+                .alignment(Alignment::Center);
+            f.render_widget(message, rows[0]);
+
+            if let Some(destination) = &self.download_destination {
+                let text = format!("Saving to {}", destination.display());
+                let destination = Paragraph::new(truncate_start_to_width(&text, rows[1].width as usize))
+                    .style(Style::default().fg(Color::DarkGray))
+                    .alignment(Alignment::Center);
+                f.render_widget(destination, rows[1]);
+            }
+
+            let progress = self.download_progress;
+            if progress.total > 0 {
+                let gauge = Gauge::default()
+                    .gauge_style(Style::default().fg(Color::Cyan).bg(Color::DarkGray))
+                    .ratio(progress.percent / 100.0)
+                    .label(format!(
+                        "{} / {} ({:.0}%, {}/s)",
+                        format_bytes(progress.current),
+                        format_bytes(progress.total),
+                        progress.percent,
+                        format_bytes(progress.bytes_per_sec)
+                    ));
+                f.render_widget(gauge, rows[2]);
+            } else {
+                // Size unknown: animate and show the running total instead of an empty bar
+                let progress = Paragraph::new(format!(
+                    "{} {} downloaded (total size unknown)",
+                    spinner_frame(self.tick),
+                    format_bytes(progress.current)
+                ))
+                    .style(Style::default().fg(Color::Cyan))
+                    .alignment(Alignment::Center);
+                f.render_widget(progress, rows[2]);
+            }
+
+            let hint = Paragraph::new("Press x to skip this file, Ctrl+C to quit")
+                .alignment(Alignment::Center);
+            f.render_widget(hint, rows[3]);
+            return;
+        }
+
         let status = vec![
             Line::from(""),
-            Line::from(Span::styled(self.downloading_message.as_str(), Style::default().fg(Color::Yellow).add_modifier(Modifier::BOLD))),
-            Line::from(""),
-            Line::from("Download in progress..."),
+            Line::from(Span::styled(
+                format!("{} {}", spinner_frame(self.tick), self.downloading_message),
+                Style::default().fg(Color::Yellow).add_modifier(Modifier::BOLD),
+            )),
             Line::from(""),
             Line::from("Press Ctrl+C to force quit"),
         ];
@@ -630,7 +2003,28 @@ impl App {
             Line::from(vec![Span::raw("  j/↓ - Move down")]),
             Line::from(vec![Span::raw("  Enter - Confirm/Select")]),
             Line::from(vec![Span::raw("  Esc - Go back/Cancel")]),
+            Line::from(vec![Span::raw("  c/C - Copy BibTeX/APA citation (results)")]),
+            Line::from(vec![Span::raw("  y - Copy the book's annas-archive.org link (results)")]),
+            Line::from(vec![Span::raw("  e - Copy the results as a Markdown table (results)")]),
+            Line::from(vec![Span::raw("  d - Download the LibGen link straight away (results)")]),
+            Line::from(vec![Span::raw("  r - Re-read the book's links (download links)")]),
+            Line::from(vec![Span::raw("  s - Cycle sort: relevance/popular/newest/size/title (results)")]),
+            Line::from(vec![Span::raw("  S - Reset to the site's relevance order (results)")]),
+            Line::from(vec![Span::raw("  +/- - Ask for 10 more/fewer results and search again (results)")]),
+            Line::from(vec![Span::raw("  f/l - Cycle the format/language shown (results)")]),
+            Line::from(vec![Span::raw("  1-9… Enter - Jump to the book with that number (results)")]),
+            Line::from(vec![Span::raw("  p - Toggle the details pane (results)")]),
+            Line::from(vec![Span::raw("  t - Switch between color and mono themes (results)")]),
+            Line::from(vec![Span::raw("  a/D - Queue book / start queued downloads (results)")]),
+            Line::from(vec![Span::raw("  b - Bookmark or unbookmark the book (results)")]),
+            Line::from(vec![Span::raw("  a - Download every format of the book (download links)")]),
+            Line::from(vec![Span::raw("  x - Skip the current download (downloading)")]),
+            Line::from(vec![Span::raw("  r - Retry the failed books when a queue finishes")]),
+            Line::from(vec![Span::raw("  r/o - Retry / open the book page when it has no links")]),
+            Line::from(vec![Span::raw("  o/r/s - Overwrite / keep both / skip when the file exists")]),
             Line::from(vec![Span::raw("  F1 - Toggle help")]),
+            Line::from(vec![Span::raw("  F2 - About: version, paths and session stats")]),
+            Line::from(vec![Span::raw("  F3 - Show favorites (search, results)")]),
             Line::from(vec![Span::raw("  Ctrl+C - Force quit")]),
             Line::from(""),
             Line::from(vec![Span::raw("Features:")]),
@@ -648,41 +2042,241 @@ impl App {
         f.render_widget(help_paragraph, chunks[1]);
     }
 
-    async fn perform_search(&mut self) -> Result<()> {
-        self.mode = AppMode::Downloading;
-        self.downloading_message = "Searching...".to_string();
-        
-        let _ = self.command_tx.send(AppCommand::Search(self.query.clone(), self.filters.clone(), 20));
+    // Label/value rows for the about screen, handy to paste into a bug report
+    fn about_fields(&self) -> Vec<(&'static str, String)> {
+        let config_file = match self.config.file_path() {
+            Ok(path) => path.display().to_string(),
+            Err(e) => format!("unknown ({})", e),
+        };
+        // Results are rebased onto the mirror that answered the search
+        let mirror = self.books.first()
+            .and_then(|book| reqwest::Url::parse(&book.url).ok())
+            .map(|url| url.origin().ascii_serialization())
+            .unwrap_or_else(|| "none contacted yet".to_string());
+
+        vec![
+            ("Version", crate::version::LONG_VERSION.to_string()),
+            ("Config file", config_file),
+            ("Download path", self.download_path.display().to_string()),
+            ("Mirror", mirror),
+            ("Retries", self.network.retries.to_string()),
+            ("Connections", self.network.connections.to_string()),
+            ("User agent", self.network.user_agent.clone().unwrap_or_else(|| "built-in".to_string())),
+            ("TLS", if self.network.insecure { "certificate checks OFF (--insecure)" } else { "verified" }.to_string()),
+            ("Theme", self.theme.label().to_string()),
+            ("Searches", self.stats.searches.to_string()),
+            ("Books viewed", self.stats.books_viewed.to_string()),
+            ("Downloads", format!("{} ({})", self.stats.downloads, format_bytes(self.stats.bytes))),
+        ]
+    }
+
+    fn draw_about(&self, f: &mut Frame) {
+        let chunks = Layout::default()
+            .direction(Direction::Vertical)
+            .constraints([
+                Constraint::Length(3),
+                Constraint::Min(0),
+            ])
+            .split(f.size());
+
+        let title = Paragraph::new("About - Anna's Archive Downloader")
+            .style(Style::default().fg(Color::Cyan).add_modifier(Modifier::BOLD))
+            .alignment(Alignment::Center);
+        f.render_widget(title, chunks[0]);
+
+        let mut about_text = vec![Line::from("")];
+        for (label, value) in self.about_fields() {
+            about_text.push(Line::from(vec![
+                Span::raw(format!("  {:<15}", format!("{}:", label))),
+                Span::styled(value, Style::default().fg(Color::Green)),
+            ]));
+        }
+        about_text.push(Line::from(""));
+        about_text.push(Line::from(vec![Span::raw(format!("  {}", self.stats.summary()))]));
+
+        let about_paragraph = Paragraph::new(about_text)
+            .block(Block::default().borders(Borders::ALL).title("About (Press F2 or Esc to close)"))
+            .wrap(Wrap { trim: false });
         
+        f.render_widget(about_paragraph, chunks[1]);
+    }
+
+    // The search screen shows where the file ended up, which may differ from the planned name after a rename
+    pub fn finish_download(&mut self, saved: Saved) {
+        self.current_task = None;
+        self.download_destination = None;
+        self.status_message = match saved {
+            Saved::Written(path) => match self.record_download(&path) {
+                Ok(()) => format!("✓ Downloaded to {}", path.display()),
+                Err(e) => format!("✓ Downloaded to {} (⚠ Could not save download history: {})", path.display(), e),
+            },
+            Saved::Skipped(path) => format!("Already there, skipped: {}", path.display()),
+        };
+        self.mode = AppMode::Search;
+    }
+
+    // Added to the status line so the "Downloaded to" message stays visible
+    pub fn post_download_failed(&mut self, message: String) {
+        self.status_message = if self.status_message.is_empty() {
+            format!("⚠ {}", message)
+        } else {
+            format!("{} (⚠ {})", self.status_message, message)
+        };
+    }
+
+    pub fn cover_loaded(&mut self, url: String, cover: Option<Cover>) {
+        let state = match cover {
+            Some(cover) => CoverState::Ready(cover),
+            None => CoverState::Failed,
+        };
+        self.covers.insert(url, state);
+    }
+
+    // Runs after each frame: fetches the cover the preview left room for and draws it there.
+    // Images sit outside ratatui's buffer, so the old one is removed before a new one goes up.
+    pub fn sync_cover<B: Backend + Write>(&mut self, terminal: &mut Terminal<B>) -> Result<()> {
+        let protocol = match self.graphics {
+            Some(protocol) => protocol,
+            None => return Ok(()),
+        };
+
+        if let Some((url, _)) = &self.cover_slot {
+            if !self.covers.contains_key(url) {
+                let url = url.clone();
+                self.fetch_cover(url);
+            }
+        }
+
+        let wanted = self.cover_slot.clone()
+            .filter(|(url, _)| matches!(self.covers.get(url), Some(CoverState::Ready(_))));
+        if wanted == self.painted_cover {
+            return Ok(());
+        }
+
+        if self.painted_cover.take().is_some() {
+            match protocol.clear() {
+                Some(sequence) => write!(terminal.backend_mut(), "{}", sequence)?,
+                None => {
+                    terminal.clear()?;
+                    terminal.draw(|f| self.draw(f))?;
+                }
+            }
+        }
+
+        if let Some((url, area)) = wanted {
+            if let Some(CoverState::Ready(cover)) = self.covers.get(&url) {
+                let backend = terminal.backend_mut();
+                crossterm::queue!(backend, crossterm::cursor::MoveTo(area.x, area.y))?;
+                write!(backend, "{}", cover.escape(protocol, area))?;
+            }
+            self.painted_cover = Some((url, area));
+        }
+        Write::flush(terminal.backend_mut())?;
         Ok(())
     }
 
-    async fn fetch_download_links(&mut self) -> Result<()> {
+    fn fetch_cover(&mut self, url: String) {
+        if self.covers.len() >= COVER_CACHE_LIMIT {
+            self.covers.clear();
+        }
+        self.covers.insert(url.clone(), CoverState::Loading);
+
+        let network = self.network.clone();
+        let transfer = self.transfer.clone();
+        let tx = self.command_tx.clone();
+        tokio::spawn(async move {
+            let bytes = transfer.cover(&network, &url).await.ok();
+            let cover = bytes.and_then(|bytes| Cover::decode(&bytes).ok());
+            let _ = tx.send(AppCommand::CoverLoaded(url, cover));
+        });
+    }
+
+    pub fn record_download(&mut self, path: &std::path::Path) -> Result<()> {
+        self.stats.record_download(file_size(path));
+
+        let book = match self.books.get(self.selected_book_index) {
+            Some(book) => book,
+            None => return Ok(()),
+        };
+
+        if let Some(md5) = book.md5.as_deref() {
+            self.history.record(md5, &book.title, path)?;
+        }
+
+        Ok(())
+    }
+
+    // Steps to the next multiple of RESULT_COUNT_STEP, within 1..=MAX_NUM_RESULTS
+    async fn change_result_count(&mut self, more: bool) -> Result<()> {
+        // Favorites aren't a search, so there is nothing to run again
+        if self.showing_favorites || self.query.trim().is_empty() {
+            return Ok(());
+        }
+
+        let count = if more {
+            (self.num_results / RESULT_COUNT_STEP + 1) * RESULT_COUNT_STEP
+        } else {
+            self.num_results.saturating_sub(1) / RESULT_COUNT_STEP * RESULT_COUNT_STEP
+        };
+        let count = count.clamp(1, scraper::MAX_NUM_RESULTS);
+        if count == self.num_results {
+            self.status_message = if more {
+                format!("Already asking for the most results ({})", count)
+            } else {
+                "Already asking for a single result".to_string()
+            };
+            return Ok(());
+        }
+
+        self.num_results = count;
+        self.perform_search().await
+    }
+
+    async fn perform_search(&mut self) -> Result<()> {
         self.mode = AppMode::Downloading;
-        self.downloading_message = "Fetching download links...".to_string();
+        self.phase = Phase::Searching;
+        self.downloading_message = "Searching...".to_string();
+        self.stats.record_search();
+        self.search_id += 1;
         
-        let book_url = self.books[self.selected_book_index].url.clone();
+        let search_id = self.search_id;
+        let query = self.query.clone();
+        let filters = self.filters.clone();
+        let num_results = self.num_results;
+        let network = self.network.clone();
+        let transfer = self.transfer.clone();
         let tx = self.command_tx.clone();
+        self.search_results.clear();
+        self.books.clear();
+        self.loading_more = false;
+        self.showing_favorites = false;
+        self.link_cache.clear();
+        if let Some(task) = self.prefetch_task.take() {
+            task.abort();
+        }
+        self.view_format = None;
+        self.view_language = None;
         
         tokio::spawn(async move {
-            let scraper = match AnnaScraper::new() {
-                Ok(s) => s,
-                Err(e) => {
-                    let _ = tx.send(AppCommand::ShowError(format!("Failed to create scraper: {}", e)));
-                    return;
-                }
-            };
+            let batch_tx = tx.clone();
+            let result = transfer.search(&network, &query, &filters, num_results, Box::new(move |batch| {
+                let _ = batch_tx.send(AppCommand::SearchBatch(search_id, batch.to_vec()));
+            })).await;
             
-            match scraper.get_book_details(&book_url).await {
-                Ok(links) => {
-                    if links.is_empty() {
-                        let _ = tx.send(AppCommand::ShowError("No download links found".to_string()));
-                    } else {
-                        // Channel communication would go here in full implementation
-                    }
+            match result {
+                Ok(books) => {
+                    let _ = tx.send(AppCommand::SearchComplete(search_id, books));
                 }
-                Err(e) => {
-                    let _ = tx.send(AppCommand::ShowError(format!("Error fetching links: {}", e)));
+                Err(e) => match e.downcast_ref::<AppError>() {
+                    Some(AppError::ResultsFiltered(count)) => {
+                        let _ = tx.send(AppCommand::ResultsFiltered(*count));
+                    }
+                    Some(AppError::Offline) => {
+                        let _ = tx.send(AppCommand::Offline);
+                    }
+                    _ => {
+                        let _ = tx.send(AppCommand::ShowError(format!("Search error: {}", e)));
+                    }
                 }
             }
         });
@@ -690,47 +2284,323 @@ impl App {
         Ok(())
     }
 
-    async fn perform_download(&mut self) -> Result<()> {
+    async fn fetch_download_links(&mut self) -> Result<()> {
+        let book_url = match self.books.get(self.selected_book_index) {
+            Some(book) => book.url.clone(),
+            None => return Ok(()),
+        };
+        
         self.mode = AppMode::Downloading;
-        let link = &self.download_links[self.download_link_index];
-        let filename = format!(
-            "{} - {}.{}",
-            self.books[self.selected_book_index].title
-                .chars()
-                .take(50)
-                .collect::<String>(),
-            self.books[self.selected_book_index].author.as_deref().unwrap_or("Unknown"),
-            self.books[self.selected_book_index].format.as_deref().unwrap_or("unknown")
-        );
+        self.phase = Phase::FetchingLinks;
+        self.downloading_message = "Fetching download links...".to_string();
+        self.stats.record_view();
+        self.book_metadata = BookMetadata::default();
+        self.quick_download = false;
+        self.status_message.clear();
         
-        self.downloading_message = format!("Downloading: {}", filename);
+        // Sent rather than applied here, so a quick download set after this call still applies
+        if let Some((links, metadata)) = self.link_cache.remove(&book_url) {
+            self.debug(format!("prefetch cache hit: {}", book_url));
+            let _ = self.command_tx.send(AppCommand::LinksFetched(links, metadata));
+            return Ok(());
+        }
+        if self.network.prefetch > 0 {
+            self.debug(format!("prefetch cache miss: {}", book_url));
+        }
         
-        let url = link.url.clone();
-        let download_path = self.download_path.clone();
+        let network = self.network.clone();
+        let transfer = self.transfer.clone();
         let tx = self.command_tx.clone();
         
         tokio::spawn(async move {
-            let downloader = match Downloader::new(download_path) {
-                Ok(d) => d,
-                Err(e) => {
-                    let _ = tx.send(AppCommand::ShowError(format!("Failed to create downloader: {}", e)));
-                    return;
-                }
-            };
-            
-            match downloader.download(&url, Some(&filename)).await {
-                Ok(path) => {
-                    let _ = tx.send(AppCommand::CompleteDownload(path));
+            match transfer.details(&network, &book_url).await {
+                Ok((links, metadata)) => {
+                    let _ = tx.send(AppCommand::LinksFetched(links, metadata));
                 }
                 Err(e) => {
-                    let _ = tx.send(AppCommand::ShowError(format!("Download failed: {}", e)));
+                    let _ = tx.send(AppCommand::ShowError(format!("Error fetching links: {}", e)));
                 }
             }
         });
         
         Ok(())
     }
-}
+
+    // Unlike fetch_download_links this stays on the links screen
+    fn refresh_links(&mut self) {
+        if self.refreshing_links {
+            return;
+        }
+        let book_url = match self.books.get(self.selected_book_index) {
+            Some(book) => book.url.clone(),
+            None => return,
+        };
+        
+        self.refreshing_links = true;
+        self.status_message = "Refreshing links…".to_string();
+        
+        let network = self.network.clone();
+        let transfer = self.transfer.clone();
+        let tx = self.command_tx.clone();
+        
+        tokio::spawn(async move {
+            let _ = match transfer.details(&network, &book_url).await {
+                Ok((links, metadata)) => tx.send(AppCommand::LinksRefreshed(links, metadata)),
+                Err(e) => tx.send(AppCommand::LinksRefreshFailed(e.to_string())),
+            };
+        });
+    }
+    
+    fn perform_download(&mut self) {
+        let (dir, filename) = match (self.download_links.get(self.download_link_index), self.books.get(self.selected_book_index)) {
+            (Some(_), Some(book)) => download_target(book, &self.download_path, &self.network),
+            _ => return,
+        };
+        
+        // Without a configured policy, ask rather than silently replace a file the user has
+        if self.network.on_conflict.is_none() {
+            if let Some(path) = Downloader::existing_target(&dir, &filename) {
+                self.mode = AppMode::ConfirmOverwrite(path);
+                return;
+            }
+        }
+        
+        self.start_download(self.network.on_conflict.unwrap_or_default());
+    }
+    
+    fn start_download(&mut self, conflict: ConflictPolicy) {
+        let (url, book, (download_path, filename)) = match (self.download_links.get(self.download_link_index), self.books.get(self.selected_book_index)) {
+            (Some(link), Some(book)) => (link.url.clone(), book.clone(), download_target(book, &self.download_path, &self.network)),
+            _ => return,
+        };
+        
+        self.mode = AppMode::Downloading;
+        self.phase = Phase::Downloading;
+        self.download_progress = Progress::default();
+        
+        self.downloading_message = format!("Downloading: {}", filename);
+        self.download_destination = Some(download_path.join(&filename));
+        
+        let network = NetworkOptions { on_conflict: Some(conflict), ..self.network.clone() };
+        let tx = self.command_tx.clone();
+        let transfer = self.transfer.clone();
+        
+        self.current_task = Some(tokio::spawn(async move {
+            let progress_tx = tx.clone();
+            let result = transfer.download(&network, download_path, &url, &filename, Box::new(move |progress| {
+                let _ = progress_tx.send(AppCommand::DownloadProgress(progress));
+            })).await;
+            
+            match result {
+                Ok(Saved::Written(path)) => match post_download(&network, &path, &book).await {
+                    Ok(warning) => {
+                        let _ = tx.send(AppCommand::CompleteDownload(Saved::Written(path)));
+                        if let Some(warning) = warning {
+                            let _ = tx.send(AppCommand::PostDownloadFailed(warning));
+                        }
+                    }
+                    Err(e) => {
+                        let _ = tx.send(AppCommand::ShowError(format!("Download failed: {:#}", e)));
+                    }
+                },
+                Ok(skipped) => {
+                    let _ = tx.send(AppCommand::CompleteDownload(skipped));
+                }
+                Err(e) => {
+                    let _ = tx.send(AppCommand::ShowError(format!("Download failed: {:#}", e)));
+                }
+            }
+        }));
+    }
+}
+
+// The folder (below download_path when a name template has folders) and file name for a book
+fn download_target(book: &Book, download_path: &Path, network: &NetworkOptions) -> (PathBuf, String) {
+    let (folder, stem) = network.book_path(book);
+    (download_path.join(folder), format!("{}.{}", stem, book.format.as_deref().unwrap_or("unknown")))
+}
+
+// Err only for a required command; otherwise a failure comes back as the message to show
+async fn post_download(network: &NetworkOptions, path: &Path, book: &Book) -> Result<Option<String>> {
+    hook::after_download(network.post_download.as_ref(), path, Some(book), network.verbose).await
+}
+
+pub type ProgressFn<'a> = Box<dyn FnMut(Progress) + Send + 'a>;
+pub type BatchFn<'a> = Box<dyn FnMut(&[Book]) + Send + 'a>;
+
+// Everything the TUI fetches: searches, detail pages, covers and the files themselves
+pub trait Transfer: Send + Sync {
+    // Hands the results to on_batch in batches once the page is parsed, then returns them all
+    fn search<'a>(&'a self, network: &'a NetworkOptions, query: &'a str, filters: &'a SearchFilters, max_results: usize, on_batch: BatchFn<'a>) -> BoxFuture<'a, Result<Vec<Book>>>;
+
+    // The links on a book's detail page, with the edition details listed there
+    fn details<'a>(&'a self, network: &'a NetworkOptions, book_url: &'a str) -> BoxFuture<'a, Result<(Vec<DownloadLink>, BookMetadata)>>;
+
+    fn cover<'a>(&'a self, network: &'a NetworkOptions, url: &'a str) -> BoxFuture<'a, Result<Vec<u8>>>;
+
+    // Saves url as dir/filename, reporting progress as it goes
+    fn download<'a>(&'a self, network: &'a NetworkOptions, dir: PathBuf, url: &'a str, filename: &'a str, on_progress: ProgressFn<'a>) -> BoxFuture<'a, Result<Saved>>;
+}
+
+// The site and its mirrors, reached with the run's network options
+pub struct NetworkTransfer;
+
+impl Transfer for NetworkTransfer {
+    fn search<'a>(&'a self, network: &'a NetworkOptions, query: &'a str, filters: &'a SearchFilters, max_results: usize, on_batch: BatchFn<'a>) -> BoxFuture<'a, Result<Vec<Book>>> {
+        Box::pin(async move {
+            let scraper = network.scraper().context("Failed to create scraper")?;
+            scraper.search_streaming(query, filters, max_results, on_batch).await
+        })
+    }
+
+    fn details<'a>(&'a self, network: &'a NetworkOptions, book_url: &'a str) -> BoxFuture<'a, Result<(Vec<DownloadLink>, BookMetadata)>> {
+        Box::pin(async move {
+            let scraper = network.scraper().context("Failed to create scraper")?;
+            scraper.get_book_details_with_metadata(book_url).await
+        })
+    }
+
+    fn cover<'a>(&'a self, network: &'a NetworkOptions, url: &'a str) -> BoxFuture<'a, Result<Vec<u8>>> {
+        Box::pin(async move {
+            let scraper = network.scraper().context("Failed to create scraper")?;
+            scraper.fetch_cover(url).await
+        })
+    }
+
+    fn download<'a>(&'a self, network: &'a NetworkOptions, dir: PathBuf, url: &'a str, filename: &'a str, on_progress: ProgressFn<'a>) -> BoxFuture<'a, Result<Saved>> {
+        Box::pin(async move {
+            let downloader = network.downloader(dir).context("Failed to create downloader")?;
+            downloader.download_with_progress(url, Some(filename), on_progress).await
+        })
+    }
+}
+
+// Resolves the preferred link for a queued book and downloads it as dir/filename
+async fn download_book(transfer: &dyn Transfer, book: &Book, dir: PathBuf, filename: &str, network: &NetworkOptions, on_progress: ProgressFn<'_>) -> Result<Saved> {
+    let (links, _) = transfer.details(network, &book.url).await?;
+    let link = scraper::preferred_link(&links)
+        .ok_or_else(|| anyhow::anyhow!("No download links found"))?;
+
+    transfer.download(network, dir, &link.url, filename, on_progress).await
+}
+
+const PREVIEW_MIN_WIDTH: u16 = 100;
+// Height of the cover at the top of the preview pane, at most half the pane
+const COVER_ROWS: u16 = 12;
+// Covers kept in memory; past this the cache starts over
+const COVER_CACHE_LIMIT: usize = 64;
+// How far + and - move the result count
+const RESULT_COUNT_STEP: usize = 10;
+// Where `e` saves the results when the clipboard can't be used
+const MARKDOWN_EXPORT_FILE: &str = "annadl-results.md";
+
+// Drops every colour after drawing; highlighted cells are reversed so the selection stays visible
+fn strip_colors(buffer: &mut ratatui::buffer::Buffer) {
+    for cell in buffer.content.iter_mut() {
+        if cell.bg != Color::Reset {
+            cell.modifier.insert(Modifier::REVERSED);
+        }
+        cell.set_fg(Color::Reset).set_bg(Color::Reset);
+    }
+}
+
+// e.g. ("EPUB ", green) before the title; foreground only, so the mono theme leaves plain text
+fn format_badge(format: Option<&str>) -> (String, Color) {
+    let format = match format {
+        Some(format) if !format.trim().is_empty() => format.trim().to_uppercase(),
+        _ => return (String::new(), Color::Reset),
+    };
+    let color = match format.as_str() {
+        "EPUB" => Color::Green,
+        "PDF" => Color::Red,
+        "MOBI" | "AZW3" => Color::Yellow,
+        "DJVU" => Color::Magenta,
+        "FB2" => Color::Cyan,
+        "CBZ" | "CBR" => Color::Blue,
+        _ => Color::Gray,
+    };
+    (format!("{:<4} ", scraper::truncate_chars(&format, 4)), color)
+}
+
+// Steps None -> each distinct value in order of appearance -> None
+fn next_view_value(values: impl Iterator<Item = String>, current: &Option<String>) -> Option<String> {
+    let mut distinct: Vec<String> = Vec::new();
+    for value in values {
+        if !distinct.iter().any(|seen| seen.eq_ignore_ascii_case(&value)) {
+            distinct.push(value);
+        }
+    }
+
+    match current {
+        None => distinct.into_iter().next(),
+        Some(current) => distinct.iter()
+            .position(|value| value.eq_ignore_ascii_case(current))
+            .and_then(|i| distinct.get(i + 1).cloned()),
+    }
+}
+
+fn spinner_frame(tick: usize) -> char {
+    const FRAMES: [char; 10] = ['⠋', '⠙', '⠹', '⠸', '⠼', '⠴', '⠦', '⠧', '⠇', '⠏'];
+    FRAMES[tick % FRAMES.len()]
+}
+
+// Cuts text to at most `max_width` terminal columns, ending in "…" when shortened
+fn truncate_to_width(text: &str, max_width: usize) -> String {
+    if text.width() <= max_width {
+        return text.to_string();
+    }
+    if max_width == 0 {
+        return String::new();
+    }
+
+    let mut out = String::new();
+    let mut width = 0;
+    for c in text.chars() {
+        let char_width = c.width().unwrap_or(0);
+        if width + char_width > max_width - 1 {
+            break;
+        }
+        out.push(c);
+        width += char_width;
+    }
+    out.push('…');
+    out
+}
+
+// Like truncate_to_width but keeps the end, e.g. "…/books/Dune.epub" for a long path
+fn truncate_start_to_width(text: &str, max_width: usize) -> String {
+    let reversed: String = text.chars().rev().collect();
+    truncate_to_width(&reversed, max_width).chars().rev().collect()
+}
+
+// Greedy word wrap into at most `max_lines` lines; the last line is truncated
+fn wrap_to_width(text: &str, max_width: usize, max_lines: usize) -> Vec<String> {
+    let mut lines: Vec<String> = Vec::new();
+    let mut current = String::new();
+
+    for word in text.split_whitespace() {
+        let candidate = if current.is_empty() {
+            word.to_string()
+        } else {
+            format!("{} {}", current, word)
+        };
+
+        if candidate.width() <= max_width || current.is_empty() {
+            current = candidate;
+        } else {
+            lines.push(std::mem::replace(&mut current, word.to_string()));
+        }
+    }
+    if !current.is_empty() || lines.is_empty() {
+        lines.push(current);
+    }
+
+    if lines.len() > max_lines {
+        let rest = lines.split_off(max_lines - 1).join(" ");
+        lines.push(rest);
+    }
+    lines.into_iter().map(|line| truncate_to_width(&line, max_width)).collect()
+}
 
 #[derive(Debug, Clone, Copy, PartialEq)]
 pub enum ControlFlow {
@@ -751,13 +2621,194 @@ enum DownloadState {
 #[cfg(test)]
 mod tests {
     use super::*;
+    use crate::naming::DateFolders;
+    use anna_dl::test_support::test_book;
     use crossterm::event::{KeyCode, KeyEvent, KeyModifiers};
     use std::path::PathBuf;
 
+    // The history, favorites and saved prefs of a test app live in a fresh temp dir
+    fn test_config() -> Config {
+        let dir = std::env::temp_dir().join(format!(
+            "annadl_app_config_{}",
+            std::time::SystemTime::now().duration_since(std::time::UNIX_EPOCH).unwrap().as_nanos()
+        ));
+        Config::load_from(Some(dir.join("config.json"))).unwrap()
+    }
+
     fn create_test_app() -> App {
-        let config = Config::default();
+        let config = test_config();
         let download_path = PathBuf::from("/tmp/test");
-        App::new(config, download_path)
+        let mut app = App::new(config, download_path);
+        // Nothing in a test reaches the real site or clipboard
+        app.transfer = Arc::new(FakeTransfer::default());
+        app.copy_to_clipboard = no_clipboard;
+        // Reading ahead would queue extra commands in tests that finish a search
+        app.network.prefetch = 0;
+        app
+    }
+
+    #[test]
+    fn test_app_applies_config_default_filters() {
+        let config = Config {
+            default_format: Some("epub".to_string()),
+            default_language: Some("en".to_string()),
+            ..test_config()
+        };
+        let app = App::new(config, PathBuf::from("/tmp/test"));
+
+        assert_eq!(app.filters.format.as_deref(), Some("epub"));
+        assert_eq!(app.filters.language.as_deref(), Some("en"));
+        assert_eq!(app.filter_format_input, "epub");
+        assert_eq!(app.filter_language_input, "en");
+    }
+
+    #[test]
+    fn test_app_applies_config_default_sort() {
+        let config = Config {
+            default_sort: Some(SortMode::Title),
+            ..test_config()
+        };
+        let app = App::new(config, PathBuf::from("/tmp/test"));
+        assert_eq!(app.sort_mode, SortMode::Title);
+    }
+
+    #[test]
+    fn test_app_takes_date_folders_from_config() {
+        let config = Config {
+            date_folders: DateFolders::Daily,
+            ..test_config()
+        };
+        let app = App::new(config, PathBuf::from("/tmp/test"));
+        assert_eq!(app.network.date_folders, DateFolders::Daily);
+    }
+
+    #[test]
+    fn test_app_restores_ui_prefs() {
+        let config = Config {
+            default_sort: Some(SortMode::Title),
+            ui: UiPrefs { show_preview: Some(false), sort: Some(SortMode::Newest), theme: Theme::Mono },
+            ..test_config()
+        };
+        let app = App::new(config.clone(), PathBuf::from("/tmp/test"));
+        // The saved sort doesn't override one set in the config
+        assert_eq!(app.sort_mode, SortMode::Title);
+        assert!(!app.show_preview);
+        assert_eq!(app.theme, Theme::Mono);
+
+        let app = App::new(Config { default_sort: None, ..config }, PathBuf::from("/tmp/test"));
+        assert_eq!(app.sort_mode, SortMode::Newest);
+
+        let app = App::new(test_config(), PathBuf::from("/tmp/test"));
+        assert!(app.show_preview);
+        assert_eq!(app.theme, Theme::Color);
+    }
+
+    #[test]
+    fn test_strip_colors_keeps_selection_visible() {
+        let mut buffer = ratatui::buffer::Buffer::empty(Rect::new(0, 0, 2, 1));
+        buffer.get_mut(0, 0).set_fg(Color::Yellow);
+        buffer.get_mut(1, 0).set_bg(Color::Blue);
+
+        strip_colors(&mut buffer);
+
+        assert_eq!(buffer.get(0, 0).fg, Color::Reset);
+        assert!(!buffer.get(0, 0).modifier.contains(Modifier::REVERSED));
+        assert_eq!(buffer.get(1, 0).bg, Color::Reset);
+        assert!(buffer.get(1, 0).modifier.contains(Modifier::REVERSED));
+    }
+
+    #[tokio::test]
+    async fn test_sort_persists_across_searches() {
+        let mut app = create_test_app();
+        app.mode = AppMode::Results;
+        app.set_results(vec![test_book("b").build(), test_book("A").build()]);
+
+        let key = KeyEvent::new(KeyCode::Char('s'), KeyModifiers::NONE);
+        for _ in 0..3 {
+            app.handle_results_navigation(key).await.unwrap();
+        }
+        assert_eq!(app.sort_mode, SortMode::Title);
+        assert_eq!(app.books[0].title, "A");
+
+        // A new batch of results picks up the same sort
+        app.set_results(vec![test_book("z").build(), test_book("m").build()]);
+        assert_eq!(app.books[0].title, "m");
+        assert_eq!(app.search_results[0].title, "z");
+    }
+
+    #[tokio::test]
+    async fn test_shift_s_resets_to_relevance_order() {
+        let mut app = create_test_app();
+        app.mode = AppMode::Results;
+        app.sort_mode = SortMode::Title;
+        app.set_results(vec![test_book("b").build(), test_book("A").build()]);
+        assert_eq!(app.books[0].title, "A");
+
+        let key = KeyEvent::new(KeyCode::Char('S'), KeyModifiers::SHIFT);
+        app.handle_results_navigation(key).await.unwrap();
+        assert_eq!(app.sort_mode, SortMode::Relevance);
+        assert_eq!(app.books[0].title, "b");
+        assert_eq!(app.status_message, "Back to the site's relevance order");
+    }
+
+    #[tokio::test]
+    async fn test_result_count_stops_at_its_limits() {
+        let mut app = create_test_app();
+        app.mode = AppMode::Results;
+        app.query = "dune".to_string();
+        app.set_results(vec![test_book("Dune").build()]);
+
+        app.num_results = scraper::MAX_NUM_RESULTS;
+        app.handle_results_navigation(KeyEvent::new(KeyCode::Char('+'), KeyModifiers::NONE)).await.unwrap();
+        assert_eq!(app.num_results, scraper::MAX_NUM_RESULTS);
+        assert!(app.status_message.contains("most results"));
+        assert!(matches!(app.mode, AppMode::Results));
+
+        app.num_results = 1;
+        app.handle_results_navigation(KeyEvent::new(KeyCode::Char('-'), KeyModifiers::NONE)).await.unwrap();
+        assert_eq!(app.num_results, 1);
+        assert!(matches!(app.mode, AppMode::Results));
+        assert_eq!(app.books.len(), 1);
+    }
+
+    #[tokio::test]
+    async fn test_plus_searches_again_for_more_results() {
+        let mut app = create_test_app();
+        let transfer = Arc::new(FakeTransfer {
+            books: (0..40).map(|i| test_book(&format!("Dune {}", i)).build()).collect(),
+            ..Default::default()
+        });
+        app.transfer = transfer.clone();
+        app.mode = AppMode::Results;
+        app.query = "dune".to_string();
+        app.num_results = 20;
+
+        app.handle_results_navigation(KeyEvent::new(KeyCode::Char('+'), KeyModifiers::NONE)).await.unwrap();
+        assert_eq!(app.num_results, 30);
+        assert!(matches!(app.mode, AppMode::Downloading));
+        assert_eq!(app.phase, Phase::Searching);
+
+        let mut found = None;
+        while let Some(command) = app.command_rx.recv().await {
+            if let AppCommand::SearchComplete(_, books) = command {
+                found = Some(books.len());
+                break;
+            }
+        }
+        assert_eq!(found, Some(30));
+        assert_eq!(*transfer.searches.lock().unwrap(), vec!["dune".to_string()]);
+    }
+
+    #[tokio::test]
+    async fn test_result_count_ignored_for_favorites() {
+        let mut app = create_test_app();
+        app.mode = AppMode::Results;
+        app.query = "dune".to_string();
+        app.showing_favorites = true;
+
+        app.handle_results_navigation(KeyEvent::new(KeyCode::Char('+'), KeyModifiers::NONE)).await.unwrap();
+        assert_eq!(app.num_results, scraper::DEFAULT_NUM_RESULTS);
+        assert!(matches!(app.mode, AppMode::Results));
     }
 
     #[test]
@@ -793,6 +2844,19 @@ mod tests {
         assert_eq!(app.query, "tes");
     }
 
+    #[tokio::test]
+    async fn test_handle_search_input_whitespace_query_rejected() {
+        let mut app = create_test_app();
+        app.query = "   ".to_string();
+
+        let key = KeyEvent::new(KeyCode::Enter, KeyModifiers::NONE);
+        let result = app.handle_search_input(key).await.unwrap();
+
+        assert_eq!(result, ControlFlow::Continue);
+        assert!(matches!(app.mode, AppMode::Error(_)));
+        assert!(app.query.is_empty());
+    }
+
     #[tokio::test]
     async fn test_handle_search_input_escape_exits() {
         let mut app = create_test_app();
@@ -829,24 +2893,8 @@ mod tests {
         let mut app = create_test_app();
         app.mode = AppMode::Results;
         app.books = vec![
-            Book {
-                title: "Book 1".to_string(),
-                author: None,
-                year: None,
-                language: None,
-                format: None,
-                size: None,
-                url: "url1".to_string(),
-            },
-            Book {
-                title: "Book 2".to_string(),
-                author: None,
-                year: None,
-                language: None,
-                format: None,
-                size: None,
-                url: "url2".to_string(),
-            },
+            test_book("Book 1").url("url1").build(),
+            test_book("Book 2").url("url2").build(),
         ];
         app.selected_book_index = 0;
 
@@ -862,24 +2910,8 @@ mod tests {
         let mut app = create_test_app();
         app.mode = AppMode::Results;
         app.books = vec![
-            Book {
-                title: "Book 1".to_string(),
-                author: None,
-                year: None,
-                language: None,
-                format: None,
-                size: None,
-                url: "url1".to_string(),
-            },
-            Book {
-                title: "Book 2".to_string(),
-                author: None,
-                year: None,
-                language: None,
-                format: None,
-                size: None,
-                url: "url2".to_string(),
-            },
+            test_book("Book 1").url("url1").build(),
+            test_book("Book 2").url("url2").build(),
         ];
         app.selected_book_index = 1;
 
@@ -895,24 +2927,8 @@ mod tests {
         let mut app = create_test_app();
         app.mode = AppMode::Results;
         app.books = vec![
-            Book {
-                title: "Book 1".to_string(),
-                author: None,
-                year: None,
-                language: None,
-                format: None,
-                size: None,
-                url: "url1".to_string(),
-            },
-            Book {
-                title: "Book 2".to_string(),
-                author: None,
-                year: None,
-                language: None,
-                format: None,
-                size: None,
-                url: "url2".to_string(),
-            },
+            test_book("Book 1").url("url1").build(),
+            test_book("Book 2").url("url2").build(),
         ];
         app.selected_book_index = 0;
 
@@ -933,15 +2949,7 @@ mod tests {
         app.mode = AppMode::Results;
         app.query = "test query".to_string();
         app.books = vec![
-            Book {
-                title: "Book 1".to_string(),
-                author: None,
-                year: None,
-                language: None,
-                format: None,
-                size: None,
-                url: "url1".to_string(),
-            },
+            test_book("Book 1").url("url1").build(),
         ];
 
         let key = KeyEvent::new(KeyCode::Esc, KeyModifiers::NONE);
@@ -1063,15 +3071,1362 @@ mod tests {
         assert_ne!(ControlFlow::Continue, ControlFlow::Exit);
     }
 
+    #[test]
+    fn test_record_download_without_md5_is_noop() {
+        let mut app = create_test_app();
+        app.history = History::default();
+        app.books = vec![test_book("Book 1").url("url1").build()];
+
+        app.record_download(std::path::Path::new("/tmp/test/book.pdf")).unwrap();
+        assert!(app.history.entries.is_empty());
+    }
+
+    #[tokio::test]
+    async fn test_copy_citation_without_books_is_noop() {
+        let mut app = create_test_app();
+        app.mode = AppMode::Results;
+
+        let key = KeyEvent::new(KeyCode::Char('c'), KeyModifiers::NONE);
+        let result = app.handle_results_navigation(key).await.unwrap();
+
+        assert_eq!(result, ControlFlow::Continue);
+        assert!(matches!(app.mode, AppMode::Results));
+        assert!(app.status_message.is_empty());
+    }
+
+    fn no_clipboard(_text: &str) -> Result<()> {
+        anyhow::bail!("No clipboard tool found")
+    }
+
+    #[tokio::test]
+    async fn test_e_copies_results_as_markdown() {
+        let mut app = create_test_app();
+        app.copy_to_clipboard = |_| Ok(());
+        app.mode = AppMode::Results;
+
+        let key = KeyEvent::new(KeyCode::Char('e'), KeyModifiers::NONE);
+        app.handle_results_navigation(key).await.unwrap();
+        assert!(app.status_message.is_empty());
+
+        app.set_results(vec![test_book("Dune").build(), test_book("Emma").build()]);
+        app.handle_results_navigation(key).await.unwrap();
+        assert_eq!(app.status_message, "Copied 2 results as Markdown");
+        assert!(matches!(app.mode, AppMode::Results));
+    }
+
+    #[tokio::test]
+    async fn test_e_saves_markdown_beside_downloads_without_a_clipboard() {
+        let dir = std::env::temp_dir().join(format!("annadl_md_export_{}", std::process::id()));
+        let mut app = App::new(test_config(), dir.clone());
+        app.transfer = Arc::new(FakeTransfer::default());
+        app.copy_to_clipboard = no_clipboard;
+        app.mode = AppMode::Results;
+        app.set_results(vec![test_book("Dune").build(), test_book("Emma").build()]);
+
+        app.handle_results_navigation(KeyEvent::new(KeyCode::Char('e'), KeyModifiers::NONE)).await.unwrap();
+
+        let saved = std::fs::read_to_string(dir.join(MARKDOWN_EXPORT_FILE)).unwrap();
+        assert_eq!(saved, export::to_markdown(&app.books));
+        assert_eq!(app.status_message, format!("No clipboard tool; saved 2 results to {}", dir.join(MARKDOWN_EXPORT_FILE).display()));
+        assert!(matches!(app.mode, AppMode::Results));
+        let _ = std::fs::remove_dir_all(&dir);
+    }
+
+    #[tokio::test]
+    async fn test_copy_link_without_books_is_noop() {
+        let mut app = create_test_app();
+        app.mode = AppMode::Results;
+
+        let key = KeyEvent::new(KeyCode::Char('y'), KeyModifiers::NONE);
+        app.handle_results_navigation(key).await.unwrap();
+
+        assert!(matches!(app.mode, AppMode::Results));
+        assert!(app.status_message.is_empty());
+    }
+
+    #[test]
+    fn test_header_status_shows_mode_count_and_filters() {
+        let mut app = create_test_app();
+        assert_eq!(app.header_status(), "Search · No filters");
+
+        app.set_results(vec![test_book("a").build(), test_book("b").build()]);
+        app.filters.format = Some("epub".to_string());
+        app.filters.language = Some("en".to_string());
+        app.mode = AppMode::Results;
+        assert_eq!(app.header_status(), "Results · 2 results · Format: epub | Lang: English (en)");
+    }
+
+    #[tokio::test]
+    async fn test_year_filter_field_applies_range() {
+        let mut app = create_test_app();
+        app.mode = AppMode::Filters;
+        for _ in 0..3 {
+            app.handle_keypress(KeyEvent::new(KeyCode::Tab, KeyModifiers::NONE)).await.unwrap();
+        }
+        for c in "1990-2005".chars() {
+            app.handle_keypress(KeyEvent::new(KeyCode::Char(c), KeyModifiers::NONE)).await.unwrap();
+        }
+        app.handle_keypress(KeyEvent::new(KeyCode::Enter, KeyModifiers::NONE)).await.unwrap();
+
+        assert_eq!((app.filters.min_year, app.filters.max_year), (Some(1990), Some(2005)));
+        assert_eq!(app.filter_summary().as_deref(), Some("Years: 1990-2005"));
+
+        // An unreadable range clears the filter rather than guessing
+        app.mode = AppMode::Filters;
+        app.filter_year_input = "soon".to_string();
+        app.handle_keypress(KeyEvent::new(KeyCode::Enter, KeyModifiers::NONE)).await.unwrap();
+        assert_eq!((app.filters.min_year, app.filters.max_year), (None, None));
+    }
+
+    #[test]
+    fn test_header_status_spins_during_network_work() {
+        let mut app = create_test_app();
+        app.mode = AppMode::Downloading;
+        app.phase = Phase::FetchingLinks;
+        app.tick = 0;
+
+        assert_eq!(app.header_status(), format!("{} Fetching links · No filters", spinner_frame(0)));
+    }
+
+    #[test]
+    fn test_append_results_streams_into_results() {
+        let mut app = create_test_app();
+        app.mode = AppMode::Downloading;
+        app.phase = Phase::Searching;
+
+        app.append_results(0, vec![test_book("a").build(), test_book("b").build()]);
+        assert!(matches!(app.mode, AppMode::Results));
+        assert!(app.loading_more);
+        assert!(app.header_status().contains("loading more"));
+
+        // A later batch keeps the highlighted book
+        app.selected_book_index = 1;
+        app.append_results(0, vec![test_book("c").build()]);
+        assert_eq!(app.books.len(), 3);
+        assert_eq!(app.books[app.selected_book_index].title, "b");
+
+        let all = app.search_results.clone();
+        app.finish_results(0, all);
+        assert!(!app.loading_more);
+        assert_eq!(app.selected_book_index, 1);
+    }
+
+    #[test]
+    fn test_append_results_ignored_after_leaving_search() {
+        let mut app = create_test_app();
+        app.mode = AppMode::Search;
+
+        app.append_results(0, vec![test_book("stale").build()]);
+        assert!(app.books.is_empty());
+        assert!(matches!(app.mode, AppMode::Search));
+    }
+
+    #[test]
+    fn test_results_from_a_superseded_search_are_dropped() {
+        let mut app = create_test_app();
+        app.mode = AppMode::Downloading;
+        app.phase = Phase::Searching;
+        app.search_id = 2;
+
+        app.append_results(1, vec![test_book("old").build()]);
+        app.finish_results(1, vec![test_book("old").build()]);
+        assert!(app.books.is_empty());
+        assert!(matches!(app.mode, AppMode::Downloading));
+
+        app.append_results(2, vec![test_book("new").build()]);
+        app.finish_results(2, vec![test_book("new").build()]);
+        assert_eq!(app.books.len(), 1);
+        assert_eq!(app.books[0].title, "new");
+        assert!(matches!(app.mode, AppMode::Results));
+    }
+
+    #[tokio::test]
+    async fn test_prefetched_links_open_without_fetching() {
+        let mut app = create_test_app();
+        app.verbose = true;
+        app.network.prefetch = 2;
+        app.mode = AppMode::Results;
+        app.set_results(vec![test_book("Dune").build(), test_book("Emma").build()]);
+        let url = app.books[0].url.clone();
+
+        app.links_prefetched(0, url.clone(), Ok((vec![test_link("LibGen")], BookMetadata::default())));
+        app.links_prefetched(0, app.books[1].url.clone(), Err("HTTP error: 503".to_string()));
+        assert!(app.link_cache.contains_key(&url));
+        assert_eq!(app.link_cache.len(), 1);
+
+        app.fetch_download_links().await.unwrap();
+        assert!(matches!(app.command_rx.try_recv(), Ok(AppCommand::LinksFetched(links, _)) if links.len() == 1));
+        // Used once; opening the book again reads its page live
+        assert!(!app.link_cache.contains_key(&url));
+
+        assert!(app.debug_log.iter().any(|line| line == &format!("prefetched {}: 1 links", url)));
+        assert!(app.debug_log.iter().any(|line| line.contains("failed: HTTP error: 503")));
+        assert!(app.debug_log.iter().any(|line| line == &format!("prefetch cache hit: {}", url)));
+    }
+
+    #[test]
+    fn test_prefetched_links_from_an_earlier_search_are_ignored() {
+        let mut app = create_test_app();
+        app.set_results(vec![test_book("Dune").build()]);
+        app.search_id = 2;
+        let url = app.books[0].url.clone();
+
+        app.links_prefetched(1, url.clone(), Ok((vec![test_link("LibGen")], BookMetadata::default())));
+        assert!(app.link_cache.is_empty());
+
+        app.links_prefetched(2, url.clone(), Ok((vec![test_link("LibGen")], BookMetadata::default())));
+        assert!(app.link_cache.contains_key(&url));
+    }
+
+    #[test]
+    fn test_prefetch_off_starts_nothing() {
+        let mut app = create_test_app();
+        app.verbose = true;
+        app.mode = AppMode::Downloading;
+        app.finish_results(0, vec![test_book("a").build()]);
+        assert!(app.prefetch_task.is_none());
+        assert!(app.debug_log.is_empty());
+    }
+
+    #[test]
+    fn test_finish_results_without_batches() {
+        let mut app = create_test_app();
+        app.mode = AppMode::Downloading;
+        app.finish_results(0, vec![test_book("a").build()]);
+        assert!(matches!(app.mode, AppMode::Results));
+        assert_eq!(app.books.len(), 1);
+    }
+
+    #[tokio::test]
+    async fn test_offline_error_offers_retry() {
+        let mut app = create_test_app();
+        app.query = "dune".to_string();
+        app.show_offline();
+        assert!(app.error_message.starts_with("No internet connection."));
+        assert!(app.error_message.contains("press r to retry"));
+
+        app.handle_keypress(KeyEvent::new(KeyCode::Char('r'), KeyModifiers::NONE)).await.unwrap();
+        assert!(matches!(app.mode, AppMode::Downloading));
+        assert_eq!(app.phase, Phase::Searching);
+        assert!(!app.offline);
+
+        // Other errors have nothing to retry
+        app.mode = AppMode::Error("Search error: HTTP error: 403 Forbidden".to_string());
+        app.handle_keypress(KeyEvent::new(KeyCode::Char('r'), KeyModifiers::NONE)).await.unwrap();
+        assert!(matches!(app.mode, AppMode::Error(_)));
+    }
+
+    #[tokio::test]
+    async fn test_search_without_dns_shows_offline() {
+        let mut app = create_test_app();
+        app.transfer = Arc::new(FakeTransfer { offline: true, ..Default::default() });
+        app.query = "dune".to_string();
+        app.perform_search().await.unwrap();
+        assert!(matches!(app.command_rx.recv().await, Some(AppCommand::Offline)));
+    }
+
+    #[test]
+    fn test_empty_search_suggests_refinements() {
+        let mut app = create_test_app();
+        app.query = "dune mesiah".to_string();
+        app.mode = AppMode::Downloading;
+        app.finish_results(0, Vec::new());
+
+        let AppMode::Error(ref message) = app.mode else { panic!("expected the error screen") };
+        assert!(message.starts_with("No results found for \"dune mesiah\"."));
+        assert!(message.contains("Check the spelling"));
+        assert!(message.contains("another mirror"));
+        assert!(!message.contains("Active filters"));
+        assert!(!message.contains("Remove or loosen"));
+    }
+
+    #[test]
+    fn test_filtered_search_names_the_filters() {
+        use ratatui::backend::TestBackend;
+
+        let mut app = create_test_app();
+        app.query = "atlas".to_string();
+        app.filters.format = Some("pdf".to_string());
+        app.filters.max_size_mb = Some(10.0);
+        app.show_no_results(Some(3));
+
+        assert!(app.error_message.starts_with("The site found 3 result(s) for \"atlas\", but the size or year filter removed them all."));
+        assert!(app.error_message.contains("Active filters: Format: pdf | Size < 10MB"));
+        assert!(app.error_message.contains("Remove or loosen the filters"));
+
+        let mut terminal = Terminal::new(TestBackend::new(100, 30)).unwrap();
+        terminal.draw(|f| app.draw(f)).unwrap();
+        let text: String = terminal.backend().buffer().content().iter().map(|cell| cell.symbol()).collect();
+        assert!(text.contains("Active filters"));
+        assert!(text.contains("another mirror"));
+        assert!(text.contains("Press ESC or Enter"));
+    }
+
+    #[test]
+    fn test_next_view_value_cycles_through_distinct_values() {
+        let values = || ["EPUB", "PDF", "epub"].iter().map(|v| v.to_string());
+        assert_eq!(next_view_value(values(), &None), Some("EPUB".to_string()));
+        assert_eq!(next_view_value(values(), &Some("epub".to_string())), Some("PDF".to_string()));
+        assert_eq!(next_view_value(values(), &Some("PDF".to_string())), None);
+        assert_eq!(next_view_value(std::iter::empty(), &None), None);
+    }
+
+    #[tokio::test]
+    async fn test_view_filters_narrow_results_in_place() {
+        let mut app = create_test_app();
+        app.mode = AppMode::Results;
+        app.set_results(vec![
+            test_book("a").format("EPUB").language("English").build(),
+            test_book("b").format("PDF").language("English").build(),
+            test_book("c").format("EPUB").language("German").build(),
+        ]);
+
+        let f = KeyEvent::new(KeyCode::Char('f'), KeyModifiers::NONE);
+        app.handle_results_navigation(f).await.unwrap();
+        assert_eq!(app.view_format.as_deref(), Some("EPUB"));
+        assert_eq!(app.books.len(), 2);
+        assert_eq!(app.status_message, "Showing format EPUB (2 of 3 results)");
+
+        let l = KeyEvent::new(KeyCode::Char('l'), KeyModifiers::NONE);
+        app.handle_results_navigation(l).await.unwrap();
+        assert_eq!(app.books.iter().map(|b| b.title.as_str()).collect::<Vec<_>>(), ["a"]);
+        assert!(app.header_status().ends_with("Showing EPUB, English"));
+
+        // The full result set is kept, so cycling back shows everything again
+        app.handle_results_navigation(f).await.unwrap();
+        app.handle_results_navigation(f).await.unwrap();
+        assert_eq!(app.view_format, None);
+        assert_eq!(app.books.len(), 2);
+        assert_eq!(app.search_results.len(), 3);
+    }
+
+    #[test]
+    fn test_clamp_selection_after_results_shrink() {
+        let mut app = create_test_app();
+        app.mode = AppMode::Results;
+        app.books = (0..15).map(|i| test_book(&i.to_string()).build()).collect();
+        app.selected_book_index = 14;
+        app.results_scroll = 5;
+
+        app.books.truncate(3);
+        app.clamp_selection();
+        assert_eq!(app.selected_book_index, 2);
+        assert_eq!(app.results_scroll, 2);
+
+        app.books.clear();
+        app.clamp_selection();
+        assert_eq!((app.selected_book_index, app.results_scroll), (0, 0));
+    }
+
+    #[test]
+    fn test_download_selection_without_links_falls_back_to_results() {
+        let mut app = create_test_app();
+        app.books = vec![test_book("a").build()];
+        app.mode = AppMode::DownloadSelection;
+        app.download_link_index = 4;
+
+        app.clamp_selection();
+        assert_eq!(app.download_link_index, 0);
+        assert!(matches!(app.mode, AppMode::Results));
+    }
+
+    #[test]
+    fn test_set_links_with_empty_payload_offers_next_steps() {
+        let mut app = create_test_app();
+        app.books = vec![test_book("a").build()];
+        app.set_links(Vec::new());
+        assert!(matches!(app.mode, AppMode::NoLinks));
+        assert!(app.error_message.is_empty());
+    }
+
+    #[tokio::test]
+    async fn test_no_links_esc_returns_to_results() {
+        let mut app = create_test_app();
+        app.books = vec![test_book("a").build()];
+        app.mode = AppMode::NoLinks;
+        app.status_message = "Could not open a browser".to_string();
+
+        let result = app.handle_keypress(KeyEvent::new(KeyCode::Esc, KeyModifiers::NONE)).await.unwrap();
+        assert_eq!(result, ControlFlow::Continue);
+        assert!(matches!(app.mode, AppMode::Results));
+        assert!(app.status_message.is_empty());
+    }
+
+    #[test]
+    fn test_draw_no_links_explains_and_lists_options() {
+        use ratatui::{backend::TestBackend, Terminal};
+
+        let mut terminal = Terminal::new(TestBackend::new(100, 30)).unwrap();
+        let mut app = create_test_app();
+        app.books = vec![test_book("Metadata Only").build()];
+        app.mode = AppMode::NoLinks;
+        terminal.draw(|f| app.draw(f)).unwrap();
+
+        let text: String = terminal.backend().buffer().content().iter().map(|cell| cell.symbol()).collect();
+        assert!(text.contains("Metadata Only"));
+        assert!(text.contains("not a network problem"));
+        assert!(text.contains("Back to results"));
+    }
+
+    #[test]
+    fn test_draw_download_selection_shows_edition_and_pages() {
+        use ratatui::{backend::TestBackend, Terminal};
+
+        let mut terminal = Terminal::new(TestBackend::new(100, 30)).unwrap();
+        let mut app = create_test_app();
+        app.books = vec![test_book("Dune").build()];
+        app.download_links = vec![DownloadLink {
+            text: "Slow Partner Server #1".to_string(),
+            url: "https://annas-archive.org/slow_download/1".to_string(),
+            source: "Slow Partner Server #1".to_string(),
+        }];
+        app.mode = AppMode::DownloadSelection;
+        terminal.draw(|f| app.draw(f)).unwrap();
+
+        let text: String = terminal.backend().buffer().content().iter().map(|cell| cell.symbol()).collect();
+        assert!(text.contains("Edition: Unknown"));
+        assert!(text.contains("Pages: Unknown"));
+
+        app.book_metadata = BookMetadata {
+            edition: Some("2nd edition".to_string()),
+            pages: Some(352),
+        };
+        terminal.draw(|f| app.draw(f)).unwrap();
+
+        let text: String = terminal.backend().buffer().content().iter().map(|cell| cell.symbol()).collect();
+        assert!(text.contains("Edition: 2nd edition"));
+        assert!(text.contains("Pages: 352"));
+    }
+
+    fn test_link(text: &str) -> DownloadLink {
+        DownloadLink {
+            text: text.to_string(),
+            url: format!("https://example.com/{}", text),
+            source: "Mirror".to_string(),
+        }
+    }
+
+    #[tokio::test]
+    async fn test_r_refreshes_links_in_place() {
+        let mut app = create_test_app();
+        app.books = vec![test_book("Dune").build()];
+        app.set_links(vec![test_link("a"), test_link("b")]);
+        app.download_link_index = 1;
+
+        app.handle_keypress(KeyEvent::new(KeyCode::Char('r'), KeyModifiers::NONE)).await.unwrap();
+        assert!(app.refreshing_links);
+        assert!(matches!(app.mode, AppMode::DownloadSelection));
+        assert!(app.status_message.contains("Refreshing"));
+
+        // "b" is still listed, now second after a new first link
+        app.apply_refreshed_links(
+            vec![test_link("new"), test_link("b"), test_link("a")],
+            BookMetadata { edition: None, pages: Some(10) },
+        );
+        assert!(!app.refreshing_links);
+        assert!(matches!(app.mode, AppMode::DownloadSelection));
+        assert_eq!(app.download_links.len(), 3);
+        assert_eq!(app.download_link_index, 1);
+        assert_eq!(app.book_metadata.pages, Some(10));
+        assert_eq!(app.status_message, "Links refreshed: 3 found");
+
+        // A late answer after leaving the screen changes nothing
+        app.mode = AppMode::Results;
+        app.apply_refreshed_links(vec![test_link("x")], BookMetadata::default());
+        assert!(matches!(app.mode, AppMode::Results));
+        assert_eq!(app.download_links.len(), 3);
+    }
+
+    #[test]
+    fn test_failed_refresh_keeps_the_current_links() {
+        let mut app = create_test_app();
+        app.books = vec![test_book("Dune").build()];
+        app.set_links(vec![test_link("a")]);
+        app.refreshing_links = true;
+
+        app.refresh_failed("Network error".to_string());
+        assert!(!app.refreshing_links);
+        assert!(matches!(app.mode, AppMode::DownloadSelection));
+        assert_eq!(app.download_links.len(), 1);
+        assert_eq!(app.status_message, "Refresh failed: Network error");
+
+        use ratatui::{backend::TestBackend, Terminal};
+        let mut terminal = Terminal::new(TestBackend::new(100, 30)).unwrap();
+        terminal.draw(|f| app.draw(f)).unwrap();
+        let text: String = terminal.backend().buffer().content().iter().map(|cell| cell.symbol()).collect();
+        assert!(text.contains("Refresh failed: Network error"));
+    }
+
+    #[tokio::test]
+    async fn test_keys_on_empty_results_do_not_panic() {
+        let mut app = create_test_app();
+        app.set_results(Vec::new());
+        app.mode = AppMode::Results;
+
+        for code in [KeyCode::Down, KeyCode::Up, KeyCode::Enter, KeyCode::Char('a'), KeyCode::Char('f'), KeyCode::Char('l'), KeyCode::Char('s')] {
+            app.handle_keypress(KeyEvent::new(code, KeyModifiers::NONE)).await.unwrap();
+        }
+        assert!(matches!(app.mode, AppMode::Results));
+        assert_eq!(app.selected_book_index, 0);
+
+        // A stale link index with an emptied link list cannot start a download
+        app.mode = AppMode::DownloadSelection;
+        app.download_link_index = 2;
+        app.handle_keypress(KeyEvent::new(KeyCode::Enter, KeyModifiers::NONE)).await.unwrap();
+        assert!(matches!(app.mode, AppMode::Results));
+    }
+
+    #[test]
+    fn test_draw_with_empty_state_does_not_panic() {
+        use ratatui::{backend::TestBackend, Terminal};
+
+        let mut terminal = Terminal::new(TestBackend::new(80, 30)).unwrap();
+        let mut app = create_test_app();
+        app.selected_book_index = 7;
+        app.results_scroll = 7;
+        for mode in [AppMode::Results, AppMode::DownloadSelection, AppMode::Downloading, AppMode::Filters] {
+            app.mode = mode;
+            terminal.draw(|f| app.draw(f)).unwrap();
+        }
+    }
+
+    #[tokio::test]
+    async fn test_f2_opens_about_and_esc_closes_it() {
+        let mut app = create_test_app();
+        app.mode = AppMode::Search;
+
+        app.handle_keypress(KeyEvent::new(KeyCode::F(2), KeyModifiers::NONE)).await.unwrap();
+        assert!(matches!(app.mode, AppMode::About));
+
+        let result = app.handle_keypress(KeyEvent::new(KeyCode::Esc, KeyModifiers::NONE)).await.unwrap();
+        assert_eq!(result, ControlFlow::Continue);
+        assert!(matches!(app.mode, AppMode::Search));
+    }
+
+    #[tokio::test]
+    async fn test_f2_opens_about_from_results_and_download_selection() {
+        let mut app = create_test_app();
+        for mode in [AppMode::Results, AppMode::DownloadSelection] {
+            app.mode = mode;
+            app.handle_keypress(KeyEvent::new(KeyCode::F(2), KeyModifiers::NONE)).await.unwrap();
+            assert!(matches!(app.mode, AppMode::About));
+        }
+
+        // Typing in the filter form is left alone
+        app.mode = AppMode::Filters;
+        app.handle_keypress(KeyEvent::new(KeyCode::F(2), KeyModifiers::NONE)).await.unwrap();
+        assert!(matches!(app.mode, AppMode::Filters));
+    }
+
+    #[test]
+    fn test_about_fields_report_paths_mirror_and_stats() {
+        let mut app = create_test_app();
+        let fields = app.about_fields();
+        let field = |fields: &[(&str, String)], name: &str| {
+            fields.iter().find(|(label, _)| *label == name).map(|(_, value)| value.clone()).unwrap()
+        };
+        assert_eq!(field(&fields, "Download path"), "/tmp/test");
+        assert_eq!(field(&fields, "Mirror"), "none contacted yet");
+        assert_eq!(field(&fields, "Version"), crate::version::LONG_VERSION);
+        assert_eq!(field(&fields, "User agent"), "built-in");
+
+        app.network.user_agent = Some("annadl-custom/1.0".to_string());
+        app.set_results(vec![test_book("a").build()]);
+        app.stats.record_search();
+        app.stats.record_download(2048);
+        let fields = app.about_fields();
+        assert_eq!(field(&fields, "Mirror"), "https://annas-archive.org");
+        assert_eq!(field(&fields, "User agent"), "annadl-custom/1.0");
+        assert_eq!(field(&fields, "Searches"), "1");
+        assert_eq!(field(&fields, "Downloads"), format!("1 ({})", format_bytes(2048)));
+    }
+
+    #[test]
+    fn test_draw_about_shows_version() {
+        use ratatui::{backend::TestBackend, Terminal};
+
+        let mut terminal = Terminal::new(TestBackend::new(100, 30)).unwrap();
+        let mut app = create_test_app();
+        app.mode = AppMode::About;
+        terminal.draw(|f| app.draw(f)).unwrap();
+
+        let text: String = terminal.backend().buffer().content().iter().map(|cell| cell.symbol()).collect();
+        assert!(text.contains("About (Press F2 or Esc to close)"));
+        assert!(text.contains(crate::version::VERSION));
+    }
+
+    #[test]
+    fn test_format_badge() {
+        assert_eq!(format_badge(Some("epub")), ("EPUB ".to_string(), Color::Green));
+        assert_eq!(format_badge(Some("PDF")), ("PDF  ".to_string(), Color::Red));
+        assert_eq!(format_badge(Some("docx")), ("DOCX ".to_string(), Color::Gray));
+        assert_eq!(format_badge(None), (String::new(), Color::Reset));
+        assert_eq!(format_badge(Some(" ")).0, "");
+    }
+
+    #[test]
+    fn test_results_show_format_badge_before_title() {
+        use ratatui::{backend::TestBackend, Terminal};
+
+        let mut terminal = Terminal::new(TestBackend::new(80, 30)).unwrap();
+        let mut app = create_test_app();
+        app.set_results(vec![test_book("Dune").format("epub").build()]);
+        app.mode = AppMode::Results;
+        terminal.draw(|f| app.draw(f)).unwrap();
+
+        let text: String = terminal.backend().buffer().content().iter().map(|cell| cell.symbol()).collect();
+        assert!(text.contains("1. EPUB Dune"), "{}", text);
+    }
+
+    #[tokio::test]
+    async fn test_bookmark_and_browse_favorites() {
+        let mut app = create_test_app();
+        app.mode = AppMode::Results;
+        app.set_results(vec![test_book("a").build(), test_book("b").build()]);
+
+        app.handle_keypress(KeyEvent::new(KeyCode::Down, KeyModifiers::NONE)).await.unwrap();
+        app.handle_keypress(KeyEvent::new(KeyCode::Char('b'), KeyModifiers::NONE)).await.unwrap();
+        assert_eq!(app.favorites.books.len(), 1);
+        assert!(app.status_message.starts_with("Bookmarked 'b'"));
+
+        app.handle_keypress(KeyEvent::new(KeyCode::F(3), KeyModifiers::NONE)).await.unwrap();
+        assert!(matches!(app.mode, AppMode::Favorites));
+        assert_eq!(app.books.iter().map(|b| b.title.as_str()).collect::<Vec<_>>(), ["b"]);
+
+        // Links opened from favorites lead back to favorites
+        app.download_links = vec![DownloadLink { url: "https://example.com/b".to_string(), text: "b".to_string(), source: "LibGen".to_string() }];
+        app.mode = AppMode::DownloadSelection;
+        app.handle_keypress(KeyEvent::new(KeyCode::Esc, KeyModifiers::NONE)).await.unwrap();
+        assert!(matches!(app.mode, AppMode::Favorites));
+
+        app.handle_keypress(KeyEvent::new(KeyCode::Esc, KeyModifiers::NONE)).await.unwrap();
+        assert!(matches!(app.mode, AppMode::Search));
+        assert!(!app.showing_favorites);
+    }
+
+    #[tokio::test]
+    async fn test_unbookmarking_last_favorite_returns_to_search() {
+        let mut app = create_test_app();
+        app.favorites.toggle(&test_book("a").build()).unwrap();
+
+        app.mode = AppMode::Search;
+        app.handle_keypress(KeyEvent::new(KeyCode::F(3), KeyModifiers::NONE)).await.unwrap();
+        assert!(matches!(app.mode, AppMode::Favorites));
+
+        app.handle_keypress(KeyEvent::new(KeyCode::Char('b'), KeyModifiers::NONE)).await.unwrap();
+        assert!(app.favorites.books.is_empty());
+        assert!(matches!(app.mode, AppMode::Search));
+        assert_eq!(app.status_message, "Removed 'a' from favorites");
+    }
+
+    #[tokio::test]
+    async fn test_f3_without_favorites_stays_put() {
+        let mut app = create_test_app();
+        app.mode = AppMode::Search;
+
+        app.handle_keypress(KeyEvent::new(KeyCode::F(3), KeyModifiers::NONE)).await.unwrap();
+        assert!(matches!(app.mode, AppMode::Search));
+        assert!(app.status_message.starts_with("No favorites yet"));
+    }
+
+    fn results_app(count: usize) -> App {
+        let mut app = create_test_app();
+        app.mode = AppMode::Results;
+        app.set_results((1..=count).map(|i| test_book(&i.to_string()).build()).collect());
+        app
+    }
+
+    async fn type_keys(app: &mut App, codes: &[KeyCode]) {
+        for code in codes {
+            app.handle_results_navigation(KeyEvent::new(*code, KeyModifiers::NONE)).await.unwrap();
+        }
+    }
+
+    #[tokio::test]
+    async fn test_number_jump_selects_book() {
+        let mut app = results_app(20);
+        type_keys(&mut app, &[KeyCode::Char('1'), KeyCode::Char('5')]).await;
+        assert_eq!(app.jump_input, "15");
+
+        type_keys(&mut app, &[KeyCode::Enter]).await;
+        assert_eq!(app.selected_book_index, 14);
+        assert!(app.selected_book_index >= app.results_scroll && app.selected_book_index < app.results_scroll + 10);
+        assert!(app.jump_input.is_empty());
+        // Enter only jumped; it did not open the book
+        assert!(matches!(app.mode, AppMode::Results));
+    }
+
+    #[tokio::test]
+    async fn test_number_jump_rejects_out_of_range_and_cancels() {
+        let mut app = results_app(3);
+        type_keys(&mut app, &[KeyCode::Char('9'), KeyCode::Enter]).await;
+        assert_eq!(app.selected_book_index, 0);
+        assert_eq!(app.status_message, "No result #9 (1-3)");
+
+        // Esc clears the number instead of leaving the results
+        type_keys(&mut app, &[KeyCode::Char('2'), KeyCode::Esc]).await;
+        assert!(app.jump_input.is_empty());
+        assert!(matches!(app.mode, AppMode::Results));
+
+        type_keys(&mut app, &[KeyCode::Char('2'), KeyCode::Char('j')]).await;
+        assert!(app.jump_input.is_empty());
+        assert_eq!(app.selected_book_index, 1);
+    }
+
+    #[test]
+    fn test_spinner_frame_cycles() {
+        assert_eq!(spinner_frame(0), spinner_frame(10));
+        assert_ne!(spinner_frame(0), spinner_frame(1));
+    }
+
+    #[tokio::test]
+    async fn test_a_toggles_book_in_queue() {
+        let mut app = create_test_app();
+        app.mode = AppMode::Results;
+        app.set_results(vec![test_book("Dune").build()]);
+
+        let key = KeyEvent::new(KeyCode::Char('a'), KeyModifiers::NONE);
+        app.handle_results_navigation(key).await.unwrap();
+        assert_eq!(app.queue.pending(), 1);
+        assert!(app.status_message.starts_with("Queued"));
+
+        app.handle_results_navigation(key).await.unwrap();
+        assert_eq!(app.queue.pending(), 0);
+    }
+
+    #[tokio::test]
+    async fn test_x_cancels_single_download_without_quitting() {
+        let mut app = create_test_app();
+        app.mode = AppMode::Downloading;
+        app.phase = Phase::Downloading;
+        app.current_task = Some(tokio::spawn(async {
+            tokio::time::sleep(std::time::Duration::from_secs(60)).await;
+        }));
+
+        let key = KeyEvent::new(KeyCode::Char('x'), KeyModifiers::NONE);
+        let result = app.handle_downloading(key).await.unwrap();
+
+        assert_eq!(result, ControlFlow::Continue);
+        assert!(app.current_task.is_none());
+        assert!(matches!(app.mode, AppMode::DownloadSelection));
+    }
+
+    #[tokio::test]
+    async fn test_x_skips_queue_item_and_reports_summary() {
+        let mut app = create_test_app();
+        app.queue.toggle(&test_book("a").build());
+        app.queue.running = true;
+        app.queue.start_next();
+        app.mode = AppMode::Downloading;
+        app.phase = Phase::Downloading;
+
+        let key = KeyEvent::new(KeyCode::Char('x'), KeyModifiers::NONE);
+        app.handle_downloading(key).await.unwrap();
+
+        assert!(matches!(app.mode, AppMode::Results));
+        assert!(!app.queue.running);
+        assert_eq!(app.status_message, "Queue finished: 0 downloaded, 1 skipped, 0 failed");
+    }
+
+    #[tokio::test]
+    async fn test_a_in_download_selection_queues_each_format_once() {
+        let mut app = create_test_app();
+        let edition = |url: &str, format: &str| {
+            test_book("Dune").url(&format!("https://annas-archive.org/md5/{}", url)).format(format).build()
+        };
+        app.set_results(vec![
+            edition("1", "EPUB"),
+            test_book("Dune Messiah").build(),
+            edition("2", "PDF"),
+            edition("3", "EPUB"),
+        ]);
+        app.mode = AppMode::DownloadSelection;
+
+        let key = KeyEvent::new(KeyCode::Char('a'), KeyModifiers::NONE);
+        app.handle_download_selection(key).await.unwrap();
+
+        let formats: Vec<_> = app.queue.items.iter().map(|item| item.book.format.as_deref()).collect();
+        assert_eq!(formats, [Some("EPUB"), Some("PDF")]);
+        assert!(app.queue.running);
+        assert!(matches!(app.mode, AppMode::Downloading));
+        app.current_task.take().unwrap().abort();
+    }
+
+    #[test]
+    fn test_finish_queue_item_records_failure() {
+        let mut app = create_test_app();
+        app.queue.toggle(&test_book("a").build());
+        app.queue.running = true;
+        app.queue.start_next();
+
+        app.finish_queue_item(0, Err("HTTP error: 404".to_string()));
+        assert!(matches!(app.mode, AppMode::QueueSummary));
+        assert!(!app.queue.running);
+
+        // Results for items that are no longer downloading are ignored
+        app.finish_queue_item(0, Ok(Saved::Written(PathBuf::from("/late.pdf"))));
+        assert_eq!(app.queue.counts(), (0, 0, 1));
+    }
+
+    #[tokio::test]
+    async fn test_queue_summary_lists_failures_and_retries_them() {
+        use ratatui::{backend::TestBackend, Terminal};
+
+        let mut app = create_test_app();
+        app.queue.toggle(&test_book("a").build());
+        app.queue.toggle(&test_book("b").build());
+        app.queue.running = true;
+        app.queue.start_next();
+        app.finish_queue_item(0, Ok(Saved::Written(PathBuf::from("/tmp/test/a.pdf"))));
+        app.current_task.take().unwrap().abort();
+        app.finish_queue_item(1, Err("HTTP error: 404".to_string()));
+        assert!(matches!(app.mode, AppMode::QueueSummary));
+
+        let mut terminal = Terminal::new(TestBackend::new(100, 30)).unwrap();
+        terminal.draw(|f| app.draw(f)).unwrap();
+        let text: String = terminal.backend().buffer().content().iter().map(|cell| cell.symbol()).collect();
+        assert!(text.contains("Downloaded: 1   Skipped: 0   Failed: 1   Time: 0s"));
+        assert!(text.contains("b: HTTP error: 404"));
+
+        app.handle_keypress(KeyEvent::new(KeyCode::Char('r'), KeyModifiers::NONE)).await.unwrap();
+        assert!(matches!(app.mode, AppMode::Downloading));
+        assert!(app.queue.running);
+        assert_eq!(app.queue.items.len(), 1);
+        assert_eq!(app.queue.items[0].book.title, "b");
+        app.current_task.take().unwrap().abort();
+    }
+
+    #[tokio::test]
+    async fn test_queued_books_with_the_same_name_get_distinct_files() {
+        let mut app = create_test_app();
+        let edition = |md5: &str| test_book("Dune").md5(md5).url(md5).build();
+        app.queue.toggle(&edition("aaaaaaaa11112222aaaaaaaa11112222"));
+        app.queue.toggle(&edition("bbbbbbbb33334444bbbbbbbb33334444"));
+        app.queue.running = true;
+
+        app.advance_queue();
+        assert_eq!(app.download_destination, Some(PathBuf::from("/tmp/test/Dune - Unknown.unknown")));
+        app.current_task.take().unwrap().abort();
+
+        app.finish_queue_item(0, Err("HTTP error: 404".to_string()));
+        assert_eq!(app.download_destination, Some(PathBuf::from("/tmp/test/Dune - Unknown (bbbbbbbb).unknown")));
+        app.current_task.take().unwrap().abort();
+    }
+
+    #[test]
+    fn test_leaving_queue_summary_reports_counts() {
+        let mut app = create_test_app();
+        app.queue.toggle(&test_book("a").build());
+        app.queue.running = true;
+        app.queue.start_next();
+        app.finish_queue_item(0, Err("HTTP error: 404".to_string()));
+
+        app.close_queue();
+        assert!(matches!(app.mode, AppMode::Results));
+        assert_eq!(app.status_message, "Queue finished: 0 downloaded, 0 skipped, 1 failed");
+        assert!(app.queue.items.is_empty());
+    }
+
+    #[test]
+    fn test_finished_queue_items_count_towards_session_stats() {
+        let path = std::env::temp_dir().join(format!("annadl_stats_{}.epub", std::process::id()));
+        std::fs::write(&path, b"12345").unwrap();
+
+        let mut app = create_test_app();
+        app.queue.toggle(&test_book("a").build());
+        app.queue.running = true;
+        app.queue.start_next();
+
+        app.finish_queue_item(0, Ok(Saved::Written(path.clone())));
+        // A late duplicate completion is not counted twice
+        app.finish_queue_item(0, Ok(Saved::Written(path.clone())));
+        assert_eq!((app.stats.downloads, app.stats.bytes), (1, 5));
+
+        let _ = std::fs::remove_file(&path);
+    }
+
+    #[test]
+    fn test_skipped_existing_files_are_not_counted_as_downloads() {
+        let path = std::env::temp_dir().join(format!("annadl_skipped_{}.epub", std::process::id()));
+        std::fs::write(&path, b"12345").unwrap();
+
+        let mut app = create_test_app();
+        let book = test_book("a").md5("0123456789abcdef0123456789abcdef").build();
+        app.set_results(vec![book.clone()]);
+        app.queue.toggle(&book);
+        app.queue.running = true;
+        app.queue.start_next();
+
+        app.finish_queue_item(0, Ok(Saved::Skipped(path.clone())));
+        assert_eq!(app.queue.counts(), (0, 1, 0));
+        app.finish_download(Saved::Skipped(path.clone()));
+        assert_eq!(app.status_message, format!("Already there, skipped: {}", path.display()));
+        assert_eq!((app.stats.downloads, app.stats.bytes), (0, 0));
+        assert!(app.history.find("0123456789abcdef0123456789abcdef").is_none());
+
+        let _ = std::fs::remove_file(&path);
+    }
+
+    #[test]
+    fn test_history_write_failure_reaches_the_status_line() {
+        // A regular file where the history's folder should be, so saving it fails
+        let blocker = std::env::temp_dir().join(format!("annadl_history_blocker_{}", std::process::id()));
+        std::fs::write(&blocker, b"").unwrap();
+
+        let mut app = create_test_app();
+        app.history = History::load_from(blocker.join("history.json")).unwrap();
+        let book = test_book("a").md5("0123456789abcdef0123456789abcdef").build();
+        app.set_results(vec![book.clone()]);
+        app.queue.toggle(&book);
+        app.queue.running = true;
+        app.queue.start_next();
+
+        app.finish_queue_item(0, Ok(Saved::Written(PathBuf::from("/tmp/test/a.epub"))));
+        assert!(app.status_message.starts_with("Queue finished: 1 downloaded"));
+        assert!(app.status_message.contains("⚠ Could not save download history"));
+
+        app.finish_download(Saved::Written(PathBuf::from("/tmp/test/a.epub")));
+        assert!(app.status_message.starts_with("✓ Downloaded to /tmp/test/a.epub (⚠ Could not save download history"));
+
+        let _ = std::fs::remove_file(&blocker);
+    }
+
+    #[tokio::test]
+    async fn test_stats_count_searches_and_views() {
+        let mut app = create_test_app();
+        let transfer = Arc::new(FakeTransfer::default());
+        app.transfer = transfer.clone();
+        app.query = "dune".to_string();
+        app.perform_search().await.unwrap();
+        assert_eq!(app.stats.searches, 1);
+        assert!(matches!(app.command_rx.recv().await, Some(AppCommand::SearchBatch(1, _))));
+        assert!(matches!(app.command_rx.recv().await, Some(AppCommand::SearchComplete(1, _))));
+        assert_eq!(*transfer.searches.lock().unwrap(), vec!["dune".to_string()]);
+
+        app.books = vec![test_book("a").build()];
+        app.fetch_download_links().await.unwrap();
+        assert_eq!(app.stats.books_viewed, 1);
+        assert!(matches!(app.command_rx.recv().await, Some(AppCommand::LinksFetched(_, _))));
+        assert_eq!(*transfer.viewed.lock().unwrap(), vec!["https://annas-archive.org/md5/a".to_string()]);
+    }
+
+    #[test]
+    fn test_download_filename() {
+        let book = test_book("Dune").format("epub").build();
+        let (dir, name) = download_target(&book, Path::new("/tmp/test"), &NetworkOptions::default());
+        assert_eq!(dir, Path::new("/tmp/test"));
+        assert_eq!(name, "Dune - Unknown.epub");
+    }
+
+    #[test]
+    fn test_download_filename_truncates_by_character() {
+        let book = test_book(&"ü".repeat(80)).format("pdf").build();
+        let (_, name) = download_target(&book, Path::new("/tmp/test"), &NetworkOptions::default());
+        assert_eq!(name, format!("{} - Unknown.pdf", "ü".repeat(50)));
+    }
+
+    #[test]
+    fn test_download_target_follows_name_template() {
+        let book = test_book("Dune").author("Frank Herbert").format("epub").build();
+        let network = NetworkOptions { name_template: Some("{author}/{title}.{format}".to_string()), ..Default::default() };
+        let (dir, name) = download_target(&book, Path::new("/tmp/test"), &network);
+        assert_eq!(dir, Path::new("/tmp/test/Frank Herbert"));
+        assert_eq!(name, "Dune.epub");
+    }
+
+    #[tokio::test]
+    async fn test_p_toggles_preview_pane() {
+        let mut app = create_test_app();
+        app.mode = AppMode::Results;
+        assert!(app.show_preview);
+
+        let key = KeyEvent::new(KeyCode::Char('p'), KeyModifiers::NONE);
+        app.handle_results_navigation(key).await.unwrap();
+        assert!(!app.show_preview);
+        app.handle_results_navigation(key).await.unwrap();
+        assert!(app.show_preview);
+    }
+
+    #[test]
+    fn test_preview_lines_include_md5_and_url() {
+        let app = create_test_app();
+        let book = test_book("Dune").md5("abcdef").build();
+
+        let text: Vec<String> = app.preview_lines(&book)
+            .iter()
+            .map(|line| line.spans.iter().map(|s| s.content.as_ref()).collect())
+            .collect();
+
+        assert_eq!(text[0], "Dune");
+        assert!(text.contains(&"MD5: abcdef".to_string()));
+        assert!(text.contains(&"URL: https://annas-archive.org/md5/Dune".to_string()));
+        assert!(text.contains(&"Year: Unknown".to_string()));
+    }
+
+    #[test]
+    fn test_preview_says_when_covers_cant_be_shown() {
+        let mut app = create_test_app();
+        app.graphics = None;
+        let book = test_book("Dune").cover_url("https://covers.example.org/dune.jpg").build();
+
+        let text: Vec<String> = app.preview_lines(&book)
+            .iter()
+            .map(|line| line.spans.iter().map(|s| s.content.as_ref()).collect())
+            .collect();
+        assert!(text.iter().any(|line| line.contains("no image support")));
+
+        let book = test_book("Dune").build();
+        let text: Vec<String> = app.preview_lines(&book)
+            .iter()
+            .map(|line| line.spans.iter().map(|s| s.content.as_ref()).collect())
+            .collect();
+        assert!(!text.iter().any(|line| line.contains("Cover")));
+    }
+
+    #[test]
+    fn test_draw_results_leaves_room_for_cover() {
+        use ratatui::{backend::TestBackend, Terminal};
+
+        let mut terminal = Terminal::new(TestBackend::new(120, 30)).unwrap();
+        let mut app = create_test_app();
+        app.graphics = Some(cover::Protocol::Kitty);
+        app.show_preview = true;
+        app.mode = AppMode::Results;
+        app.books = vec![test_book("Dune").cover_url("https://covers.example.org/dune.jpg").build()];
+
+        app.covers.insert("https://covers.example.org/dune.jpg".to_string(), CoverState::Loading);
+        terminal.draw(|f| app.draw(f)).unwrap();
+        let text: String = terminal.backend().buffer().content().iter().map(|cell| cell.symbol()).collect();
+        assert!(text.contains("Loading cover..."));
+        let (url, area) = app.cover_slot.clone().unwrap();
+        assert_eq!(url, "https://covers.example.org/dune.jpg");
+        assert!(area.x >= 72 && (1..=COVER_ROWS).contains(&area.height), "{:?}", area);
+
+        app.cover_loaded(url, None);
+        terminal.draw(|f| app.draw(f)).unwrap();
+        let text: String = terminal.backend().buffer().content().iter().map(|cell| cell.symbol()).collect();
+        assert!(text.contains("No cover available"));
+
+        // Leaving the results gives the space back
+        app.mode = AppMode::Help;
+        terminal.draw(|f| app.draw(f)).unwrap();
+        assert!(app.cover_slot.is_none());
+    }
+
+    #[test]
+    fn test_truncate_to_width() {
+        assert_eq!(truncate_to_width("Short", 10), "Short");
+        assert_eq!(truncate_to_width("A very long academic title", 10), "A very lo…");
+        assert_eq!(truncate_to_width("日本語のタイトル", 7), "日本語…");
+        // A wide character that would overrun the last column is dropped whole
+        assert_eq!(truncate_to_width("日本語のタイトル", 6), "日本…");
+        assert_eq!(truncate_to_width("abc", 0), "");
+    }
+
+    #[test]
+    fn test_truncate_start_to_width() {
+        assert_eq!(truncate_start_to_width("/tmp/Dune.epub", 20), "/tmp/Dune.epub");
+        assert_eq!(truncate_start_to_width("/home/me/books/Dune.epub", 11), "…/Dune.epub");
+    }
+
+    #[test]
+    fn test_wrap_to_width() {
+        assert_eq!(wrap_to_width("one two three", 20, 3), vec!["one two three"]);
+        assert_eq!(wrap_to_width("one two three", 7, 3), vec!["one two", "three"]);
+        assert_eq!(
+            wrap_to_width("alpha beta gamma delta epsilon", 11, 2),
+            vec!["alpha beta", "gamma delt…"]
+        );
+        assert!(wrap_to_width("", 10, 3) == vec![String::new()]);
+    }
+
+    #[tokio::test]
+    async fn test_perform_download_sets_download_phase() {
+        let mut app = create_test_app();
+        app.books = vec![test_book("Book 1").url("url1").build()];
+        app.download_links = vec![DownloadLink {
+            text: "Link 1".to_string(),
+            url: "http://127.0.0.1:9/file".to_string(),
+            source: "Source 1".to_string(),
+        }];
+        app.download_progress = Progress::new(10, 20, std::time::Duration::from_secs(1));
+
+        app.perform_download();
+
+        assert!(matches!(app.mode, AppMode::Downloading));
+        assert_eq!(app.phase, Phase::Downloading);
+        assert_eq!(app.download_progress, Progress::default());
+    }
+
+    #[tokio::test]
+    async fn test_download_shows_destination_then_final_path() {
+        use ratatui::{backend::TestBackend, Terminal};
+
+        let mut app = create_test_app();
+        app.books = vec![test_book("Dune").format("epub").build()];
+        app.download_links = vec![test_link("file")];
+        app.network.on_conflict = Some(ConflictPolicy::Rename);
+
+        app.perform_download();
+        assert_eq!(app.download_destination, Some(PathBuf::from("/tmp/test/Dune - Unknown.epub")));
+
+        let mut terminal = Terminal::new(TestBackend::new(100, 30)).unwrap();
+        terminal.draw(|f| app.draw(f)).unwrap();
+        let text: String = terminal.backend().buffer().content().iter().map(|cell| cell.symbol()).collect();
+        assert!(text.contains("Saving to /tmp/test/Dune - Unknown.epub"));
+
+        app.current_task.take().unwrap().abort();
+        app.finish_download(Saved::Written(PathBuf::from("/tmp/test/Dune (1).epub")));
+        assert!(matches!(app.mode, AppMode::Search));
+        assert_eq!(app.status_message, "✓ Downloaded to /tmp/test/Dune (1).epub");
+        assert!(app.download_destination.is_none());
+
+        app.post_download_failed("Post-download command 'false' failed".to_string());
+        assert_eq!(app.status_message, "✓ Downloaded to /tmp/test/Dune (1).epub (⚠ Post-download command 'false' failed)");
+    }
+
+    #[tokio::test]
+    async fn test_d_downloads_the_libgen_link_without_the_selection_screen() {
+        let mut app = create_test_app();
+        app.set_results(vec![test_book("Dune").build()]);
+        app.mode = AppMode::Results;
+
+        app.handle_keypress(KeyEvent::new(KeyCode::Char('d'), KeyModifiers::NONE)).await.unwrap();
+        assert!(app.quick_download);
+        assert_eq!(app.phase, Phase::FetchingLinks);
+
+        app.set_links(vec![
+            DownloadLink {
+                text: "Slow Partner Server #1".to_string(),
+                url: "http://127.0.0.1:9/slow".to_string(),
+                source: "Anna's Archive".to_string(),
+            },
+            DownloadLink {
+                text: "Libgen.li".to_string(),
+                url: "http://127.0.0.1:9/libgen".to_string(),
+                source: "LibGen".to_string(),
+            },
+        ]);
+        assert!(!app.quick_download);
+        assert_eq!(app.download_link_index, 1);
+        assert!(matches!(app.mode, AppMode::Downloading));
+        assert_eq!(app.phase, Phase::Downloading);
+    }
+
+    #[tokio::test]
+    async fn test_d_without_libgen_link_falls_back_to_selection() {
+        let mut app = create_test_app();
+        app.set_results(vec![test_book("Dune").build()]);
+        app.mode = AppMode::Results;
+
+        app.handle_keypress(KeyEvent::new(KeyCode::Char('d'), KeyModifiers::NONE)).await.unwrap();
+        app.set_links(vec![DownloadLink {
+            text: "Slow Partner Server #1".to_string(),
+            url: "http://127.0.0.1:9/slow".to_string(),
+            source: "Anna's Archive".to_string(),
+        }]);
+        assert!(matches!(app.mode, AppMode::DownloadSelection));
+        assert!(app.status_message.contains("No LibGen link"));
+
+        // Enter keeps the selection screen for the next book
+        app.fetch_download_links().await.unwrap();
+        assert!(!app.quick_download);
+    }
+
+    #[tokio::test]
+    async fn test_existing_file_asks_before_downloading() {
+        use ratatui::backend::TestBackend;
+
+        let dir = std::env::temp_dir().join(format!("annadl_confirm_test_{}", std::process::id()));
+        std::fs::create_dir_all(&dir).unwrap();
+        let mut app = App::new(test_config(), dir.clone());
+        app.transfer = Arc::new(FakeTransfer::default());
+        std::fs::write(dir.join("Dune - Unknown.epub"), b"mine").unwrap();
+        app.set_results(vec![test_book("Dune").format("epub").build()]);
+        app.download_links = vec![DownloadLink {
+            text: "Link 1".to_string(),
+            url: "http://127.0.0.1:9/file".to_string(),
+            source: "LibGen".to_string(),
+        }];
+        app.mode = AppMode::DownloadSelection;
+
+        app.handle_keypress(KeyEvent::new(KeyCode::Enter, KeyModifiers::NONE)).await.unwrap();
+        assert!(matches!(app.mode, AppMode::ConfirmOverwrite(_)));
+
+        let mut terminal = Terminal::new(TestBackend::new(100, 30)).unwrap();
+        terminal.draw(|f| app.draw(f)).unwrap();
+        let text: String = terminal.backend().buffer().content().iter().map(|cell| cell.symbol()).collect();
+        assert!(text.contains("File already exists"));
+        assert!(text.contains("(1).epub"));
+
+        app.handle_keypress(KeyEvent::new(KeyCode::Esc, KeyModifiers::NONE)).await.unwrap();
+        assert!(matches!(app.mode, AppMode::DownloadSelection));
+
+        app.handle_keypress(KeyEvent::new(KeyCode::Enter, KeyModifiers::NONE)).await.unwrap();
+        app.handle_keypress(KeyEvent::new(KeyCode::Char('r'), KeyModifiers::NONE)).await.unwrap();
+        assert!(matches!(app.mode, AppMode::Downloading));
+        if let Some(task) = app.current_task.take() {
+            task.abort();
+        }
+
+        // A configured policy skips the question
+        app.network.on_conflict = Some(ConflictPolicy::Overwrite);
+        app.mode = AppMode::DownloadSelection;
+        app.handle_keypress(KeyEvent::new(KeyCode::Enter, KeyModifiers::NONE)).await.unwrap();
+        assert!(matches!(app.mode, AppMode::Downloading));
+        if let Some(task) = app.current_task.take() {
+            task.abort();
+        }
+
+        std::fs::remove_dir_all(&dir).unwrap();
+    }
+
+    // Answers searches and detail pages with canned books and links, and "downloads" by
+    // reporting progress in steps, recording what it was asked for
+    #[derive(Default)]
+    struct FakeTransfer {
+        books: Vec<Book>,
+        links: Vec<DownloadLink>,
+        searches: std::sync::Mutex<Vec<String>>,
+        viewed: std::sync::Mutex<Vec<String>>,
+        requests: std::sync::Mutex<Vec<(PathBuf, String, String)>>,
+        offline: bool,
+        existing: bool,
+    }
+
+    impl Transfer for FakeTransfer {
+        fn search<'a>(&'a self, _network: &'a NetworkOptions, query: &'a str, _filters: &'a SearchFilters, max_results: usize, mut on_batch: BatchFn<'a>) -> BoxFuture<'a, Result<Vec<Book>>> {
+            Box::pin(async move {
+                self.searches.lock().unwrap().push(query.to_string());
+                if self.offline {
+                    return Err(AppError::Offline.into());
+                }
+                let books: Vec<Book> = self.books.iter().take(max_results).cloned().collect();
+                on_batch(&books);
+                Ok(books)
+            })
+        }
+
+        fn details<'a>(&'a self, _network: &'a NetworkOptions, book_url: &'a str) -> BoxFuture<'a, Result<(Vec<DownloadLink>, BookMetadata)>> {
+            Box::pin(async move {
+                self.viewed.lock().unwrap().push(book_url.to_string());
+                Ok((self.links.clone(), BookMetadata::default()))
+            })
+        }
+
+        fn cover<'a>(&'a self, _network: &'a NetworkOptions, _url: &'a str) -> BoxFuture<'a, Result<Vec<u8>>> {
+            Box::pin(async { Err(anyhow::anyhow!("No covers in tests")) })
+        }
+
+        fn download<'a>(&'a self, _network: &'a NetworkOptions, dir: PathBuf, url: &'a str, filename: &'a str, mut on_progress: ProgressFn<'a>) -> BoxFuture<'a, Result<Saved>> {
+            Box::pin(async move {
+                self.requests.lock().unwrap().push((dir.clone(), url.to_string(), filename.to_string()));
+                for current in [50, 100] {
+                    on_progress(Progress::new(current, 100, std::time::Duration::from_secs(1)));
+                }
+                if self.existing {
+                    return Ok(Saved::Skipped(dir.join(filename)));
+                }
+                Ok(Saved::Written(dir.join(filename)))
+            })
+        }
+    }
+
+    fn drain_commands(app: &mut App) -> Vec<AppCommand> {
+        let mut commands = Vec::new();
+        while let Ok(command) = app.command_rx.try_recv() {
+            commands.push(command);
+        }
+        commands
+    }
+
+    #[tokio::test]
+    async fn test_download_reports_progress_then_completes() {
+        let mut app = create_test_app();
+        let transfer = Arc::new(FakeTransfer::default());
+        app.transfer = transfer.clone();
+        app.set_results(vec![test_book("Dune").format("epub").build()]);
+        app.download_links = vec![test_link("LibGen")];
+
+        app.start_download(ConflictPolicy::Overwrite);
+        assert!(matches!(app.mode, AppMode::Downloading));
+        app.current_task.take().unwrap().await.unwrap();
+
+        let commands = drain_commands(&mut app);
+        let percents: Vec<f64> = commands.iter()
+            .filter_map(|command| match command {
+                AppCommand::DownloadProgress(progress) => Some(progress.percent),
+                _ => None,
+            })
+            .collect();
+        assert_eq!(percents, vec![50.0, 100.0]);
+        let expected = PathBuf::from("/tmp/test/Dune - Unknown.epub");
+        assert!(matches!(commands.last(), Some(AppCommand::CompleteDownload(Saved::Written(path))) if *path == expected));
+        assert_eq!(
+            *transfer.requests.lock().unwrap(),
+            vec![(PathBuf::from("/tmp/test"), "https://example.com/LibGen".to_string(), "Dune - Unknown.epub".to_string())]
+        );
+    }
+
+    #[tokio::test]
+    async fn test_download_of_an_existing_file_reports_a_skip() {
+        let mut app = create_test_app();
+        app.transfer = Arc::new(FakeTransfer { existing: true, ..Default::default() });
+        app.set_results(vec![test_book("Dune").format("epub").build()]);
+        app.download_links = vec![test_link("LibGen")];
+
+        app.start_download(ConflictPolicy::Skip);
+        app.current_task.take().unwrap().await.unwrap();
+
+        let expected = PathBuf::from("/tmp/test/Dune - Unknown.epub");
+        let commands = drain_commands(&mut app);
+        assert!(matches!(commands.last(), Some(AppCommand::CompleteDownload(Saved::Skipped(path))) if *path == expected));
+    }
+
+    #[tokio::test]
+    async fn test_queued_download_takes_the_preferred_link() {
+        let mut app = create_test_app();
+        let transfer = Arc::new(FakeTransfer {
+            links: vec![test_link("Slow"), test_link("LibGen")],
+            ..Default::default()
+        });
+        app.transfer = transfer.clone();
+        let book = test_book("Emma").build();
+        app.queue.toggle(&book);
+        let index = app.queue.start_next().unwrap();
+
+        app.spawn_queue_download(index);
+        app.current_task.take().unwrap().await.unwrap();
+
+        let commands = drain_commands(&mut app);
+        assert_eq!(commands.iter().filter(|command| matches!(command, AppCommand::DownloadProgress(_))).count(), 2);
+        assert!(matches!(commands.last(), Some(AppCommand::QueueItemFinished(0, Ok(Saved::Written(path)))) if path.ends_with("Emma - Unknown.unknown")));
+        assert_eq!(transfer.requests.lock().unwrap()[0].1, "https://example.com/LibGen");
+    }
+
+    #[tokio::test]
+    async fn test_queued_download_without_links_fails_the_item() {
+        let mut app = create_test_app();
+        app.transfer = Arc::new(FakeTransfer::default());
+        app.queue.toggle(&test_book("Emma").build());
+        let index = app.queue.start_next().unwrap();
+
+        app.spawn_queue_download(index);
+        app.current_task.take().unwrap().await.unwrap();
+
+        let commands = drain_commands(&mut app);
+        assert!(matches!(commands.last(), Some(AppCommand::QueueItemFinished(0, Err(message))) if message == "No download links found"));
+    }
+
     #[test]
     fn test_app_command_clone() {
-        let cmd = AppCommand::Search("test".to_string(), SearchFilters::default(), 5);
+        let cmd = AppCommand::SearchComplete(3, vec![test_book("test").build()]);
         let cloned = cmd.clone();
 
         match (cmd, cloned) {
-            (AppCommand::Search(q1, _, n1), AppCommand::Search(q2, _, n2)) => {
-                assert_eq!(q1, q2);
-                assert_eq!(n1, n2);
+            (AppCommand::SearchComplete(id1, books1), AppCommand::SearchComplete(id2, books2)) => {
+                assert_eq!(id1, id2);
+                assert_eq!(books1[0].title, books2[0].title);
             }
             _ => panic!("Clone failed"),
         }
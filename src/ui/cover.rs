@@ -0,0 +1,165 @@
+use anyhow::{Context, Result};
+use base64::engine::general_purpose::STANDARD;
+use base64::Engine;
+use ratatui::layout::Rect;
+
+// Terminal graphics protocols a cover can be drawn with. Sixel terminals aren't served:
+// they get the text fallback in the preview instead.
+#[derive(Debug, Clone, Copy, PartialEq)]
+pub enum Protocol {
+    Kitty,
+    // iTerm2's inline images, which WezTerm also understands
+    Iterm2,
+}
+
+impl Protocol {
+    // Read from the environment: asking the terminal would mean waiting for its reply
+    // in the middle of the input loop
+    pub fn detect() -> Option<Self> {
+        Self::from_env(|name| std::env::var(name).ok().filter(|value| !value.is_empty()))
+    }
+
+    fn from_env(var: impl Fn(&str) -> Option<String>) -> Option<Self> {
+        // Multiplexers don't pass the sequences through, and the image would land in the wrong place
+        let term = var("TERM").unwrap_or_default();
+        if var("TMUX").is_some() || term.starts_with("screen") {
+            return None;
+        }
+
+        let program = var("TERM_PROGRAM").unwrap_or_default();
+        if var("KITTY_WINDOW_ID").is_some() || term == "xterm-kitty" || program == "ghostty" {
+            Some(Protocol::Kitty)
+        } else if program == "iTerm.app" || program == "WezTerm" {
+            Some(Protocol::Iterm2)
+        } else {
+            None
+        }
+    }
+
+    // Removes every image drawn so far. iTerm2 images live in the cells and can only be
+    // painted over, so there is no sequence for it and the caller redraws the screen.
+    pub fn clear(self) -> Option<&'static str> {
+        match self {
+            Protocol::Kitty => Some("\x1b_Ga=d,d=A,q=2\x1b\\"),
+            Protocol::Iterm2 => None,
+        }
+    }
+}
+
+// Larger than any preview pane needs, so the PNG sent on each change stays small
+const MAX_PIXELS: u32 = 400;
+// Kitty takes the payload in pieces of at most this many bytes
+const KITTY_CHUNK: usize = 4096;
+
+// A cover decoded and shrunk once, then re-sent whenever the preview moves
+#[derive(Debug, Clone)]
+pub struct Cover {
+    png_base64: String,
+    width: u32,
+    height: u32,
+}
+
+impl Cover {
+    // Kitty only reads PNG, so every cover is re-encoded whatever the site served
+    pub fn decode(bytes: &[u8]) -> Result<Self> {
+        let image = image::load_from_memory(bytes)
+            .context("Unsupported cover image")?
+            .thumbnail(MAX_PIXELS, MAX_PIXELS);
+        let (width, height) = image::GenericImageView::dimensions(&image);
+
+        let mut png = Vec::new();
+        image.write_to(&mut std::io::Cursor::new(&mut png), image::ImageOutputFormat::Png)
+            .context("Failed to encode cover")?;
+
+        Ok(Cover { png_base64: STANDARD.encode(png), width, height })
+    }
+
+    // Columns and rows it fills inside area, keeping its shape; a cell is about twice as tall as wide
+    pub fn fit(&self, area: Rect) -> (u16, u16) {
+        let columns_per_row = self.width as f64 / self.height.max(1) as f64 * 2.0;
+        let columns = (area.height as f64 * columns_per_row).round();
+        if columns <= area.width as f64 {
+            (columns.max(1.0) as u16, area.height)
+        } else {
+            let rows = (area.width as f64 / columns_per_row).round().max(1.0);
+            (area.width, rows as u16)
+        }
+    }
+
+    // Draws the cover with its top-left corner at the cursor, without moving the cursor on Kitty
+    pub fn escape(&self, protocol: Protocol, area: Rect) -> String {
+        let (columns, rows) = self.fit(area);
+        match protocol {
+            Protocol::Kitty => {
+                let chunks: Vec<&[u8]> = self.png_base64.as_bytes().chunks(KITTY_CHUNK).collect();
+                let mut sequence = String::new();
+                for (i, chunk) in chunks.iter().enumerate() {
+                    let more = if i + 1 < chunks.len() { 1 } else { 0 };
+                    let chunk = std::str::from_utf8(chunk).unwrap_or_default();
+                    if i == 0 {
+                        sequence.push_str(&format!("\x1b_Ga=T,f=100,c={},r={},C=1,q=2,m={};{}\x1b\\", columns, rows, more, chunk));
+                    } else {
+                        sequence.push_str(&format!("\x1b_Gm={};{}\x1b\\", more, chunk));
+                    }
+                }
+                sequence
+            }
+            Protocol::Iterm2 => format!(
+                "\x1b]1337;File=inline=1;width={};height={};preserveAspectRatio=1:{}\x07",
+                columns, rows, self.png_base64
+            ),
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn env<'a>(vars: &'a [(&'a str, &'a str)]) -> impl Fn(&str) -> Option<String> + 'a {
+        move |name| vars.iter().find(|(key, _)| *key == name).map(|(_, value)| value.to_string())
+    }
+
+    fn cover(width: u32, height: u32, payload: &str) -> Cover {
+        Cover { png_base64: payload.to_string(), width, height }
+    }
+
+    #[test]
+    fn test_detect_protocol_from_env() {
+        assert_eq!(Protocol::from_env(env(&[("TERM", "xterm-kitty")])), Some(Protocol::Kitty));
+        assert_eq!(Protocol::from_env(env(&[("KITTY_WINDOW_ID", "1"), ("TERM", "xterm-256color")])), Some(Protocol::Kitty));
+        assert_eq!(Protocol::from_env(env(&[("TERM_PROGRAM", "iTerm.app")])), Some(Protocol::Iterm2));
+        assert_eq!(Protocol::from_env(env(&[("TERM_PROGRAM", "WezTerm")])), Some(Protocol::Iterm2));
+        assert_eq!(Protocol::from_env(env(&[("TERM", "xterm-256color")])), None);
+        assert_eq!(Protocol::from_env(env(&[("TERM", "xterm-kitty"), ("TMUX", "/tmp/tmux-1000/default,1,0")])), None);
+    }
+
+    #[test]
+    fn test_fit_keeps_shape_inside_area() {
+        let area = Rect::new(0, 0, 30, 10);
+        // A 2:3 book cover is 13 columns wide at 10 rows
+        assert_eq!(cover(200, 300, "").fit(area), (13, 10));
+        // A wide image runs out of columns first
+        assert_eq!(cover(600, 100, "").fit(area), (30, 3));
+    }
+
+    #[test]
+    fn test_kitty_escape_is_chunked() {
+        let payload = "A".repeat(KITTY_CHUNK + 10);
+        let sequence = cover(200, 300, &payload).escape(Protocol::Kitty, Rect::new(0, 0, 30, 10));
+        assert!(sequence.starts_with("\x1b_Ga=T,f=100,c=13,r=10,C=1,q=2,m=1;"));
+        assert!(sequence.ends_with(&format!("\x1b_Gm=0;{}\x1b\\", "A".repeat(10))));
+        assert_eq!(sequence.matches("\x1b_G").count(), 2);
+    }
+
+    #[test]
+    fn test_iterm2_escape() {
+        let sequence = cover(200, 300, "QUJD").escape(Protocol::Iterm2, Rect::new(0, 0, 30, 10));
+        assert_eq!(sequence, "\x1b]1337;File=inline=1;width=13;height=10;preserveAspectRatio=1:QUJD\x07");
+    }
+
+    #[test]
+    fn test_decode_rejects_non_images() {
+        assert!(Cover::decode(b"<html>not found</html>").is_err());
+    }
+}
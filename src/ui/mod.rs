@@ -1,3 +1,6 @@
 pub mod app;
+pub mod cover;
+pub mod progress;
+pub mod queue;
 
 pub use app::{App, AppCommand, AppMode, ControlFlow};
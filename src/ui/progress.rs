@@ -0,0 +1,119 @@
+use crate::downloader::{Downloader, Progress, Saved};
+use anyhow::Result;
+use serde::Serialize;
+use std::path::Path;
+use std::time::{Duration, Instant};
+
+// Progress lines closer together than this are dropped; the final one always goes out
+const JSON_PROGRESS_INTERVAL: Duration = Duration::from_millis(100);
+
+pub async fn download_with_bar(downloader: &Downloader, url: &str, filename: Option<&str>) -> Result<Saved> {
+    let pb = Downloader::progress_bar();
+    pb.set_message("Downloading");
+    
+    let saved = downloader.download_with_progress(url, filename, |progress| {
+        Downloader::update_progress_bar(&pb, &progress);
+    }).await?;
+    
+    match &saved {
+        Saved::Written(path) => pb.finish_with_message(format!("Downloaded {}", path.display())),
+        Saved::Skipped(path) => pb.finish_with_message(format!("Already there, skipped {}", path.display())),
+    }
+    Ok(saved)
+}
+
+// One line of `get --json` output on stderr, for wrappers that drive their own progress bar
+#[derive(Debug, Serialize)]
+#[serde(tag = "event", rename_all = "lowercase")]
+pub enum JsonEvent<'a> {
+    Progress {
+        current: u64,
+        total: u64,
+        percent: f64,
+        bytes_per_sec: u64,
+    },
+    Complete {
+        // None when the file went to stdout
+        path: Option<&'a Path>,
+        bytes: u64,
+    },
+    Error {
+        message: String,
+        exit_code: i32,
+    },
+    // Something worth knowing that doesn't stop the download
+    Warning {
+        message: String,
+    },
+}
+
+impl JsonEvent<'_> {
+    pub fn emit(&self) {
+        if let Ok(line) = serde_json::to_string(self) {
+            eprintln!("{}", line);
+        }
+    }
+}
+
+#[derive(Default)]
+pub struct JsonProgress {
+    last: Option<Instant>,
+}
+
+impl JsonProgress {
+    pub fn report(&mut self, progress: &Progress) {
+        if let Some(event) = self.event(progress, Instant::now()) {
+            event.emit();
+        }
+    }
+
+    fn event(&mut self, progress: &Progress, now: Instant) -> Option<JsonEvent<'static>> {
+        let finished = progress.total > 0 && progress.current >= progress.total;
+        let due = self.last.map_or(true, |last| now.duration_since(last) >= JSON_PROGRESS_INTERVAL);
+        if !due && !finished {
+            return None;
+        }
+
+        self.last = Some(now);
+        Some(JsonEvent::Progress {
+            current: progress.current,
+            total: progress.total,
+            percent: (progress.percent * 10.0).round() / 10.0,
+            bytes_per_sec: progress.bytes_per_sec,
+        })
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_json_events_serialize_with_event_tag() {
+        let progress = JsonEvent::Progress { current: 512, total: 2048, percent: 25.0, bytes_per_sec: 256 };
+        assert_eq!(
+            serde_json::to_string(&progress).unwrap(),
+            r#"{"event":"progress","current":512,"total":2048,"percent":25.0,"bytes_per_sec":256}"#
+        );
+
+        let complete = JsonEvent::Complete { path: Some(Path::new("/books/dune.epub")), bytes: 2048 };
+        assert_eq!(serde_json::to_string(&complete).unwrap(), r#"{"event":"complete","path":"/books/dune.epub","bytes":2048}"#);
+
+        let error = JsonEvent::Error { message: "Download failed".to_string(), exit_code: 4 };
+        assert_eq!(serde_json::to_string(&error).unwrap(), r#"{"event":"error","message":"Download failed","exit_code":4}"#);
+
+        let warning = JsonEvent::Warning { message: "--insecure disables TLS certificate checks".to_string() };
+        assert_eq!(serde_json::to_string(&warning).unwrap(), r#"{"event":"warning","message":"--insecure disables TLS certificate checks"}"#);
+    }
+
+    #[test]
+    fn test_json_progress_is_throttled_but_keeps_the_last_update() {
+        let mut reporter = JsonProgress::default();
+        let start = Instant::now();
+
+        assert!(reporter.event(&Progress::new(0, 100, Duration::ZERO), start).is_some());
+        assert!(reporter.event(&Progress::new(10, 100, Duration::ZERO), start + Duration::from_millis(10)).is_none());
+        assert!(reporter.event(&Progress::new(20, 100, Duration::ZERO), start + Duration::from_millis(150)).is_some());
+        assert!(reporter.event(&Progress::new(100, 100, Duration::ZERO), start + Duration::from_millis(160)).is_some());
+    }
+}
@@ -0,0 +1,270 @@
+use crate::naming::BatchNames;
+use crate::scraper::Book;
+use std::path::PathBuf;
+use std::time::{Duration, Instant};
+
+#[derive(Debug, Clone, PartialEq)]
+pub enum QueueStatus {
+    Pending,
+    Downloading,
+    Done(PathBuf),
+    Skipped,
+    Failed(String),
+}
+
+#[derive(Debug, Clone)]
+pub struct QueueItem {
+    pub book: Book,
+    pub status: QueueStatus,
+}
+
+#[derive(Debug, Default)]
+pub struct DownloadQueue {
+    pub items: Vec<QueueItem>,
+    pub running: bool,
+    // Set when the queue was filled with every format of one title
+    pub by_format: bool,
+    // When the first item of this run started, for the time shown in the summary
+    pub started: Option<Instant>,
+    // File names given out so far, kept across a retry so a book keeps its name
+    pub names: BatchNames,
+}
+
+impl DownloadQueue {
+    // Adds the book, or removes it again if it is already pending
+    pub fn toggle(&mut self, book: &Book) -> bool {
+        if let Some(pos) = self.items.iter().position(|item| {
+            item.book.url == book.url && item.status == QueueStatus::Pending
+        }) {
+            self.items.remove(pos);
+            false
+        } else {
+            self.items.push(QueueItem {
+                book: book.clone(),
+                status: QueueStatus::Pending,
+            });
+            true
+        }
+    }
+    
+    // Queues the first book of each format not already queued; returns how many were added
+    pub fn add_formats(&mut self, books: &[Book]) -> usize {
+        let mut seen: Vec<String> = Vec::new();
+        let mut added = 0;
+        
+        for book in books {
+            let format = book.format.as_deref().unwrap_or("unknown").to_lowercase();
+            if seen.contains(&format) {
+                continue;
+            }
+            seen.push(format);
+            
+            if !self.contains(book) {
+                self.items.push(QueueItem {
+                    book: book.clone(),
+                    status: QueueStatus::Pending,
+                });
+                added += 1;
+            }
+        }
+        
+        self.by_format = true;
+        added
+    }
+    
+    pub fn contains(&self, book: &Book) -> bool {
+        self.items.iter().any(|item| item.book.url == book.url && item.status == QueueStatus::Pending)
+    }
+    
+    pub fn pending(&self) -> usize {
+        self.items.iter().filter(|item| item.status == QueueStatus::Pending).count()
+    }
+    
+    pub fn current(&self) -> Option<usize> {
+        self.items.iter().position(|item| item.status == QueueStatus::Downloading)
+    }
+    
+    // Marks the next pending item as downloading and returns its index
+    pub fn start_next(&mut self) -> Option<usize> {
+        let index = self.items.iter().position(|item| item.status == QueueStatus::Pending)?;
+        self.items[index].status = QueueStatus::Downloading;
+        self.started.get_or_insert_with(Instant::now);
+        Some(index)
+    }
+    
+    // Only an item that is still downloading can finish; late results from a skipped item are ignored
+    pub fn finish(&mut self, index: usize, status: QueueStatus) -> bool {
+        match self.items.get_mut(index) {
+            Some(item) if item.status == QueueStatus::Downloading => {
+                item.status = status;
+                true
+            }
+            _ => false,
+        }
+    }
+    
+    pub fn elapsed(&self) -> Duration {
+        self.started.map(|started| started.elapsed()).unwrap_or_default()
+    }
+    
+    // (downloaded, skipped, failed)
+    pub fn counts(&self) -> (usize, usize, usize) {
+        let count = |f: fn(&QueueStatus) -> bool| self.items.iter().filter(|item| f(&item.status)).count();
+        (
+            count(|s| matches!(s, QueueStatus::Done(_))),
+            count(|s| matches!(s, QueueStatus::Skipped)),
+            count(|s| matches!(s, QueueStatus::Failed(_))),
+        )
+    }
+    
+    pub fn failed(&self) -> impl Iterator<Item = (&Book, &str)> {
+        self.items.iter().filter_map(|item| match &item.status {
+            QueueStatus::Failed(error) => Some((&item.book, error.as_str())),
+            _ => None,
+        })
+    }
+    
+    pub fn summary(&self) -> String {
+        let (downloaded, skipped, failed) = self.counts();
+        format!("Queue finished: {} downloaded, {} skipped, {} failed", downloaded, skipped, failed)
+    }
+    
+    // Starts a new run with only the failed items; the summary after it covers just those.
+    // Returns how many were queued again.
+    pub fn retry_failed(&mut self) -> usize {
+        self.items.retain(|item| matches!(item.status, QueueStatus::Failed(_)));
+        for item in &mut self.items {
+            item.status = QueueStatus::Pending;
+        }
+        self.started = None;
+        self.items.len()
+    }
+    
+    // e.g. "EPUB: downloaded, PDF: failed, MOBI: skipped"
+    pub fn format_summary(&self) -> String {
+        let results: Vec<String> = self.items.iter()
+            .filter_map(|item| {
+                let outcome = match item.status {
+                    QueueStatus::Done(_) => "downloaded",
+                    QueueStatus::Skipped => "skipped",
+                    QueueStatus::Failed(_) => "failed",
+                    _ => return None,
+                };
+                Some(format!("{}: {}", item.book.format.as_deref().unwrap_or("unknown"), outcome))
+            })
+            .collect();
+        
+        format!("Formats finished: {}", results.join(", "))
+    }
+    
+    pub fn clear_finished(&mut self) {
+        self.items.retain(|item| matches!(item.status, QueueStatus::Pending | QueueStatus::Downloading));
+        self.started = None;
+        self.names.clear();
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use anna_dl::test_support::test_book;
+
+    #[test]
+    fn test_toggle_adds_and_removes() {
+        let mut queue = DownloadQueue::default();
+        assert!(queue.toggle(&test_book("a").build()));
+        assert!(queue.contains(&test_book("a").build()));
+        assert!(!queue.toggle(&test_book("a").build()));
+        assert_eq!(queue.pending(), 0);
+    }
+
+    #[test]
+    fn test_start_next_and_finish() {
+        let mut queue = DownloadQueue::default();
+        queue.toggle(&test_book("a").build());
+        queue.toggle(&test_book("b").build());
+
+        assert_eq!(queue.start_next(), Some(0));
+        assert_eq!(queue.current(), Some(0));
+        assert!(queue.finish(0, QueueStatus::Skipped));
+        // A late completion for the skipped item does not overwrite it
+        assert!(!queue.finish(0, QueueStatus::Done(PathBuf::from("/a.pdf"))));
+
+        assert_eq!(queue.start_next(), Some(1));
+        assert!(queue.finish(1, QueueStatus::Done(PathBuf::from("/b.pdf"))));
+        assert_eq!(queue.start_next(), None);
+    }
+
+    #[test]
+    fn test_summary_counts_outcomes() {
+        let mut queue = DownloadQueue::default();
+        for title in ["a", "b", "c"] {
+            queue.toggle(&test_book(title).build());
+        }
+        queue.start_next();
+        queue.finish(0, QueueStatus::Done(PathBuf::from("/a.pdf")));
+        queue.start_next();
+        queue.finish(1, QueueStatus::Skipped);
+        queue.start_next();
+        queue.finish(2, QueueStatus::Failed("404".to_string()));
+
+        assert_eq!(queue.summary(), "Queue finished: 1 downloaded, 1 skipped, 1 failed");
+        queue.clear_finished();
+        assert!(queue.items.is_empty());
+    }
+
+    #[test]
+    fn test_retry_failed_requeues_only_failures() {
+        let mut queue = DownloadQueue::default();
+        for title in ["a", "b", "c"] {
+            queue.toggle(&test_book(title).build());
+        }
+        queue.start_next();
+        assert!(queue.started.is_some());
+        queue.finish(0, QueueStatus::Done(PathBuf::from("/a.pdf")));
+        queue.start_next();
+        queue.finish(1, QueueStatus::Failed("404".to_string()));
+        queue.start_next();
+        queue.finish(2, QueueStatus::Skipped);
+
+        assert_eq!(queue.counts(), (1, 1, 1));
+        let failed: Vec<_> = queue.failed().map(|(book, error)| (book.title.as_str(), error)).collect();
+        assert_eq!(failed, [("b", "404")]);
+
+        assert_eq!(queue.retry_failed(), 1);
+        assert_eq!(queue.pending(), 1);
+        assert_eq!(queue.items[0].book.title, "b");
+        assert!(queue.started.is_none());
+    }
+
+    #[test]
+    fn test_add_formats_skips_duplicate_formats() {
+        let mut queue = DownloadQueue::default();
+        let editions = [
+            test_book("dune-epub").format("EPUB").build(),
+            test_book("dune-pdf").format("PDF").build(),
+            test_book("dune-epub-2").format("epub").build(),
+            test_book("dune-mobi").format("MOBI").build(),
+        ];
+
+        assert_eq!(queue.add_formats(&editions), 3);
+        assert!(queue.by_format);
+        let titles: Vec<&str> = queue.items.iter().map(|item| item.book.title.as_str()).collect();
+        assert_eq!(titles, ["dune-epub", "dune-pdf", "dune-mobi"]);
+
+        // Formats that are already pending are not queued twice
+        assert_eq!(queue.add_formats(&editions), 0);
+    }
+
+    #[test]
+    fn test_format_summary() {
+        let mut queue = DownloadQueue::default();
+        queue.add_formats(&[test_book("a").format("EPUB").build(), test_book("b").format("PDF").build()]);
+        queue.start_next();
+        queue.finish(0, QueueStatus::Done(PathBuf::from("/a.epub")));
+        queue.start_next();
+        queue.finish(1, QueueStatus::Failed("404".to_string()));
+
+        assert_eq!(queue.format_summary(), "Formats finished: EPUB: downloaded, PDF: failed");
+    }
+}
@@ -0,0 +1,75 @@
+use serde::Serialize;
+
+// Filled in by build.rs
+pub const VERSION: &str = env!("CARGO_PKG_VERSION");
+pub const GIT_COMMIT: &str = env!("ANNADL_GIT_COMMIT");
+pub const BUILD_DATE: &str = env!("ANNADL_BUILD_DATE");
+pub const RUSTC_VERSION: &str = env!("ANNADL_RUSTC_VERSION");
+pub const TARGET: &str = env!("ANNADL_TARGET");
+
+// Shown by `annadl --version`
+pub const LONG_VERSION: &str = concat!(
+    env!("CARGO_PKG_VERSION"),
+    " (",
+    env!("ANNADL_GIT_COMMIT"),
+    " ",
+    env!("ANNADL_BUILD_DATE"),
+    ")"
+);
+
+#[derive(Debug, Clone, Serialize)]
+pub struct BuildInfo {
+    pub version: &'static str,
+    pub commit: &'static str,
+    pub build_date: &'static str,
+    pub rustc: &'static str,
+    pub target: &'static str,
+}
+
+pub fn build_info() -> BuildInfo {
+    BuildInfo {
+        version: VERSION,
+        commit: GIT_COMMIT,
+        build_date: BUILD_DATE,
+        rustc: RUSTC_VERSION,
+        target: TARGET,
+    }
+}
+
+impl BuildInfo {
+    pub fn human(&self) -> String {
+        format!(
+            "annadl {}\ncommit:     {}\nbuilt:      {}\ncompiler:   {}\ntarget:     {}",
+            self.version, self.commit, self.build_date, self.rustc, self.target
+        )
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_build_info_is_populated() {
+        let info = build_info();
+        assert_eq!(info.version, env!("CARGO_PKG_VERSION"));
+        assert!(!info.commit.is_empty());
+        assert!(LONG_VERSION.starts_with(info.version));
+    }
+
+    #[test]
+    fn test_human_and_json_forms() {
+        let info = BuildInfo {
+            version: "0.1.0",
+            commit: "abc123",
+            build_date: "2026-10-14",
+            rustc: "rustc 1.80.0",
+            target: "x86_64-unknown-linux-gnu",
+        };
+        assert!(info.human().starts_with("annadl 0.1.0\ncommit:     abc123"));
+
+        let json: serde_json::Value = serde_json::to_value(&info).unwrap();
+        assert_eq!(json["commit"], "abc123");
+        assert_eq!(json["build_date"], "2026-10-14");
+    }
+}